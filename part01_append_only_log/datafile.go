@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"errors"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 )
@@ -13,6 +14,10 @@ const (
 	TEMP_FILENAME    = "tmp.db"
 )
 
+var (
+	ErrNoRecordAtOffset = errors.New("no record found at the specified offset")
+)
+
 type DataFile struct {
 	dir      string
 	fullpath string
@@ -137,22 +142,17 @@ func (df *DataFile) Close() error {
 	return df.file.Close()
 }
 
+// ReadRecordAt decodes the single record starting at the given byte offset.
+// Returns ErrNoRecordAtOffset if the offset is at the end of the file, and
+// io.ErrUnexpectedEOF or ErrCorruptRecord if the record is truncated or damaged.
 func (df *DataFile) ReadRecordAt(offset int64) (*record, error) {
-	_, err := df.file.Seek(int64(offset), io.SeekStart)
+	section := io.NewSectionReader(df.file, offset, math.MaxInt64-offset)
+	rec, _, err := readRecord(section)
+	if err == io.EOF {
+		return nil, ErrNoRecordAtOffset
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer df.file.Seek(0, io.SeekStart) // Reset the file pointer to the start after reading
-
-	scanner := bufio.NewScanner(df.file)
-	if scanner.Scan() {
-		line := scanner.Text()
-		rec := new(record)
-		rec.FromString(line)
-		return rec, nil
-	}
-	if scanner.Err() == nil { // If no error but no lines were read, return nil
-		return nil, errors.New("no record found at the specified offset")
-	}
-	return nil, scanner.Err()
+	return &rec, nil
 }
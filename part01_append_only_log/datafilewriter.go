@@ -2,17 +2,21 @@ package kvstorefromscratch
 
 import (
 	"bufio"
-	"fmt"
 )
 
 type DatFileWriter struct {
 	writer *bufio.Writer
 }
 
+// Append encodes the record and writes it to the buffered writer.
+// Returns the number of bytes written.
 func (dfw *DatFileWriter) Append(data record) (int, error) {
-	record := data.String()
-	var bytes int
-	if bytes, err := fmt.Fprintln(dfw.writer, record); err != nil {
+	encoded, err := data.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	bytes, err := dfw.writer.Write(encoded)
+	if err != nil {
 		return bytes, err
 	}
 	return bytes, nil
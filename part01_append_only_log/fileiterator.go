@@ -3,34 +3,51 @@ package kvstorefromscratch
 import (
 	"bufio"
 	"io"
+	"math"
 	"os"
 )
 
 type FileIterator struct {
-	scanner    *bufio.Scanner
+	reader     *bufio.Reader
+	current    record
+	err        error
 	openedfile *os.File
 }
 
 func newFileIterator(openedfile *os.File, offset int64) (*FileIterator, error) {
-	_, err := openedfile.Seek(offset, io.SeekStart) // Reset file pointer to the given offset (relative to the start of the file)
-	if err != nil {
-		return nil, err
-	}
-	scanner := bufio.NewScanner(openedfile)
+	// Positional reads through a SectionReader leave the shared file pointer untouched.
+	section := io.NewSectionReader(openedfile, offset, math.MaxInt64-offset)
 	fileIterator := &FileIterator{
-		scanner:    scanner,
+		reader:     bufio.NewReader(section),
 		openedfile: openedfile,
 	}
 	return fileIterator, nil
 }
 
+// HasNext decodes the next record and reports whether one was available.
+// It returns false at the end of the file or on the first malformed record;
+// use Err to tell the two apart.
 func (fi *FileIterator) HasNext() bool {
-	return fi.scanner.Scan()
+	if fi.err != nil {
+		return false
+	}
+	rec, _, err := readRecord(fi.reader)
+	if err != nil {
+		if err != io.EOF {
+			fi.err = err
+		}
+		return false
+	}
+	fi.current = rec
+	return true
 }
 
 func (fi *FileIterator) Get() record {
-	var data record
-	line := fi.scanner.Text()
-	data.FromString(line)
-	return data
+	return fi.current
+}
+
+// Err returns the error that stopped the iteration, or nil if the iterator
+// reached a clean end of file. A truncated record yields io.ErrUnexpectedEOF.
+func (fi *FileIterator) Err() error {
+	return fi.err
 }
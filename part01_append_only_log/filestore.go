@@ -60,7 +60,7 @@ func (f *FileStore) Put(K, V string) error {
 // It iterates through the records in the underlying database file, searching for
 // a record with the specified key and a PUT operation. If found, it returns the
 // corresponding value. If the key does not exist, it returns ErrKeyDoesntExist.
-// Returns an error if there is a problem accessing the iterator.
+// Returns an error if there is a problem accessing the iterator or a record is malformed.
 func (f *FileStore) Get(K string) (string, error) {
 	iterator, err := f.dbFile.GetIterator(0)
 	if err != nil {
@@ -76,6 +76,9 @@ func (f *FileStore) Get(K string) (string, error) {
 			valueForKey = ""
 		}
 	}
+	if err := iterator.Err(); err != nil {
+		return "", err
+	}
 	if valueForKey == "" {
 		return "", ErrKeyDoesntExist
 	}
@@ -83,3 +83,30 @@ func TestFileStore_PutOverwrite(t *testing.T) {
 		t.Errorf("Get after overwrite returned %q, want %q", got, val2)
 	}
 }
+
+func TestFileStore_ValueWithNewlinesAndPipes(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	store, err := ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+
+	key := "multi|line"
+	val := "first|line\nsecond|line\n"
+	if err := store.Put(key, val); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.Put("next", "value"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	got, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if got != val {
+		t.Errorf("Get returned %q, want %q", got, val)
+	}
+}
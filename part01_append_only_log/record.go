@@ -1,8 +1,40 @@
 package kvstorefromscratch
 
 import (
-	"fmt"
-	"strings"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// On-disk layout of a record (all integers are big-endian):
+//
+//	+----------+---------+----+-------+--------+--------+-----+-------+
+//	| crc32 4B | version | op | flags | keyLen | valLen | key | value |
+//	|          |   1B    | 1B |  1B   |   4B   |   4B   |     |       |
+//	+----------+---------+----+-------+--------+--------+-----+-------+
+//
+// The checksum covers every byte that follows it, so a torn or bit-flipped
+// record is detected instead of being handed back as garbage.
+const (
+	RECORD_VERSION     = 1
+	RECORD_HEADER_SIZE = 15
+
+	MAX_KEY_SIZE   = 64 * 1024        // 64 KiB
+	MAX_VALUE_SIZE = 64 * 1024 * 1024 // 64 MiB
+)
+
+const (
+	opCodePut byte = 1
+	opCodeDel byte = 2
+)
+
+var (
+	ErrCorruptRecord        = errors.New("record checksum mismatch")
+	ErrUnknownRecordVersion = errors.New("unknown record format version")
+	ErrUnknownOperation     = errors.New("unknown record operation")
+	ErrKeyTooLarge          = errors.New("key exceeds MAX_KEY_SIZE")
+	ErrValueTooLarge        = errors.New("value exceeds MAX_VALUE_SIZE")
 )
 
 type record struct {
@@ -14,15 +46,151 @@ type KVPair struct {
 	key, val string
 }
 
-func (r *record) String() string {
-	return fmt.Sprintf("%s|%s|%s", r.operation, r.data.key, r.data.val)
+// recordHeader is the decoded fixed-size prefix of an encoded record.
+type recordHeader struct {
+	checksum uint32
+	version  byte
+	opCode   byte
+	flags    byte
+	keyLen   uint32
+	valLen   uint32
+}
+
+// MarshalBinary encodes the record into its versioned, checksummed on-disk form.
+// Returns an error if the operation is unknown or the key/value exceed the size limits.
+func (r *record) MarshalBinary() ([]byte, error) {
+	opCode, err := opCodeFor(r.operation)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.data.key) > MAX_KEY_SIZE {
+		return nil, ErrKeyTooLarge
+	}
+	if len(r.data.val) > MAX_VALUE_SIZE {
+		return nil, ErrValueTooLarge
+	}
+
+	buf := make([]byte, RECORD_HEADER_SIZE+len(r.data.key)+len(r.data.val))
+	buf[4] = RECORD_VERSION
+	buf[5] = opCode
+	buf[6] = 0 // flags, reserved for future use
+	binary.BigEndian.PutUint32(buf[7:11], uint32(len(r.data.key)))
+	binary.BigEndian.PutUint32(buf[11:15], uint32(len(r.data.val)))
+	copy(buf[RECORD_HEADER_SIZE:], r.data.key)
+	copy(buf[RECORD_HEADER_SIZE+len(r.data.key):], r.data.val)
+	binary.BigEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a single encoded record occupying the whole of data.
+func (r *record) UnmarshalBinary(data []byte) error {
+	if len(data) < RECORD_HEADER_SIZE {
+		return io.ErrUnexpectedEOF
+	}
+	header, err := decodeRecordHeader(data[:RECORD_HEADER_SIZE])
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != RECORD_HEADER_SIZE+header.bodySize() {
+		return io.ErrUnexpectedEOF
+	}
+	decoded, err := header.decodeBody(data[:RECORD_HEADER_SIZE], data[RECORD_HEADER_SIZE:])
+	if err != nil {
+		return err
+	}
+	*r = decoded
+	return nil
+}
+
+// readRecord reads the next encoded record from r and returns it along with the
+// number of bytes it occupied. It returns io.EOF if r is exhausted exactly at a
+// record boundary and io.ErrUnexpectedEOF if the record is truncated.
+func readRecord(r io.Reader) (record, int64, error) {
+	var headerBuf [RECORD_HEADER_SIZE]byte
+	if _, err := io.ReadFull(r, headerBuf[:]); err != nil {
+		return record{}, 0, err
+	}
+	header, err := decodeRecordHeader(headerBuf[:])
+	if err != nil {
+		return record{}, 0, err
+	}
+
+	body := make([]byte, header.bodySize())
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return record{}, 0, err
+	}
+	rec, err := header.decodeBody(headerBuf[:], body)
+	if err != nil {
+		return record{}, 0, err
+	}
+	return rec, RECORD_HEADER_SIZE + header.bodySize(), nil
+}
+
+// decodeRecordHeader parses the fixed-size header. Lengths are sanity checked
+// against the size limits so a corrupt header can't trigger a huge allocation.
+func decodeRecordHeader(buf []byte) (recordHeader, error) {
+	header := recordHeader{
+		checksum: binary.BigEndian.Uint32(buf[0:4]),
+		version:  buf[4],
+		opCode:   buf[5],
+		flags:    buf[6],
+		keyLen:   binary.BigEndian.Uint32(buf[7:11]),
+		valLen:   binary.BigEndian.Uint32(buf[11:15]),
+	}
+	if header.version != RECORD_VERSION {
+		return recordHeader{}, ErrUnknownRecordVersion
+	}
+	if header.keyLen > MAX_KEY_SIZE || header.valLen > MAX_VALUE_SIZE {
+		return recordHeader{}, ErrCorruptRecord
+	}
+	return header, nil
+}
+
+func (h recordHeader) bodySize() int64 {
+	return int64(h.keyLen) + int64(h.valLen)
+}
+
+// decodeBody verifies the checksum over header and body and builds the record.
+func (h recordHeader) decodeBody(headerBuf, body []byte) (record, error) {
+	crc := crc32.ChecksumIEEE(headerBuf[4:])
+	crc = crc32.Update(crc, crc32.IEEETable, body)
+	if crc != h.checksum {
+		return record{}, ErrCorruptRecord
+	}
+	operation, err := operationFor(h.opCode)
+	if err != nil {
+		return record{}, err
+	}
+	return record{
+		operation: operation,
+		data: KVPair{
+			key: string(body[:h.keyLen]),
+			val: string(body[h.keyLen:]),
+		},
+	}, nil
+}
+
+func opCodeFor(operation string) (byte, error) {
+	switch operation {
+	case OPERATION_PUT:
+		return opCodePut, nil
+	case OPERATION_DEL:
+		return opCodeDel, nil
+	}
+	return 0, ErrUnknownOperation
 }
 
-func (r *record) FromString(data string) {
-	parts := strings.SplitN(data, "|", 3)
-	r.operation = parts[0]
-	r.data.key = parts[1]
-	r.data.val = parts[2]
+func operationFor(opCode byte) (string, error) {
+	switch opCode {
+	case opCodePut:
+		return OPERATION_PUT, nil
+	case opCodeDel:
+		return OPERATION_DEL, nil
+	}
+	return "", ErrUnknownOperation
 }
 
 func (r *record) GetKey() string {
@@ -0,0 +1,57 @@
+package kvstorefromscratch
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestRecord_RoundTrip(t *testing.T) {
+	inputs := []record{
+		{operation: OPERATION_PUT, data: KVPair{key: "foo", val: "bar"}},
+		{operation: OPERATION_PUT, data: KVPair{key: "multi\nline", val: "a|b|c\nd\x00e"}},
+		{operation: OPERATION_PUT, data: KVPair{key: "empty-value", val: ""}},
+		{operation: OPERATION_DEL, data: KVPair{key: "foo"}},
+	}
+	for _, in := range inputs {
+		encoded, err := in.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary(%+v) failed: %v", in, err)
+		}
+		var out record
+		if err := out.UnmarshalBinary(encoded); err != nil {
+			t.Fatalf("UnmarshalBinary failed: %v", err)
+		}
+		if out != in {
+			t.Errorf("round trip returned %+v, want %+v", out, in)
+		}
+	}
+}
+
+func TestRecord_DetectsCorruption(t *testing.T) {
+	in := record{operation: OPERATION_PUT, data: KVPair{key: "foo", val: "bar"}}
+	encoded, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+
+	flipped := bytes.Clone(encoded)
+	flipped[len(flipped)-1] ^= 0xFF
+	var out record
+	if err := out.UnmarshalBinary(flipped); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("UnmarshalBinary of flipped byte returned %v, want ErrCorruptRecord", err)
+	}
+
+	_, _, err = readRecord(bytes.NewReader(encoded[:len(encoded)-1]))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("readRecord of truncated record returned %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestRecord_RejectsUnknownOperation(t *testing.T) {
+	in := record{operation: "UPSERT", data: KVPair{key: "foo"}}
+	if _, err := in.MarshalBinary(); !errors.Is(err, ErrUnknownOperation) {
+		t.Errorf("MarshalBinary returned %v, want ErrUnknownOperation", err)
+	}
+}
@@ -0,0 +1,217 @@
+package kvstorefromscratchpart2
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidBackup  = errors.New("invalid backup")
+	ErrTargetNotEmpty = errors.New("target directory already contains segments")
+)
+
+// backupFile is a file to be copied by a backup: the first size bytes of data.
+type backupFile struct {
+	name string
+	size int64
+	data io.ReaderAt
+}
+
+// Backup writes a consistent copy of the store to w as a tar stream, while reads and
+// writes continue. The copy contains the segment files as they were when Backup was
+// called, with the active segment cut off at its size at that moment, so it holds every
+// write acknowledged before the call and none of the writes after it. It also holds the
+// compaction state, so log positions and versions handed out by the store before the
+// backup aren't mistaken for locations in the restored one.
+//
+// Hint files are not included; Restore rebuilds them. The stream can be restored with
+// Restore, or unpacked with tar into an empty directory and opened directly.
+func (f *FileStore) Backup(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	modTime := timeNow()
+	err := f.backupFiles(func(bf backupFile) error {
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     bf.name,
+			Size:     bf.size,
+			Mode:     0644,
+			ModTime:  modTime,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, io.NewSectionReader(bf.data, 0, bf.size))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// BackupTo writes a consistent copy of the store into dir, see Backup. The directory is
+// created if needed and must not contain segments already. The copy is fsynced, and dir
+// can be opened as a store.
+func (f *FileStore) BackupTo(dir string) error {
+	if err := prepareTargetDir(dir); err != nil {
+		return err
+	}
+	return f.backupFiles(func(bf backupFile) error {
+		return writeFileSynced(filepath.Join(dir, bf.name), io.NewSectionReader(bf.data, 0, bf.size))
+	})
+}
+
+// backupFiles calls fn for every segment of a snapshot of the store, in increasing ID
+// order, and then for the compaction state if the store has been compacted. The snapshot
+// keeps Compact from closing the segments while they are copied.
+func (f *FileStore) backupFiles(fn func(backupFile) error) error {
+	snap, err := f.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	f.mu.RLock()
+	files := make([]backupFile, 0, len(snap.segments))
+	for id, segment := range snap.segments {
+		size := segment.Size()
+		if id == snap.activeSegmentID {
+			size = snap.activeSize
+		}
+		files = append(files, backupFile{name: segmentFileName(id, SEGMENT_EXT), size: size, data: segment.file})
+	}
+	f.mu.RUnlock()
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	if snap.compactions > 0 {
+		state := compactionState(snap.compacted, snap.compactions)
+		files = append(files, backupFile{name: COMPACTION_STATE_FILENAME, size: int64(len(state)), data: bytes.NewReader(state)})
+	}
+
+	for _, bf := range files {
+		if err := fn(bf); err != nil {
+			return fmt.Errorf("backing up %s: %w", bf.name, err)
+		}
+	}
+	return nil
+}
+
+// Restore unpacks a backup written by Backup into dir, which is created if needed and
+// must not contain a store already. Every record is checked with Verify, and the store
+// is opened once so its index loads and the hint files are rebuilt. If any of this fails,
+// the restored files are removed again and an error wrapping ErrInvalidBackup is returned
+// for a damaged or unexpected backup.
+func Restore(r io.Reader, dir string) (err error) {
+	if err := prepareTargetDir(dir); err != nil {
+		return err
+	}
+
+	var restored []string // Names of the restored files
+	var segments int
+	defer func() {
+		if err != nil {
+			for _, name := range restored {
+				os.Remove(filepath.Join(dir, name))
+				os.Remove(filepath.Join(dir, strings.TrimSuffix(name, SEGMENT_EXT)+HINT_EXT))
+			}
+		}
+	}()
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+		}
+		if header.Typeflag != tar.TypeReg || !(isSegmentFileName(header.Name) || header.Name == COMPACTION_STATE_FILENAME) {
+			return fmt.Errorf("%w: unexpected entry %q", ErrInvalidBackup, header.Name)
+		}
+		path := filepath.Join(dir, header.Name)
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%w: duplicate entry %q", ErrInvalidBackup, header.Name)
+		}
+		restored = append(restored, header.Name)
+		if err := writeFileSynced(path, tr); err != nil {
+			return err
+		}
+		if header.Name != COMPACTION_STATE_FILENAME {
+			segments++
+		}
+	}
+	if segments == 0 {
+		return fmt.Errorf("%w: no segments", ErrInvalidBackup)
+	}
+	if _, _, err := readCompactionState(dir); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+	}
+
+	report, err := Verify(dir)
+	if err != nil {
+		return err
+	}
+	for _, segment := range report.Segments {
+		if len(segment.Problems) > 0 {
+			return fmt.Errorf("%w: segment %d: %v", ErrInvalidBackup, segment.ID, segment.Problems[0])
+		}
+	}
+
+	store, err := ConnectFileStore(dir)
+	if err != nil {
+		return err
+	}
+	return store.Close()
+}
+
+// isSegmentFileName reports whether name is the plain file name of a segment, which
+// also rules out paths escaping the restore directory.
+func isSegmentFileName(name string) bool {
+	id, err := strconv.Atoi(strings.TrimSuffix(name, SEGMENT_EXT))
+	return err == nil && id > 0 && name == segmentFileName(id, SEGMENT_EXT)
+}
+
+// prepareTargetDir creates dir if needed and checks that it holds no segments, nor the
+// compaction state of a store that was there before.
+func prepareTargetDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	ids, err := listSegmentIDs(dir, SEGMENT_EXT)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{PRIMARY_FILENAME, COMPACTION_STATE_FILENAME} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return ErrTargetNotEmpty
+		}
+	}
+	if len(ids) > 0 {
+		return ErrTargetNotEmpty
+	}
+	return nil
+}
+
+// writeFileSynced creates the file at path with the contents of r and fsyncs it.
+func writeFileSynced(path string, r io.Reader) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
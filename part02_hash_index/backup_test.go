@@ -0,0 +1,213 @@
+package kvstorefromscratchpart2
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFileStore_BackupWhileWriting(t *testing.T) {
+	store, err := ConnectFileStoreWithOptions(t.TempDir(), smallSegmentOptions())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+	const keys = 200
+	for i := 0; i < keys; i++ {
+		if err := store.Put("key-"+strconv.Itoa(i), "v0"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	// Overwrite every key in rounds, each round as one batch, and compact now and then
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 1; ; round++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			batch := NewWriteBatch()
+			for i := 0; i < keys; i++ {
+				batch.Put("key-"+strconv.Itoa(i), "v"+strconv.Itoa(round))
+			}
+			batch.Put("new-"+strconv.Itoa(round), "x")
+			if err := store.Write(batch); err != nil {
+				t.Errorf("Write failed: %v", err)
+				return
+			}
+			if round%5 == 0 {
+				if err := store.Compact(); err != nil {
+					t.Errorf("Compact failed: %v", err)
+					return
+				}
+			}
+		}
+	}()
+
+	var archives []*bytes.Buffer
+	var dirs []string
+	for i := 0; i < 3; i++ {
+		buf := &bytes.Buffer{}
+		if err := store.Backup(buf); err != nil {
+			t.Fatalf("Backup failed: %v", err)
+		}
+		archives = append(archives, buf)
+		dir := filepath.Join(t.TempDir(), "copy")
+		if err := store.BackupTo(dir); err != nil {
+			t.Fatalf("BackupTo failed: %v", err)
+		}
+		dirs = append(dirs, dir)
+	}
+	close(stop)
+	wg.Wait()
+
+	for _, buf := range archives {
+		dir := t.TempDir()
+		if err := Restore(buf, dir); err != nil {
+			t.Fatalf("Restore failed: %v", err)
+		}
+		dirs = append(dirs, dir)
+	}
+
+	// Every copy must hold all keys, all from the same round
+	for _, dir := range dirs {
+		restored, err := ConnectFileStore(dir)
+		if err != nil {
+			t.Fatalf("ConnectFileStore on a backup failed: %v", err)
+		}
+		if restored.Recovery() != nil {
+			t.Errorf("backup in %s had a torn tail: %+v", dir, restored.Recovery())
+		}
+		want, err := restored.Get("key-0")
+		if err != nil {
+			t.Fatalf("Get(key-0) from backup failed: %v", err)
+		}
+		for i := 1; i < keys; i++ {
+			if got, err := restored.Get("key-" + strconv.Itoa(i)); err != nil || got != want {
+				t.Errorf("backup in %s has key-%d = (%q, %v), want %q like key-0", dir, i, got, err, want)
+				break
+			}
+		}
+		restored.Close()
+	}
+}
+
+func TestBackup_KeepsCompactionState(t *testing.T) {
+	store, err := ConnectFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+
+	// After the compaction, the latest record of x is where the first one was
+	stale, err := store.PutIfAbsent("x", "1")
+	if err != nil {
+		t.Fatalf("PutIfAbsent failed: %v", err)
+	}
+	store.Put("x", "2")
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	_, current, _ := store.GetWithVersion("x")
+	if current.SegmentID != stale.SegmentID || current.Offset != stale.Offset {
+		t.Fatalf("x was compacted to %v, want it at %v", current, stale)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := store.Backup(buf); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	restoredDir := t.TempDir()
+	if err := Restore(buf, restoredDir); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	copiedDir := filepath.Join(t.TempDir(), "copy")
+	if err := store.BackupTo(copiedDir); err != nil {
+		t.Fatalf("BackupTo failed: %v", err)
+	}
+
+	for _, dir := range []string{restoredDir, copiedDir} {
+		restored, err := ConnectFileStore(dir)
+		if err != nil {
+			t.Fatalf("ConnectFileStore on a backup failed: %v", err)
+		}
+		if _, version, err := restored.GetWithVersion("x"); err != nil || version != current {
+			t.Errorf("backup in %s has x at (%v, %v), want the version %v of the store", dir, version, err, current)
+		}
+		if _, err := restored.CompareAndSwap("x", stale, "3"); err != ErrVersionMismatch {
+			t.Errorf("CompareAndSwap in %s with a version from before the compaction returned %v, want ErrVersionMismatch", dir, err)
+		}
+		restored.Close()
+	}
+}
+
+func TestRestore_RejectsBadBackups(t *testing.T) {
+	segment, err := (&record{operation: OPERATION_PUT, data: KVPair{key: "k", val: "v"}}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := bytes.Clone(segment)
+	corrupt[len(corrupt)-1] ^= 0xFF
+
+	tests := []struct {
+		name    string
+		entries map[string][]byte
+	}{
+		{"path outside the directory", map[string][]byte{"../000001.db": segment}},
+		{"not a segment", map[string][]byte{"000001.hint": segment}},
+		{"corrupt record", map[string][]byte{"000001.db": segment, "000002.db": corrupt}},
+		{"empty", map[string][]byte{}},
+		{"only a compaction state", map[string][]byte{COMPACTION_STATE_FILENAME: compactionState(1, 1)}},
+		{"invalid compaction state", map[string][]byte{"000001.db": segment, COMPACTION_STATE_FILENAME: []byte("garbage")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			tw := tar.NewWriter(buf)
+			for name, data := range tt.entries {
+				tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: int64(len(data)), Mode: 0644})
+				tw.Write(data)
+			}
+			tw.Close()
+
+			dir := t.TempDir()
+			if err := Restore(buf, dir); !errors.Is(err, ErrInvalidBackup) {
+				t.Fatalf("Restore returned %v, want ErrInvalidBackup", err)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("Restore left %d files behind", len(entries))
+			}
+		})
+	}
+
+	if err := Restore(strings.NewReader("not a tar stream"), t.TempDir()); !errors.Is(err, ErrInvalidBackup) {
+		t.Errorf("Restore of garbage returned %v, want ErrInvalidBackup", err)
+	}
+}
+
+func TestBackupTo_RefusesNonEmptyTarget(t *testing.T) {
+	tmpDir := t.TempDir()
+	store, err := ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.BackupTo(tmpDir); err != ErrTargetNotEmpty {
+		t.Errorf("BackupTo into the store's own directory returned %v, want ErrTargetNotEmpty", err)
+	}
+	if err := Restore(strings.NewReader(""), tmpDir); err != ErrTargetNotEmpty {
+		t.Errorf("Restore into a store's directory returned %v, want ErrTargetNotEmpty", err)
+	}
+}
@@ -0,0 +1,115 @@
+package kvstorefromscratchpart2
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrCorruptBatch     = errors.New("malformed write batch frame")
+	ErrUncommittedBatch = errors.New("write batch is missing its commit marker")
+)
+
+// WriteBatch collects Puts and Dels that FileStore.Write commits atomically: after a
+// crash, either all of them or none of them are visible.
+//
+// On disk a batch is framed by a BATCH_BEGIN record and a BATCH_COMMIT record, both
+// carrying the number of records in between. The frame is written with a single write
+// call, and replay only applies a batch once it reaches the commit marker.
+//
+// A WriteBatch is not safe for concurrent use.
+type WriteBatch struct {
+	records []record
+}
+
+// NewWriteBatch returns an empty WriteBatch.
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put adds the insertion or update of key K to the batch.
+func (b *WriteBatch) Put(K, V string) {
+	b.records = append(b.records, record{
+		operation: OPERATION_PUT,
+		data:      KVPair{key: K, val: V},
+	})
+}
+
+// Del adds the deletion of key K to the batch.
+func (b *WriteBatch) Del(K string) {
+	b.records = append(b.records, record{
+		operation: OPERATION_DEL,
+		data:      KVPair{key: K},
+	})
+}
+
+// Len returns the number of operations in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.records)
+}
+
+// Reset empties the batch so it can be reused.
+func (b *WriteBatch) Reset() {
+	b.records = b.records[:0]
+}
+
+// Write commits every operation of the batch atomically, in the order they were added.
+// An empty batch is a no-op. If any operation is invalid, e.g. its key is too large,
+// nothing is written. The batch can be reused after Write returns.
+func (f *FileStore) Write(b *WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return ErrStoreClosed
+	}
+	return f.writeBatch(b)
+}
+
+// writeBatch appends the non-empty batch b as a single frame and applies it to the
+// index. The caller must hold f.mu for writing.
+func (f *FileStore) writeBatch(b *WriteBatch) error {
+	frame := make([]record, 0, b.Len()+2)
+	frame = append(frame, batchMarker(OPERATION_BATCH_BEGIN, b.Len()))
+	frame = append(frame, b.records...)
+	frame = append(frame, batchMarker(OPERATION_BATCH_COMMIT, b.Len()))
+
+	if err := f.maybeRollover(); err != nil {
+		return err
+	}
+	offsets, err := f.active.AppendBatch(frame)
+	if err != nil {
+		return err
+	}
+	for i, rec := range b.records {
+		offset := offsets[i+1] // offsets[0] is the BATCH_BEGIN marker
+		switch rec.operation {
+		case OPERATION_PUT:
+			f.index.Insert(rec.data.key, f.active.id, offset)
+		case OPERATION_DEL:
+			f.index.Delete(rec.data.key)
+		}
+		f.activeHints = append(f.activeHints, newHintEntry(rec, offset, offsets[i+2]-offset))
+	}
+	return f.afterAppend()
+}
+
+// batchMarker returns a BATCH_BEGIN or BATCH_COMMIT record for a batch of count records.
+func batchMarker(operation string, count int) record {
+	var val [4]byte
+	binary.BigEndian.PutUint32(val[:], uint32(count))
+	return record{
+		operation: operation,
+		data:      KVPair{val: string(val[:])},
+	}
+}
+
+// decodeBatchCount returns the record count carried by a batch marker.
+func decodeBatchCount(marker record) (uint32, error) {
+	if len(marker.data.val) != 4 {
+		return 0, ErrCorruptBatch
+	}
+	return binary.BigEndian.Uint32([]byte(marker.data.val)), nil
+}
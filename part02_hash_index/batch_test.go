@@ -0,0 +1,119 @@
+package kvstorefromscratchpart2
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileStore_WriteBatch(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	store, err := ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	if err := store.Put("stale", "old"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	batch := NewWriteBatch()
+	batch.Put("account:1", "90")
+	batch.Put("account:2", "110")
+	batch.Del("stale")
+	batch.Put("account:1", "80") // Later operations win
+	if err := store.Write(batch); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	check := func(store *FileStore) {
+		t.Helper()
+		for key, want := range map[string]string{"account:1": "80", "account:2": "110"} {
+			if got, err := store.Get(key); err != nil || got != want {
+				t.Errorf("Get(%q) returned (%q, %v), want %q", key, got, err, want)
+			}
+		}
+		if _, err := store.Get("stale"); err != ErrKeyDoesntExist {
+			t.Errorf("Get(stale) returned %v, want ErrKeyDoesntExist", err)
+		}
+	}
+	check(store)
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	store, err = ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer store.Close()
+	check(store)
+}
+
+func TestFileStore_WriteBatchRejectedAsAWhole(t *testing.T) {
+	store, err := ConnectFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+
+	batch := NewWriteBatch()
+	batch.Put("ok", "value")
+	batch.Put(strings.Repeat("k", MAX_KEY_SIZE+1), "value")
+	if err := store.Write(batch); err != ErrKeyTooLarge {
+		t.Fatalf("Write returned %v, want ErrKeyTooLarge", err)
+	}
+	if _, err := store.Get("ok"); err != ErrKeyDoesntExist {
+		t.Errorf("Get(ok) returned %v, want ErrKeyDoesntExist", err)
+	}
+	if store.active.Size() != 0 {
+		t.Errorf("active segment is %d bytes, want nothing written", store.active.Size())
+	}
+}
+
+func TestConnectFileStore_DiscardsTornBatchAtEveryByte(t *testing.T) {
+	before := putRecord("before", "1")
+	frame := []record{
+		batchMarker(OPERATION_BATCH_BEGIN, 2),
+		putRecord("a", "1"),
+		{operation: OPERATION_DEL, data: KVPair{key: "before"}},
+		batchMarker(OPERATION_BATCH_COMMIT, 2),
+	}
+	var frameEncoded []byte
+	for _, rec := range frame {
+		encoded, err := rec.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		frameEncoded = append(frameEncoded, encoded...)
+	}
+
+	// Every cut short of the full frame, including ones on record boundaries, loses the batch
+	for cut := 1; cut < len(frameEncoded); cut++ {
+		t.Run(fmt.Sprintf("cut-%d", cut), func(t *testing.T) {
+			tmpDir := t.TempDir()
+			good := writeSegment(t, tmpDir, 1, before)
+			path := filepath.Join(tmpDir, segmentFileName(1, SEGMENT_EXT))
+			if err := os.WriteFile(path, append(good, frameEncoded[:cut]...), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			store, err := ConnectFileStore(tmpDir)
+			if err != nil {
+				t.Fatalf("ConnectFileStore failed: %v", err)
+			}
+			defer store.Close()
+			if report := store.Recovery(); report == nil || report.TruncatedAt != int64(len(good)) {
+				t.Errorf("Recovery returned %+v, want truncation at %d", report, len(good))
+			}
+			if _, err := store.Get("a"); err != ErrKeyDoesntExist {
+				t.Errorf("Get(a) returned %v, want ErrKeyDoesntExist", err)
+			}
+			if got, err := store.Get("before"); err != nil || got != "1" {
+				t.Errorf("Get(before) returned (%q, %v), want 1", got, err)
+			}
+		})
+	}
+}
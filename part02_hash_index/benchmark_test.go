@@ -56,3 +56,23 @@ func getNthItemFromKVStore(store Store, N int) (string, error) {
 	}
 	return val, nil
 }
+
+func BenchmarkHashIndexGetOffset(b *testing.B) {
+	for _, keys := range []int{10000, 100000, 1000000} {
+		b.Run(fmt.Sprintf("Get-%d", keys), func(b *testing.B) {
+			index := NewHashIndex(INITIAL_INDEX_BUCKETS)
+			names := make([]string, keys)
+			for i := range names {
+				names[i] = fmt.Sprintf("key-%d", i)
+				index.Insert(names[i], 1, int64(i))
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := index.GetOffset(names[i%keys]); err != nil {
+					b.Errorf("GetOffset failed: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	kvs "kvstorefromscratchpart2"
+)
+
+var errCheckFailed = errors.New("damaged records found")
+
+// check verifies the data directory without opening the store, and with -repair fixes
+// what it found. It runs before the store is opened, since opening a damaged store
+// either fails or truncates its tail.
+func check(dir string, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	flags.SetOutput(out)
+	repair := flags.String("repair", "", "repair damaged segments: truncate (drop everything after the first damage) or quarantine (move damaged regions to .quarantine files)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errUsage
+	}
+
+	var report *kvs.VerifyReport
+	var err error
+	switch *repair {
+	case "":
+		report, err = kvs.Verify(dir)
+	case "truncate":
+		report, err = kvs.Repair(dir, kvs.REPAIR_TRUNCATE)
+	case "quarantine":
+		report, err = kvs.Repair(dir, kvs.REPAIR_QUARANTINE)
+	default:
+		return fmt.Errorf("unknown repair mode %q, want truncate or quarantine", *repair)
+	}
+	if err != nil {
+		return err
+	}
+
+	records, problems := 0, 0
+	for _, segment := range report.Segments {
+		records += segment.Records
+		for _, problem := range segment.Problems {
+			fmt.Fprintf(out, "%s: %v\n", segment.Path, problem)
+			problems++
+		}
+	}
+	// Repair deletes these files right away; otherwise the store cleans them up on open
+	badHint, orphaned := "invalid hint file, rebuilt on open", "left over from an interrupted write, removed on open"
+	if *repair != "" {
+		badHint, orphaned = "invalid hint file, removed", "left over from an interrupted write, removed"
+	}
+	for _, path := range report.BadHints {
+		fmt.Fprintf(out, "%s: %s\n", path, badHint)
+	}
+	for _, path := range report.OrphanedFiles {
+		fmt.Fprintf(out, "%s: %s\n", path, orphaned)
+	}
+	fmt.Fprintf(out, "%d segments, %d records, %d damaged regions\n", len(report.Segments), records, problems)
+
+	switch {
+	case *repair != "" && !report.OK():
+		fmt.Fprintln(out, "repaired")
+	case !report.OK():
+		return errCheckFailed
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	kvs "kvstorefromscratchpart2"
+)
+
+const (
+	DUMP_MAX_VALUE_LEN = 64 // Longer values are cut short in dump output
+)
+
+const commandHelp = `commands:
+  get KEY          print the value of KEY
+  put KEY VALUE    set KEY to VALUE
+  del KEY          delete KEY
+  keys [PREFIX]    list the live keys, optionally only those starting with PREFIX
+  stats            print the number of keys, segments and their size
+  dump             print every record in the log, including overwritten and deleted ones
+  check [-repair truncate|quarantine]
+                   verify every record without opening the store, optionally repairing
+                   damaged segments; only available from the shell, not interactively
+  help             print this help
+Without a command, kvcli reads commands from standard input. Arguments containing
+spaces can be quoted: put greeting "hello world".
+`
+
+var errUsage = errors.New("usage")
+
+// cli runs commands against an open store, writing their output to out.
+type cli struct {
+	store *kvs.FileStore
+	out   io.Writer
+}
+
+// run executes a single command given as its name followed by its arguments.
+func (c *cli) run(args []string) error {
+	name, args := args[0], args[1:]
+	var err error
+	switch name {
+	case "get":
+		err = c.get(args)
+	case "put":
+		err = c.put(args)
+	case "del":
+		err = c.del(args)
+	case "keys":
+		err = c.keys(args)
+	case "stats":
+		err = c.stats(args)
+	case "dump":
+		err = c.dump(args)
+	case "check":
+		return fmt.Errorf("check can't run on an open store, run kvcli check from the shell")
+	case "help":
+		_, err = io.WriteString(c.out, commandHelp)
+	default:
+		return fmt.Errorf("unknown command %q, try help", name)
+	}
+	if err == errUsage {
+		return fmt.Errorf("wrong number of arguments for %s, try help", name)
+	}
+	return err
+}
+
+func (c *cli) get(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	val, err := c.store.Get(args[0])
+	if err == kvs.ErrKeyDoesntExist {
+		return fmt.Errorf("key %s doesn't exist", display(args[0]))
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(c.out, val)
+	return err
+}
+
+func (c *cli) put(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	return c.store.Put(args[0], args[1])
+}
+
+// del deletes a key. A missing key is reported rather than written to the log, so a typo
+// doesn't go unnoticed.
+func (c *cli) del(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	if _, err := c.store.Get(args[0]); err == kvs.ErrKeyDoesntExist {
+		return fmt.Errorf("key %s doesn't exist", display(args[0]))
+	} else if err != nil {
+		return err
+	}
+	return c.store.Del(args[0])
+}
+
+func (c *cli) keys(args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+	it, err := c.store.ScanPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for it.HasNext() {
+		key, _ := it.Get()
+		if _, err := fmt.Fprintln(c.out, display(key)); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+func (c *cli) stats(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	stats, err := c.store.Stats()
+	if err != nil {
+		return err
+	}
+	index := "hash"
+	if stats.IndexType == kvs.INDEX_ORDERED {
+		index = "ordered"
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "keys:\t%d\n", stats.Keys)
+	fmt.Fprintf(tw, "segments:\t%d\n", stats.Segments)
+	fmt.Fprintf(tw, "active segment:\t%d (%d bytes)\n", stats.ActiveSegmentID, stats.ActiveSize)
+	fmt.Fprintf(tw, "disk size:\t%d bytes\n", stats.DiskSize)
+	fmt.Fprintf(tw, "index:\t%s\n", index)
+	return tw.Flush()
+}
+
+// dump prints one line per record in the log, oldest first.
+func (c *cli) dump(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	tw := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SEGMENT\tOFFSET\tSIZE\tOP\tKEY\tVALUE\tEXPIRES")
+	err := c.store.WalkLog(func(entry kvs.LogEntry) error {
+		val := display(truncate(entry.Value, DUMP_MAX_VALUE_LEN))
+		if len(entry.Value) > DUMP_MAX_VALUE_LEN {
+			val += "..."
+		}
+		switch entry.Operation {
+		case kvs.OPERATION_BATCH_BEGIN, kvs.OPERATION_BATCH_COMMIT:
+			val = strconv.Itoa(entry.BatchSize) + " records"
+		}
+		expires := "-"
+		if !entry.ExpiresAt.IsZero() {
+			expires = entry.ExpiresAt.UTC().Format(time.RFC3339)
+		}
+		_, err := fmt.Fprintf(tw, "%d\t%d\t%d\t%s\t%s\t%s\t%s\n",
+			entry.SegmentID, entry.Offset, entry.Size, entry.Operation, display(entry.Key), val, expires)
+		return err
+	})
+	if flushErr := tw.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// truncate cuts s down to at most n bytes without splitting a UTF-8 encoded character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	cut := n
+	for cut > 0 && cut > n-utf8.UTFMax && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut]
+}
+
+// display returns s unchanged if it is printable text without spaces, and quoted
+// otherwise, so binary keys and values can't mess up the terminal or the columns.
+func display(s string) string {
+	if !utf8.ValidString(s) || s == "" {
+		return strconv.Quote(s)
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) || unicode.IsSpace(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
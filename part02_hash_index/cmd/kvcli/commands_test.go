@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	kvs "kvstorefromscratchpart2"
+)
+
+func newTestCLI(t *testing.T) (*cli, *bytes.Buffer) {
+	t.Helper()
+	store, err := kvs.ConnectFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	out := &bytes.Buffer{}
+	return &cli{store: store, out: out}, out
+}
+
+func TestCLI_Commands(t *testing.T) {
+	c, out := newTestCLI(t)
+
+	for _, args := range [][]string{
+		{"put", "user:1", "alice"},
+		{"put", "user:2", "bob"},
+		{"put", "order:1", "two apples"},
+		{"del", "user:2"},
+	} {
+		if err := c.run(args); err != nil {
+			t.Fatalf("%v failed: %v", args, err)
+		}
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"get", "user:1"}, "alice\n"},
+		{[]string{"keys"}, "order:1\nuser:1\n"},
+		{[]string{"keys", "user:"}, "user:1\n"},
+	}
+	for _, tt := range tests {
+		out.Reset()
+		if err := c.run(tt.args); err != nil {
+			t.Errorf("%v failed: %v", tt.args, err)
+		} else if out.String() != tt.want {
+			t.Errorf("%v printed %q, want %q", tt.args, out.String(), tt.want)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"get", "user:2"},
+		{"del", "user:2"},
+		{"get"},
+		{"frobnicate"},
+	} {
+		if err := c.run(args); err == nil {
+			t.Errorf("%v succeeded, want an error", args)
+		}
+	}
+}
+
+func TestCLI_StatsAndDump(t *testing.T) {
+	c, out := newTestCLI(t)
+	c.run([]string{"put", "greeting", "hello\x00world"})
+	c.run([]string{"del", "greeting"})
+
+	if err := c.run([]string{"stats"}); err != nil {
+		t.Fatalf("stats failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "keys:            0\n") || !strings.Contains(out.String(), "segments:        1\n") {
+		t.Errorf("stats printed:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := c.run([]string{"dump"}); err != nil {
+		t.Fatalf("dump failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("dump printed %d lines, want a header and 2 records:\n%s", len(lines), out.String())
+	}
+	if fields := strings.Fields(lines[1]); !reflect.DeepEqual(fields, []string{"1", "0", "34", "PUT", "greeting", `"hello\x00world"`, "-"}) {
+		t.Errorf("dump printed PUT as %q", lines[1])
+	}
+	if fields := strings.Fields(lines[2]); len(fields) < 5 || fields[3] != "DEL" || fields[4] != "greeting" {
+		t.Errorf("dump printed DEL as %q", lines[2])
+	}
+}
+
+func TestCLI_DumpCutsLongValues(t *testing.T) {
+	c, out := newTestCLI(t)
+	c.run([]string{"put", "price", strings.Repeat("€", 30)}) // 3 bytes each
+	c.run([]string{"put", "binary", strings.Repeat("\x00", 100)})
+
+	if err := c.run([]string{"dump"}); err != nil {
+		t.Fatalf("dump failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("dump printed %d lines, want a header and 2 records:\n%s", len(lines), out.String())
+	}
+	if fields := strings.Fields(lines[1]); len(fields) < 6 || fields[5] != strings.Repeat("€", 21)+"..." {
+		t.Errorf("dump printed a long UTF-8 value as %q, want it cut after 21 characters", lines[1])
+	}
+	if fields := strings.Fields(lines[2]); len(fields) < 6 || fields[5] != strconv.Quote(strings.Repeat("\x00", DUMP_MAX_VALUE_LEN))+"..." {
+		t.Errorf("dump printed a long binary value as %q, want it quoted and cut", lines[2])
+	}
+}
+
+func TestCLI_REPL(t *testing.T) {
+	c, out := newTestCLI(t)
+	errOut := &bytes.Buffer{}
+
+	input := strings.Join([]string{
+		`put greeting "hello world"`,
+		`put 'path with spaces' raw\n`,
+		`get greeting`,
+		`get 'path with spaces'`,
+		`get missing`,
+		`put "unterminated`,
+		``,
+		`exit`,
+		`get greeting`,
+	}, "\n")
+	if err := c.repl(strings.NewReader(input), errOut); err != nil {
+		t.Fatalf("repl failed: %v", err)
+	}
+
+	if want := "hello world\nraw\\n\n"; out.String() != want {
+		t.Errorf("repl printed %q, want %q", out.String(), want)
+	}
+	if got := strings.Count(errOut.String(), "error: "); got != 2 {
+		t.Errorf("repl reported %d errors, want 2:\n%s", got, errOut.String())
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"  get   key ", []string{"get", "key"}},
+		{`put key "a \"quoted\" value\n"`, []string{"put", "key", "a \"quoted\" value\n"}},
+		{`put key 'single \n'`, []string{"put", "key", `single \n`}},
+		{`put "" ''`, []string{"put", "", ""}},
+	}
+	for _, tt := range tests {
+		got, err := splitArgs(tt.line)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitArgs(%q) = (%q, %v), want %q", tt.line, got, err, tt.want)
+		}
+	}
+	for _, line := range []string{`"open`, `'open`, `"bad \q"`} {
+		if _, err := splitArgs(line); err == nil {
+			t.Errorf("splitArgs(%q) succeeded, want an error", line)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tmpDir := t.TempDir()
+	store, err := kvs.ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	store.Put("a", "1")
+	store.Put("b", "2")
+	store.Close()
+
+	out := &bytes.Buffer{}
+	if err := check(tmpDir, nil, out); err != nil {
+		t.Fatalf("check failed: %v\n%s", err, out.String())
+	}
+	if !strings.HasSuffix(out.String(), "1 segments, 2 records, 0 damaged regions\n") {
+		t.Errorf("check printed %q", out.String())
+	}
+
+	// Corrupt the first record's checksum
+	path := filepath.Join(tmpDir, "000001.db")
+	data, _ := os.ReadFile(path)
+	data[0] ^= 0xFF
+	os.WriteFile(path, data, 0644)
+	orphan := filepath.Join(tmpDir, "tmp.db")
+	os.WriteFile(orphan, []byte("partial"), 0644)
+
+	out.Reset()
+	if err := check(tmpDir, nil, out); err != errCheckFailed {
+		t.Errorf("check of a damaged store returned %v, want errCheckFailed", err)
+	}
+	if !strings.Contains(out.String(), "record checksum mismatch") || !strings.Contains(out.String(), orphan+": left over from an interrupted write, removed on open\n") {
+		t.Errorf("check printed %q", out.String())
+	}
+
+	out.Reset()
+	if err := check(tmpDir, []string{"-repair", "quarantine"}, out); err != nil {
+		t.Fatalf("check -repair failed: %v", err)
+	}
+	if !strings.Contains(out.String(), orphan+": left over from an interrupted write, removed\n") {
+		t.Errorf("check -repair printed %q", out.String())
+	}
+	if err := check(tmpDir, nil, &bytes.Buffer{}); err != nil {
+		t.Errorf("check after repair returned %v", err)
+	}
+	if err := check(tmpDir, []string{"-repair", "delete-everything"}, &bytes.Buffer{}); err == nil {
+		t.Errorf("check with an unknown repair mode succeeded")
+	}
+}
@@ -0,0 +1,74 @@
+// Command kvcli inspects and edits a store's data directory.
+//
+//	kvcli -dir ./data get KEY
+//	kvcli -dir ./data put KEY VALUE
+//	kvcli -dir ./data del KEY
+//	kvcli -dir ./data keys [PREFIX]
+//	kvcli -dir ./data stats
+//	kvcli -dir ./data dump
+//	kvcli -dir ./data check [-repair truncate|quarantine]
+//	kvcli -dir ./data              (interactive mode)
+//
+// The directory is opened with ConnectFileStore, so a torn write at the end of the log is
+// repaired and reported on open. Writes are fsynced before the command returns. A store
+// must not be opened by kvcli while a server has it open. check is the exception: it reads
+// the files directly, so it can inspect a store that fails to open.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	kvs "kvstorefromscratchpart2"
+)
+
+func main() {
+	dir := flag.String("dir", "./data/", "data directory of the store")
+	ordered := flag.Bool("ordered", false, "use the ordered index, faster for keys and large prefix listings")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: kvcli [-dir DIR] [-ordered] [command [args...]]\n\n%s\nflags:\n", commandHelp)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() > 0 && flag.Arg(0) == "check" {
+		if err := check(*dir, flag.Args()[1:], os.Stdout); err != nil {
+			if err == errUsage {
+				err = fmt.Errorf("wrong number of arguments for check, try help")
+			}
+			fmt.Fprintf(os.Stderr, "kvcli: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	opts := kvs.DefaultOptions()
+	opts.SyncMode = kvs.SYNC_ALWAYS
+	if *ordered {
+		opts.IndexType = kvs.INDEX_ORDERED
+	}
+	store, err := kvs.ConnectFileStoreWithOptions(*dir, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kvcli: opening %s: %v\n", *dir, err)
+		os.Exit(1)
+	}
+	if report := store.Recovery(); report != nil {
+		fmt.Fprintf(os.Stderr, "kvcli: discarded %d bytes at the end of segment %d (%v)\n",
+			report.DiscardedBytes, report.SegmentID, report.Reason)
+	}
+
+	c := &cli{store: store, out: os.Stdout}
+	if flag.NArg() == 0 {
+		err = c.repl(os.Stdin, os.Stderr)
+	} else {
+		err = c.run(flag.Args())
+	}
+	if closeErr := store.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kvcli: %v\n", err)
+		os.Exit(1)
+	}
+}
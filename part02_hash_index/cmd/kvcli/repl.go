@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	kvs "kvstorefromscratchpart2"
+)
+
+const (
+	REPL_PROMPT = "kvcli> "
+)
+
+// repl reads commands from in, one per line, until "exit", "quit" or the end of the
+// input. Prompts and errors go to errOut, so a failing command doesn't end the session
+// and the output of the commands stays clean.
+func (c *cli) repl(in io.Reader, errOut io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	// A line may carry a maximum-size value, quoted
+	scanner.Buffer(make([]byte, 64*1024), 4*(kvs.MAX_KEY_SIZE+kvs.MAX_VALUE_SIZE))
+
+	for {
+		fmt.Fprint(errOut, REPL_PROMPT)
+		if !scanner.Scan() {
+			fmt.Fprintln(errOut)
+			return scanner.Err()
+		}
+		args, err := splitArgs(scanner.Text())
+		if err != nil {
+			fmt.Fprintf(errOut, "error: %v\n", err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "exit" || args[0] == "quit" {
+			return nil
+		}
+		if err := c.run(args); err != nil {
+			fmt.Fprintf(errOut, "error: %v\n", err)
+		}
+	}
+}
+
+// splitArgs splits a line into space separated words. A word in double quotes may contain
+// spaces and Go escape sequences such as \n or \x00; a word in single quotes is taken
+// literally.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return args, nil
+		}
+
+		switch line[0] {
+		case '"':
+			end := 1
+			for ; end < len(line) && line[end] != '"'; end++ {
+				if line[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(line) {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			arg, err := strconv.Unquote(line[:end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted string %s", line[:end+1])
+			}
+			args = append(args, arg)
+			line = line[end+1:]
+		case '\'':
+			end := strings.IndexByte(line[1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			args = append(args, line[1:end+1])
+			line = line[end+2:]
+		default:
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			args = append(args, line[:end])
+			line = line[end:]
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Command kvserver serves a FileStore over TCP using the Redis protocol (RESP), so
+// redis-cli and Redis client libraries can talk to it.
+//
+//	kvserver -dir ./data -addr 127.0.0.1:6380
+//	redis-cli -p 6380 SET greeting hello
+//
+// Supported commands: PING, GET, SET (with EX/PX), DEL, EXISTS, SCAN (with MATCH/COUNT)
+// and QUIT.
+//
+// With -http, the same store is also served over the HTTP/JSON API of package httpapi:
+//
+//	kvserver -dir ./data -http 127.0.0.1:8080
+//	curl -X PUT -d '{"value": "hello"}' http://127.0.0.1:8080/kv/greeting
+//
+// With -replication, followers can stream the log from that address; a server started
+// with -follow is such a follower. It applies the leader's writes to its own data
+// directory, reconnecting whenever the connection drops, and refuses SET and DEL, as well
+// as PUT and DELETE over HTTP:
+//
+//	kvserver -dir ./leader -replication 127.0.0.1:7000
+//	kvserver -dir ./standby -addr 127.0.0.1:6381 -follow 127.0.0.1:7000
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	kvs "kvstorefromscratchpart2"
+	"kvstorefromscratchpart2/httpapi"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:6380", "address to listen on")
+	httpAddr := flag.String("http", "", "address to serve the HTTP API on; disabled if empty")
+	dir := flag.String("dir", "./data/", "data directory of the store")
+	replicationAddr := flag.String("replication", "", "address to serve followers on; disabled if empty")
+	leaderAddr := flag.String("follow", "", "replication address of a leader to follow; makes the server read-only")
+	flag.Parse()
+
+	store, err := kvs.ConnectFileStore(*dir)
+	if err != nil {
+		log.Fatalf("kvserver: opening %s: %v", *dir, err)
+	}
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		store.Close()
+		log.Fatalf("kvserver: %v", err)
+	}
+
+	server := NewServer(store)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *replicationAddr != "" {
+		replicationListener, err := net.Listen("tcp", *replicationAddr)
+		if err != nil {
+			store.Close()
+			log.Fatalf("kvserver: %v", err)
+		}
+		defer replicationListener.Close()
+		log.Printf("kvserver: serving followers on %s", replicationListener.Addr())
+		go serveFollowers(ctx, store, replicationListener)
+	}
+	if *leaderAddr != "" {
+		follower, err := kvs.NewFollower(store)
+		if err != nil {
+			store.Close()
+			log.Fatalf("kvserver: %v", err)
+		}
+		server.ReadOnly = true
+		go follow(ctx, follower, *leaderAddr, server)
+	}
+
+	var httpServer *http.Server
+	if *httpAddr != "" {
+		opts := httpapi.DefaultOptions()
+		opts.ReadOnly = *leaderAddr != ""
+		httpServer = &http.Server{Addr: *httpAddr, Handler: httpapi.NewHandlerWithOptions(store, opts)}
+		go func() {
+			log.Printf("kvserver: serving HTTP on %s", *httpAddr)
+			if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Printf("kvserver: %v", err)
+				server.Close()
+			}
+		}()
+	}
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		server.Close()
+	}()
+
+	log.Printf("kvserver: serving %s on %s", *dir, listener.Addr())
+	err = server.Serve(listener)
+	if err != ErrServerClosed {
+		log.Printf("kvserver: %v", err)
+	}
+	if httpServer != nil {
+		httpServer.Shutdown(context.Background())
+	}
+	cancel() // Stops replication before the store is closed
+	if err := store.Close(); err != nil {
+		log.Fatalf("kvserver: closing store: %v", err)
+	}
+}
+
+// serveFollowers streams the store's log to every follower that connects to l.
+func serveFollowers(ctx context.Context, store *kvs.FileStore, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			log.Printf("kvserver: follower %s connected", conn.RemoteAddr())
+			err := store.ServeReplication(ctx, conn)
+			log.Printf("kvserver: follower %s disconnected: %v", conn.RemoteAddr(), err)
+		}()
+	}
+}
+
+// follow applies the log of the leader at addr, reconnecting after a second whenever the
+// connection fails. If the leader no longer has the follower's position, the store has to
+// be reseeded, so the server is shut down.
+func follow(ctx context.Context, follower *kvs.Follower, addr string, server *Server) {
+	for ctx.Err() == nil {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			stop := context.AfterFunc(ctx, func() { conn.Close() })
+			log.Printf("kvserver: following %s from %v", addr, follower.Position())
+			err = follower.Follow(conn)
+			stop()
+			conn.Close()
+		}
+		if errors.Is(err, kvs.ErrPositionLost) {
+			log.Printf("kvserver: %v; restore the data directory from a backup of the leader", err)
+			server.Close()
+			return
+		}
+		if ctx.Err() == nil {
+			log.Printf("kvserver: following %s: %v", addr, err)
+			time.Sleep(time.Second)
+		}
+	}
+}
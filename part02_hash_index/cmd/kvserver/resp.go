@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Limits on what a client may send, so a bad length prefix can't make the server allocate
+// arbitrary amounts of memory. The bulk limit leaves room for the largest value the store
+// accepts.
+const (
+	MAX_ARRAY_LEN  = 1024 * 1024
+	MAX_BULK_LEN   = 64*1024*1024 + 1024
+	MAX_INLINE_LEN = 64 * 1024
+)
+
+var ErrProtocol = errors.New("protocol error")
+
+// respReader decodes commands sent by a client. Clients send either an array of bulk
+// strings (what redis-cli and client libraries use) or an inline command, a single line
+// of space separated words (handy with telnet or nc).
+type respReader struct {
+	reader *bufio.Reader
+}
+
+func newRESPReader(r io.Reader) *respReader {
+	return &respReader{reader: bufio.NewReader(r)}
+}
+
+// ReadCommand returns the next command and its arguments. Empty inline lines are skipped.
+// It returns io.EOF if the client closed the connection between commands, and an error
+// wrapping ErrProtocol if the input is malformed.
+func (rr *respReader) ReadCommand() ([]string, error) {
+	for {
+		line, err := rr.readLine(MAX_INLINE_LEN)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != '*' {
+			if args := strings.Fields(line); len(args) > 0 {
+				return args, nil
+			}
+			continue
+		}
+
+		n, err := parseLength(line[1:], -1, MAX_ARRAY_LEN) // "*-1" is a null array
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 {
+			continue
+		}
+		args := make([]string, 0, min(n, 64)) // Grows with the arguments actually sent
+		for i := 0; i < n; i++ {
+			arg, err := rr.readBulkString()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		return args, nil
+	}
+}
+
+// readBulkString reads a "$<len>\r\n<bytes>\r\n" element.
+func (rr *respReader) readBulkString() (string, error) {
+	line, err := rr.readLine(MAX_INLINE_LEN)
+	if err != nil {
+		return "", unexpectedEOF(err)
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return "", fmt.Errorf("%w: expected '$', got %q", ErrProtocol, line)
+	}
+	n, err := parseLength(line[1:], 0, MAX_BULK_LEN) // A command argument can't be null
+	if err != nil {
+		return "", err
+	}
+	// The buffer grows as the payload arrives rather than being sized by the claimed
+	// length, so a client can't make the server allocate memory it never sends.
+	var payload strings.Builder
+	if _, err := io.CopyN(&payload, rr.reader, int64(n)); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	var crlf [2]byte
+	if _, err := io.ReadFull(rr.reader, crlf[:]); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	if crlf != [2]byte{'\r', '\n'} {
+		return "", fmt.Errorf("%w: bulk string not terminated by CRLF", ErrProtocol)
+	}
+	return payload.String(), nil
+}
+
+// readLine reads a line terminated by "\n" (optionally preceded by "\r") and strips the
+// terminator. Lines longer than limit are rejected.
+func (rr *respReader) readLine(limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := rr.reader.ReadLine()
+		if err != nil {
+			if len(line) > 0 {
+				return "", unexpectedEOF(err)
+			}
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > limit {
+			return "", fmt.Errorf("%w: line too long", ErrProtocol)
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// parseLength parses the length of an array or bulk string, which must be in [min, limit].
+func parseLength(s string, min, limit int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < min || n > limit {
+		return 0, fmt.Errorf("%w: invalid length %q", ErrProtocol, s)
+	}
+	return n, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// respWriter encodes replies. Writes are buffered; call Flush once a reply is complete.
+type respWriter struct {
+	writer *bufio.Writer
+}
+
+func newRESPWriter(w io.Writer) *respWriter {
+	return &respWriter{writer: bufio.NewWriter(w)}
+}
+
+// WriteSimpleString writes "+<s>\r\n". s must not contain CR or LF.
+func (rw *respWriter) WriteSimpleString(s string) {
+	rw.writer.WriteString("+" + s + "\r\n")
+}
+
+// WriteError writes "-<msg>\r\n". By convention msg starts with an upper-case error kind
+// such as "ERR".
+func (rw *respWriter) WriteError(msg string) {
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	rw.writer.WriteString("-" + msg + "\r\n")
+}
+
+// WriteInteger writes ":<n>\r\n".
+func (rw *respWriter) WriteInteger(n int64) {
+	rw.writer.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+// WriteBulkString writes "$<len>\r\n<s>\r\n"; s may contain any bytes.
+func (rw *respWriter) WriteBulkString(s string) {
+	rw.writer.WriteString("$" + strconv.Itoa(len(s)) + "\r\n")
+	rw.writer.WriteString(s)
+	rw.writer.WriteString("\r\n")
+}
+
+// WriteNull writes the null bulk string, used for a missing key.
+func (rw *respWriter) WriteNull() {
+	rw.writer.WriteString("$-1\r\n")
+}
+
+// WriteArrayHeader starts an array of n elements; the elements are written next.
+func (rw *respWriter) WriteArrayHeader(n int) {
+	rw.writer.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func (rw *respWriter) Flush() error {
+	return rw.writer.Flush()
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kvs "kvstorefromscratchpart2"
+)
+
+const (
+	DEFAULT_SCAN_COUNT = 10
+
+	// MAX_SCAN_CURSORS is the number of unfinished SCANs a connection may have; starting
+	// another one evicts the oldest cursor, which then fails with "invalid cursor".
+	MAX_SCAN_CURSORS = 64
+)
+
+// Server serves a FileStore to RESP clients such as redis-cli. Each connection is handled
+// by its own goroutine; the store takes care of concurrent access.
+type Server struct {
+	store *kvs.FileStore
+
+	// ReadOnly makes SET and DEL fail with a READONLY error, e.g. on a replication
+	// follower. Set it before calling Serve.
+	ReadOnly bool
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+var ErrServerClosed = errors.New("server closed")
+
+const errReadOnly = "READONLY You can't write against a read only replica."
+
+func NewServer(store *kvs.FileStore) *Server {
+	return &Server{
+		store:     store,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on l until l fails or the server is closed. It always
+// returns a non-nil error; after Close it returns ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.handleConn(conn)
+	}
+}
+
+// Close stops the listeners, closes every open connection and waits for their handlers
+// to return. It does not close the store.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// session is the per-connection state.
+type session struct {
+	reader *respReader
+	writer *respWriter
+
+	// SCAN cursors handed out on this connection, mapped to the key the next call
+	// continues from. redis-cli expects numeric cursors, so keys can't be used directly.
+	scanCursors map[uint64]string
+	nextCursor  uint64
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	sess := &session{
+		reader:      newRESPReader(conn),
+		writer:      newRESPWriter(conn),
+		scanCursors: make(map[uint64]string),
+	}
+	for {
+		args, err := sess.reader.ReadCommand()
+		if err != nil {
+			if errors.Is(err, ErrProtocol) {
+				sess.writer.WriteError("ERR " + err.Error())
+				sess.writer.Flush()
+			} else if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("kvserver: %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		quit := s.dispatch(sess, args)
+		if err := sess.writer.Flush(); err != nil || quit {
+			return
+		}
+	}
+}
+
+// dispatch runs a single command and writes its reply. It reports whether the client
+// asked to close the connection.
+func (s *Server) dispatch(sess *session, args []string) bool {
+	w := sess.writer
+	name := strings.ToUpper(args[0])
+	args = args[1:]
+
+	switch name {
+	case "PING":
+		switch len(args) {
+		case 0:
+			w.WriteSimpleString("PONG")
+		case 1:
+			w.WriteBulkString(args[0])
+		default:
+			wrongArity(w, name)
+		}
+	case "GET":
+		if len(args) != 1 {
+			wrongArity(w, name)
+			return false
+		}
+		s.get(w, args[0])
+	case "SET":
+		if len(args) < 2 {
+			wrongArity(w, name)
+			return false
+		}
+		if s.ReadOnly {
+			w.WriteError(errReadOnly)
+			return false
+		}
+		s.set(w, args)
+	case "DEL":
+		if len(args) == 0 {
+			wrongArity(w, name)
+			return false
+		}
+		if s.ReadOnly {
+			w.WriteError(errReadOnly)
+			return false
+		}
+		s.del(w, args)
+	case "EXISTS":
+		if len(args) == 0 {
+			wrongArity(w, name)
+			return false
+		}
+		s.exists(w, args)
+	case "SCAN":
+		if len(args) == 0 {
+			wrongArity(w, name)
+			return false
+		}
+		s.scan(sess, args)
+	case "COMMAND":
+		// Sent by redis-cli on startup to fetch command docs; an empty reply is enough
+		w.WriteArrayHeader(0)
+	case "QUIT":
+		w.WriteSimpleString("OK")
+		return true
+	default:
+		w.WriteError("ERR unknown command '" + shortName(name) + "'")
+	}
+	return false
+}
+
+func (s *Server) get(w *respWriter, key string) {
+	val, err := s.store.Get(key)
+	if err == kvs.ErrKeyDoesntExist {
+		w.WriteNull()
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteBulkString(val)
+}
+
+// set handles SET key value [EX seconds | PX milliseconds].
+func (s *Server) set(w *respWriter, args []string) {
+	key, val := args[0], args[1]
+	var ttl time.Duration
+	for opts := args[2:]; len(opts) > 0; opts = opts[2:] {
+		if len(opts) < 2 || ttl != 0 {
+			w.WriteError("ERR syntax error")
+			return
+		}
+		n, err := strconv.ParseInt(opts[1], 10, 64)
+		if err != nil || n <= 0 {
+			w.WriteError("ERR invalid expire time in 'set' command")
+			return
+		}
+		switch strings.ToUpper(opts[0]) {
+		case "EX":
+			ttl = time.Duration(n) * time.Second
+		case "PX":
+			ttl = time.Duration(n) * time.Millisecond
+		default:
+			w.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	var err error
+	if ttl > 0 {
+		err = s.store.PutWithTTL(key, val, ttl)
+	} else {
+		err = s.store.Put(key, val)
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteSimpleString("OK")
+}
+
+// del handles DEL key [key ...] and replies with the number of keys that existed.
+// Only keys that exist are deleted, so DEL of a missing key doesn't grow the log.
+func (s *Server) del(w *respWriter, keys []string) {
+	var deleted int64
+	for _, key := range keys {
+		ok, err := s.delIfExists(key)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		if ok {
+			deleted++
+		}
+	}
+	w.WriteInteger(deleted)
+}
+
+// delIfExists deletes key and reports whether it existed. The delete only goes through
+// if the key is still at the version that was read, so of several clients deleting the
+// same key concurrently exactly one counts it.
+func (s *Server) delIfExists(key string) (bool, error) {
+	for {
+		_, version, err := s.store.GetWithVersion(key)
+		if err == kvs.ErrKeyDoesntExist {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		err = s.store.DeleteIfVersion(key, version)
+		if err != kvs.ErrVersionMismatch {
+			return err == nil, err
+		}
+		// Written or deleted in the meantime, look again
+	}
+}
+
+// exists handles EXISTS key [key ...]; a key given twice is counted twice.
+func (s *Server) exists(w *respWriter, keys []string) {
+	var found int64
+	for _, key := range keys {
+		_, err := s.store.Get(key)
+		if err == kvs.ErrKeyDoesntExist {
+			continue
+		}
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		found++
+	}
+	w.WriteInteger(found)
+}
+
+// scan handles SCAN cursor [MATCH pattern] [COUNT count]. Keys are returned in key order;
+// the reply is the next cursor, "0" once the scan is complete, and a batch of keys.
+//
+// Like Redis, a key that exists for the whole scan is returned exactly once, while keys
+// added or removed during it may or may not be.
+func (s *Server) scan(sess *session, args []string) {
+	w := sess.writer
+
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		w.WriteError("ERR invalid cursor")
+		return
+	}
+	start := ""
+	if cursor != 0 {
+		var ok bool
+		if start, ok = sess.scanCursors[cursor]; !ok {
+			w.WriteError("ERR invalid cursor")
+			return
+		}
+		delete(sess.scanCursors, cursor)
+	}
+
+	pattern, count := "*", DEFAULT_SCAN_COUNT
+	for opts := args[1:]; len(opts) > 0; opts = opts[2:] {
+		if len(opts) < 2 {
+			w.WriteError("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(opts[0]) {
+		case "MATCH":
+			pattern = opts[1]
+		case "COUNT":
+			count, err = strconv.Atoi(opts[1])
+			if err != nil || count <= 0 {
+				w.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			w.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	// Only the keys sharing the pattern's literal prefix can match, and a continued scan
+	// starts at the cursor's key. As in Redis, COUNT bounds the keys examined, so a call
+	// may return fewer matches; one more key is fetched to continue from.
+	prefix := literalPrefix(pattern)
+	examined, err := s.store.ScanKeys(max(start, prefix), kvs.PrefixEnd(prefix), count+1)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	var keys []string
+	next := ""
+	for i, key := range examined {
+		if i == count {
+			next = key
+			break
+		}
+		if matchGlob(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+
+	nextCursor := "0"
+	if next != "" {
+		nextCursor = strconv.FormatUint(sess.addCursor(next), 10)
+	}
+	w.WriteArrayHeader(2)
+	w.WriteBulkString(nextCursor)
+	w.WriteArrayHeader(len(keys))
+	for _, key := range keys {
+		w.WriteBulkString(key)
+	}
+}
+
+// addCursor hands out a new SCAN cursor that continues from key. If the session has
+// MAX_SCAN_CURSORS open already, the oldest one is dropped, so clients that abandon scans
+// don't make the session grow without bound.
+func (sess *session) addCursor(key string) uint64 {
+	if len(sess.scanCursors) >= MAX_SCAN_CURSORS {
+		oldest := sess.nextCursor
+		for cursor := range sess.scanCursors {
+			oldest = min(oldest, cursor) // Cursors are handed out in increasing order
+		}
+		delete(sess.scanCursors, oldest)
+	}
+	sess.nextCursor++
+	sess.scanCursors[sess.nextCursor] = key
+	return sess.nextCursor
+}
+
+// literalPrefix returns the part of a glob pattern before its first special character.
+func literalPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// matchGlob reports whether s matches a Redis-style glob pattern: '*' matches any run of
+// bytes, '?' a single byte, "[abc]" / "[a-z]" / "[^a]" a byte class and '\' escapes the
+// next character. Unlike path.Match, '/' is not special.
+func matchGlob(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchGlob(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				// Unterminated class, match '[' literally
+				if s[0] != '[' {
+					return false
+				}
+				break
+			}
+			if !matchClass(pattern[1:end+1], s[0]) {
+				return false
+			}
+			pattern = pattern[end+1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
+
+// matchClass reports whether c is in the byte class, given without its brackets.
+func matchClass(class string, c byte) bool {
+	negate := len(class) > 0 && class[0] == '^'
+	if negate {
+		class = class[1:]
+	}
+	matched := false
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			lo, hi := class[i], class[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if lo <= c && c <= hi {
+				matched = true
+			}
+			i += 2
+		} else if class[i] == c {
+			matched = true
+		}
+	}
+	return matched != negate
+}
+
+func wrongArity(w *respWriter, name string) {
+	w.WriteError("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+}
+
+func writeStoreError(w *respWriter, err error) {
+	w.WriteError("ERR " + err.Error())
+}
+
+// shortName lower-cases a command name and cuts it short for use in an error message.
+func shortName(name string) string {
+	const maxLen = 64
+	name = strings.ToLower(name)
+	if len(name) > maxLen {
+		return name[:maxLen] + "..."
+	}
+	return name
+}
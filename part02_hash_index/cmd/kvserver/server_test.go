@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	kvs "kvstorefromscratchpart2"
+)
+
+// startServer serves a fresh store on a loopback port and returns a connected client.
+// The configure functions are applied to the server before it starts serving.
+func startServer(t *testing.T, configure ...func(*Server)) *testClient {
+	t.Helper()
+	store, err := kvs.ConnectFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	server := NewServer(store)
+	for _, fn := range configure {
+		fn(server)
+	}
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(listener) }()
+	t.Cleanup(func() {
+		server.Close()
+		if err := <-done; err != ErrServerClosed {
+			t.Errorf("Serve returned %v, want ErrServerClosed", err)
+		}
+		store.Close()
+	})
+	return dial(t, listener.Addr().String())
+}
+
+// testClient is a minimal RESP client. Replies are decoded into strings, nil for a
+// null bulk string, int64, []any, or respError.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type respError string
+
+func dial(t *testing.T, addr string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// do sends args as an array of bulk strings and returns the decoded reply.
+func (c *testClient) do(args ...string) any {
+	c.t.Helper()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, sb.String()); err != nil {
+		c.t.Fatalf("write failed: %v", err)
+	}
+	return c.readReply()
+}
+
+func (c *testClient) readReply() any {
+	c.t.Helper()
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("read failed: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return respError(line[1:])
+	case ':':
+		n, _ := strconv.ParseInt(line[1:], 10, 64)
+		return n
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			c.t.Fatalf("read failed: %v", err)
+		}
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		elems := make([]any, n)
+		for i := range elems {
+			elems[i] = c.readReply()
+		}
+		return elems
+	}
+	c.t.Fatalf("unexpected reply %q", line)
+	return nil
+}
+
+func TestServer_Commands(t *testing.T) {
+	client := startServer(t)
+
+	tests := []struct {
+		args []string
+		want any
+	}{
+		{[]string{"PING"}, "PONG"},
+		{[]string{"ping", "hello"}, "hello"},
+		{[]string{"GET", "missing"}, nil},
+		{[]string{"SET", "greeting", "hello\r\nworld"}, "OK"},
+		{[]string{"GET", "greeting"}, "hello\r\nworld"},
+		{[]string{"SET", "session", "token", "EX", "60"}, "OK"},
+		{[]string{"GET", "session"}, "token"},
+		{[]string{"EXISTS", "greeting", "missing", "session", "greeting"}, int64(3)},
+		{[]string{"DEL", "greeting", "missing"}, int64(1)},
+		{[]string{"GET", "greeting"}, nil},
+		{[]string{"EXISTS", "greeting"}, int64(0)},
+		{[]string{"SET", "key", "val", "EX", "0"}, respError("ERR invalid expire time in 'set' command")},
+		{[]string{"SET", "key", "val", "KEEPTTL"}, respError("ERR syntax error")},
+		{[]string{"GET"}, respError("ERR wrong number of arguments for 'get' command")},
+		{[]string{"FLUSHALL"}, respError("ERR unknown command 'flushall'")},
+	}
+	for _, tt := range tests {
+		if got := client.do(tt.args...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q returned %#v, want %#v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestServer_ReadOnly(t *testing.T) {
+	client := startServer(t, func(s *Server) { s.ReadOnly = true })
+
+	for _, args := range [][]string{{"SET", "key", "val"}, {"DEL", "key"}} {
+		if got := client.do(args...); got != respError(errReadOnly) {
+			t.Errorf("%q returned %#v, want a READONLY error", args, got)
+		}
+	}
+	if got := client.do("GET", "key"); got != nil {
+		t.Errorf("GET returned %#v, want nil", got)
+	}
+}
+
+func TestServer_Scan(t *testing.T) {
+	client := startServer(t)
+
+	var want []string
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("user:%02d", i)
+		want = append(want, key)
+		if got := client.do("SET", key, "v"); got != "OK" {
+			t.Fatalf("SET returned %v", got)
+		}
+	}
+	client.do("SET", "other", "v")
+
+	var got []string
+	cursor := "0"
+	for calls := 0; ; calls++ {
+		if calls > 10 {
+			t.Fatalf("SCAN did not finish")
+		}
+		reply, ok := client.do("SCAN", cursor, "MATCH", "user:*", "COUNT", "10").([]any)
+		if !ok || len(reply) != 2 {
+			t.Fatalf("SCAN returned %#v", reply)
+		}
+		for _, key := range reply[1].([]any) {
+			got = append(got, key.(string))
+		}
+		cursor = reply[0].(string)
+		if cursor == "0" {
+			break
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SCAN returned %v, want %v", got, want)
+	}
+
+	reply := client.do("SCAN", "0", "MATCH", "user:1?").([]any)
+	if keys := reply[1].([]any); len(keys) != 10 {
+		t.Errorf("SCAN MATCH user:1? returned %v, want 10 keys", keys)
+	}
+	if got := client.do("SCAN", "12345"); got != respError("ERR invalid cursor") {
+		t.Errorf("SCAN with unknown cursor returned %#v", got)
+	}
+}
+
+func TestServer_ConcurrentDelCountsEachKeyOnce(t *testing.T) {
+	client := startServer(t)
+	addr := client.conn.RemoteAddr().String()
+
+	const clients, keys = 8, 50
+	for i := 0; i < keys; i++ {
+		client.do("SET", fmt.Sprintf("key-%d", i), "v")
+	}
+	others := make([]*testClient, clients)
+	for c := range others {
+		others[c] = dial(t, addr)
+	}
+	var wg sync.WaitGroup
+	var total atomic.Int64
+	for _, other := range others {
+		wg.Add(1)
+		go func(other *testClient) {
+			defer wg.Done()
+			for i := 0; i < keys; i++ {
+				n, ok := other.do("DEL", fmt.Sprintf("key-%d", i)).(int64)
+				if !ok {
+					t.Errorf("DEL didn't return an integer")
+					return
+				}
+				total.Add(n)
+			}
+		}(other)
+	}
+	wg.Wait()
+	if total.Load() != keys {
+		t.Errorf("DELs from %d clients counted %d deleted keys, want %d", clients, total.Load(), keys)
+	}
+}
+
+func TestServer_AbandonedScansAreEvicted(t *testing.T) {
+	client := startServer(t)
+	client.do("SET", "a", "v")
+	client.do("SET", "b", "v")
+
+	var cursors []string
+	for i := 0; i <= MAX_SCAN_CURSORS; i++ {
+		reply := client.do("SCAN", "0", "COUNT", "1").([]any)
+		cursors = append(cursors, reply[0].(string))
+	}
+	if got := client.do("SCAN", cursors[0]); got != respError("ERR invalid cursor") {
+		t.Errorf("SCAN with the oldest of %d abandoned cursors returned %#v, want it evicted", len(cursors), got)
+	}
+	reply, ok := client.do("SCAN", cursors[len(cursors)-1]).([]any)
+	if !ok || reply[0] != "0" || len(reply[1].([]any)) != 1 {
+		t.Errorf("SCAN with the newest cursor returned %#v, want the last key", reply)
+	}
+}
+
+func TestServer_InlineCommandsAndConcurrentClients(t *testing.T) {
+	client := startServer(t)
+	other := dial(t, client.conn.RemoteAddr().String())
+
+	if _, err := io.WriteString(client.conn, "SET shared value\r\n"); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if got := client.readReply(); got != "OK" {
+		t.Fatalf("inline SET returned %#v", got)
+	}
+	if got := other.do("GET", "shared"); got != "value" {
+		t.Errorf("GET from second client returned %#v, want value", got)
+	}
+	if got := other.do("QUIT"); got != "OK" {
+		t.Errorf("QUIT returned %#v", got)
+	}
+	if _, err := other.reader.ReadByte(); err != io.EOF {
+		t.Errorf("connection still open after QUIT: %v", err)
+	}
+}
+
+func TestServer_MalformedInput(t *testing.T) {
+	client := startServer(t)
+	addr := client.conn.RemoteAddr().String()
+
+	for _, input := range []string{
+		"*1\r\n$-1\r\nX",            // Null bulk string as an argument
+		"*1\r\n$-2\r\n",             // Negative length
+		"*2\r\n$3\r\nGET\r\n$x\r\n", // Length isn't a number
+		"*1\r\n$3\r\nGETX\r\n",      // Bulk string longer than its length
+		"*1\r\n+GET\r\n",            // Not a bulk string
+	} {
+		bad := dial(t, addr)
+		if _, err := io.WriteString(bad.conn, input); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		reply, ok := bad.readReply().(respError)
+		if !ok || !strings.HasPrefix(string(reply), "ERR protocol error") {
+			t.Errorf("input %q returned %#v, want a protocol error", input, reply)
+		}
+		if _, err := bad.reader.ReadByte(); err != io.EOF {
+			t.Errorf("connection still open after input %q: %v", input, err)
+		}
+	}
+
+	// The server is still up
+	if got := client.do("PING"); got != "PONG" {
+		t.Errorf("PING after malformed input returned %#v, want PONG", got)
+	}
+}
+
+func TestRESPReader_ClaimedLengthsAreNotAllocatedUpFront(t *testing.T) {
+	// Headers claiming the largest bulk string and array, with hardly any data behind them
+	inputs := []string{
+		"*1\r\n$" + strconv.Itoa(MAX_BULK_LEN) + "\r\nabc",
+		"*" + strconv.Itoa(MAX_ARRAY_LEN) + "\r\n$3\r\nGET\r\n",
+	}
+	for _, input := range inputs {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := newRESPReader(strings.NewReader(input)).ReadCommand()
+		runtime.ReadMemStats(&after)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("ReadCommand of %.20q returned %v, want io.ErrUnexpectedEOF", input, err)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1024*1024 {
+			t.Errorf("ReadCommand of %.20q allocated %d bytes for a few bytes of input", input, allocated)
+		}
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"user:*", "user:42:name", true},
+		{"user:*:name", "user:42:name", true},
+		{"user:*:name", "user:42:email", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{`a\*b`, "a*b", true},
+		{`a\*b`, "axb", false},
+		{"a/*", "a/b/c", true},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package kvstorefromscratchpart2
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	COMPACTED_EXT = ".compacted"
+
+	// COMPACTION_STATE_FILENAME holds the ID of the newest segment written by Compact and
+	// the number of compactions so far. Log positions in that segment or before it may refer
+	// to records that were rewritten, see LogPosition.
+	COMPACTION_STATE_FILENAME = "compaction.state"
+)
+
+// Compact merges every sealed segment into a single segment that only contains the
+// latest PUT record of each live key; overwritten values, deleted keys and expired
+// records are dropped.
+// The active segment is sealed first, so everything written before the call is compacted.
+//
+// The merged records are written to TEMP_FILENAME and, once durable, renamed to
+// "<id>.compacted", where id is the highest sealed segment ID. That rename is the commit
+// point: afterwards the sealed segments are deleted and the merged file takes over the
+// highest sealed ID. If the process dies in between, ConnectFileStore completes the
+// cleanup; if it dies before the commit point, the original segments are left untouched.
+//
+// Reads and writes continue while the records are copied, since sealed segments never
+// change. Only the final switch-over blocks them. Keys written or deleted during the copy
+// keep their newer record.
+//
+// Segments that an open Snapshot reads from are removed from the directory like the
+// others, but kept open until the last such snapshot is closed. The snapshot keeps reading
+// through the open file, and the disk space is only reclaimed once it is closed. This
+// relies on the POSIX semantics of removing an open file.
+func (f *FileStore) Compact() error {
+	f.compactMu.Lock()
+	defer f.compactMu.Unlock()
+
+	sealed, err := f.sealForCompaction()
+	if err != nil || len(sealed) == 0 {
+		return err
+	}
+	target := sealed[len(sealed)-1]
+
+	merged, err := target.NewSibblingFile()
+	if err != nil {
+		return err
+	}
+	moved, expired, err := f.copyLiveRecords(merged, sealed)
+	if err == nil {
+		err = merged.file.Sync()
+	}
+	if err != nil {
+		merged.Close()
+		os.Remove(merged.fullpath)
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		merged.Close()
+		os.Remove(merged.fullpath)
+		return ErrStoreClosed
+	}
+
+	committedPath := filepath.Join(f.dir, segmentFileName(target.id, COMPACTED_EXT))
+	if err := os.Rename(merged.fullpath, committedPath); err != nil {
+		merged.Close()
+		os.Remove(merged.fullpath)
+		return err
+	}
+
+	// Committed: switch the in-memory state over before touching the old files, so the
+	// store stays consistent even if the cleanup below fails.
+	for _, segment := range sealed {
+		delete(f.segments, segment.id)
+		f.retireSegment(segment)
+	}
+	merged.id = target.id
+	merged.fullpath = committedPath
+	f.segments[merged.id] = merged
+	f.compacted = merged.id
+	f.compactions++
+	hints := make([]hintEntry, 0, len(moved))
+	for _, m := range moved {
+		f.index.Relocate(m.from.Key, m.from.SegmentID, m.from.Offset, merged.id, m.to.offset)
+		hints = append(hints, m.to)
+	}
+	for _, ko := range expired {
+		f.index.DeleteIfAt(ko.Key, ko.SegmentID, ko.Offset)
+	}
+
+	if err := finishCompaction(f.dir, merged.id, f.compactions); err != nil {
+		return err
+	}
+	merged.fullpath = filepath.Join(f.dir, segmentFileName(merged.id, SEGMENT_EXT))
+	writeHintFile(f.dir, merged.id, merged.Size(), hints) // Best effort; the segment is replayed in full if it's missing
+	return nil
+}
+
+// movedRecord is a record copied by compaction: where it was, and where it is now.
+type movedRecord struct {
+	from keyOffset
+	to   hintEntry
+}
+
+// sealForCompaction seals the active segment if it has any records and returns every
+// sealed segment in increasing ID order.
+func (f *FileStore) sealForCompaction() ([]*DataFile, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, ErrStoreClosed
+	}
+
+	if f.active.Size() > 0 {
+		if err := f.rollover(); err != nil {
+			return nil, err
+		}
+	}
+	var sealed []*DataFile
+	for _, segment := range f.sortedSegments() {
+		if segment.id != f.active.id {
+			sealed = append(sealed, segment)
+		}
+	}
+	return sealed, nil
+}
+
+// copyLiveRecords appends the latest record of every key that lives in one of the sealed
+// segments to merged, and returns where each record came from and where it went. Records
+// that have expired are not copied; their locations are returned separately so the index
+// entries can be dropped along with them.
+func (f *FileStore) copyLiveRecords(merged *DataFile, sealed []*DataFile) ([]movedRecord, []keyOffset, error) {
+	sealedByID := make(map[int]*DataFile, len(sealed))
+	for _, segment := range sealed {
+		sealedByID[segment.id] = segment
+	}
+
+	// Collect the locations first so the index isn't locked while reading from disk
+	var live []keyOffset
+	f.index.ForEach(func(ko keyOffset) bool {
+		if _, ok := sealedByID[ko.SegmentID]; ok {
+			live = append(live, ko)
+		}
+		return true
+	})
+
+	writer, err := merged.Writer()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := timeNow().UnixNano()
+	moved := make([]movedRecord, 0, len(live))
+	var expired []keyOffset
+	for _, ko := range live {
+		rec, err := sealedByID[ko.SegmentID].ReadRecordAt(ko.Offset)
+		if err != nil {
+			return nil, nil, err
+		}
+		if rec.isExpired(now) {
+			expired = append(expired, ko)
+			continue
+		}
+		bytesWritten, err := writer.Append(*rec)
+		if err != nil {
+			return nil, nil, err
+		}
+		moved = append(moved, movedRecord{
+			from: ko,
+			to:   newHintEntry(*rec, merged.bytesWrittenSoFar, bytesWritten),
+		})
+		merged.bytesWrittenSoFar += bytesWritten
+	}
+	return moved, expired, writer.Flush()
+}
+
+// finishCompaction deletes every segment up to and including id, which the committed
+// "<id>.compacted" file supersedes, and then renames it to the segment file for id.
+// The compaction state, with compactions as the number of compactions including this one,
+// is recorded before anything is deleted, and hint files are deleted first so a stale hint
+// can never describe the merged segment.
+func finishCompaction(dir string, id, compactions int) error {
+	if err := writeFileAtomic(dir, COMPACTION_STATE_FILENAME, compactionState(id, compactions)); err != nil {
+		return err
+	}
+	for _, ext := range []string{HINT_EXT, SEGMENT_EXT} {
+		ids, err := listSegmentIDs(dir, ext)
+		if err != nil {
+			return err
+		}
+		for _, segmentID := range ids {
+			if segmentID > id {
+				break
+			}
+			if err := os.Remove(filepath.Join(dir, segmentFileName(segmentID, ext))); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(
+		filepath.Join(dir, segmentFileName(id, COMPACTED_EXT)),
+		filepath.Join(dir, segmentFileName(id, SEGMENT_EXT)),
+	)
+}
+
+// finishInterruptedCompaction completes any compaction that committed its output but
+// was interrupted before cleaning up the segments it replaces.
+func finishInterruptedCompaction(dir string) error {
+	ids, err := listSegmentIDs(dir, COMPACTED_EXT)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	_, compactions, err := readCompactionState(dir)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		// The state may or may not have been recorded before the interruption. Counting
+		// the compaction again is harmless: it only invalidates more log positions.
+		compactions++
+		if err := finishCompaction(dir, id, compactions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactionState returns the contents of COMPACTION_STATE_FILENAME.
+func compactionState(id, compactions int) []byte {
+	return []byte(fmt.Sprintf("%d %d\n", id, compactions))
+}
+
+// readCompactionState returns the ID of the newest segment written by Compact and the
+// number of compactions so far, or zeros if the store has never been compacted.
+func readCompactionState(dir string) (int, int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, COMPACTION_STATE_FILENAME))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var id, compactions int
+	if _, err := fmt.Sscanf(string(data), "%d %d\n", &id, &compactions); err != nil || id < 0 || compactions < 0 {
+		return 0, 0, fmt.Errorf("invalid %s: %q", COMPACTION_STATE_FILENAME, data)
+	}
+	return id, compactions, nil
+}
+
+// writeFileAtomic replaces the file name in dir with data. It is written and fsynced under
+// a temporary name first, so a crash leaves either the old or the new contents.
+func writeFileAtomic(dir, name string, data []byte) error {
+	tmpPath := filepath.Join(dir, name+".tmp")
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(dir, name))
+}
@@ -0,0 +1,75 @@
+package kvstorefromscratchpart2
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFileStore_CompactDropsStaleRecords(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	store, err := ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 100; i++ {
+			if err := store.Put(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d-%d", i, round)); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+		}
+	}
+	for i := 0; i < 50; i++ {
+		if err := store.Del(fmt.Sprintf("key-%d", i)); err != nil {
+			t.Fatalf("Del failed: %v", err)
+		}
+	}
+
+	sizeBefore := store.diskSize()
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if sizeAfter := store.diskSize(); sizeAfter*10 > sizeBefore {
+		t.Errorf("size after Compact is %d, want well below %d", sizeAfter, sizeBefore)
+	}
+
+	// Writes after compaction must land behind the compacted records
+	if err := store.Put("key-99", "latest"); err != nil {
+		t.Fatalf("Put after Compact failed: %v", err)
+	}
+
+	check := func(store *FileStore) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			got, err := store.Get(key)
+			switch {
+			case i < 50:
+				if err != ErrKeyDoesntExist {
+					t.Errorf("Get(%q) returned err %v, want ErrKeyDoesntExist", key, err)
+				}
+			case i == 99:
+				if err != nil || got != "latest" {
+					t.Errorf("Get(%q) returned (%q, %v), want latest", key, got, err)
+				}
+			default:
+				want := fmt.Sprintf("value-%d-9", i)
+				if err != nil || got != want {
+					t.Errorf("Get(%q) returned (%q, %v), want %q", key, got, err, want)
+				}
+			}
+		}
+	}
+	check(store)
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	store, err = ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer store.Close()
+	check(store)
+}
@@ -0,0 +1,66 @@
+package kvstorefromscratchpart2
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+// Compression selects how the values of PUT records are compressed on disk.
+type Compression int
+
+const (
+	// COMPRESSION_NONE stores values as they are.
+	COMPRESSION_NONE Compression = iota
+	// COMPRESSION_FLATE compresses values with DEFLATE (compress/flate) at its fastest
+	// level. Verbose text such as JSON typically shrinks to a fraction of its size.
+	COMPRESSION_FLATE
+)
+
+// compressionConfig is what a DataFile needs to know to compress the records written to it.
+type compressionConfig struct {
+	algorithm Compression
+	threshold int // Values shorter than this are stored as they are
+}
+
+// flateWriters recycles compressors, which are expensive to allocate.
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed) // Only fails for an invalid level
+		return w
+	},
+}
+
+// compressValue returns val compressed according to cfg, and whether it was compressed.
+// A value below the threshold, or one that doesn't get smaller, is returned unchanged.
+func compressValue(cfg compressionConfig, val string) ([]byte, bool) {
+	if cfg.algorithm != COMPRESSION_FLATE || len(val) < cfg.threshold || len(val) == 0 {
+		return nil, false
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(val) / 2)
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	io.WriteString(w, val) // Writing to a bytes.Buffer can't fail
+	w.Close()
+	if buf.Len() >= len(val) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// decompressValue reverses compressValue. It returns ErrCorruptRecord if data isn't valid
+// DEFLATE data or inflates to more than MAX_VALUE_SIZE bytes.
+func decompressValue(data []byte) (string, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	var buf bytes.Buffer
+	buf.Grow(2 * len(data))
+	n, err := buf.ReadFrom(io.LimitReader(r, MAX_VALUE_SIZE+1))
+	if err != nil || n > MAX_VALUE_SIZE {
+		return "", ErrCorruptRecord
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,146 @@
+package kvstorefromscratchpart2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+// verboseJSON returns a compressible value of roughly n bytes.
+func verboseJSON(n int) string {
+	var sb strings.Builder
+	sb.WriteString("[")
+	for i := 0; sb.Len() < n; i++ {
+		fmt.Fprintf(&sb, `{"id": %d, "status": "active", "description": "a fairly verbose field"},`, i)
+	}
+	sb.WriteString("{}]")
+	return sb.String()
+}
+
+func TestRecord_CompressedRoundTrip(t *testing.T) {
+	flate := compressionConfig{algorithm: COMPRESSION_FLATE, threshold: 64}
+	random := make([]byte, 1024)
+	for i := range random {
+		random[i] = byte(rand.IntN(256))
+	}
+
+	tests := []struct {
+		name       string
+		in         record
+		compressed bool
+	}{
+		{"large value", record{operation: OPERATION_PUT, data: KVPair{key: "k", val: verboseJSON(4096)}, expiresAt: 1700000000}, true},
+		{"below threshold", record{operation: OPERATION_PUT, data: KVPair{key: "k", val: strings.Repeat("a", 63)}}, false},
+		{"incompressible", record{operation: OPERATION_PUT, data: KVPair{key: "k", val: string(random)}}, false},
+		{"delete", record{operation: OPERATION_DEL, data: KVPair{key: strings.Repeat("k", 1024)}}, false},
+	}
+	for _, tt := range tests {
+		encoded, err := tt.in.marshal(flate)
+		if err != nil {
+			t.Fatalf("%s: marshal failed: %v", tt.name, err)
+		}
+		if compressed := encoded[6]&FLAG_COMPRESSED != 0; compressed != tt.compressed {
+			t.Errorf("%s: compressed is %v, want %v", tt.name, compressed, tt.compressed)
+		}
+		var out record
+		if err := out.UnmarshalBinary(encoded); err != nil {
+			t.Fatalf("%s: UnmarshalBinary failed: %v", tt.name, err)
+		}
+		if out != tt.in {
+			t.Errorf("%s: round trip returned a different record", tt.name)
+		}
+	}
+
+	// A valid checksum over data that doesn't inflate is still corrupt
+	in := record{operation: OPERATION_PUT, data: KVPair{key: "k", val: verboseJSON(1024)}}
+	encoded, err := in.marshal(flate)
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	for i := RECORD_HEADER_SIZE + 1; i < len(encoded); i++ {
+		encoded[i] = 0xFF
+	}
+	binary.BigEndian.PutUint32(encoded[0:4], crc32.ChecksumIEEE(encoded[4:]))
+	var out record
+	if err := out.UnmarshalBinary(encoded); err != ErrCorruptRecord {
+		t.Errorf("UnmarshalBinary of garbage compressed data returned %v, want ErrCorruptRecord", err)
+	}
+}
+
+func TestFileStore_Compression(t *testing.T) {
+	tmpDir := t.TempDir()
+	opts := DefaultOptions()
+	opts.Compression = COMPRESSION_FLATE
+	store, err := ConnectFileStoreWithOptions(tmpDir, opts)
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+
+	value := verboseJSON(64 * 1024)
+	for i := 0; i < 10; i++ {
+		if err := store.Put(fmt.Sprintf("doc-%d", i), value); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	store.Put("short", "tiny")
+	if size := store.diskSize(); size > int64(len(value)) {
+		t.Errorf("log is %d bytes for 10 copies of a %d byte value, want it compressed", size, len(value))
+	}
+	if got, err := store.Get("doc-3"); err != nil || got != value {
+		t.Errorf("Get(doc-3) returned a different value (err %v)", err)
+	}
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Compressed records are read back without compression enabled, both by Get and by
+	// iterating over the log
+	store, err = ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+	if got, err := store.Get("doc-9"); err != nil || got != value {
+		t.Errorf("Get(doc-9) after reopening returned a different value (err %v)", err)
+	}
+	var walked int
+	err = store.WalkLog(func(e LogEntry) error {
+		if strings.HasPrefix(e.Key, "doc-") {
+			walked++
+			if e.Value != value || e.Size >= int64(len(value)) {
+				t.Errorf("WalkLog returned %s with a %d byte value in a %d byte record", e.Key, len(e.Value), e.Size)
+			}
+		}
+		return nil
+	})
+	if err != nil || walked != 10 {
+		t.Errorf("WalkLog returned %v after %d documents, want 10", err, walked)
+	}
+	store.Close()
+	report, err := Verify(tmpDir)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if !report.OK() {
+		t.Errorf("Verify found problems in compressed segments: %+v", report.Segments)
+	}
+}
+
+func TestOptions_RejectsInvalidCompression(t *testing.T) {
+	for _, modify := range []func(*Options){
+		func(o *Options) { o.Compression = Compression(7) },
+		func(o *Options) { o.CompressionThreshold = -1 },
+	} {
+		opts := DefaultOptions()
+		modify(&opts)
+		if _, err := ConnectFileStoreWithOptions(t.TempDir(), opts); err != ErrInvalidOptions {
+			t.Errorf("ConnectFileStoreWithOptions returned %v, want ErrInvalidOptions", err)
+		}
+	}
+}
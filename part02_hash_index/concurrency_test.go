@@ -0,0 +1,121 @@
+package kvstorefromscratchpart2
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// These tests are meant to be run with the race detector: go test -race
+
+func TestFileStore_ConcurrentPutGetDel(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	store, err := ConnectFileStoreWithOptions(tmpDir, smallSegmentOptions())
+	if err != nil {
+		t.Fatalf("ConnectFileStoreWithOptions failed: %v", err)
+	}
+	defer store.Close()
+
+	const writers, readers, keysPerWriter = 4, 8, 200
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keysPerWriter; i++ {
+				key := fmt.Sprintf("w%d-key-%d", w, i)
+				if err := store.Put(key, fmt.Sprintf("value-%d", i)); err != nil {
+					t.Errorf("Put(%q) failed: %v", key, err)
+					return
+				}
+				if i%5 == 0 {
+					if err := store.Del(key); err != nil {
+						t.Errorf("Del(%q) failed: %v", key, err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 0; i < keysPerWriter*2; i++ {
+				key := fmt.Sprintf("w%d-key-%d", r%writers, i%keysPerWriter)
+				val, err := store.Get(key)
+				if err != nil && err != ErrKeyDoesntExist {
+					t.Errorf("Get(%q) failed: %v", key, err)
+					return
+				}
+				// A record read concurrently with writes must never be another key's value
+				if err == nil && val != fmt.Sprintf("value-%d", i%keysPerWriter) {
+					t.Errorf("Get(%q) returned %q", key, val)
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	for w := 0; w < writers; w++ {
+		for i := 0; i < keysPerWriter; i++ {
+			key := fmt.Sprintf("w%d-key-%d", w, i)
+			got, err := store.Get(key)
+			if i%5 == 0 {
+				if err != ErrKeyDoesntExist {
+					t.Errorf("Get(%q) returned err %v, want ErrKeyDoesntExist", key, err)
+				}
+			} else if want := fmt.Sprintf("value-%d", i); err != nil || got != want {
+				t.Errorf("Get(%q) returned (%q, %v), want %q", key, got, err, want)
+			}
+		}
+	}
+}
+
+func TestFileStore_CompactDuringWrites(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	store, err := ConnectFileStoreWithOptions(tmpDir, smallSegmentOptions())
+	if err != nil {
+		t.Fatalf("ConnectFileStoreWithOptions failed: %v", err)
+	}
+	defer store.Close()
+
+	const keys, rounds = 50, 20
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for round := 0; round < rounds; round++ {
+			for i := 0; i < keys; i++ {
+				if err := store.Put(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d-%d", i, round)); err != nil {
+					t.Errorf("Put failed: %v", err)
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			if err := store.Compact(); err != nil {
+				t.Errorf("Compact failed: %v", err)
+				return
+			}
+			if _, err := store.Get("key-0"); err != nil && err != ErrKeyDoesntExist {
+				t.Errorf("Get during compaction failed: %v", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	for i := 0; i < keys; i++ {
+		want := fmt.Sprintf("value-%d-%d", i, rounds-1)
+		if got, err := store.Get(fmt.Sprintf("key-%d", i)); err != nil || got != want {
+			t.Errorf("Get(key-%d) returned (%q, %v), want %q", i, got, err, want)
+		}
+	}
+}
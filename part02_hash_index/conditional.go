@@ -0,0 +1,119 @@
+package kvstorefromscratchpart2
+
+import "errors"
+
+var (
+	ErrKeyExists       = errors.New("key already exists")
+	ErrVersionMismatch = errors.New("key is not at the expected version")
+)
+
+// GetWithVersion returns the value for key K along with its version, which
+// CompareAndSwap and DeleteIfVersion take to check that the key hasn't been written
+// since. It returns ErrKeyDoesntExist if the key doesn't exist or has expired.
+func (f *FileStore) GetWithVersion(K string) (string, Version, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return "", Version{}, ErrStoreClosed
+	}
+
+	recordRead, version, err := f.lookup(K)
+	if err != nil {
+		return "", Version{}, err
+	}
+	if recordRead.isExpired(timeNow().UnixNano()) {
+		return "", Version{}, ErrKeyDoesntExist
+	}
+	return recordRead.GetValue(), version, nil
+}
+
+// PutIfAbsent stores the key-value pair only if key K doesn't exist or has expired, and
+// returns the version of the new value. Otherwise it writes nothing and returns
+// ErrKeyExists.
+//
+// Like the other conditional writes, the check and the write are made under the store's
+// write lock, so they are linearizable with respect to every other write: of several
+// concurrent PutIfAbsent calls for the same key, exactly one succeeds.
+func (f *FileStore) PutIfAbsent(K, V string) (Version, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return Version{}, ErrStoreClosed
+	}
+
+	if _, err := f.liveVersion(K); err != ErrKeyDoesntExist {
+		if err == nil {
+			err = ErrKeyExists
+		}
+		return Version{}, err
+	}
+	return f.appendRecord(record{
+		operation: OPERATION_PUT,
+		data:      KVPair{key: K, val: V},
+	})
+}
+
+// CompareAndSwap stores V as the value of key K only if the key is still at version
+// expected, as returned by GetWithVersion or by an earlier conditional write, and returns
+// the new version. If the key has been written or deleted since, or has expired, it writes
+// nothing and returns ErrVersionMismatch.
+//
+// Compact moves records and so changes their versions, see Version; after a compaction
+// the caller has to read the key again to get its current version.
+func (f *FileStore) CompareAndSwap(K string, expected Version, V string) (Version, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return Version{}, ErrStoreClosed
+	}
+
+	if err := f.checkVersion(K, expected); err != nil {
+		return Version{}, err
+	}
+	return f.appendRecord(record{
+		operation: OPERATION_PUT,
+		data:      KVPair{key: K, val: V},
+	})
+}
+
+// DeleteIfVersion deletes key K only if it is still at version expected, see
+// CompareAndSwap. Otherwise it writes nothing and returns ErrVersionMismatch.
+func (f *FileStore) DeleteIfVersion(K string, expected Version) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return ErrStoreClosed
+	}
+
+	if err := f.checkVersion(K, expected); err != nil {
+		return err
+	}
+	_, err := f.appendRecord(record{
+		operation: OPERATION_DEL,
+		data:      KVPair{key: K},
+	})
+	return err
+}
+
+// checkVersion returns ErrVersionMismatch unless key K exists, hasn't expired and is at
+// version expected. The caller must hold f.mu.
+func (f *FileStore) checkVersion(K string, expected Version) error {
+	version, err := f.liveVersion(K)
+	if err == ErrKeyDoesntExist || (err == nil && !f.isCurrent(expected, version.SegmentID, version.Offset)) {
+		return ErrVersionMismatch
+	}
+	return err
+}
+
+// liveVersion returns the version of key K, or ErrKeyDoesntExist if it doesn't exist or
+// has expired. The caller must hold f.mu.
+func (f *FileStore) liveVersion(K string) (Version, error) {
+	recordRead, version, err := f.lookup(K)
+	if err != nil {
+		return Version{}, err
+	}
+	if recordRead.isExpired(timeNow().UnixNano()) {
+		return Version{}, ErrKeyDoesntExist
+	}
+	return version, nil
+}
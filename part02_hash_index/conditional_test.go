@@ -0,0 +1,219 @@
+package kvstorefromscratchpart2
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFileStore_ConditionalWrites(t *testing.T) {
+	tmpDir := t.TempDir()
+	store, err := ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+
+	if _, _, err := store.GetWithVersion("leader"); err != ErrKeyDoesntExist {
+		t.Errorf("GetWithVersion of a missing key returned %v, want ErrKeyDoesntExist", err)
+	}
+	v1, err := store.PutIfAbsent("leader", "node-1")
+	if err != nil {
+		t.Fatalf("PutIfAbsent failed: %v", err)
+	}
+	if _, err := store.PutIfAbsent("leader", "node-2"); err != ErrKeyExists {
+		t.Errorf("second PutIfAbsent returned %v, want ErrKeyExists", err)
+	}
+	if val, version, err := store.GetWithVersion("leader"); err != nil || val != "node-1" || version != v1 {
+		t.Errorf("GetWithVersion returned (%q, %v, %v), want (node-1, %v)", val, version, err, v1)
+	}
+
+	v2, err := store.CompareAndSwap("leader", v1, "node-1 renewed")
+	if err != nil {
+		t.Fatalf("CompareAndSwap failed: %v", err)
+	}
+	if v2 == v1 {
+		t.Errorf("CompareAndSwap returned the old version %v", v1)
+	}
+	if _, err := store.CompareAndSwap("leader", v1, "node-2"); err != ErrVersionMismatch {
+		t.Errorf("CompareAndSwap with a stale version returned %v, want ErrVersionMismatch", err)
+	}
+	if err := store.DeleteIfVersion("leader", v1); err != ErrVersionMismatch {
+		t.Errorf("DeleteIfVersion with a stale version returned %v, want ErrVersionMismatch", err)
+	}
+	if got, _ := store.Get("leader"); got != "node-1 renewed" {
+		t.Errorf("Get returned %q after failed conditional writes, want node-1 renewed", got)
+	}
+
+	// Versions are log locations, so they are the same after a restart
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	store, err = ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer store.Close()
+	if _, version, err := store.GetWithVersion("leader"); err != nil || version != v2 {
+		t.Errorf("GetWithVersion after reopening returned (%v, %v), want %v", version, err, v2)
+	}
+
+	// An unconditional write changes the version as well
+	store.Put("leader", "node-3")
+	if _, err := store.CompareAndSwap("leader", v2, "node-1"); err != ErrVersionMismatch {
+		t.Errorf("CompareAndSwap after a Put returned %v, want ErrVersionMismatch", err)
+	}
+	_, v3, _ := store.GetWithVersion("leader")
+	if err := store.DeleteIfVersion("leader", v3); err != nil {
+		t.Fatalf("DeleteIfVersion failed: %v", err)
+	}
+	if _, err := store.CompareAndSwap("leader", v3, "node-3"); err != ErrVersionMismatch {
+		t.Errorf("CompareAndSwap of a deleted key returned %v, want ErrVersionMismatch", err)
+	}
+	if _, err := store.PutIfAbsent("leader", "node-2"); err != nil {
+		t.Errorf("PutIfAbsent of a deleted key failed: %v", err)
+	}
+}
+
+func TestFileStore_ConditionalWritesAndExpiry(t *testing.T) {
+	advance := fakeClock(t)
+	store, err := ConnectFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+
+	store.PutWithTTL("lease", "node-1", time.Second)
+	_, version, err := store.GetWithVersion("lease")
+	if err != nil {
+		t.Fatalf("GetWithVersion failed: %v", err)
+	}
+	advance(2 * time.Second)
+
+	// An expired key is absent: its version can't be swapped, but it can be claimed again
+	if _, err := store.CompareAndSwap("lease", version, "node-1"); err != ErrVersionMismatch {
+		t.Errorf("CompareAndSwap of an expired key returned %v, want ErrVersionMismatch", err)
+	}
+	if _, _, err := store.GetWithVersion("lease"); err != ErrKeyDoesntExist {
+		t.Errorf("GetWithVersion of an expired key returned %v, want ErrKeyDoesntExist", err)
+	}
+	if _, err := store.PutIfAbsent("lease", "node-2"); err != nil {
+		t.Errorf("PutIfAbsent of an expired key failed: %v", err)
+	}
+}
+
+func TestFileStore_CompactionChangesVersions(t *testing.T) {
+	store, err := ConnectFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+
+	version, err := store.PutIfAbsent("key", "value")
+	if err != nil {
+		t.Fatalf("PutIfAbsent failed: %v", err)
+	}
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if _, err := store.CompareAndSwap("key", version, "new"); err != ErrVersionMismatch {
+		t.Errorf("CompareAndSwap across a compaction returned %v, want ErrVersionMismatch", err)
+	}
+	_, version, _ = store.GetWithVersion("key")
+	if _, err := store.CompareAndSwap("key", version, "new"); err != nil {
+		t.Errorf("CompareAndSwap with the version read after compaction failed: %v", err)
+	}
+
+	// The merged segment takes over a segment ID, so the latest record of a key can land
+	// exactly where an older one used to be. The older version still doesn't match.
+	store.Del("key")
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	stale, err := store.PutIfAbsent("other", "first")
+	if err != nil {
+		t.Fatalf("PutIfAbsent failed: %v", err)
+	}
+	store.Put("other", "second")
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if _, current, _ := store.GetWithVersion("other"); current.SegmentID != stale.SegmentID || current.Offset != stale.Offset {
+		t.Fatalf("compaction moved other to %v, want it at the location of its first record %v", current, stale)
+	}
+	if _, err := store.CompareAndSwap("other", stale, "third"); err != ErrVersionMismatch {
+		t.Errorf("CompareAndSwap with a version from before the compaction returned %v, want ErrVersionMismatch", err)
+	}
+}
+
+func TestFileStore_ConcurrentConditionalWrites(t *testing.T) {
+	store, err := ConnectFileStoreWithOptions(t.TempDir(), smallSegmentOptions())
+	if err != nil {
+		t.Fatalf("ConnectFileStoreWithOptions failed: %v", err)
+	}
+	defer store.Close()
+
+	// Exactly one of the candidates wins the election
+	const candidates = 16
+	var winners atomic.Int32
+	var wg sync.WaitGroup
+	for c := 0; c < candidates; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			_, err := store.PutIfAbsent("leader", fmt.Sprintf("node-%d", c))
+			switch err {
+			case nil:
+				winners.Add(1)
+			case ErrKeyExists:
+			default:
+				t.Errorf("PutIfAbsent failed: %v", err)
+			}
+		}(c)
+	}
+	wg.Wait()
+	if winners.Load() != 1 {
+		t.Errorf("%d candidates won the election, want 1", winners.Load())
+	}
+
+	// CompareAndSwap increments aren't lost, while plain Puts to other keys roll the
+	// segments over underneath them
+	const workers, increments = 8, 50
+	store.Put("counter", "0")
+	for w := 0; w < workers; w++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				for {
+					val, version, err := store.GetWithVersion("counter")
+					if err != nil {
+						t.Errorf("GetWithVersion failed: %v", err)
+						return
+					}
+					n, _ := strconv.Atoi(val)
+					_, err = store.CompareAndSwap("counter", version, strconv.Itoa(n+1))
+					if err == nil {
+						break
+					}
+					if err != ErrVersionMismatch {
+						t.Errorf("CompareAndSwap failed: %v", err)
+						return
+					}
+				}
+			}
+		}()
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				store.Put(fmt.Sprintf("w%d-key-%d", w, i), "value")
+			}
+		}(w)
+	}
+	wg.Wait()
+	if got, _ := store.Get("counter"); got != strconv.Itoa(workers*increments) {
+		t.Errorf("counter is %s, want %d", got, workers*increments)
+	}
+}
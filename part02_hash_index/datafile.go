@@ -2,50 +2,81 @@ package kvstorefromscratchpart2
 
 import (
 	"bufio"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 )
 
 const (
-	PRIMARY_FILENAME = "my.db"
+	PRIMARY_FILENAME = "my.db" // Single-file layout used before segments; migrated to segment 1 on open
+	TEMP_FILENAME    = "tmp.db"
+	SEGMENT_EXT      = ".db"
+)
+
+var (
+	ErrNoRecordAtOffset = errors.New("no record found at the specified offset")
 )
 
 type DataFile struct {
+	id                int // Segment ID; segments are replayed in increasing ID order
 	dir               string
 	fullpath          string
 	file              *os.File
-	bytesWrittenSoFar int64 // Track the total bytes written so far
+	bytesWrittenSoFar int64             // Track the total bytes written so far
+	compression       compressionConfig // How records appended to this file are compressed
+	writeErr          error             // Set if a failed append couldn't be cut off again
 }
 
-// NewDataFile creates a new DataFile instance by opening or creating the primary data file
-// at the specified directory path. It returns a pointer to the DataFile and an error if
-// the file cannot be opened or created.
+// NewDataFile creates a new DataFile instance by opening or creating the segment file
+// with the given ID in the specified directory. It returns a pointer to the DataFile and
+// an error if the file cannot be opened or created.
 //
 // Parameters:
 //
 //	path - The directory path where the data file should be located.
+//	id   - The segment ID, which determines the file name (see segmentFileName).
 //
 // Returns:
 //
 //	*DataFile - Pointer to the created DataFile instance.
 //	error     - Error encountered during file opening or creation, or nil if successful.
-func NewDataFile(path string) (*DataFile, error) {
-	fullPath := filepath.Join(path, PRIMARY_FILENAME)
+func NewDataFile(path string, id int) (*DataFile, error) {
+	fullPath := filepath.Join(path, segmentFileName(id, SEGMENT_EXT))
 
 	f, err := os.OpenFile(fullPath, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
 	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 
 	return &DataFile{
-		dir:      path,
-		fullpath: fullPath,
-		file:     f,
+		id:                id,
+		dir:               path,
+		fullpath:          fullPath,
+		file:              f,
+		bytesWrittenSoFar: info.Size(), // Offsets of new records continue after the existing ones
 	}, nil
 }
 
+// segmentFileName returns the file name of the segment with the given ID, zero padded
+// so that a lexical directory listing is also in replay order.
+func segmentFileName(id int, ext string) string {
+	return fmt.Sprintf("%06d%s", id, ext)
+}
+
+// ID returns the segment ID of the data file.
+func (df *DataFile) ID() int {
+	return df.id
+}
+
 // GetIterator returns a new FileIterator starting at the specified offset within the DataFile.
 // It provides sequential access to the file's contents from the given position.
 // If the iterator cannot be created, an error is returned.
@@ -53,38 +84,124 @@ func (df *DataFile) GetIterator(offset int64) (*FileIterator, error) {
 	return newFileIterator(df.file, offset)
 }
 
+// NewSibblingFile creates a new sibling data file in the same directory as the current DataFile.
+// The new file is created (or truncated) with the temporary filename defined by TEMP_FILENAME.
+// It returns a pointer to the newly created DataFile and an error if the file creation fails.
+func (df *DataFile) NewSibblingFile() (*DataFile, error) {
+	fullPath := filepath.Join(df.dir, TEMP_FILENAME)
+	f, err := os.Create(fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DataFile{
+		dir:         df.dir,
+		fullpath:    fullPath,
+		file:        f,
+		compression: df.compression,
+	}, nil
+}
+
+// Size returns the number of bytes in the data file.
+func (df *DataFile) Size() int64 {
+	return df.bytesWrittenSoFar
+}
+
 // Append writes the record to the file, flushes, and returns the starting byte offset.
+// If the write fails, whatever part of the record reached the file is cut off again.
 func (df *DataFile) Append(data record) (int64, error) {
 	writer, err := df.Writer()
 	if err != nil {
 		return 0, err
 	}
 	bytesWritten, err := writer.Append(data)
-	if err != nil {
-		return 0, err
+	if err == nil {
+		err = writer.Flush()
 	}
-	err = writer.Flush()
 	if err != nil {
-		return 0, err
+		return 0, df.discardPartialWrite(err)
 	}
 	startingOffset := df.bytesWrittenSoFar
 	df.bytesWrittenSoFar += bytesWritten
 	return startingOffset, nil
 }
 
+// AppendBatch writes the records back to back with a single write, flushes, and returns
+// the starting byte offset of each record followed by the offset just past the last one.
+// Like Append, it cuts off a partially written batch.
+func (df *DataFile) AppendBatch(data []record) ([]int64, error) {
+	writer, err := df.Writer()
+	if err != nil {
+		return nil, err
+	}
+	sizes, err := writer.AppendBatch(data)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		return nil, df.discardPartialWrite(err)
+	}
+	offsets := make([]int64, len(sizes)+1)
+	offsets[0] = df.bytesWrittenSoFar
+	for i, size := range sizes {
+		offsets[i+1] = offsets[i] + size
+	}
+	df.bytesWrittenSoFar = offsets[len(sizes)]
+	return offsets, nil
+}
+
+// discardPartialWrite truncates the file back to bytesWrittenSoFar after a failed append,
+// since some of its bytes may have reached the file, and returns err. Without that, the
+// next record would be written after them while its offset is taken from
+// bytesWrittenSoFar. If the file can't be truncated, it is marked unusable and every later
+// append fails.
+func (df *DataFile) discardPartialWrite(err error) error {
+	if truncErr := df.file.Truncate(df.bytesWrittenSoFar); truncErr != nil {
+		df.writeErr = fmt.Errorf("segment %d is unusable after a failed write (%v): %w", df.id, err, truncErr)
+	}
+	return err
+}
+
 // Writer returns a new DatFileWriter instance associated with the DataFile.
 // The DatFileWriter uses a buffered writer for efficient writing to the underlying file.
-// It returns the DatFileWriter and any error encountered during creation.
+// It returns the DatFileWriter and any error encountered during creation, or the error
+// that made the file unusable.
 func (df *DataFile) Writer() (*DatFileWriter, error) {
+	if df.writeErr != nil {
+		return nil, df.writeErr
+	}
 	_, err := df.file.Seek(0, io.SeekEnd) // Ensure the file pointer is at the end of the file before writing new records
 	if err != nil {
 		return nil, err
 	}
 	return &DatFileWriter{
-		writer: bufio.NewWriter(df.file),
+		writer:      bufio.NewWriter(df.file),
+		compression: df.compression,
 	}, nil
 }
 
+// Remove closes the data file and deletes it from disk.
+func (df *DataFile) Remove() error {
+	if err := df.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(df.fullpath)
+}
+
+// Truncate cuts the data file down to size bytes and fsyncs it.
+func (df *DataFile) Truncate(size int64) error {
+	if err := df.file.Truncate(size); err != nil {
+		return err
+	}
+	df.bytesWrittenSoFar = size
+	return df.file.Sync()
+}
+
+// Sync commits the data file's contents to stable storage.
+func (df *DataFile) Sync() error {
+	return df.file.Sync()
+}
+
 // Close closes the underlying file associated with the DataFile, releasing any
 // resources held by it. It returns any error produced by the underlying file's
 // Close operation. The DataFile should not be used after Close has been called.
@@ -92,25 +209,43 @@ func (df *DataFile) Close() error {
 	return df.file.Close()
 }
 
-// ReadRecordAt reads a single record (one line) starting at the given byte offset,
-// parses it with record.FromString, and returns it. The file pointer is restored to
-// the start. Returns an error if seeking, scanning, parsing fails, or no record is found.
-func (df *DataFile) ReadRecordAt(offset int64) (*record, error) {
-	_, err := df.file.Seek(int64(offset), io.SeekStart)
-	if err != nil {
-		return nil, err
+// ReadExpiryAt returns the expiry of the record starting at the given byte offset, 0 if
+// it has none. Only the header is read, not the key or value, so unlike ReadRecordAt it
+// doesn't verify the record's checksum.
+func (df *DataFile) ReadExpiryAt(offset int64) (int64, error) {
+	var buf [RECORD_HEADER_SIZE + 8]byte
+	section := io.NewSectionReader(df.file, offset, math.MaxInt64-offset)
+	if _, err := io.ReadFull(section, buf[:RECORD_HEADER_SIZE]); err != nil {
+		if err == io.EOF {
+			return 0, ErrNoRecordAtOffset
+		}
+		return 0, err
+	}
+	header, err := decodeRecordHeader(buf[:RECORD_HEADER_SIZE])
+	if err != nil || header.flags&FLAG_HAS_EXPIRY == 0 {
+		return 0, err
+	}
+	if _, err := io.ReadFull(section, buf[RECORD_HEADER_SIZE:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
 	}
-	defer df.file.Seek(0, io.SeekStart) // Reset the file pointer to the start after reading
+	return int64(binary.BigEndian.Uint64(buf[RECORD_HEADER_SIZE:])), nil
+}
 
-	scanner := bufio.NewScanner(df.file)
-	if scanner.Scan() {
-		line := scanner.Text()
-		rec := new(record)
-		rec.FromString(line)
-		return rec, nil
+// ReadRecordAt decodes the single record starting at the given byte offset.
+// It uses positional reads, so the shared file pointer is left untouched.
+// Returns ErrNoRecordAtOffset if the offset is at the end of the file, and
+// io.ErrUnexpectedEOF or ErrCorruptRecord if the record is truncated or damaged.
+func (df *DataFile) ReadRecordAt(offset int64) (*record, error) {
+	section := io.NewSectionReader(df.file, offset, math.MaxInt64-offset)
+	rec, _, err := readRecord(section)
+	if err == io.EOF {
+		return nil, ErrNoRecordAtOffset
 	}
-	if scanner.Err() == nil { // If no error but no lines were read, return nil
-		return nil, errors.New("no record found at the specified offset")
+	if err != nil {
+		return nil, err
 	}
-	return nil, scanner.Err()
+	return &rec, nil
 }
@@ -0,0 +1,84 @@
+package kvstorefromscratchpart2
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestDataFile_FailedAppendLeavesNoBytesBehind(t *testing.T) {
+	df, err := NewDataFile(t.TempDir(), 1)
+	if err != nil {
+		t.Fatalf("NewDataFile failed: %v", err)
+	}
+	defer df.Close()
+	if _, err := df.Append(record{operation: OPERATION_PUT, data: KVPair{key: "a", val: "1"}}); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	size := df.Size()
+
+	// Part of a record reached the file before the write failed
+	other, err := os.OpenFile(df.fullpath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	other.Write([]byte("partial record"))
+	other.Close()
+	writeFailed := errors.New("disk full")
+	if err := df.discardPartialWrite(writeFailed); err != writeFailed {
+		t.Fatalf("discardPartialWrite returned %v, want the write error", err)
+	}
+
+	offset, err := df.Append(record{operation: OPERATION_PUT, data: KVPair{key: "b", val: "2"}})
+	if err != nil {
+		t.Fatalf("Append after a failed write failed: %v", err)
+	}
+	if offset != size {
+		t.Errorf("Append after a failed write returned offset %d, want %d", offset, size)
+	}
+	if rec, err := df.ReadRecordAt(offset); err != nil || rec.data.key != "b" {
+		t.Errorf("ReadRecordAt(%d) returned (%+v, %v), want the record of b", offset, rec, err)
+	}
+}
+
+func TestDataFile_UnusableAfterFailedTruncate(t *testing.T) {
+	tmpDir := t.TempDir()
+	store, err := ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	store.Put("a", "1")
+
+	// A read-only descriptor fails both the write and the truncate that follows it
+	readOnly, err := os.Open(store.active.fullpath)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	store.mu.Lock()
+	writable := store.active.file
+	store.active.file = readOnly
+	store.mu.Unlock()
+	if err := store.Put("b", "2"); err == nil {
+		t.Fatalf("Put to a read-only segment succeeded")
+	}
+	store.mu.Lock()
+	store.active.file = writable
+	store.mu.Unlock()
+	readOnly.Close()
+	if err := store.Put("c", "3"); err == nil || store.active.writeErr == nil {
+		t.Errorf("Put after the segment became unusable returned %v, want the write error", err)
+	}
+	store.Close()
+
+	store, err = ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer store.Close()
+	if got, err := store.Get("a"); err != nil || got != "1" {
+		t.Errorf("Get(a) returned (%q, %v), want 1", got, err)
+	}
+	if err := store.Put("d", "4"); err != nil {
+		t.Errorf("Put after reopening failed: %v", err)
+	}
+}
@@ -2,23 +2,48 @@ package kvstorefromscratchpart2
 
 import (
 	"bufio"
-	"fmt"
 )
 
 type DatFileWriter struct {
-	writer *bufio.Writer
+	writer      *bufio.Writer
+	compression compressionConfig
 }
 
+// Append encodes the record and writes it to the buffered writer. The value of a PUT is
+// compressed if the segment's compression settings call for it.
+// Returns the number of bytes written.
 func (dfw *DatFileWriter) Append(data record) (int64, error) {
-	record := data.String()
-	var bytes int
-	var err error
-	if bytes, err = fmt.Fprintln(dfw.writer, record); err != nil {
+	encoded, err := data.marshal(dfw.compression)
+	if err != nil {
+		return 0, err
+	}
+	bytes, err := dfw.writer.Write(encoded)
+	if err != nil {
 		return int64(bytes), err
 	}
 	return int64(bytes), nil
 }
 
+// AppendBatch encodes every record before writing any of them, so an invalid record fails
+// the whole batch without writing anything, and then writes them in a single call.
+// Returns the size of each encoded record.
+func (dfw *DatFileWriter) AppendBatch(data []record) ([]int64, error) {
+	sizes := make([]int64, len(data))
+	var encoded []byte
+	for i, rec := range data {
+		buf, err := rec.marshal(dfw.compression)
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = int64(len(buf))
+		encoded = append(encoded, buf...)
+	}
+	if _, err := dfw.writer.Write(encoded); err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
 func (dfw *DatFileWriter) Flush() error {
 	return dfw.writer.Flush()
 }
@@ -3,40 +3,62 @@ package kvstorefromscratchpart2
 import (
 	"bufio"
 	"io"
+	"math"
 	"os"
 )
 
 type FileIterator struct {
-	scanner    *bufio.Scanner
+	reader     *bufio.Reader
 	curOffset  int64
+	current    record
+	currentAt  int64
+	err        error
 	openedfile *os.File
 }
 
 func newFileIterator(openedfile *os.File, offset int64) (*FileIterator, error) {
-	_, err := openedfile.Seek(offset, io.SeekStart) // Reset file pointer to the given offset (relative to the start of the file)
-	if err != nil {
-		return nil, err
-	}
-	scanner := bufio.NewScanner(openedfile)
+	// Positional reads through a SectionReader leave the shared file pointer untouched.
+	section := io.NewSectionReader(openedfile, offset, math.MaxInt64-offset)
 	fileIterator := &FileIterator{
-		scanner:    scanner,
+		reader:     bufio.NewReader(section),
 		curOffset:  offset,
 		openedfile: openedfile,
 	}
 	return fileIterator, nil
 }
 
+// HasNext decodes the next record and reports whether one was available.
+// It returns false at the end of the file or on the first malformed record;
+// use Err to tell the two apart.
 func (fi *FileIterator) HasNext() bool {
-	return fi.scanner.Scan()
+	if fi.err != nil {
+		return false
+	}
+	rec, size, err := readRecord(fi.reader)
+	if err != nil {
+		if err != io.EOF {
+			fi.err = err
+		}
+		return false
+	}
+	fi.current = rec
+	fi.currentAt = fi.curOffset
+	fi.curOffset += size
+	return true
 }
 
 // Get returns the current record and its starting offset in the file.
 func (fi *FileIterator) Get() (record, int64) {
-	var data record
-	line := fi.scanner.Text()
-	data.FromString(line)
-	bytesRead := int64(len(line)) + 1          // +1 for the newline character
-	fi.curOffset += bytesRead                  // Update the current offset (including newline character)
-	startingOffset := fi.curOffset - bytesRead // Calculate the starting offset of the record
-	return data, startingOffset
+	return fi.current, fi.currentAt
+}
+
+// Err returns the error that stopped the iteration, or nil if the iterator
+// reached a clean end of file. A truncated record yields io.ErrUnexpectedEOF.
+func (fi *FileIterator) Err() error {
+	return fi.err
+}
+
+// Offset returns the offset just past the last successfully decoded record.
+func (fi *FileIterator) Offset() int64 {
+	return fi.curOffset
 }
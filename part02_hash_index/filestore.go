@@ -4,100 +4,240 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
 const (
-	OPERATION_PUT = "PUT"
-	OPERATION_DEL = "DEL"
+	OPERATION_PUT          = "PUT"
+	OPERATION_DEL          = "DEL"
+	OPERATION_BATCH_BEGIN  = "BATCH_BEGIN"  // Opens a WriteBatch frame; the value holds the record count
+	OPERATION_BATCH_COMMIT = "BATCH_COMMIT" // Closes a WriteBatch frame; the value holds the record count
 )
 
 var (
 	ErrKeyDoesntExist = errors.New("given key doesn't exist")
+	ErrStoreClosed    = errors.New("store is closed")
 )
 
+// FileStore is safe for concurrent use. Writes are serialized through mu, while Gets share
+// it and read records with positional reads, so any number of them run in parallel.
 type FileStore struct {
-	dbFile *DataFile
-	index  *hashIndex
+	mu        sync.RWMutex // Guards the fields below; held exclusively by writers
+	compactMu sync.Mutex   // Serializes Compact calls
+
+	dir      string
+	opts     Options
+	segments map[int]*DataFile // All segments by ID, including the active one
+	active   *DataFile         // The segment new records are appended to
+	index    keyIndex
+	closed   bool
+	dirty    bool            // The active segment has writes that haven't been fsynced
+	recovery *RecoveryReport // What was cut off the active segment on open, if anything
+
+	stopSync chan struct{} // Closed to stop the SYNC_INTERVAL goroutine
+	syncDone chan struct{} // Closed once the SYNC_INTERVAL goroutine has exited
+
+	activeHints []hintEntry // Hint entries for the active segment, written out when it is sealed
+
+	snapshots   map[*Snapshot]struct{}  // Open snapshots
+	tailers     map[*logTailer]struct{} // Open log tailers
+	retired     []*DataFile             // Segments replaced by Compact but still read by a snapshot or tailer
+	compacted   int                     // ID of the newest segment written by Compact, 0 if none
+	compactions int                     // Number of compactions so far
+	appended    chan struct{}           // Closed on the next append, if a tailer waits for one
 }
 
-// ConnectFileStore initializes and returns a new FileStore instance at the specified file path.
-// It ensures that the directory for the file exists, creating it if necessary.
-// If the directory cannot be created or the data file cannot be opened, an error is returned.
-// On success, it returns a Store backed by the file at the given path.
-func ConnectFileStore(path string) (Store, error) {
+// ConnectFileStore opens the store in the directory at path using DefaultOptions.
+// See ConnectFileStoreWithOptions.
+func ConnectFileStore(path string) (*FileStore, error) {
+	return ConnectFileStoreWithOptions(path, DefaultOptions())
+}
 
-	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+// ConnectFileStoreWithOptions initializes and returns a new FileStore instance in the specified directory.
+// It ensures that the directory exists, creating it if necessary, opens every segment file
+// in it and rebuilds the index by replaying them in order. The segment with the highest ID
+// becomes the active segment that new records are appended to. Sealed segments are loaded
+// from their hint files when a valid one exists. A record left half-written at the end of the
+// active segment by a crash is truncated away; see Recovery for what was discarded.
+// Temporary files left behind by an interrupted Compact or hint write are discarded, and a Compact that
+// was interrupted after its output was committed is completed.
+// If the options are invalid, the directory cannot be created or a segment cannot be opened
+// or replayed, an error is returned. In SYNC_INTERVAL mode a background goroutine fsyncs the
+// active segment until Close is called.
+func ConnectFileStoreWithOptions(path string, opts Options) (*FileStore, error) {
+	if err := opts.validate(); err != nil {
 		return nil, err
 	}
 
-	file, err := NewDataFile(path)
-	if err != nil {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	for _, tmpFile := range []string{TEMP_FILENAME, HINT_TEMP_FILENAME} {
+		if err := os.Remove(filepath.Join(path, tmpFile)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if err := finishInterruptedCompaction(path); err != nil {
 		return nil, err
 	}
 
-	hashIndex := NewHashIndex(1000000)
-	err = hashIndex.LoadFromFile(file)
+	compacted, compactions, err := readCompactionState(path)
+	if err != nil {
+		return nil, err
+	}
+	segments, err := openSegments(path)
 	if err != nil {
 		return nil, err
 	}
 
-	return &FileStore{
-		dbFile: file,
-		index:  hashIndex,
-	}, nil
+	store := &FileStore{
+		dir:      path,
+		opts:     opts,
+		segments: make(map[int]*DataFile, len(segments)),
+		active:   segments[len(segments)-1],
+		index:    newKeyIndex(opts.IndexType),
+
+		snapshots:   make(map[*Snapshot]struct{}),
+		tailers:     make(map[*logTailer]struct{}),
+		compacted:   compacted,
+		compactions: compactions,
+	}
+	for _, segment := range segments {
+		segment.compression = opts.compression()
+		store.segments[segment.id] = segment
+	}
+	if err := store.loadIndex(segments); err != nil {
+		closeSegments(segments)
+		return nil, err
+	}
+	store.startSyncLoop()
+	return store, nil
 }
 
 // Put stores the given key-value pair in the file store.
-// It appends a new record with the specified key and value to the underlying database file.
-// Returns an error if writing or flushing the record fails.
+// It appends a new record with the specified key and value to the active segment,
+// rolling over to a new segment first if the active one is full.
+// Returns an error if writing or flushing the record fails, or in SYNC_ALWAYS mode if
+// it can't be fsynced.
 func (f *FileStore) Put(K, V string) error {
 
 	dataToAppend := record{
 		operation: OPERATION_PUT,
 		data:      KVPair{key: K, val: V},
 	}
+	return f.put(dataToAppend)
+}
+
+// put appends a PUT record to the active segment and points the index at it.
+func (f *FileStore) put(dataToAppend record) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return ErrStoreClosed
+	}
+
+	_, err := f.appendRecord(dataToAppend)
+	return err
+}
 
-	startingOffset, err := f.dbFile.Append(dataToAppend)
+// appendRecord appends a PUT or DEL record to the active segment, rolling over first if
+// it is full, and applies it to the index. It returns the version of the record, which is
+// valid even if the error is only about syncing it. The caller must hold f.mu for writing.
+func (f *FileStore) appendRecord(dataToAppend record) (Version, error) {
+	if err := f.maybeRollover(); err != nil {
+		return Version{}, err
+	}
+	startingOffset, err := f.active.Append(dataToAppend)
 	if err != nil {
-		return err
+		return Version{}, err
+	}
+	f.addActiveHint(dataToAppend, startingOffset)
+	if dataToAppend.operation == OPERATION_DEL {
+		f.index.Delete(dataToAppend.data.key) // If the key doesn't exist, it's a no-op
+	} else {
+		f.index.Insert(dataToAppend.data.key, f.active.id, startingOffset)
 	}
-	f.index.Insert(K, startingOffset)
-	return nil
+	return f.versionAt(f.active.id, startingOffset), f.afterAppend()
 }
 
 // Get returns the value for key K or an error if not found.
 func (f *FileStore) Get(K string) (string, error) {
-	offset, err := f.index.GetOffset(K)
-	if err != nil {
-		return "", err
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return "", ErrStoreClosed
 	}
-	recordRead, err := f.dbFile.ReadRecordAt(offset)
+
+	recordRead, _, err := f.lookup(K)
 	if err != nil {
 		return "", err
 	}
+	if recordRead.isExpired(timeNow().UnixNano()) {
+		return "", ErrKeyDoesntExist
+	}
 	return recordRead.GetValue(), nil
 }
 
+// lookup returns the latest record of key K and its version, even if the record has
+// expired. It returns ErrKeyDoesntExist if the index has no record of K. The caller must
+// hold f.mu.
+func (f *FileStore) lookup(K string) (*record, Version, error) {
+	segmentID, offset, err := f.index.GetOffset(K)
+	if err != nil {
+		return nil, Version{}, err
+	}
+	recordRead, err := f.segments[segmentID].ReadRecordAt(offset)
+	if err != nil {
+		return nil, Version{}, err
+	}
+	return recordRead, f.versionAt(segmentID, offset), nil
+}
+
 // Del deletes the key-value pair associated with the given key K from the file store.
-// It appends a delete operation record to the underlying database file and flushes the changes.
-// Returns an error if writing or flushing the record fails.
+// It appends a delete operation record to the active segment and flushes the changes.
+// Returns an error if writing or flushing the record fails, or in SYNC_ALWAYS mode if
+// it can't be fsynced.
 func (f *FileStore) Del(K string) error {
 	dataToAppend := record{
 		operation: OPERATION_DEL,
 		data:      KVPair{key: K},
 	}
-	_, err := f.dbFile.Append(dataToAppend)
-	if err != nil {
-		return err
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return ErrStoreClosed
 	}
-	//delete from index as-well
-	f.index.Delete(K) // If the key doesn't exist, it's a no-op
 
-	return nil
+	_, err := f.appendRecord(dataToAppend)
+	return err
 }
 
-// Close closes the underlying database file associated with the FileStore.
-// It returns an error if the file cannot be closed.
+// Close fsyncs the active segment unless the sync mode is SYNC_NEVER, then closes every
+// segment file associated with the FileStore. It returns the first error encountered.
+// Any later call on the store returns ErrStoreClosed.
 func (f *FileStore) Close() error {
-	return f.dbFile.Close()
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return ErrStoreClosed
+	}
+	f.closed = true
+	f.wakeTailers()
+	f.mu.Unlock()
+	f.stopSyncLoop()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var firstErr error
+	if f.opts.SyncMode != SYNC_NEVER {
+		firstErr = f.syncActive()
+	}
+	for _, segment := range f.segments {
+		if err := segment.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	closeSegments(f.retired)
+	f.retired = nil
+	return firstErr
 }
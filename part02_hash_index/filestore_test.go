@@ -2,6 +2,7 @@ package kvstorefromscratchpart2
 
 import (
 	"testing"
+	"time"
 )
 
 func TestFileStore_PutGetDel(t *testing.T) {
@@ -84,3 +85,107 @@ func TestFileStore_PutOverwrite(t *testing.T) {
 		t.Errorf("Get after overwrite returned %q, want %q", got, val2)
 	}
 }
+
+func TestFileStore_ArbitraryBytesSurviveReopen(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	store, err := ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+
+	pairs := map[string]string{
+		"plain":      "value",
+		"with|pipes": "a|b|c",
+		"newline":    "line one\nline two\n",
+	}
+	for k, v := range pairs {
+		if err := store.Put(k, v); err != nil {
+			t.Fatalf("Put(%q) failed: %v", k, err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	store, err = ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer store.Close()
+
+	// Writes after reopening must land at the right offsets too
+	if err := store.Put("after-reopen", "ok"); err != nil {
+		t.Fatalf("Put after reopen failed: %v", err)
+	}
+	pairs["after-reopen"] = "ok"
+
+	for k, want := range pairs {
+		got, err := store.Get(k)
+		if err != nil {
+			t.Fatalf("Get(%q) failed: %v", k, err)
+		}
+		if got != want {
+			t.Errorf("Get(%q) returned %q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestFileStore_SyncModes(t *testing.T) {
+	modes := []struct {
+		name string
+		mode SyncMode
+	}{
+		{name: "always", mode: SYNC_ALWAYS},
+		{name: "interval", mode: SYNC_INTERVAL},
+		{name: "never", mode: SYNC_NEVER},
+	}
+	for _, m := range modes {
+		t.Run(m.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			opts := DefaultOptions()
+			opts.SyncMode = m.mode
+			opts.SyncInterval = time.Millisecond
+
+			store, err := ConnectFileStoreWithOptions(tmpDir, opts)
+			if err != nil {
+				t.Fatalf("ConnectFileStoreWithOptions failed: %v", err)
+			}
+			if err := store.Put("foo", "bar"); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			if m.mode == SYNC_ALWAYS && store.dirty {
+				t.Errorf("active segment is dirty after Put in SYNC_ALWAYS mode")
+			}
+			if err := store.Sync(); err != nil {
+				t.Fatalf("Sync failed: %v", err)
+			}
+			if store.dirty {
+				t.Errorf("active segment is dirty after Sync")
+			}
+			if err := store.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			if err := store.Sync(); err != ErrStoreClosed {
+				t.Errorf("Sync after Close returned %v, want ErrStoreClosed", err)
+			}
+
+			store, err = ConnectFileStoreWithOptions(tmpDir, opts)
+			if err != nil {
+				t.Fatalf("reopen failed: %v", err)
+			}
+			defer store.Close()
+			if got, err := store.Get("foo"); err != nil || got != "bar" {
+				t.Errorf("Get after reopen returned (%q, %v), want bar", got, err)
+			}
+		})
+	}
+}
+
+func TestConnectFileStore_RejectsInvalidOptions(t *testing.T) {
+	opts := DefaultOptions()
+	opts.SyncInterval = 0
+	if _, err := ConnectFileStoreWithOptions(t.TempDir(), opts); err != ErrInvalidOptions {
+		t.Errorf("ConnectFileStoreWithOptions returned %v, want ErrInvalidOptions", err)
+	}
+}
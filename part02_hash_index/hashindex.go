@@ -1,48 +1,128 @@
 package kvstorefromscratchpart2
 
-type hashIndex struct {
-	index   [][]keyOffset
-	maxHash int
-}
+import (
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
 
-type keyOffset struct {
-	Key    string
-	Offset int64
+const (
+	INITIAL_INDEX_BUCKETS = 1024
+	MAX_INDEX_LOAD_FACTOR = 0.75 // Keys per bucket above which the index doubles its buckets
+)
+
+// hashIndex maps keys to the location of their latest record. It is safe for
+// concurrent use: lookups share a read lock and updates take the write lock.
+//
+// Keys are spread over the buckets with 64-bit FNV-1a. The number of buckets is always a
+// power of two and doubles whenever the load factor exceeds MAX_INDEX_LOAD_FACTOR, so the
+// expected bucket length, and with it the lookup cost, stays constant as the index grows.
+//
+// Snapshots share the buckets with the index. Each bucket remembers the epoch in which it
+// was last copied; taking a snapshot starts a new epoch, so the next update of a bucket
+// copies it first instead of changing the one the snapshot sees.
+type hashIndex struct {
+	mu           sync.RWMutex
+	index        [][]keyOffset
+	maxHash      int      // Number of buckets, a power of two
+	count        int      // Number of keys
+	epoch        uint64   // Incremented by every snapshot
+	bucketEpochs []uint64 // Epoch in which each bucket was last copied; shared if < epoch
 }
 
-// NewHashIndex creates a hashIndex with the given number of buckets (maxHash).
+// NewHashIndex creates a hashIndex with at least the given number of buckets (maxHash),
+// rounded up to a power of two. The index grows on its own, so maxHash only needs to be
+// large enough to avoid the first few resizes; INITIAL_INDEX_BUCKETS is a good default.
 func NewHashIndex(maxHash int) *hashIndex {
-
+	buckets := 1
+	for buckets < maxHash {
+		buckets <<= 1
+	}
 	return &hashIndex{
-		index:   make([][]keyOffset, maxHash),
-		maxHash: maxHash,
+		index:        make([][]keyOffset, buckets),
+		maxHash:      buckets,
+		bucketEpochs: make([]uint64, buckets),
 	}
 }
 
-// Insert adds a key and its corresponding offset to the hash index.
-// If the key already exists, its offset is updated.
+// Insert adds a key and the location of its latest record (segment ID and offset within
+// that segment) to the hash index. If the key already exists, its location is updated.
 // The key is hashed to determine its position in the index.
 // Collisions are handled by storing multiple key-offset pairs in a slice at each position.
-func (hi *hashIndex) Insert(key string, offset int64) {
-	hashOfKey := hash(key)
-	pos := hashOfKey % int64(hi.maxHash)
-	if hi.index[pos] == nil {
-		hi.index[pos] = []keyOffset{}
-	}
+func (hi *hashIndex) Insert(key string, segmentID int, offset int64) {
+	hi.mu.Lock()
+	defer hi.mu.Unlock()
+
+	pos := hi.writableBucket(key)
 	// Check if the key already exists and update the offset if needed
 	for i, ko := range hi.index[pos] {
 		if ko.Key == key {
+			hi.index[pos][i].SegmentID = segmentID
 			hi.index[pos][i].Offset = offset
 			return
 		}
 	}
-	hi.index[pos] = append(hi.index[pos], keyOffset{Key: key, Offset: offset})
+	hi.index[pos] = append(hi.index[pos], keyOffset{Key: key, SegmentID: segmentID, Offset: offset})
+	hi.count++
+	if float64(hi.count) > float64(hi.maxHash)*MAX_INDEX_LOAD_FACTOR {
+		hi.grow()
+	}
+}
+
+// grow doubles the number of buckets and rehashes every key into them.
+// Callers hold the write lock.
+func (hi *hashIndex) grow() {
+	newIndex := make([][]keyOffset, hi.maxHash*2)
+	mask := uint64(len(newIndex) - 1)
+	for _, bucket := range hi.index {
+		for _, ko := range bucket {
+			pos := hash(ko.Key) & mask
+			newIndex[pos] = append(newIndex[pos], ko)
+		}
+	}
+	hi.index = newIndex
+	hi.maxHash = len(newIndex)
+	hi.bucketEpochs = make([]uint64, len(newIndex))
+	for i := range hi.bucketEpochs {
+		hi.bucketEpochs[i] = hi.epoch // Freshly built, nothing shares them
+	}
+}
+
+// writableBucket returns the position of the bucket that holds key, after copying the
+// bucket if a snapshot shares it. Callers hold the write lock.
+func (hi *hashIndex) writableBucket(key string) uint64 {
+	pos := hi.bucketFor(key)
+	if hi.bucketEpochs[pos] != hi.epoch {
+		hi.index[pos] = slices.Clone(hi.index[pos])
+		hi.bucketEpochs[pos] = hi.epoch
+	}
+	return pos
 }
 
-// GetOffset retrieves the offset associated with the given key from the hash index.
+// snapshot returns a read-only hashIndex that shares the current buckets. Only the list
+// of buckets is copied; the buckets themselves are copied lazily by later updates.
+func (hi *hashIndex) snapshot() indexView {
+	hi.mu.Lock()
+	defer hi.mu.Unlock()
+
+	hi.epoch++
+	return &hashIndex{
+		index:   slices.Clone(hi.index),
+		maxHash: hi.maxHash,
+		count:   hi.count,
+	}
+}
+
+// bucketFor returns the position of the bucket that holds key.
+func (hi *hashIndex) bucketFor(key string) uint64 {
+	return hash(key) & uint64(hi.maxHash-1)
+}
+
+// GetOffset retrieves the location associated with the given key from the hash index.
 // It computes the hash of the key, determines its position in the index, and searches
-// for the key in the corresponding bucket. If the key is found, its offset is returned.
-// If the key is not found, it returns -1 and an ErrorKeyNotFound error.
+// for the key in the corresponding bucket. If the key is found, its segment ID and offset
+// are returned. If the key is not found, it returns -1, -1 and ErrKeyDoesntExist.
 //
 // Parameters:
 //
@@ -50,67 +130,151 @@ func (hi *hashIndex) Insert(key string, offset int64) {
 //
 // Returns:
 //
-//	int64 - the offset associated with the key, or -1 if not found.
+//	int   - the ID of the segment holding the key's latest record, or -1 if not found.
+//	int64 - the offset of that record within the segment, or -1 if not found.
 //	error - an error if the key is not found.
-func (hi *hashIndex) GetOffset(key string) (int64, error) {
-	hashOfKey := hash(key)
-	pos := hashOfKey % int64(hi.maxHash)
-	if hi.index[pos] == nil {
-		return -1, ErrKeyDoesntExist
-	}
+func (hi *hashIndex) GetOffset(key string) (int, int64, error) {
+	hi.mu.RLock()
+	defer hi.mu.RUnlock()
+
+	pos := hi.bucketFor(key)
 	for _, ko := range hi.index[pos] {
 		if ko.Key == key {
-			return ko.Offset, nil
+			return ko.SegmentID, ko.Offset, nil
+		}
+	}
+	return -1, -1, ErrKeyDoesntExist
+}
+
+// Relocate moves key to a new location, but only if its latest record is still the one at
+// (fromSegmentID, fromOffset). It reports whether the key was moved. This lets compaction
+// copy records without blocking writers and then skip keys that were overwritten or
+// deleted in the meantime.
+func (hi *hashIndex) Relocate(key string, fromSegmentID int, fromOffset int64, toSegmentID int, toOffset int64) bool {
+	hi.mu.Lock()
+	defer hi.mu.Unlock()
+
+	pos := hi.bucketFor(key)
+	for i, ko := range hi.index[pos] {
+		if ko.Key == key {
+			if ko.SegmentID != fromSegmentID || ko.Offset != fromOffset {
+				return false
+			}
+			pos = hi.writableBucket(key)
+			hi.index[pos][i].SegmentID = toSegmentID
+			hi.index[pos][i].Offset = toOffset
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteIfAt removes key, but only if its latest record is still the one at
+// (segmentID, offset). It reports whether the key was removed.
+func (hi *hashIndex) DeleteIfAt(key string, segmentID int, offset int64) bool {
+	hi.mu.Lock()
+	defer hi.mu.Unlock()
+
+	pos := hi.bucketFor(key)
+	bucket := hi.index[pos]
+	for i, ko := range bucket {
+		if ko.Key == key {
+			if ko.SegmentID != segmentID || ko.Offset != offset {
+				return false
+			}
+			pos = hi.writableBucket(key)
+			bucket = hi.index[pos]
+			bucket[i] = bucket[len(bucket)-1]
+			hi.index[pos] = bucket[:len(bucket)-1]
+			hi.count--
+			return true
 		}
 	}
-	return -1, ErrKeyDoesntExist
+	return false
 }
 
 // Delete removes the entry associated with the given key from the hash index.
 // If the key does not exist in the index, then its a no-op.
 // This operation is safe to call even if the key is not present.
 func (hi *hashIndex) Delete(key string) {
-	hashOfKey := hash(key)
-	pos := hashOfKey % int64(hi.maxHash)
+	hi.mu.Lock()
+	defer hi.mu.Unlock()
+
+	pos := hi.bucketFor(key)
 	bucket := hi.index[pos]
-	if bucket == nil {
-		return
-	}
 	for i, ko := range bucket {
 		if ko.Key == key {
+			pos = hi.writableBucket(key)
+			bucket = hi.index[pos]
 			bucket[i] = bucket[len(bucket)-1]
 			hi.index[pos] = bucket[:len(bucket)-1]
+			hi.count--
 			return
 		}
 	}
 }
 
-// LoadFromFile rebuilds the index by replaying records from file (from offset 0).
-// PUT -> Insert(key, offset); DEL -> Delete(key). Returns any iterator error.
-func (hi *hashIndex) LoadFromFile(file *DataFile) error {
-	iterator, err := file.GetIterator(0)
-	if err != nil {
-		return err
-	}
-
-	for iterator.HasNext() {
-		record, startingOffset := iterator.Get()
-		switch record.operation {
-		case OPERATION_PUT:
-			hi.Insert(record.data.key, startingOffset)
-		case OPERATION_DEL:
-			hi.Delete(record.data.key)
+// Len returns the number of keys in the index.
+func (hi *hashIndex) Len() int {
+	hi.mu.RLock()
+	defer hi.mu.RUnlock()
+
+	return hi.count
+}
+
+// Ascend calls fn for every key in [start, end) in increasing key order; an empty end means
+// no upper bound. A hash index keeps no order, so the matching keys are collected and sorted
+// first, which costs O(n log n) per call. Use the ordered index for scan-heavy workloads.
+// fn is called without holding the lock, so it may use the index.
+func (hi *hashIndex) Ascend(start, end string, fn func(ko keyOffset) bool) {
+	hi.mu.RLock()
+	var matches []keyOffset
+	for _, bucket := range hi.index {
+		for _, ko := range bucket {
+			if ko.Key >= start && (end == "" || ko.Key < end) {
+				matches = append(matches, ko)
+			}
+		}
+	}
+	hi.mu.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool { return strings.Compare(matches[i].Key, matches[j].Key) < 0 })
+	for _, ko := range matches {
+		if !fn(ko) {
+			return
 		}
 	}
-	return nil
 }
 
-// hash computes a simple hash value for the given string key by summing the ASCII values
-// of each character in the key. It returns the resulting sum as an int64.
-func hash(key string) int64 {
-	var hash int64 = 0
+// ForEach calls fn for every key in the index, in no particular order.
+// Iteration stops early if fn returns false. The index is read locked for the
+// whole iteration, so fn must be quick and must not modify the index.
+func (hi *hashIndex) ForEach(fn func(ko keyOffset) bool) {
+	hi.mu.RLock()
+	defer hi.mu.RUnlock()
+
+	for _, bucket := range hi.index {
+		for _, ko := range bucket {
+			if !fn(ko) {
+				return
+			}
+		}
+	}
+}
+
+const (
+	fnvOffsetBasis64 = 14695981039346656037
+	fnvPrime64       = 1099511628211
+)
+
+// hash computes the 64-bit FNV-1a hash of the key. Unlike a plain byte sum, it depends on
+// the order of the bytes, so keys like "key-12" and "key-21" land in different buckets.
+// It is computed inline to avoid the allocation of hash/fnv's []byte interface.
+func hash(key string) uint64 {
+	var hash uint64 = fnvOffsetBasis64
 	for i := 0; i < len(key); i++ {
-		hash += int64(key[i])
+		hash ^= uint64(key[i])
+		hash *= fnvPrime64
 	}
 	return hash
 }
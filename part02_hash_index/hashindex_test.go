@@ -0,0 +1,94 @@
+package kvstorefromscratchpart2
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashIndex_GrowsAndKeepsEveryKey(t *testing.T) {
+	index := NewHashIndex(4)
+	const keys = 10000
+	for i := 0; i < keys; i++ {
+		index.Insert(fmt.Sprintf("key-%d", i), 1, int64(i))
+	}
+	if index.Len() != keys {
+		t.Errorf("Len returned %d, want %d", index.Len(), keys)
+	}
+	if float64(index.Len()) > float64(index.maxHash)*MAX_INDEX_LOAD_FACTOR {
+		t.Errorf("index has %d buckets for %d keys, want load factor <= %v", index.maxHash, keys, MAX_INDEX_LOAD_FACTOR)
+	}
+
+	for i := 0; i < keys; i += 2 {
+		index.Delete(fmt.Sprintf("key-%d", i))
+	}
+	for i := 0; i < keys; i++ {
+		_, offset, err := index.GetOffset(fmt.Sprintf("key-%d", i))
+		if i%2 == 0 {
+			if err != ErrKeyDoesntExist {
+				t.Fatalf("GetOffset(key-%d) returned %v after Delete, want ErrKeyDoesntExist", i, err)
+			}
+		} else if err != nil || offset != int64(i) {
+			t.Fatalf("GetOffset(key-%d) returned (%d, %v), want %d", i, offset, err, i)
+		}
+	}
+	if index.Len() != keys/2 {
+		t.Errorf("Len after deletes returned %d, want %d", index.Len(), keys/2)
+	}
+}
+
+func TestHashIndex_SpreadsSimilarKeys(t *testing.T) {
+	if hash("key-12") == hash("key-21") {
+		t.Errorf("key-12 and key-21 hash to the same value")
+	}
+
+	index := NewHashIndex(1 << 16)
+	const keys = 1 << 15
+	for i := 0; i < keys; i++ {
+		index.Insert(fmt.Sprintf("key-%d", i), 1, int64(i))
+	}
+	longest := 0
+	for _, bucket := range index.index {
+		longest = max(longest, len(bucket))
+	}
+	// With a uniform hash, the longest chain at load factor 0.5 stays in single digits
+	if longest > 10 {
+		t.Errorf("longest bucket has %d keys, want a uniform spread", longest)
+	}
+}
+
+func TestHashIndex_SnapshotIsCopyOnWrite(t *testing.T) {
+	hi := NewHashIndex(4)
+	hi.Insert("a", 1, 0)
+	hi.Insert("b", 1, 10)
+	view := hi.snapshot()
+
+	hi.Insert("a", 2, 0)
+	hi.Delete("b")
+	hi.Relocate("a", 2, 0, 3, 0)
+	for i := 0; i < 100; i++ { // Forces the index to grow
+		hi.Insert(fmt.Sprintf("key-%d", i), 1, int64(i))
+	}
+
+	if segmentID, offset, err := view.GetOffset("a"); err != nil || segmentID != 1 || offset != 0 {
+		t.Errorf("snapshot GetOffset(a) returned (%d, %d, %v), want (1, 0)", segmentID, offset, err)
+	}
+	if _, _, err := view.GetOffset("b"); err != nil {
+		t.Errorf("snapshot lost deleted key b: %v", err)
+	}
+	if view.Len() != 2 {
+		t.Errorf("snapshot has %d keys, want 2", view.Len())
+	}
+	if segmentID, _, _ := hi.GetOffset("a"); segmentID != 3 {
+		t.Errorf("index has a in segment %d, want 3", segmentID)
+	}
+
+	// A second snapshot shares buckets that were already copied for the first one
+	second := hi.snapshot()
+	hi.Insert("a", 4, 0)
+	if segmentID, _, _ := second.GetOffset("a"); segmentID != 3 {
+		t.Errorf("second snapshot has a in segment %d, want 3", segmentID)
+	}
+	if segmentID, _, _ := view.GetOffset("a"); segmentID != 1 {
+		t.Errorf("first snapshot has a in segment %d, want 1", segmentID)
+	}
+}
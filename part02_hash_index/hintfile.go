@@ -0,0 +1,151 @@
+package kvstorefromscratchpart2
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+// A hint file sits next to a sealed segment ("000001.hint" for "000001.db") and lists
+// the key, offset and size of every record in it, without the values. Loading a segment
+// from its hint is much cheaper than decoding every record.
+//
+// Layout (all integers are big-endian):
+//
+//	header:  | magic 4B |
+//	entries: | op 1B | keyLen 4B | offset 8B | size 4B | expiresAt 8B | key |  (repeated)
+//	footer:  | segmentSize 8B | crc32 4B |
+//
+// The checksum covers every byte before it. The recorded segment size guards against a
+// hint that describes a different version of the segment. A hint with a different magic,
+// e.g. one written in an older layout, is treated as corrupt and rewritten.
+const (
+	HINT_EXT               = ".hint"
+	HINT_TEMP_FILENAME     = "tmp.hint"
+	HINT_MAGIC             = "KVH\x01"
+	HINT_ENTRY_HEADER_SIZE = 25
+	HINT_FOOTER_SIZE       = 12
+)
+
+var (
+	ErrCorruptHintFile = errors.New("hint file is corrupt")
+	ErrStaleHintFile   = errors.New("hint file does not match its segment")
+)
+
+// hintEntry describes one record of a segment.
+type hintEntry struct {
+	operation string
+	key       string
+	offset    int64
+	size      int64
+	expiresAt int64
+}
+
+// newHintEntry returns the hint entry for rec, stored at offset and occupying size bytes.
+func newHintEntry(rec record, offset, size int64) hintEntry {
+	return hintEntry{
+		operation: rec.operation,
+		key:       rec.data.key,
+		offset:    offset,
+		size:      size,
+		expiresAt: rec.expiresAt,
+	}
+}
+
+// writeHintFile atomically writes the hint file for the segment with the given ID and size.
+func writeHintFile(dir string, segmentID int, segmentSize int64, entries []hintEntry) error {
+	tmpPath := filepath.Join(dir, HINT_TEMP_FILENAME)
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath) // No-op once renamed
+
+	crc := crc32.NewIEEE()
+	writer := bufio.NewWriter(f)
+	writer.WriteString(HINT_MAGIC)
+	crc.Write([]byte(HINT_MAGIC))
+	var header [HINT_ENTRY_HEADER_SIZE]byte
+	for _, entry := range entries {
+		opCode, err := opCodeFor(entry.operation)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		header[0] = opCode
+		binary.BigEndian.PutUint32(header[1:5], uint32(len(entry.key)))
+		binary.BigEndian.PutUint64(header[5:13], uint64(entry.offset))
+		binary.BigEndian.PutUint32(header[13:17], uint32(entry.size))
+		binary.BigEndian.PutUint64(header[17:25], uint64(entry.expiresAt))
+		writer.Write(header[:])
+		writer.WriteString(entry.key)
+		crc.Write(header[:])
+		crc.Write([]byte(entry.key))
+	}
+	var footer [HINT_FOOTER_SIZE]byte
+	binary.BigEndian.PutUint64(footer[0:8], uint64(segmentSize))
+	crc.Write(footer[0:8])
+	binary.BigEndian.PutUint32(footer[8:12], crc.Sum32())
+	writer.Write(footer[:])
+
+	if err := writer.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(dir, segmentFileName(segmentID, HINT_EXT)))
+}
+
+// readHintFile reads the hint file for the segment with the given ID. It returns
+// ErrCorruptHintFile if the checksum doesn't match, ErrStaleHintFile if the hint was
+// written for a segment of a different size, and an os.ErrNotExist error if there is none.
+func readHintFile(dir string, segmentID int, segmentSize int64) ([]hintEntry, error) {
+	data, err := os.ReadFile(filepath.Join(dir, segmentFileName(segmentID, HINT_EXT)))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(HINT_MAGIC)+HINT_FOOTER_SIZE || string(data[:len(HINT_MAGIC)]) != HINT_MAGIC {
+		return nil, ErrCorruptHintFile
+	}
+	body, footer := data[:len(data)-4], data[len(data)-HINT_FOOTER_SIZE:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(footer[8:12]) {
+		return nil, ErrCorruptHintFile
+	}
+	if int64(binary.BigEndian.Uint64(footer[0:8])) != segmentSize {
+		return nil, ErrStaleHintFile
+	}
+
+	entriesBuf := data[len(HINT_MAGIC) : len(data)-HINT_FOOTER_SIZE]
+	var entries []hintEntry
+	for len(entriesBuf) > 0 {
+		if len(entriesBuf) < HINT_ENTRY_HEADER_SIZE {
+			return nil, ErrCorruptHintFile
+		}
+		operation, err := operationFor(entriesBuf[0])
+		if err != nil {
+			return nil, ErrCorruptHintFile
+		}
+		keyLen := int(binary.BigEndian.Uint32(entriesBuf[1:5]))
+		if len(entriesBuf) < HINT_ENTRY_HEADER_SIZE+keyLen {
+			return nil, ErrCorruptHintFile
+		}
+		entries = append(entries, hintEntry{
+			operation: operation,
+			key:       string(entriesBuf[HINT_ENTRY_HEADER_SIZE : HINT_ENTRY_HEADER_SIZE+keyLen]),
+			offset:    int64(binary.BigEndian.Uint64(entriesBuf[5:13])),
+			size:      int64(binary.BigEndian.Uint32(entriesBuf[13:17])),
+			expiresAt: int64(binary.BigEndian.Uint64(entriesBuf[17:25])),
+		})
+		entriesBuf = entriesBuf[HINT_ENTRY_HEADER_SIZE+keyLen:]
+	}
+	return entries, nil
+}
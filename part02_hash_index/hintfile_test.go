@@ -0,0 +1,106 @@
+package kvstorefromscratchpart2
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHintFile_RoundTrip(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	entries := []hintEntry{
+		{operation: OPERATION_PUT, key: "foo", offset: 0, size: 21},
+		{operation: OPERATION_DEL, key: "bar", offset: 21, size: 18},
+		{operation: OPERATION_PUT, key: "multi\nline", offset: 39, size: 38, expiresAt: 1700000000000000000},
+	}
+	if err := writeHintFile(tmpDir, 7, 69, entries); err != nil {
+		t.Fatalf("writeHintFile failed: %v", err)
+	}
+
+	got, err := readHintFile(tmpDir, 7, 69)
+	if err != nil {
+		t.Fatalf("readHintFile failed: %v", err)
+	}
+	if len(got) != len(entries) {
+		t.Fatalf("readHintFile returned %d entries, want %d", len(got), len(entries))
+	}
+	for i := range entries {
+		if got[i] != entries[i] {
+			t.Errorf("entry %d is %+v, want %+v", i, got[i], entries[i])
+		}
+	}
+
+	if _, err := readHintFile(tmpDir, 7, 70); !errors.Is(err, ErrStaleHintFile) {
+		t.Errorf("readHintFile with wrong segment size returned %v, want ErrStaleHintFile", err)
+	}
+
+	path := filepath.Join(tmpDir, segmentFileName(7, HINT_EXT))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[3] ^= 0xFF
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readHintFile(tmpDir, 7, 69); !errors.Is(err, ErrCorruptHintFile) {
+		t.Errorf("readHintFile of corrupted file returned %v, want ErrCorruptHintFile", err)
+	}
+}
+
+func TestFileStore_LoadsSealedSegmentsFromHints(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	store, err := ConnectFileStoreWithOptions(tmpDir, smallSegmentOptions())
+	if err != nil {
+		t.Fatalf("ConnectFileStoreWithOptions failed: %v", err)
+	}
+	if err := addNItemsToKVStore(store, 200); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Del("key-10"); err != nil {
+		t.Fatalf("Del failed: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	sealedIDs, err := listSegmentIDs(tmpDir, HINT_EXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sealedIDs) == 0 {
+		t.Fatal("no hint files were written for sealed segments")
+	}
+
+	// Corrupt one hint so that segment falls back to a full replay
+	corruptPath := filepath.Join(tmpDir, segmentFileName(sealedIDs[0], HINT_EXT))
+	if err := os.WriteFile(corruptPath, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = ConnectFileStoreWithOptions(tmpDir, smallSegmentOptions())
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer store.Close()
+
+	if _, err := store.Get("key-10"); err != ErrKeyDoesntExist {
+		t.Errorf("Get of deleted key returned %v, want ErrKeyDoesntExist", err)
+	}
+	for i := 0; i < 200; i++ {
+		if i == 10 {
+			continue
+		}
+		if _, err := getNthItemFromKVStore(store, i); err != nil {
+			t.Errorf("Get failed after reopen: %v", err)
+		}
+	}
+
+	// The fallback replay rewrites the corrupted hint
+	if _, err := readHintFile(tmpDir, sealedIDs[0], store.segments[sealedIDs[0]].Size()); err != nil {
+		t.Errorf("hint for segment %d was not rewritten: %v", sealedIDs[0], err)
+	}
+}
@@ -0,0 +1,235 @@
+// Package httpapi exposes a Store over HTTP with JSON bodies:
+//
+//	GET    /kv/{key}        -> 200 {"key": "...", "value": "..."}, or 404
+//	PUT    /kv/{key}        <- {"value": "..."}, -> 204
+//	DELETE /kv/{key}        -> 204
+//	GET    /kv?prefix=p     -> 200 {"items": [{"key": ..., "value": ...}], "truncated": false}
+//
+// Errors are returned as {"error": "..."} with a matching status code. A read-only handler
+// answers PUT and DELETE with 403 Forbidden. Keys may contain
+// '/', but since JSON strings are UTF-8, keys and values should be too.
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	kvs "kvstorefromscratchpart2"
+)
+
+const (
+	DEFAULT_MAX_BODY_SIZE  = 1024 * 1024 // 1 MiB
+	DEFAULT_MAX_LIST_ITEMS = 1000
+)
+
+// Options limits the size of requests and responses.
+type Options struct {
+	// MaxBodySize is the largest request body accepted, in bytes. Larger bodies are
+	// rejected with 413 Request Entity Too Large.
+	MaxBodySize int64
+
+	// MaxListItems caps how many pairs a prefix listing returns; a client may ask for
+	// fewer with ?limit=n.
+	MaxListItems int
+
+	// ReadOnly makes PUT and DELETE fail with 403 Forbidden, e.g. on a replication
+	// follower, whose store must only be written by the leader's log.
+	ReadOnly bool
+}
+
+func DefaultOptions() Options {
+	return Options{
+		MaxBodySize:  DEFAULT_MAX_BODY_SIZE,
+		MaxListItems: DEFAULT_MAX_LIST_ITEMS,
+	}
+}
+
+// Handler serves the HTTP API for a Store.
+type Handler struct {
+	store kvs.Store
+	opts  Options
+	mux   *http.ServeMux
+}
+
+// NewHandler is equivalent to NewHandlerWithOptions(store, DefaultOptions()).
+func NewHandler(store kvs.Store) *Handler {
+	return NewHandlerWithOptions(store, DefaultOptions())
+}
+
+// NewHandlerWithOptions returns a handler serving store. Zero or negative limits in opts
+// are replaced by their defaults.
+func NewHandlerWithOptions(store kvs.Store, opts Options) *Handler {
+	if opts.MaxBodySize <= 0 {
+		opts.MaxBodySize = DEFAULT_MAX_BODY_SIZE
+	}
+	if opts.MaxListItems <= 0 {
+		opts.MaxListItems = DEFAULT_MAX_LIST_ITEMS
+	}
+
+	h := &Handler{store: store, opts: opts, mux: http.NewServeMux()}
+	h.mux.HandleFunc("GET /kv/{key...}", h.get)
+	if opts.ReadOnly {
+		h.mux.HandleFunc("PUT /kv/{key...}", rejectWrite)
+		h.mux.HandleFunc("DELETE /kv/{key...}", rejectWrite)
+	} else {
+		h.mux.HandleFunc("PUT /kv/{key...}", h.put)
+		h.mux.HandleFunc("DELETE /kv/{key...}", h.del)
+	}
+	h.mux.HandleFunc("GET /kv", h.list)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+type pair struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type putRequest struct {
+	Value *string `json:"value"`
+}
+
+type listResponse struct {
+	Items     []pair `json:"items"`
+	Truncated bool   `json:"truncated"` // More keys match the prefix than were returned
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request) {
+	key, ok := pathKey(w, r)
+	if !ok {
+		return
+	}
+	val, err := h.store.Get(key)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, pair{Key: key, Value: val})
+}
+
+func (h *Handler) put(w http.ResponseWriter, r *http.Request) {
+	key, ok := pathKey(w, r)
+	if !ok {
+		return
+	}
+
+	var req putRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, h.opts.MaxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if req.Value == nil {
+		writeError(w, http.StatusBadRequest, `body must be {"value": "..."}`)
+		return
+	}
+
+	if err := h.store.Put(key, *req.Value); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// del removes the key. Deleting a key that doesn't exist also succeeds, so retries are safe.
+func (h *Handler) del(w http.ResponseWriter, r *http.Request) {
+	key, ok := pathKey(w, r)
+	if !ok {
+		return
+	}
+	if err := h.store.Del(key); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rejectWrite answers a PUT or DELETE on a read-only handler.
+func rejectWrite(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusForbidden, "store is read-only")
+}
+
+// list returns the pairs whose key starts with the prefix query parameter, in key order.
+// Without a prefix every key matches.
+func (h *Handler) list(w http.ResponseWriter, r *http.Request) {
+	limit := h.opts.MaxListItems
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(n, limit)
+	}
+
+	it, err := h.store.ScanPrefix(r.URL.Query().Get("prefix"))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	defer it.Close()
+
+	resp := listResponse{Items: []pair{}}
+	for it.HasNext() {
+		if len(resp.Items) == limit {
+			resp.Truncated = true
+			break
+		}
+		key, val := it.Get()
+		resp.Items = append(resp.Items, pair{Key: key, Value: val})
+	}
+	if err := it.Err(); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// pathKey returns the key from the URL, writing a 400 if it is empty.
+func pathKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := r.PathValue("key")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, "key must not be empty")
+		return "", false
+	}
+	return key, true
+}
+
+// writeStoreError maps an error returned by the store to a status code.
+func writeStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, kvs.ErrKeyDoesntExist):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, kvs.ErrKeyTooLarge), errors.Is(err, kvs.ErrValueTooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+	case errors.Is(err, kvs.ErrStoreClosed):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{Error: msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,168 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	kvs "kvstorefromscratchpart2"
+)
+
+func newTestServer(t *testing.T, opts Options) *httptest.Server {
+	t.Helper()
+	store, err := kvs.ConnectFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	server := httptest.NewServer(NewHandlerWithOptions(store, opts))
+	t.Cleanup(func() {
+		server.Close()
+		store.Close()
+	})
+	return server
+}
+
+// do sends a request and decodes the JSON response body into out, if out is not nil.
+func do(t *testing.T, method, url, body string, out any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest failed: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("decoding %s %s response failed: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestHandler_PutGetDelete(t *testing.T) {
+	server := newTestServer(t, DefaultOptions())
+	url := server.URL + "/kv/users/42"
+
+	var errResp errorResponse
+	if status := do(t, "GET", url, "", &errResp); status != http.StatusNotFound {
+		t.Errorf("GET of missing key returned %d, want 404", status)
+	}
+	if errResp.Error != kvs.ErrKeyDoesntExist.Error() {
+		t.Errorf("GET of missing key returned error %q", errResp.Error)
+	}
+
+	if status := do(t, "PUT", url, `{"value": "line one\nline two"}`, nil); status != http.StatusNoContent {
+		t.Fatalf("PUT returned %d, want 204", status)
+	}
+	var got pair
+	if status := do(t, "GET", url, "", &got); status != http.StatusOK {
+		t.Fatalf("GET returned %d, want 200", status)
+	}
+	if want := (pair{Key: "users/42", Value: "line one\nline two"}); got != want {
+		t.Errorf("GET returned %+v, want %+v", got, want)
+	}
+
+	if status := do(t, "DELETE", url, "", nil); status != http.StatusNoContent {
+		t.Fatalf("DELETE returned %d, want 204", status)
+	}
+	if status := do(t, "GET", url, "", nil); status != http.StatusNotFound {
+		t.Errorf("GET after DELETE returned %d, want 404", status)
+	}
+	if status := do(t, "DELETE", url, "", nil); status != http.StatusNoContent {
+		t.Errorf("second DELETE returned %d, want 204", status)
+	}
+}
+
+func TestHandler_List(t *testing.T) {
+	server := newTestServer(t, DefaultOptions())
+	for _, key := range []string{"user:1", "user:2", "user:3", "order:1"} {
+		if status := do(t, "PUT", server.URL+"/kv/"+key, `{"value": "v-`+key+`"}`, nil); status != http.StatusNoContent {
+			t.Fatalf("PUT %s returned %d", key, status)
+		}
+	}
+
+	var got listResponse
+	if status := do(t, "GET", server.URL+"/kv?prefix=user:", "", &got); status != http.StatusOK {
+		t.Fatalf("GET /kv?prefix=user: returned %d", status)
+	}
+	want := listResponse{Items: []pair{
+		{Key: "user:1", Value: "v-user:1"},
+		{Key: "user:2", Value: "v-user:2"},
+		{Key: "user:3", Value: "v-user:3"},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listing returned %+v, want %+v", got, want)
+	}
+
+	got = listResponse{}
+	do(t, "GET", server.URL+"/kv?prefix=user:&limit=2", "", &got)
+	if len(got.Items) != 2 || !got.Truncated {
+		t.Errorf("listing with limit=2 returned %+v, want 2 items and truncated", got)
+	}
+
+	got = listResponse{}
+	do(t, "GET", server.URL+"/kv?prefix=none:", "", &got)
+	if got.Items == nil || len(got.Items) != 0 || got.Truncated {
+		t.Errorf("empty listing returned %+v, want an empty item list", got)
+	}
+
+	if status := do(t, "GET", server.URL+"/kv?limit=zero", "", nil); status != http.StatusBadRequest {
+		t.Errorf("listing with invalid limit returned %d, want 400", status)
+	}
+}
+
+func TestHandler_RejectsBadRequests(t *testing.T) {
+	server := newTestServer(t, Options{MaxBodySize: 64})
+
+	tests := []struct {
+		name, method, path, body string
+		want                     int
+	}{
+		{"body over the limit", "PUT", "/kv/big", `{"value": "` + strings.Repeat("x", 100) + `"}`, http.StatusRequestEntityTooLarge},
+		{"key over MAX_KEY_SIZE", "PUT", "/kv/" + strings.Repeat("k", kvs.MAX_KEY_SIZE+1), `{"value": "v"}`, http.StatusRequestEntityTooLarge},
+		{"invalid JSON", "PUT", "/kv/key", `value`, http.StatusBadRequest},
+		{"missing value", "PUT", "/kv/key", `{}`, http.StatusBadRequest},
+		{"unknown field", "PUT", "/kv/key", `{"value": "v", "ttl": 5}`, http.StatusBadRequest},
+		{"empty key", "GET", "/kv/", "", http.StatusBadRequest},
+		{"unsupported method", "POST", "/kv/key", `{"value": "v"}`, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		if status := do(t, tt.method, server.URL+tt.path, tt.body, nil); status != tt.want {
+			t.Errorf("%s: %s returned %d, want %d", tt.name, tt.method, status, tt.want)
+		}
+	}
+}
+
+func TestHandler_ReadOnly(t *testing.T) {
+	store, err := kvs.ConnectFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+	store.Put("k", "v")
+	opts := DefaultOptions()
+	opts.ReadOnly = true
+	server := httptest.NewServer(NewHandlerWithOptions(store, opts))
+	defer server.Close()
+
+	var errResp errorResponse
+	if status := do(t, "PUT", server.URL+"/kv/k", `{"value": "new"}`, &errResp); status != http.StatusForbidden {
+		t.Errorf("PUT on a read-only handler returned %d, want 403", status)
+	}
+	if errResp.Error == "" {
+		t.Errorf("PUT on a read-only handler returned no error message")
+	}
+	if status := do(t, "DELETE", server.URL+"/kv/k", "", nil); status != http.StatusForbidden {
+		t.Errorf("DELETE on a read-only handler returned %d, want 403", status)
+	}
+	var got pair
+	if status := do(t, "GET", server.URL+"/kv/k", "", &got); status != http.StatusOK || got.Value != "v" {
+		t.Errorf("GET on a read-only handler returned (%d, %+v), want 200 and the unchanged value", status, got)
+	}
+}
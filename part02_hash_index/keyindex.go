@@ -0,0 +1,149 @@
+package kvstorefromscratchpart2
+
+import "fmt"
+
+// keyIndex maps every live key to the location of its latest record. FileStore can use
+// either the hashIndex, for the fastest point lookups, or the skipListIndex, which keeps
+// keys sorted so range scans don't have to sort. Implementations are safe for concurrent use.
+type keyIndex interface {
+	indexView
+	// Insert sets the location of the latest record of key.
+	Insert(key string, segmentID int, offset int64)
+	// Relocate moves key to a new location if it is still at the old one, see hashIndex.Relocate.
+	Relocate(key string, fromSegmentID int, fromOffset int64, toSegmentID int, toOffset int64) bool
+	// Delete removes key; it is a no-op if key is not present.
+	Delete(key string)
+	// DeleteIfAt removes key if its latest record is still at the given location, and
+	// reports whether it did.
+	DeleteIfAt(key string, segmentID int, offset int64) bool
+	// snapshot returns a read-only view of the index as it is now. Later updates of the
+	// index don't show up in the view.
+	snapshot() indexView
+}
+
+// indexView is the read-only part of keyIndex, all that a Snapshot needs.
+type indexView interface {
+	// GetOffset returns the location of the latest record of key, or ErrKeyDoesntExist.
+	GetOffset(key string) (int, int64, error)
+	// Len returns the number of keys.
+	Len() int
+	// ForEach calls fn for every key in no particular order until fn returns false.
+	ForEach(fn func(ko keyOffset) bool)
+	// Ascend calls fn for every key in [start, end) in increasing order until fn returns
+	// false. An empty end means no upper bound.
+	Ascend(start, end string, fn func(ko keyOffset) bool)
+}
+
+type keyOffset struct {
+	Key       string
+	SegmentID int
+	Offset    int64
+}
+
+// newKeyIndex creates an empty index of the given type.
+func newKeyIndex(indexType IndexType) keyIndex {
+	if indexType == INDEX_ORDERED {
+		return NewSkipListIndex()
+	}
+	return NewHashIndex(INITIAL_INDEX_BUCKETS)
+}
+
+// replayError reports the record at which the replay of a segment stopped.
+type replayError struct {
+	offset int64 // Offset of the record that couldn't be replayed
+	err    error
+}
+
+func (e *replayError) Error() string {
+	return fmt.Sprintf("record at offset %d: %v", e.offset, e.err)
+}
+
+func (e *replayError) Unwrap() error {
+	return e.err
+}
+
+// loadFromFile replays the records of a single segment (from offset 0) into the index.
+// PUT -> Insert(key, segment, offset); DEL -> Delete(key); expired PUTs are skipped and
+// hide any older value of their key. The records of a WriteBatch are
+// buffered until its commit marker and then applied together; a batch without one is
+// never applied.
+//
+// It returns a hint entry for every applied record, which the caller can persist as the
+// segment's hint file, and goodSize, the offset just past the last applied record or
+// committed batch. If the replay stops early, the error is a *replayError.
+func loadFromFile(index keyIndex, file *DataFile) ([]hintEntry, int64, error) {
+	iterator, err := file.GetIterator(0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var entries []hintEntry
+	var goodSize int64
+	var batch []hintEntry // Records of the open batch, nil outside of a batch
+	var batchCount uint32
+	inBatch := false
+	for iterator.HasNext() {
+		record, startingOffset := iterator.Get()
+		entry := newHintEntry(record, startingOffset, iterator.Offset()-startingOffset)
+
+		switch {
+		case record.operation == OPERATION_BATCH_BEGIN && !inBatch:
+			inBatch, batch = true, nil
+			batchCount, err = decodeBatchCount(record)
+		case record.operation == OPERATION_BATCH_COMMIT && inBatch:
+			var count uint32
+			count, err = decodeBatchCount(record)
+			if err == nil && (count != batchCount || int(count) != len(batch)) {
+				err = ErrCorruptBatch
+			}
+			if err == nil {
+				for _, member := range batch {
+					applyHint(index, file.id, member)
+				}
+				entries = append(entries, batch...)
+				inBatch, batch = false, nil
+				goodSize = iterator.Offset()
+			}
+		case record.operation == OPERATION_BATCH_BEGIN || record.operation == OPERATION_BATCH_COMMIT:
+			err = ErrCorruptBatch // Nested BEGIN, or COMMIT without BEGIN
+		case inBatch:
+			batch = append(batch, entry)
+		default:
+			applyHint(index, file.id, entry)
+			entries = append(entries, entry)
+			goodSize = iterator.Offset()
+		}
+		if err != nil {
+			return entries, goodSize, &replayError{offset: startingOffset, err: err}
+		}
+	}
+	if err := iterator.Err(); err != nil {
+		return entries, goodSize, &replayError{offset: iterator.Offset(), err: err}
+	}
+	if inBatch {
+		return entries, goodSize, &replayError{offset: iterator.Offset(), err: ErrUncommittedBatch}
+	}
+	return entries, goodSize, nil
+}
+
+// loadFromHints applies the hint entries of a segment to the index, in order.
+func loadFromHints(index keyIndex, segmentID int, entries []hintEntry) {
+	for _, entry := range entries {
+		applyHint(index, segmentID, entry)
+	}
+}
+
+// applyHint applies a single record to the index. A PUT that has already expired acts
+// like a DEL: the key must not fall back to an older value.
+func applyHint(index keyIndex, segmentID int, entry hintEntry) {
+	switch entry.operation {
+	case OPERATION_PUT:
+		if entry.expiresAt != 0 && entry.expiresAt <= timeNow().UnixNano() {
+			index.Delete(entry.key)
+			return
+		}
+		index.Insert(entry.key, segmentID, entry.offset)
+	case OPERATION_DEL:
+		index.Delete(entry.key)
+	}
+}
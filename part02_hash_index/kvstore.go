@@ -17,6 +17,55 @@ type Store interface {
 	// Returns error if operation fails.
 	Del(K string) error
 
+	// GetWithVersion is Get that also returns the version of the value, for the
+	// conditional writes below.
+	GetWithVersion(K string) (string, Version, error)
+
+	// PutIfAbsent inserts the key only if it doesn't exist, and returns ErrKeyExists
+	// otherwise. On success it returns the version of the new value.
+	PutIfAbsent(K, V string) (Version, error)
+
+	// CompareAndSwap updates the key only if it is still at the expected version, and
+	// returns ErrVersionMismatch otherwise. On success it returns the new version.
+	CompareAndSwap(K string, expected Version, V string) (Version, error)
+
+	// DeleteIfVersion removes the key only if it is still at the expected version, and
+	// returns ErrVersionMismatch otherwise.
+	DeleteIfVersion(K string, expected Version) error
+
+	// Scan returns an iterator over the keys in [start, end) and their values, in
+	// increasing key order. An empty end means no upper bound.
+	Scan(start, end string) (Iterator, error)
+
+	// ScanPrefix returns an iterator over the keys starting with prefix and their
+	// values, in increasing key order.
+	ScanPrefix(prefix string) (Iterator, error)
+
+	// Sync flushes every acknowledged write to stable storage.
+	// Returns error if operation fails.
+	Sync() error
+
+	Close() error
+}
+
+// Iterator walks over key/value pairs in key order.
+//
+//	for it.HasNext() {
+//		key, val := it.Get()
+//	}
+//	if err := it.Err(); err != nil { ... }
+type Iterator interface {
+
+	// HasNext advances to the next pair and reports whether there is one.
+	HasNext() bool
+
+	// Get returns the current key and value.
+	Get() (string, string)
+
+	// Err returns the error that stopped the iteration, or nil at the end of the range.
+	Err() error
+
+	// Close releases the resources held by the iterator.
 	Close() error
 }
 
@@ -45,6 +94,27 @@ func (jdb kvStore) Del(K string) error {
 func (jdb kvStore) Get(K string) (string, error) {
 	return jdb.store.Get(K)
 }
+func (jdb kvStore) GetWithVersion(K string) (string, Version, error) {
+	return jdb.store.GetWithVersion(K)
+}
+func (jdb kvStore) PutIfAbsent(K, V string) (Version, error) {
+	return jdb.store.PutIfAbsent(K, V)
+}
+func (jdb kvStore) CompareAndSwap(K string, expected Version, V string) (Version, error) {
+	return jdb.store.CompareAndSwap(K, expected, V)
+}
+func (jdb kvStore) DeleteIfVersion(K string, expected Version) error {
+	return jdb.store.DeleteIfVersion(K, expected)
+}
+func (jdb kvStore) Scan(start, end string) (Iterator, error) {
+	return jdb.store.Scan(start, end)
+}
+func (jdb kvStore) ScanPrefix(prefix string) (Iterator, error) {
+	return jdb.store.ScanPrefix(prefix)
+}
+func (jdb kvStore) Sync() error {
+	return jdb.store.Sync()
+}
 func (jdb kvStore) Close() error {
 	return jdb.store.Close()
 }
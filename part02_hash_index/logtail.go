@@ -0,0 +1,208 @@
+package kvstorefromscratchpart2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var ErrPositionLost = errors.New("log position is no longer available")
+
+// LogPosition is a place in the log: the offset of a record within its segment, as
+// returned by DataFile.Append. The zero LogPosition is the start of the log.
+//
+// Compaction rewrites sealed segments, so a position only stays valid as long as its
+// segment isn't compacted. The merged segment takes over the ID of the newest segment it
+// replaces; Compactions, the number of compactions the store had done when the position
+// was handed out, tells a position inside the merged segment apart from one inside a
+// segment it replaced.
+type LogPosition struct {
+	SegmentID   int
+	Offset      int64
+	Compactions int
+}
+
+func (p LogPosition) String() string {
+	return fmt.Sprintf("%d:%d", p.SegmentID, p.Offset)
+}
+
+// logTailer reads the log record by record from a position onwards, and can wait for
+// records that haven't been written yet. Like a Snapshot it pins the segments it still has
+// to read, so Compact doesn't close them underneath it: a tailer that was reading a segment
+// when it got compacted finishes reading the original records.
+//
+// A logTailer is not safe for concurrent use.
+type logTailer struct {
+	store    *FileStore
+	pos      LogPosition       // Next record to read
+	segments map[int]*DataFile // Segments at or after pos, including ones created later; guarded by store.mu
+}
+
+// newLogTailer returns a tailer that starts reading at from. It returns ErrPositionLost if
+// from points into a segment that has since been compacted, or anywhere the log doesn't
+// reach. The tailer must be released with close.
+func (f *FileStore) newLogTailer(from LogPosition) (*logTailer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, ErrStoreClosed
+	}
+
+	if from.SegmentID == 0 && from.Offset == 0 {
+		from.SegmentID = f.sortedSegments()[0].id
+	} else if from.SegmentID < f.compacted || (from.SegmentID == f.compacted && from.Compactions != f.compactions) {
+		return nil, fmt.Errorf("%w: segment %d has been compacted", ErrPositionLost, from.SegmentID)
+	}
+	segment, ok := f.segments[from.SegmentID]
+	if !ok || from.Offset < 0 || from.Offset > segment.Size() {
+		return nil, fmt.Errorf("%w: %v is outside of the log", ErrPositionLost, from)
+	}
+	from.Compactions = f.compactions
+
+	t := &logTailer{store: f, pos: from, segments: make(map[int]*DataFile)}
+	for id, segment := range f.segments {
+		if id >= from.SegmentID {
+			t.segments[id] = segment
+		}
+	}
+	f.tailers[t] = struct{}{}
+	return t, nil
+}
+
+// next returns the next record, where it starts and its encoded form, and advances past
+// it. It reports false once the tailer has caught up with the end of the log.
+func (t *logTailer) next() (record, LogPosition, []byte, bool, error) {
+	for {
+		rec, encoded, sealed, err := t.readNext()
+		if err != nil || encoded != nil {
+			pos := t.pos
+			if err == nil {
+				t.pos.Offset += int64(len(encoded))
+			}
+			return rec, pos, encoded, encoded != nil, err
+		}
+		if !sealed {
+			return record{}, t.pos, nil, false, nil
+		}
+		if err := t.nextSegment(); err != nil {
+			return record{}, t.pos, nil, false, err
+		}
+	}
+}
+
+// readNext reads the record at the tailer's position. At the end of a segment it returns no
+// record, and whether the segment is sealed, so nothing will be appended to it anymore.
+func (t *logTailer) readNext() (record, []byte, bool, error) {
+	f := t.store
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return record{}, nil, false, ErrStoreClosed
+	}
+
+	segment := t.segments[t.pos.SegmentID]
+	if t.pos.Offset >= segment.Size() {
+		return record{}, nil, segment != f.active, nil
+	}
+	rec, encoded, err := segment.readEncodedRecordAt(t.pos.Offset)
+	if err != nil {
+		return record{}, nil, false, fmt.Errorf("reading %v: %w", t.pos, err)
+	}
+	return rec, encoded, false, nil
+}
+
+// nextSegment moves the tailer to the start of the segment after the current one, which
+// must be sealed, and unpins the current one. A segment written by Compact is never among
+// the tailer's segments unless it existed when the tailer started, since it replaces
+// segments the tailer still reads in their original form.
+func (t *logTailer) nextSegment() error {
+	f := t.store
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return ErrStoreClosed
+	}
+
+	ids := make([]int, 0, len(t.segments))
+	for id := range t.segments {
+		if id > t.pos.SegmentID {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("no segment after sealed segment %d", t.pos.SegmentID)
+	}
+	sort.Ints(ids)
+
+	delete(t.segments, t.pos.SegmentID)
+	f.closeUnpinned()
+	t.pos.SegmentID, t.pos.Offset = ids[0], 0
+	return nil
+}
+
+// wait blocks until a record may have been appended after the tailer's position, the
+// store is closed or ctx is done.
+func (t *logTailer) wait(ctx context.Context) error {
+	f := t.store
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return ErrStoreClosed
+	}
+	segment := t.segments[t.pos.SegmentID]
+	if segment != f.active || t.pos.Offset < segment.Size() {
+		f.mu.Unlock()
+		return nil // Something was appended, or the segment was sealed, since next returned
+	}
+	if f.appended == nil {
+		f.appended = make(chan struct{})
+	}
+	appended := f.appended
+	f.mu.Unlock()
+
+	select {
+	case <-appended:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close releases the tailer and the segments it pinned.
+func (t *logTailer) close() {
+	f := t.store
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.tailers, t)
+	t.segments = nil
+	f.closeUnpinned()
+}
+
+// wakeTailers wakes every tailer waiting in wait. Callers hold the write lock.
+func (f *FileStore) wakeTailers() {
+	if f.appended != nil {
+		close(f.appended)
+		f.appended = nil
+	}
+}
+
+// readEncodedRecordAt reads the record at offset and returns it along with its encoded
+// form, exactly as it is stored.
+func (df *DataFile) readEncodedRecordAt(offset int64) (record, []byte, error) {
+	header := make([]byte, RECORD_HEADER_SIZE)
+	if _, err := df.file.ReadAt(header, offset); err != nil {
+		return record{}, nil, err
+	}
+	h, err := decodeRecordHeader(header)
+	if err != nil {
+		return record{}, nil, err
+	}
+	encoded := make([]byte, RECORD_HEADER_SIZE+h.bodySize())
+	copy(encoded, header)
+	if _, err := df.file.ReadAt(encoded[RECORD_HEADER_SIZE:], offset+RECORD_HEADER_SIZE); err != nil {
+		return record{}, nil, err
+	}
+	rec, _, err := decodeRecord(encoded)
+	return rec, encoded, err
+}
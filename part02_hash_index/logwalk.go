@@ -0,0 +1,76 @@
+package kvstorefromscratchpart2
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrStopWalk can be returned by a WalkLog callback to end the walk early; WalkLog then
+// returns nil.
+var ErrStopWalk = errors.New("stop walking the log")
+
+// LogEntry is a single record of the log, as seen by WalkLog.
+type LogEntry struct {
+	SegmentID int
+	Offset    int64  // Offset of the record in its segment
+	Size      int64  // Size of the encoded record in bytes
+	Operation string // OPERATION_PUT, OPERATION_DEL, OPERATION_BATCH_BEGIN or OPERATION_BATCH_COMMIT
+	Key       string
+	Value     string    // Empty unless Operation is OPERATION_PUT
+	ExpiresAt time.Time // Zero unless the PUT was written with PutWithTTL
+	BatchSize int       // Number of records in the batch, for batch markers
+}
+
+// WalkLog calls fn for every record in the log, oldest first: segment by segment in
+// increasing ID order, and by offset within a segment. Overwritten, deleted and expired
+// records are included, as are the markers framing a WriteBatch, so the walk shows
+// exactly what is on disk.
+//
+// Writes are blocked while the log is walked, and fn must not call other methods of the
+// store. If fn returns an error the walk stops and the error is returned, except for
+// ErrStopWalk, which stops the walk and returns nil.
+func (f *FileStore) WalkLog(fn func(LogEntry) error) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return ErrStoreClosed
+	}
+
+	for _, segment := range f.sortedSegments() {
+		iterator, err := segment.GetIterator(0)
+		if err != nil {
+			return err
+		}
+		for iterator.HasNext() {
+			rec, offset := iterator.Get()
+			entry := LogEntry{
+				SegmentID: segment.id,
+				Offset:    offset,
+				Size:      iterator.Offset() - offset,
+				Operation: rec.operation,
+				Key:       rec.data.key,
+				Value:     rec.data.val,
+			}
+			if rec.expiresAt != 0 {
+				entry.ExpiresAt = time.Unix(0, rec.expiresAt)
+			}
+			if rec.operation == OPERATION_BATCH_BEGIN || rec.operation == OPERATION_BATCH_COMMIT {
+				count, err := decodeBatchCount(rec)
+				if err != nil {
+					return err
+				}
+				entry.Value, entry.BatchSize = "", int(count)
+			}
+			if err := fn(entry); err != nil {
+				if err == ErrStopWalk {
+					return nil
+				}
+				return err
+			}
+		}
+		if err := iterator.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package kvstorefromscratchpart2
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFileStore_WalkLog(t *testing.T) {
+	advance := fakeClock(t)
+	tmpDir := t.TempDir()
+
+	store, err := ConnectFileStoreWithOptions(tmpDir, smallSegmentOptions())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+
+	store.Put("a", "1")
+	store.PutWithTTL("b", "2", time.Second)
+	batch := NewWriteBatch()
+	batch.Put("c", "3")
+	batch.Del("a")
+	if err := store.Write(batch); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	advance(time.Minute)
+
+	var got []LogEntry
+	if err := store.WalkLog(func(entry LogEntry) error {
+		got = append(got, entry)
+		return nil
+	}); err != nil {
+		t.Fatalf("WalkLog failed: %v", err)
+	}
+
+	want := []struct {
+		operation, key, val string
+		batchSize           int
+	}{
+		{OPERATION_PUT, "a", "1", 0},
+		{OPERATION_PUT, "b", "2", 0},
+		{OPERATION_BATCH_BEGIN, "", "", 2},
+		{OPERATION_PUT, "c", "3", 0},
+		{OPERATION_DEL, "a", "", 0},
+		{OPERATION_BATCH_COMMIT, "", "", 2},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("WalkLog visited %d records, want %d", len(got), len(want))
+	}
+	var offset int64
+	for i, w := range want {
+		e := got[i]
+		if e.Operation != w.operation || e.Key != w.key || e.Value != w.val || e.BatchSize != w.batchSize {
+			t.Errorf("record %d is %+v, want %+v", i, e, w)
+		}
+		if e.SegmentID != 1 || e.Offset != offset {
+			t.Errorf("record %d is at (%d, %d), want (1, %d)", i, e.SegmentID, e.Offset, offset)
+		}
+		offset += e.Size
+	}
+	if got[1].ExpiresAt.IsZero() || !got[0].ExpiresAt.IsZero() {
+		t.Errorf("ExpiresAt is %v for the TTL record and %v for the plain one", got[1].ExpiresAt, got[0].ExpiresAt)
+	}
+
+	visited := 0
+	if err := store.WalkLog(func(LogEntry) error {
+		visited++
+		return ErrStopWalk
+	}); err != nil || visited != 1 {
+		t.Errorf("WalkLog with ErrStopWalk returned %v after %d records, want nil after 1", err, visited)
+	}
+	failure := errors.New("failure")
+	if err := store.WalkLog(func(LogEntry) error { return failure }); err != failure {
+		t.Errorf("WalkLog returned %v, want the callback's error", err)
+	}
+}
+
+func TestFileStore_Stats(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	store, err := ConnectFileStoreWithOptions(tmpDir, smallSegmentOptions())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	if err := addNItemsToKVStore(store, 100); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.Del("key-0"); err != nil {
+		t.Fatalf("Del failed: %v", err)
+	}
+
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if stats.Keys != 99 {
+		t.Errorf("Stats reports %d keys, want 99", stats.Keys)
+	}
+	if stats.Segments < 2 || stats.ActiveSegmentID != stats.Segments {
+		t.Errorf("Stats reports %d segments with %d active", stats.Segments, stats.ActiveSegmentID)
+	}
+	if stats.DiskSize != store.diskSize() || stats.ActiveSize != store.active.Size() {
+		t.Errorf("Stats reports sizes %d/%d, want %d/%d", stats.DiskSize, stats.ActiveSize, store.diskSize(), store.active.Size())
+	}
+
+	store.Close()
+	if _, err := store.Stats(); err != ErrStoreClosed {
+		t.Errorf("Stats after Close returned %v, want ErrStoreClosed", err)
+	}
+}
@@ -0,0 +1,112 @@
+package kvstorefromscratchpart2
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	DEFAULT_MAX_SEGMENT_SIZE = 64 * 1024 * 1024 // 64 MiB
+	DEFAULT_SYNC_INTERVAL    = time.Second
+
+	DEFAULT_COMPRESSION_THRESHOLD = 512 // bytes
+)
+
+// SyncMode controls when appended records are fsynced to stable storage.
+type SyncMode int
+
+const (
+	// SYNC_ALWAYS fsyncs after every Put and Del, before it returns. An acknowledged
+	// write survives a power failure, at the cost of one fsync per write.
+	SYNC_ALWAYS SyncMode = iota
+	// SYNC_INTERVAL fsyncs from a background goroutine every Options.SyncInterval.
+	// A power failure loses at most the writes of the last interval.
+	SYNC_INTERVAL
+	// SYNC_NEVER leaves flushing to the operating system. Writes survive a crash of
+	// the process but not of the machine, unless Sync is called explicitly.
+	SYNC_NEVER
+)
+
+// IndexType selects the in-memory index that maps keys to their records.
+type IndexType int
+
+const (
+	// INDEX_HASH is a hash table: O(1) lookups, but scans have to sort the matching keys.
+	INDEX_HASH IndexType = iota
+	// INDEX_ORDERED is a skip list: O(log n) lookups, and scans walk the keys in order.
+	INDEX_ORDERED
+)
+
+var (
+	ErrInvalidOptions = errors.New("invalid store options")
+)
+
+// Options configures a FileStore. Use DefaultOptions and override individual fields
+// rather than building the struct from scratch, so new fields get sensible defaults.
+type Options struct {
+	// MaxSegmentSize is the size in bytes after which the active segment is sealed and
+	// writes roll over into a new segment. A single record is never split, so a segment
+	// may exceed this size by up to one record.
+	MaxSegmentSize int64
+
+	// SyncMode selects the durability/latency trade-off of writes.
+	SyncMode SyncMode
+
+	// SyncInterval is how often the active segment is fsynced in SYNC_INTERVAL mode.
+	SyncInterval time.Duration
+
+	// IndexType selects the in-memory index. Use INDEX_ORDERED if the store is scanned often.
+	IndexType IndexType
+
+	// Compression selects how values are compressed on disk. Only new records are
+	// affected; existing ones are read back whichever way they were written, so the
+	// setting can be changed between opens. Compaction rewrites records with the current
+	// setting.
+	Compression Compression
+
+	// CompressionThreshold is the size in bytes from which values are compressed. Short
+	// values rarely shrink enough to be worth it. A value is stored as it is if
+	// compressing it doesn't make it smaller.
+	CompressionThreshold int
+}
+
+// DefaultOptions returns the Options used by ConnectFileStore.
+func DefaultOptions() Options {
+	return Options{
+		MaxSegmentSize: DEFAULT_MAX_SEGMENT_SIZE,
+		SyncMode:       SYNC_INTERVAL,
+		SyncInterval:   DEFAULT_SYNC_INTERVAL,
+		IndexType:      INDEX_HASH,
+
+		Compression:          COMPRESSION_NONE,
+		CompressionThreshold: DEFAULT_COMPRESSION_THRESHOLD,
+	}
+}
+
+// validate returns ErrInvalidOptions if the options can't be used to open a store.
+func (o Options) validate() error {
+	if o.MaxSegmentSize <= 0 {
+		return ErrInvalidOptions
+	}
+	switch o.SyncMode {
+	case SYNC_ALWAYS, SYNC_NEVER:
+	case SYNC_INTERVAL:
+		if o.SyncInterval <= 0 {
+			return ErrInvalidOptions
+		}
+	default:
+		return ErrInvalidOptions
+	}
+	if o.IndexType != INDEX_HASH && o.IndexType != INDEX_ORDERED {
+		return ErrInvalidOptions
+	}
+	if (o.Compression != COMPRESSION_NONE && o.Compression != COMPRESSION_FLATE) || o.CompressionThreshold < 0 {
+		return ErrInvalidOptions
+	}
+	return nil
+}
+
+// compression returns the compression settings for new segments.
+func (o Options) compression() compressionConfig {
+	return compressionConfig{algorithm: o.Compression, threshold: o.CompressionThreshold}
+}
@@ -1,28 +1,285 @@
 package kvstorefromscratchpart2
 
 import (
-	"fmt"
-	"strings"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// On-disk layout of a record (all integers are big-endian):
+//
+//	+----------+---------+----+-------+--------+--------+-----------+-----+-------+
+//	| crc32 4B | version | op | flags | keyLen | valLen | expiresAt | key | value |
+//	|          |   1B    | 1B |  1B   |   4B   |   4B   | 8B, opt.  |     |       |
+//	+----------+---------+----+-------+--------+--------+-----------+-----+-------+
+//
+// The checksum covers every byte that follows it, so a torn or bit-flipped
+// record is detected instead of being handed back as garbage. Optional fields
+// are only present when their bit is set in flags. If FLAG_COMPRESSED is set, the
+// value is stored compressed and valLen is its compressed length.
+const (
+	RECORD_VERSION     = 1
+	RECORD_HEADER_SIZE = 15
+
+	FLAG_HAS_EXPIRY = 0x01 // expiresAt (Unix nanoseconds) follows the header
+	FLAG_COMPRESSED = 0x02 // The value is compressed with COMPRESSION_FLATE
+	knownFlags      = FLAG_HAS_EXPIRY | FLAG_COMPRESSED
+
+	MAX_KEY_SIZE   = 64 * 1024        // 64 KiB
+	MAX_VALUE_SIZE = 64 * 1024 * 1024 // 64 MiB
+)
+
+const (
+	opCodePut         byte = 1
+	opCodeDel         byte = 2
+	opCodeBatchBegin  byte = 3
+	opCodeBatchCommit byte = 4
+)
+
+var (
+	ErrCorruptRecord        = errors.New("record checksum mismatch")
+	ErrUnknownRecordVersion = errors.New("unknown record format version")
+	ErrUnknownOperation     = errors.New("unknown record operation")
+	ErrKeyTooLarge          = errors.New("key exceeds MAX_KEY_SIZE")
+	ErrValueTooLarge        = errors.New("value exceeds MAX_VALUE_SIZE")
 )
 
 type record struct {
 	operation string
 	data      KVPair
+	expiresAt int64 // Unix nanoseconds after which a PUT is no longer visible; 0 means never
 }
 
 type KVPair struct {
 	key, val string
 }
 
-func (r *record) String() string {
-	return fmt.Sprintf("%s|%s|%s", r.operation, r.data.key, r.data.val)
+// recordHeader is the decoded fixed-size prefix of an encoded record.
+type recordHeader struct {
+	checksum uint32
+	version  byte
+	opCode   byte
+	flags    byte
+	keyLen   uint32
+	valLen   uint32
+}
+
+// MarshalBinary encodes the record into its versioned, checksummed on-disk form.
+// Returns an error if the operation is unknown or the key/value exceed the size limits.
+func (r *record) MarshalBinary() ([]byte, error) {
+	return r.marshal(compressionConfig{})
+}
+
+// marshal is MarshalBinary, compressing the value of a PUT record according to cfg.
+// The size limits apply to the uncompressed value.
+func (r *record) marshal(cfg compressionConfig) ([]byte, error) {
+	opCode, err := opCodeFor(r.operation)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.data.key) > MAX_KEY_SIZE {
+		return nil, ErrKeyTooLarge
+	}
+	if len(r.data.val) > MAX_VALUE_SIZE {
+		return nil, ErrValueTooLarge
+	}
+
+	var flags byte
+	optionalSize := 0
+	if r.expiresAt != 0 {
+		flags |= FLAG_HAS_EXPIRY
+		optionalSize += 8
+	}
+	val := r.data.val
+	if r.operation == OPERATION_PUT {
+		if compressed, ok := compressValue(cfg, val); ok {
+			flags |= FLAG_COMPRESSED
+			val = string(compressed)
+		}
+	}
+
+	buf := make([]byte, RECORD_HEADER_SIZE+optionalSize+len(r.data.key)+len(val))
+	buf[4] = RECORD_VERSION
+	buf[5] = opCode
+	buf[6] = flags
+	binary.BigEndian.PutUint32(buf[7:11], uint32(len(r.data.key)))
+	binary.BigEndian.PutUint32(buf[11:15], uint32(len(val)))
+	pos := RECORD_HEADER_SIZE
+	if flags&FLAG_HAS_EXPIRY != 0 {
+		binary.BigEndian.PutUint64(buf[pos:pos+8], uint64(r.expiresAt))
+		pos += 8
+	}
+	copy(buf[pos:], r.data.key)
+	copy(buf[pos+len(r.data.key):], val)
+	binary.BigEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a single encoded record occupying the whole of data.
+func (r *record) UnmarshalBinary(data []byte) error {
+	if len(data) < RECORD_HEADER_SIZE {
+		return io.ErrUnexpectedEOF
+	}
+	header, err := decodeRecordHeader(data[:RECORD_HEADER_SIZE])
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != RECORD_HEADER_SIZE+header.bodySize() {
+		return io.ErrUnexpectedEOF
+	}
+	decoded, err := header.decodeBody(data[:RECORD_HEADER_SIZE], data[RECORD_HEADER_SIZE:])
+	if err != nil {
+		return err
+	}
+	*r = decoded
+	return nil
+}
+
+// readRecord reads the next encoded record from r and returns it along with the
+// number of bytes it occupied. It returns io.EOF if r is exhausted exactly at a
+// record boundary and io.ErrUnexpectedEOF if the record is truncated.
+func readRecord(r io.Reader) (record, int64, error) {
+	var headerBuf [RECORD_HEADER_SIZE]byte
+	if _, err := io.ReadFull(r, headerBuf[:]); err != nil {
+		return record{}, 0, err
+	}
+	header, err := decodeRecordHeader(headerBuf[:])
+	if err != nil {
+		return record{}, 0, err
+	}
+
+	body := make([]byte, header.bodySize())
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return record{}, 0, err
+	}
+	rec, err := header.decodeBody(headerBuf[:], body)
+	if err != nil {
+		return record{}, 0, err
+	}
+	return rec, RECORD_HEADER_SIZE + header.bodySize(), nil
+}
+
+// decodeRecord decodes the record at the start of data and returns it along with the
+// number of bytes it occupies. Unlike UnmarshalBinary, data may continue past the record.
+func decodeRecord(data []byte) (record, int64, error) {
+	if len(data) < RECORD_HEADER_SIZE {
+		return record{}, 0, io.ErrUnexpectedEOF
+	}
+	header, err := decodeRecordHeader(data[:RECORD_HEADER_SIZE])
+	if err != nil {
+		return record{}, 0, err
+	}
+	size := RECORD_HEADER_SIZE + header.bodySize()
+	if int64(len(data)) < size {
+		return record{}, 0, io.ErrUnexpectedEOF
+	}
+	rec, err := header.decodeBody(data[:RECORD_HEADER_SIZE], data[RECORD_HEADER_SIZE:size])
+	if err != nil {
+		return record{}, 0, err
+	}
+	return rec, size, nil
+}
+
+// decodeRecordHeader parses the fixed-size header. Lengths are sanity checked
+// against the size limits so a corrupt header can't trigger a huge allocation.
+func decodeRecordHeader(buf []byte) (recordHeader, error) {
+	header := recordHeader{
+		checksum: binary.BigEndian.Uint32(buf[0:4]),
+		version:  buf[4],
+		opCode:   buf[5],
+		flags:    buf[6],
+		keyLen:   binary.BigEndian.Uint32(buf[7:11]),
+		valLen:   binary.BigEndian.Uint32(buf[11:15]),
+	}
+	if header.version != RECORD_VERSION {
+		return recordHeader{}, ErrUnknownRecordVersion
+	}
+	if header.keyLen > MAX_KEY_SIZE || header.valLen > MAX_VALUE_SIZE || header.flags&^knownFlags != 0 {
+		return recordHeader{}, ErrCorruptRecord
+	}
+	return header, nil
+}
+
+// optionalSize returns the size of the optional fields selected by the flags.
+func (h recordHeader) optionalSize() int64 {
+	if h.flags&FLAG_HAS_EXPIRY != 0 {
+		return 8
+	}
+	return 0
+}
+
+// bodySize returns the size of everything after the fixed header.
+func (h recordHeader) bodySize() int64 {
+	return h.optionalSize() + int64(h.keyLen) + int64(h.valLen)
+}
+
+// decodeBody verifies the checksum over header and body and builds the record.
+func (h recordHeader) decodeBody(headerBuf, body []byte) (record, error) {
+	crc := crc32.ChecksumIEEE(headerBuf[4:])
+	crc = crc32.Update(crc, crc32.IEEETable, body)
+	if crc != h.checksum {
+		return record{}, ErrCorruptRecord
+	}
+	operation, err := operationFor(h.opCode)
+	if err != nil {
+		return record{}, err
+	}
+	var expiresAt int64
+	if h.flags&FLAG_HAS_EXPIRY != 0 {
+		expiresAt = int64(binary.BigEndian.Uint64(body[0:8]))
+	}
+	body = body[h.optionalSize():]
+	val := string(body[h.keyLen:])
+	if h.flags&FLAG_COMPRESSED != 0 {
+		if val, err = decompressValue(body[h.keyLen:]); err != nil {
+			return record{}, err
+		}
+	}
+	return record{
+		operation: operation,
+		data: KVPair{
+			key: string(body[:h.keyLen]),
+			val: val,
+		},
+		expiresAt: expiresAt,
+	}, nil
+}
+
+// isExpired reports whether the record has an expiry that is at or before now (Unix nanoseconds).
+func (r *record) isExpired(now int64) bool {
+	return r.expiresAt != 0 && r.expiresAt <= now
+}
+
+func opCodeFor(operation string) (byte, error) {
+	switch operation {
+	case OPERATION_PUT:
+		return opCodePut, nil
+	case OPERATION_DEL:
+		return opCodeDel, nil
+	case OPERATION_BATCH_BEGIN:
+		return opCodeBatchBegin, nil
+	case OPERATION_BATCH_COMMIT:
+		return opCodeBatchCommit, nil
+	}
+	return 0, ErrUnknownOperation
 }
 
-func (r *record) FromString(data string) {
-	parts := strings.SplitN(data, "|", 3)
-	r.operation = parts[0]
-	r.data.key = parts[1]
-	r.data.val = parts[2]
+func operationFor(opCode byte) (string, error) {
+	switch opCode {
+	case opCodePut:
+		return OPERATION_PUT, nil
+	case opCodeDel:
+		return OPERATION_DEL, nil
+	case opCodeBatchBegin:
+		return OPERATION_BATCH_BEGIN, nil
+	case opCodeBatchCommit:
+		return OPERATION_BATCH_COMMIT, nil
+	}
+	return "", ErrUnknownOperation
 }
 
 func (r *record) GetKey() string {
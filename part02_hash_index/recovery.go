@@ -0,0 +1,69 @@
+package kvstorefromscratchpart2
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// RecoveryReport describes a damaged tail that was cut off the active segment when the
+// store was opened, typically a record that was only partially written when the process
+// died.
+type RecoveryReport struct {
+	SegmentID      int   // Segment that was truncated
+	TruncatedAt    int64 // New size of the segment, the end of its last intact record
+	DiscardedBytes int64 // Number of bytes that were cut off
+	Reason         error // Why the tail was rejected, e.g. io.ErrUnexpectedEOF or ErrCorruptRecord
+}
+
+// Recovery returns what was discarded from the active segment when the store was opened,
+// or nil if the log ended cleanly.
+func (f *FileStore) Recovery() *RecoveryReport {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.recovery
+}
+
+// truncateTornTail cuts a damaged tail off the active segment. goodSize is the end of the
+// last record or batch that was replayed before replayErr stopped the replay.
+//
+// Only damage that can be explained by an interrupted append is repaired: a truncated
+// record, a record that fails its checksum but is the last one in the segment, a run of
+// zero bytes left by a file that was extended but never written, or a WriteBatch that is
+// missing its commit marker. The whole uncommitted batch is discarded in those cases.
+// Anything else means intact records would be thrown away, so replayErr is returned instead.
+func (f *FileStore) truncateTornTail(segment *DataFile, goodSize int64, replayErr error) error {
+	var stoppedAt *replayError
+	if !errors.As(replayErr, &stoppedAt) || !isTornTail(segment, stoppedAt.offset, stoppedAt.err) {
+		return replayErr
+	}
+
+	f.recovery = &RecoveryReport{
+		SegmentID:      segment.id,
+		TruncatedAt:    goodSize,
+		DiscardedBytes: segment.Size() - goodSize,
+		Reason:         stoppedAt.err,
+	}
+	return segment.Truncate(goodSize)
+}
+
+// isTornTail reports whether the bytes of segment from offset on look like the remains
+// of an interrupted append rather than corruption in the middle of the log.
+func isTornTail(segment *DataFile, offset int64, replayErr error) bool {
+	if errors.Is(replayErr, io.ErrUnexpectedEOF) || errors.Is(replayErr, ErrUncommittedBatch) {
+		return true
+	}
+
+	tail := make([]byte, segment.Size()-offset)
+	if _, err := segment.file.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return false
+	}
+	if len(bytes.Trim(tail, "\x00")) == 0 {
+		return true
+	}
+	if len(tail) < RECORD_HEADER_SIZE {
+		return false
+	}
+	header, err := decodeRecordHeader(tail[:RECORD_HEADER_SIZE])
+	return err == nil && RECORD_HEADER_SIZE+header.bodySize() == int64(len(tail))
+}
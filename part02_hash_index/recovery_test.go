@@ -0,0 +1,143 @@
+package kvstorefromscratchpart2
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSegment writes the encoded records to the segment file with the given ID and
+// returns the encoding.
+func writeSegment(t *testing.T, dir string, id int, recs ...record) []byte {
+	t.Helper()
+	var data []byte
+	for _, rec := range recs {
+		encoded, err := rec.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, encoded...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, segmentFileName(id, SEGMENT_EXT)), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func putRecord(key, val string) record {
+	return record{operation: OPERATION_PUT, data: KVPair{key: key, val: val}}
+}
+
+func TestConnectFileStore_TruncatesTornWriteAtEveryByte(t *testing.T) {
+	intact := []record{putRecord("a", "1"), putRecord("b", "2"), {operation: OPERATION_DEL, data: KVPair{key: "a"}}}
+	torn := putRecord("torn", "value that was being written")
+	tornEncoded, err := torn.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for cut := 1; cut < len(tornEncoded); cut++ {
+		t.Run(fmt.Sprintf("cut-%d", cut), func(t *testing.T) {
+			tmpDir := t.TempDir()
+			good := writeSegment(t, tmpDir, 1, intact...)
+			path := filepath.Join(tmpDir, segmentFileName(1, SEGMENT_EXT))
+			if err := os.WriteFile(path, append(good, tornEncoded[:cut]...), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			store, err := ConnectFileStore(tmpDir)
+			if err != nil {
+				t.Fatalf("ConnectFileStore failed: %v", err)
+			}
+			report := store.Recovery()
+			if report == nil {
+				t.Fatal("Recovery returned nil, want a report of the torn record")
+			}
+			if report.TruncatedAt != int64(len(good)) || report.DiscardedBytes != int64(cut) {
+				t.Errorf("Recovery returned %+v, want truncation at %d discarding %d bytes", report, len(good), cut)
+			}
+			if _, err := store.Get("torn"); err != ErrKeyDoesntExist {
+				t.Errorf("Get(torn) returned %v, want ErrKeyDoesntExist", err)
+			}
+			if _, err := store.Get("a"); err != ErrKeyDoesntExist {
+				t.Errorf("Get(a) returned %v, want ErrKeyDoesntExist", err)
+			}
+			if got, err := store.Get("b"); err != nil || got != "2" {
+				t.Errorf("Get(b) returned (%q, %v), want 2", got, err)
+			}
+
+			// New writes go right after the last intact record and survive a reopen
+			if err := store.Put("c", "3"); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			if err := store.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			store, err = ConnectFileStore(tmpDir)
+			if err != nil {
+				t.Fatalf("reopen failed: %v", err)
+			}
+			defer store.Close()
+			if store.Recovery() != nil {
+				t.Errorf("Recovery after a clean reopen returned %+v, want nil", store.Recovery())
+			}
+			if got, err := store.Get("c"); err != nil || got != "3" {
+				t.Errorf("Get(c) returned (%q, %v), want 3", got, err)
+			}
+		})
+	}
+}
+
+func TestConnectFileStore_TruncatesChecksumFailingTail(t *testing.T) {
+	tmpDir := t.TempDir()
+	data := writeSegment(t, tmpDir, 1, putRecord("a", "1"), putRecord("b", "2"))
+	data[len(data)-1] ^= 0xFF
+	if err := os.WriteFile(filepath.Join(tmpDir, segmentFileName(1, SEGMENT_EXT)), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+	if report := store.Recovery(); report == nil || !errors.Is(report.Reason, ErrCorruptRecord) {
+		t.Errorf("Recovery returned %+v, want a checksum failure", report)
+	}
+	if _, err := store.Get("b"); err != ErrKeyDoesntExist {
+		t.Errorf("Get(b) returned %v, want ErrKeyDoesntExist", err)
+	}
+}
+
+func TestConnectFileStore_TruncatesZeroFilledTail(t *testing.T) {
+	tmpDir := t.TempDir()
+	data := writeSegment(t, tmpDir, 1, putRecord("a", "1"))
+	data = append(data, make([]byte, 4096)...)
+	if err := os.WriteFile(filepath.Join(tmpDir, segmentFileName(1, SEGMENT_EXT)), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+	if report := store.Recovery(); report == nil || report.DiscardedBytes != 4096 {
+		t.Errorf("Recovery returned %+v, want 4096 discarded bytes", report)
+	}
+}
+
+func TestConnectFileStore_RefusesCorruptionBeforeIntactRecords(t *testing.T) {
+	tmpDir := t.TempDir()
+	data := writeSegment(t, tmpDir, 1, putRecord("a", "1"), putRecord("b", "2"))
+	data[RECORD_HEADER_SIZE] ^= 0xFF // Damage the first record; the second one is intact
+	if err := os.WriteFile(filepath.Join(tmpDir, segmentFileName(1, SEGMENT_EXT)), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ConnectFileStore(tmpDir); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("ConnectFileStore returned %v, want ErrCorruptRecord", err)
+	}
+}
@@ -0,0 +1,391 @@
+package kvstorefromscratchpart2
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Replication streams a leader's log to a follower over any reliable byte stream, usually
+// a TCP connection. The follower opens the stream by sending where to start, and the leader
+// answers with frames (all integers are big-endian):
+//
+//	hello:    | magic 4B | segmentID 8B | offset 8B | compactions 8B |   (follower to leader)
+//	position: | 'P' | segmentID 8B | offset 8B | compactions 8B |
+//	record:   | 'R' | segmentID 8B | offset 8B | compactions 8B | size 4B | record |
+//	error:    | 'E' | code 1B | size 4B | message |
+//
+// A record frame carries a record exactly as it is stored in the leader's log, followed by
+// the position right after it. A position frame moves the follower's position without a
+// record: the leader sends one first, when it moves on to a new segment, and as a heartbeat
+// while the log is idle. After an error frame the leader closes the stream.
+const (
+	REPL_MAGIC                    = "KVR\x01"
+	REPL_FRAME_POSITION           = 'P'
+	REPL_FRAME_RECORD             = 'R'
+	REPL_FRAME_ERROR              = 'E'
+	REPL_POSITION_SIZE            = 24
+	REPL_HEARTBEAT_INTERVAL       = 5 * time.Second
+	REPL_POSITION_SAVE_INTERVAL   = time.Second
+	REPLICATION_POSITION_FILENAME = "replication.pos"
+
+	replErrorGeneric      byte = 0
+	replErrorPositionLost byte = 1
+)
+
+var ErrReplicationProtocol = errors.New("replication protocol error")
+
+// ServeReplication streams the log to the follower at the other end of conn, starting at
+// the position it asks for, and then keeps sending records as they are appended. It
+// returns when ctx is done, the store is closed or conn fails. Any number of followers can
+// be served at once, each by its own call.
+//
+// Replication is asynchronous: records are sent once they are appended, independently of
+// when the leader fsyncs them and without waiting for the follower to apply them. Reading
+// the log doesn't block writers, but segments a follower still has to read aren't reclaimed
+// by Compact until it has read them.
+//
+// If the requested position is no longer in the log, typically because Compact rewrote its
+// segment while the follower was disconnected, the follower is told so and
+// ServeReplication returns an error wrapping ErrPositionLost. The follower then has to be
+// reseeded, e.g. from a backup.
+func (f *FileStore) ServeReplication(ctx context.Context, conn io.ReadWriter) error {
+	from, err := readReplicationHello(conn)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(conn)
+	t, err := f.newLogTailer(from)
+	if err != nil {
+		writeReplicationError(w, err)
+		return err
+	}
+	defer t.close()
+
+	sent := t.pos
+	if err := writeReplicationPosition(w, REPL_FRAME_POSITION, sent); err != nil {
+		return err
+	}
+	for {
+		_, _, encoded, ok, err := t.next()
+		if err != nil {
+			writeReplicationError(w, err)
+			return err
+		}
+		if ok {
+			if err := writeReplicationRecord(w, t.pos, encoded); err != nil {
+				return err
+			}
+			sent = t.pos
+			continue
+		}
+
+		if t.pos != sent {
+			if err := writeReplicationPosition(w, REPL_FRAME_POSITION, t.pos); err != nil {
+				return err
+			}
+			sent = t.pos
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		waitCtx, cancel := context.WithTimeout(ctx, REPL_HEARTBEAT_INTERVAL)
+		err = t.wait(waitCtx)
+		cancel()
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err == context.DeadlineExceeded:
+			// Idle: a heartbeat lets the follower notice a dead connection
+			if err := writeReplicationPosition(w, REPL_FRAME_POSITION, t.pos); err != nil {
+				return err
+			}
+		case err != nil:
+			writeReplicationError(w, err)
+			return err
+		}
+	}
+}
+
+// Follower applies the log of a leader, received through ServeReplication, to its own
+// store. Records are applied in log order with their original expiry times, and the
+// records of a WriteBatch are applied atomically. The follower's store shouldn't be
+// written to by anything else, or the two stores diverge.
+//
+// The position up to which the leader's log has been applied is saved in
+// REPLICATION_POSITION_FILENAME in the store's directory, so following can resume where it
+// left off, after a disconnect as well as after a restart. The position is only saved once
+// the records before it have been fsynced, and at most every REPL_POSITION_SAVE_INTERVAL,
+// so after a crash a few records may be applied a second time; since they are applied in
+// order, that doesn't change the outcome.
+type Follower struct {
+	store *FileStore
+
+	mu       sync.Mutex
+	pos      LogPosition // Position in the leader's log up to which records are applied
+	saved    LogPosition // Position last written to REPLICATION_POSITION_FILENAME
+	lastSave time.Time
+	batch    *WriteBatch // Records of the batch being received, nil outside of a batch
+}
+
+// NewFollower returns a Follower applying records to store, resuming at the position saved
+// in its directory, or at the start of the leader's log if there is none.
+func NewFollower(store *FileStore) (*Follower, error) {
+	fl := &Follower{store: store}
+	data, err := os.ReadFile(filepath.Join(store.dir, REPLICATION_POSITION_FILENAME))
+	if os.IsNotExist(err) {
+		return fl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Sscanf(string(data), "%d %d %d\n", &fl.pos.SegmentID, &fl.pos.Offset, &fl.pos.Compactions)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", REPLICATION_POSITION_FILENAME, err)
+	}
+	fl.saved = fl.pos
+	return fl, nil
+}
+
+// Position returns the position in the leader's log up to which records have been applied.
+func (fl *Follower) Position() LogPosition {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	return fl.pos
+}
+
+// Follow asks the leader at the other end of conn for the records after the follower's
+// position and applies them as they arrive. It only returns once conn fails or is closed,
+// the leader reports an error, or a record can't be applied; close conn to stop following.
+// The position is saved before Follow returns, and calling Follow again with a new
+// connection resumes from it. If the leader no longer has the position, the error wraps
+// ErrPositionLost and the store has to be reseeded. Follow must not be called concurrently.
+func (fl *Follower) Follow(conn io.ReadWriter) (err error) {
+	defer func() {
+		if saveErr := fl.save(true); err == nil {
+			err = saveErr
+		}
+	}()
+
+	if err := writeReplicationHello(conn, fl.Position()); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	for {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case REPL_FRAME_POSITION:
+			pos, err := readReplicationPosition(r)
+			if err != nil {
+				return err
+			}
+			fl.advance(pos)
+		case REPL_FRAME_RECORD:
+			pos, rec, err := readReplicationRecord(r)
+			if err != nil {
+				return err
+			}
+			if err := fl.apply(rec); err != nil {
+				return err
+			}
+			fl.advance(pos)
+		case REPL_FRAME_ERROR:
+			return readReplicationError(r)
+		default:
+			return fmt.Errorf("%w: unknown frame %q", ErrReplicationProtocol, kind)
+		}
+		if r.Buffered() == 0 {
+			// About to wait for the leader, a good moment to save the position
+			if err := fl.save(false); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// apply applies a record of the leader's log to the follower's store. Records between a
+// BATCH_BEGIN and a BATCH_COMMIT are collected and written as one batch on commit.
+func (fl *Follower) apply(rec record) error {
+	switch rec.operation {
+	case OPERATION_BATCH_BEGIN:
+		if fl.batch != nil {
+			return fmt.Errorf("%w: batch inside a batch", ErrCorruptBatch)
+		}
+		fl.batch = NewWriteBatch()
+		return nil
+	case OPERATION_BATCH_COMMIT:
+		if fl.batch == nil {
+			return fmt.Errorf("%w: commit outside of a batch", ErrCorruptBatch)
+		}
+		batch := fl.batch
+		fl.batch = nil
+		return fl.store.Write(batch)
+	}
+
+	if fl.batch != nil {
+		fl.batch.records = append(fl.batch.records, rec)
+		return nil
+	}
+	if rec.operation == OPERATION_DEL {
+		return fl.store.Del(rec.data.key)
+	}
+	return fl.store.put(rec)
+}
+
+// advance moves the position forward, unless a batch is still being received: until it
+// is committed, the follower resumes at its start.
+func (fl *Follower) advance(pos LogPosition) {
+	if fl.batch != nil {
+		return
+	}
+	fl.mu.Lock()
+	fl.pos = pos
+	fl.mu.Unlock()
+}
+
+// save fsyncs the store and then writes the position to REPLICATION_POSITION_FILENAME, if
+// it changed. Unless force is set, it does so at most every REPL_POSITION_SAVE_INTERVAL.
+func (fl *Follower) save(force bool) error {
+	pos := fl.Position()
+	if pos == fl.saved || (!force && time.Since(fl.lastSave) < REPL_POSITION_SAVE_INTERVAL) {
+		return nil
+	}
+	if err := fl.store.Sync(); err != nil {
+		return err
+	}
+	data := fmt.Sprintf("%d %d %d\n", pos.SegmentID, pos.Offset, pos.Compactions)
+	if err := writeFileAtomic(fl.store.dir, REPLICATION_POSITION_FILENAME, []byte(data)); err != nil {
+		return err
+	}
+	fl.saved, fl.lastSave = pos, time.Now()
+	return nil
+}
+
+func writeReplicationHello(w io.Writer, pos LogPosition) error {
+	buf := make([]byte, 0, len(REPL_MAGIC)+REPL_POSITION_SIZE)
+	buf = append(buf, REPL_MAGIC...)
+	buf = appendReplicationPosition(buf, pos)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readReplicationHello(r io.Reader) (LogPosition, error) {
+	buf := make([]byte, len(REPL_MAGIC)+REPL_POSITION_SIZE)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return LogPosition{}, err
+	}
+	if string(buf[:len(REPL_MAGIC)]) != REPL_MAGIC {
+		return LogPosition{}, fmt.Errorf("%w: bad magic %q", ErrReplicationProtocol, buf[:len(REPL_MAGIC)])
+	}
+	return decodeReplicationPosition(buf[len(REPL_MAGIC):]), nil
+}
+
+func appendReplicationPosition(buf []byte, pos LogPosition) []byte {
+	buf = binary.BigEndian.AppendUint64(buf, uint64(pos.SegmentID))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(pos.Offset))
+	return binary.BigEndian.AppendUint64(buf, uint64(pos.Compactions))
+}
+
+func decodeReplicationPosition(buf []byte) LogPosition {
+	return LogPosition{
+		SegmentID:   int(binary.BigEndian.Uint64(buf[0:8])),
+		Offset:      int64(binary.BigEndian.Uint64(buf[8:16])),
+		Compactions: int(binary.BigEndian.Uint64(buf[16:24])),
+	}
+}
+
+func writeReplicationPosition(w io.Writer, kind byte, pos LogPosition) error {
+	buf := make([]byte, 0, 1+REPL_POSITION_SIZE)
+	buf = append(buf, kind)
+	_, err := w.Write(appendReplicationPosition(buf, pos))
+	return err
+}
+
+func readReplicationPosition(r io.Reader) (LogPosition, error) {
+	buf := make([]byte, REPL_POSITION_SIZE)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return LogPosition{}, err
+	}
+	return decodeReplicationPosition(buf), nil
+}
+
+func writeReplicationRecord(w io.Writer, pos LogPosition, encoded []byte) error {
+	if err := writeReplicationPosition(w, REPL_FRAME_RECORD, pos); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(len(encoded))); err != nil {
+		return err
+	}
+	_, err := w.Write(encoded)
+	return err
+}
+
+// readReplicationRecord reads the rest of a record frame. The record is decoded, and so
+// checked against its checksum, before it is returned.
+func readReplicationRecord(r io.Reader) (LogPosition, record, error) {
+	pos, err := readReplicationPosition(r)
+	if err != nil {
+		return LogPosition{}, record{}, err
+	}
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return LogPosition{}, record{}, err
+	}
+	if size < RECORD_HEADER_SIZE || size > RECORD_HEADER_SIZE+8+MAX_KEY_SIZE+MAX_VALUE_SIZE {
+		return LogPosition{}, record{}, fmt.Errorf("%w: record of %d bytes", ErrReplicationProtocol, size)
+	}
+	encoded := make([]byte, size)
+	if _, err := io.ReadFull(r, encoded); err != nil {
+		return LogPosition{}, record{}, err
+	}
+	var rec record
+	if err := rec.UnmarshalBinary(encoded); err != nil {
+		return LogPosition{}, record{}, err
+	}
+	return pos, rec, nil
+}
+
+// writeReplicationError sends err to the follower. It is best effort, since the stream
+// is closed right after.
+func writeReplicationError(w *bufio.Writer, err error) {
+	code := replErrorGeneric
+	if errors.Is(err, ErrPositionLost) {
+		code = replErrorPositionLost
+	}
+	message := err.Error()
+	w.WriteByte(REPL_FRAME_ERROR)
+	w.WriteByte(code)
+	binary.Write(w, binary.BigEndian, uint32(len(message)))
+	w.WriteString(message)
+	w.Flush()
+}
+
+func readReplicationError(r io.Reader) error {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > 64*1024 {
+		return fmt.Errorf("%w: error message of %d bytes", ErrReplicationProtocol, size)
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return err
+	}
+	if header[0] == replErrorPositionLost {
+		return fmt.Errorf("%w: leader: %s", ErrPositionLost, message)
+	}
+	return fmt.Errorf("leader: %s", message)
+}
@@ -0,0 +1,290 @@
+package kvstorefromscratchpart2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// replicate serves leader to follower over the two ends of a connection, and returns a
+// function that disconnects them and returns the error Follow returned.
+func replicate(t *testing.T, leader *FileStore, follower *Follower, leaderConn, followerConn net.Conn) func() error {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		leader.ServeReplication(ctx, leaderConn)
+		leaderConn.Close()
+	}()
+	followed := make(chan error, 1)
+	go func() {
+		followed <- follower.Follow(followerConn)
+	}()
+	return func() error {
+		followerConn.Close()
+		err := <-followed
+		cancel()
+		<-served
+		return err
+	}
+}
+
+// replicateOverPipe is replicate over an in-memory net.Pipe.
+func replicateOverPipe(t *testing.T, leader *FileStore, follower *Follower) func() error {
+	leaderConn, followerConn := net.Pipe()
+	return replicate(t, leader, follower, leaderConn, followerConn)
+}
+
+// waitForValue waits until store has key set to want.
+func waitForValue(t *testing.T, store *FileStore, key, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := store.Get(key)
+		if err == nil && got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("follower Get(%q) returned (%q, %v), want %q", key, got, err, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func connectPair(t *testing.T) (*FileStore, *FileStore, string) {
+	t.Helper()
+	leader, err := ConnectFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	t.Cleanup(func() { leader.Close() })
+	followerDir := t.TempDir()
+	follower, err := ConnectFileStore(followerDir)
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	return leader, follower, followerDir
+}
+
+func TestReplication_FollowerCatchesUpAndTails(t *testing.T) {
+	leader, followerStore, _ := connectPair(t)
+	defer followerStore.Close()
+
+	leader.Put("a", "1")
+	leader.Put("b", "2")
+	leader.Del("a")
+	if err := leader.PutWithTTL("session", "token", time.Hour); err != nil {
+		t.Fatalf("PutWithTTL failed: %v", err)
+	}
+
+	follower, err := NewFollower(followerStore)
+	if err != nil {
+		t.Fatalf("NewFollower failed: %v", err)
+	}
+	stop := replicateOverPipe(t, leader, follower)
+	waitForValue(t, followerStore, "session", "token")
+
+	// Live writes are streamed as they happen
+	batch := NewWriteBatch()
+	batch.Put("c", "3")
+	batch.Del("b")
+	if err := leader.Write(batch); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	leader.Put("d", "4")
+	waitForValue(t, followerStore, "d", "4")
+	if err := stop(); err == nil {
+		t.Errorf("Follow returned nil after the connection was closed")
+	}
+
+	for key, want := range map[string]string{"c": "3", "d": "4", "session": "token"} {
+		if got, err := followerStore.Get(key); err != nil || got != want {
+			t.Errorf("follower Get(%q) returned (%q, %v), want %q", key, got, err, want)
+		}
+	}
+	for _, key := range []string{"a", "b"} {
+		if _, err := followerStore.Get(key); err != ErrKeyDoesntExist {
+			t.Errorf("follower Get(%q) returned %v, want ErrKeyDoesntExist", key, err)
+		}
+	}
+
+	expiries := make(map[string]time.Time)
+	for _, store := range []*FileStore{leader, followerStore} {
+		store.WalkLog(func(e LogEntry) error {
+			if e.Key == "session" {
+				expiries[fmt.Sprint(store == leader)] = e.ExpiresAt
+			}
+			return nil
+		})
+	}
+	if expiries["true"].IsZero() || !expiries["true"].Equal(expiries["false"]) {
+		t.Errorf("expiry on the follower is %v, want %v as on the leader", expiries["false"], expiries["true"])
+	}
+
+	pos := follower.Position()
+	if pos.SegmentID != leader.active.id || pos.Offset != leader.active.Size() {
+		t.Errorf("follower position is %v, want the end of the leader's log at %d:%d", pos, leader.active.id, leader.active.Size())
+	}
+}
+
+func TestReplication_ResumesAfterRestart(t *testing.T) {
+	leader, followerStore, followerDir := connectPair(t)
+	leader.opts.MaxSegmentSize = 256 // Several segments to walk through
+
+	if err := addNItemsToKVStore(leader, 20); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	follower, err := NewFollower(followerStore)
+	if err != nil {
+		t.Fatalf("NewFollower failed: %v", err)
+	}
+	stop := replicateOverPipe(t, leader, follower)
+	waitForValue(t, followerStore, "key-19", "value-19")
+	stop()
+	saved := follower.Position()
+	if err := followerStore.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Written while the follower is down
+	leader.Put("key-0", "changed")
+	leader.Del("key-1")
+	leader.Put("late", "value")
+
+	followerStore, err = ConnectFileStore(followerDir)
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer followerStore.Close()
+	follower, err = NewFollower(followerStore)
+	if err != nil {
+		t.Fatalf("NewFollower failed: %v", err)
+	}
+	if follower.Position() != saved {
+		t.Fatalf("follower resumes at %v, want the saved position %v", follower.Position(), saved)
+	}
+
+	// Resume over loopback TCP this time
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	followerConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	leaderConn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	stop = replicate(t, leader, follower, leaderConn, followerConn)
+	waitForValue(t, followerStore, "late", "value")
+	stop()
+
+	if got, err := followerStore.Get("key-0"); err != nil || got != "changed" {
+		t.Errorf("follower Get(key-0) returned (%q, %v), want changed", got, err)
+	}
+	if _, err := followerStore.Get("key-1"); err != ErrKeyDoesntExist {
+		t.Errorf("follower Get(key-1) returned %v, want ErrKeyDoesntExist", err)
+	}
+	if got, err := followerStore.Get("key-19"); err != nil || got != "value-19" {
+		t.Errorf("follower Get(key-19) returned (%q, %v), want value-19", got, err)
+	}
+	// Only the three new records were applied, not the whole log again
+	var applied int
+	followerStore.WalkLog(func(e LogEntry) error {
+		applied++
+		return nil
+	})
+	if applied != 23 {
+		t.Errorf("follower log has %d records, want 23", applied)
+	}
+}
+
+func TestReplication_FollowerKeepsUpWithCompaction(t *testing.T) {
+	leader, followerStore, _ := connectPair(t)
+	defer followerStore.Close()
+	leader.opts.MaxSegmentSize = 256
+
+	if err := addNItemsToKVStore(leader, 20); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	// A tailer pins the segments it hasn't read yet, so compacting them while it reads
+	// doesn't lose records
+	tailer, err := leader.newLogTailer(LogPosition{})
+	if err != nil {
+		t.Fatalf("newLogTailer failed: %v", err)
+	}
+	if err := leader.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	var puts int
+	for {
+		rec, _, _, ok, err := tailer.next()
+		if err != nil {
+			t.Fatalf("next failed: %v", err)
+		}
+		if !ok {
+			break
+		}
+		if rec.operation == OPERATION_PUT {
+			puts++
+		}
+	}
+	tailer.close()
+	leader.Put("key-20", "value-20")
+	if puts != 20 {
+		t.Errorf("tailer read %d PUTs across the compaction, want 20", puts)
+	}
+	if len(leader.retired) != 0 {
+		t.Errorf("%d compacted segments still open after the tailer was closed", len(leader.retired))
+	}
+
+	// An idle follower is moved past the segment that's about to be compacted, so it can
+	// reconnect afterwards
+	follower, err := NewFollower(followerStore)
+	if err != nil {
+		t.Fatalf("NewFollower failed: %v", err)
+	}
+	stop := replicateOverPipe(t, leader, follower)
+	waitForValue(t, followerStore, "key-20", "value-20")
+	caughtUp := follower.Position()
+	if err := leader.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for follower.Position().SegmentID == caughtUp.SegmentID && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	stop()
+
+	leader.Put("after", "compaction")
+	stop = replicateOverPipe(t, leader, follower)
+	waitForValue(t, followerStore, "after", "compaction")
+	stop()
+
+	// A position in a compacted segment is gone
+	stale := LogPosition{SegmentID: caughtUp.SegmentID, Offset: 0, Compactions: caughtUp.Compactions}
+	if _, err := leader.newLogTailer(stale); !errors.Is(err, ErrPositionLost) {
+		t.Errorf("newLogTailer(%v) returned %v, want ErrPositionLost", stale, err)
+	}
+	leaderConn, followerConn := net.Pipe()
+	defer followerConn.Close()
+	served := make(chan error, 1)
+	go func() {
+		served <- leader.ServeReplication(context.Background(), leaderConn)
+		leaderConn.Close()
+	}()
+	lost := &Follower{store: followerStore, pos: stale, saved: stale}
+	if err := lost.Follow(followerConn); !errors.Is(err, ErrPositionLost) {
+		t.Errorf("Follow from %v returned %v, want ErrPositionLost", stale, err)
+	}
+	if err := <-served; !errors.Is(err, ErrPositionLost) {
+		t.Errorf("ServeReplication returned %v, want ErrPositionLost", err)
+	}
+}
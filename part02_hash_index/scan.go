@@ -0,0 +1,120 @@
+package kvstorefromscratchpart2
+
+// ScanIterator walks over the live key/value pairs in a key range, in increasing key order.
+//
+// The set of keys is fixed when the scan starts, while each value is read when the
+// iterator reaches its key: a key overwritten during the scan yields its newer value, and
+// a key deleted during the scan is skipped. Use a snapshot for a fully consistent view.
+type ScanIterator struct {
+	get  func(key string) (string, error) // Reads the current value of a key
+	keys []string
+	pos  int
+	key  string
+	val  string
+	err  error
+}
+
+// Scan returns an iterator over the live keys in [start, end) in increasing key order.
+// An empty end means no upper bound, so Scan("", "") visits every key.
+func (f *FileStore) Scan(start, end string) (Iterator, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return nil, ErrStoreClosed
+	}
+
+	var keys []string
+	f.index.Ascend(start, end, func(ko keyOffset) bool {
+		keys = append(keys, ko.Key)
+		return true
+	})
+	return &ScanIterator{get: f.Get, keys: keys}, nil
+}
+
+// ScanKeys returns up to limit live keys in [start, end) in increasing key order, or all of
+// them if limit is 0. An empty end means no upper bound. Unlike Scan it doesn't read the
+// values: only the header of each record is read, to leave out keys that have expired.
+func (f *FileStore) ScanKeys(start, end string, limit int) ([]string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return nil, ErrStoreClosed
+	}
+
+	var keys []string
+	var err error
+	now := timeNow().UnixNano()
+	f.index.Ascend(start, end, func(ko keyOffset) bool {
+		var expiresAt int64
+		expiresAt, err = f.segments[ko.SegmentID].ReadExpiryAt(ko.Offset)
+		if err != nil {
+			return false
+		}
+		if expiresAt == 0 || expiresAt > now {
+			keys = append(keys, ko.Key)
+		}
+		return limit == 0 || len(keys) < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// ScanPrefix returns an iterator over the live keys starting with prefix, in increasing
+// key order.
+func (f *FileStore) ScanPrefix(prefix string) (Iterator, error) {
+	return f.Scan(prefix, PrefixEnd(prefix))
+}
+
+// PrefixEnd returns the smallest key greater than every key starting with prefix, or ""
+// (no upper bound) if there is none, i.e. the prefix is empty or all 0xFF bytes.
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// HasNext advances to the next live key and reports whether there is one.
+// It returns false at the end of the range or on error; use Err to tell them apart.
+func (it *ScanIterator) HasNext() bool {
+	if it.err != nil {
+		return false
+	}
+	for it.pos < len(it.keys) {
+		key := it.keys[it.pos]
+		it.pos++
+		val, err := it.get(key)
+		if err == ErrKeyDoesntExist {
+			continue // Deleted since the scan started
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.key, it.val = key, val
+		return true
+	}
+	return false
+}
+
+// Get returns the current key and value.
+func (it *ScanIterator) Get() (string, string) {
+	return it.key, it.val
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *ScanIterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator. It must not be used afterwards.
+func (it *ScanIterator) Close() error {
+	it.keys = nil
+	return nil
+}
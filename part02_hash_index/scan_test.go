@@ -0,0 +1,159 @@
+package kvstorefromscratchpart2
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// collectScan drains a scan into "key=value" strings. It takes the scan's return values
+// directly so calls read as collectScan(t)(store.Scan(...)).
+func collectScan(t *testing.T) func(it Iterator, err error) []string {
+	return func(it Iterator, err error) []string {
+		t.Helper()
+		return drainScan(t, it, err)
+	}
+}
+
+func drainScan(t *testing.T, it Iterator, err error) []string {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	defer it.Close()
+	var pairs []string
+	for it.HasNext() {
+		key, val := it.Get()
+		pairs = append(pairs, key+"="+val)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("iteration failed: %v", err)
+	}
+	return pairs
+}
+
+func TestFileStore_Scan(t *testing.T) {
+	for _, indexType := range []IndexType{INDEX_HASH, INDEX_ORDERED} {
+		t.Run(fmt.Sprintf("index-%d", indexType), func(t *testing.T) {
+			opts := smallSegmentOptions()
+			opts.IndexType = indexType
+			store, err := ConnectFileStoreWithOptions(t.TempDir(), opts)
+			if err != nil {
+				t.Fatalf("ConnectFileStoreWithOptions failed: %v", err)
+			}
+			defer store.Close()
+
+			for _, key := range []string{"user:42:name", "user:42:email", "user:421:name", "user:43:name", "account:1", "user:42:zip", "\xff\xff"} {
+				if err := store.Put(key, "v-"+key); err != nil {
+					t.Fatalf("Put failed: %v", err)
+				}
+			}
+			if err := store.Del("user:42:zip"); err != nil {
+				t.Fatalf("Del failed: %v", err)
+			}
+
+			got := collectScan(t)(store.ScanPrefix("user:42:"))
+			want := []string{"user:42:email=v-user:42:email", "user:42:name=v-user:42:name"}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("ScanPrefix(user:42:) returned %q, want %q", got, want)
+			}
+
+			// ':' sorts after '1', so user:421:* comes before user:42:*; end is exclusive
+			got = collectScan(t)(store.Scan("user:421", "user:43:name"))
+			want = []string{"user:421:name=v-user:421:name", "user:42:email=v-user:42:email", "user:42:name=v-user:42:name"}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Scan(user:421, user:43:name) returned %q, want %q", got, want)
+			}
+
+			got = collectScan(t)(store.ScanPrefix("\xff"))
+			if want := []string{"\xff\xff=v-\xff\xff"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("ScanPrefix(0xFF) returned %q, want %q", got, want)
+			}
+
+			if got := collectScan(t)(store.Scan("", "")); len(got) != 6 {
+				t.Errorf("full Scan returned %d pairs, want 6", len(got))
+			}
+		})
+	}
+}
+
+func TestFileStore_ScanKeys(t *testing.T) {
+	advance := fakeClock(t)
+	for _, indexType := range []IndexType{INDEX_HASH, INDEX_ORDERED} {
+		t.Run(fmt.Sprintf("index-%d", indexType), func(t *testing.T) {
+			opts := smallSegmentOptions()
+			opts.IndexType = indexType
+			store, err := ConnectFileStoreWithOptions(t.TempDir(), opts)
+			if err != nil {
+				t.Fatalf("ConnectFileStoreWithOptions failed: %v", err)
+			}
+			defer store.Close()
+
+			for _, key := range []string{"a", "b", "c", "d", "e"} {
+				store.Put(key, "v-"+key)
+			}
+			store.Del("b")
+			store.PutWithTTL("c", "v-c", time.Second)
+			store.PutWithTTL("d", "v-d", time.Hour)
+			advance(time.Minute)
+
+			if got, err := store.ScanKeys("", "", 0); err != nil || !reflect.DeepEqual(got, []string{"a", "d", "e"}) {
+				t.Errorf("ScanKeys of every key returned (%q, %v), want a, d and e", got, err)
+			}
+			if got, err := store.ScanKeys("b", "e", 0); err != nil || !reflect.DeepEqual(got, []string{"d"}) {
+				t.Errorf("ScanKeys(b, e) returned (%q, %v), want d", got, err)
+			}
+			if got, err := store.ScanKeys("", "", 2); err != nil || !reflect.DeepEqual(got, []string{"a", "d"}) {
+				t.Errorf("ScanKeys with limit 2 returned (%q, %v), want a and d", got, err)
+			}
+
+			// The value isn't read, so a corrupt value doesn't stop the listing
+			store.mu.RLock()
+			segmentID, offset, _ := store.index.GetOffset("e")
+			path := store.segments[segmentID].fullpath
+			store.mu.RUnlock()
+			file, err := os.OpenFile(path, os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatalf("OpenFile failed: %v", err)
+			}
+			file.WriteAt([]byte("X"), offset+RECORD_HEADER_SIZE+int64(len("e")))
+			file.Close()
+			if _, err := store.Get("e"); err != ErrCorruptRecord {
+				t.Fatalf("Get(e) returned %v, want ErrCorruptRecord", err)
+			}
+			if got, err := store.ScanKeys("e", "", 0); err != nil || !reflect.DeepEqual(got, []string{"e"}) {
+				t.Errorf("ScanKeys(e) returned (%q, %v), want e", got, err)
+			}
+		})
+	}
+}
+
+func TestSkipListIndex_OrderedAfterUpdates(t *testing.T) {
+	index := NewSkipListIndex()
+	for i := 999; i >= 0; i-- {
+		index.Insert(fmt.Sprintf("key-%04d", i), 1, int64(i))
+	}
+	for i := 0; i < 1000; i += 3 {
+		index.Delete(fmt.Sprintf("key-%04d", i))
+	}
+	index.Insert("key-0001", 2, 7)
+
+	prev := ""
+	count := 0
+	index.ForEach(func(ko keyOffset) bool {
+		if ko.Key <= prev {
+			t.Fatalf("key %q follows %q", ko.Key, prev)
+		}
+		prev = ko.Key
+		count++
+		return true
+	})
+	if count != index.Len() || count != 666 {
+		t.Errorf("ForEach visited %d keys, Len is %d, want 666", count, index.Len())
+	}
+	if segmentID, offset, err := index.GetOffset("key-0001"); err != nil || segmentID != 2 || offset != 7 {
+		t.Errorf("GetOffset(key-0001) returned (%d, %d, %v), want (2, 7)", segmentID, offset, err)
+	}
+}
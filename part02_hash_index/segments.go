@@ -0,0 +1,168 @@
+package kvstorefromscratchpart2
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// listSegmentIDs returns the IDs of all files in dir with the given extension whose
+// name is a segment ID, sorted in increasing order. Other files are ignored.
+func listSegmentIDs(dir, ext string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(name, ext))
+		if err != nil || id <= 0 {
+			continue // Not a segment, e.g. PRIMARY_FILENAME or TEMP_FILENAME
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// migrateLegacyFile renames a PRIMARY_FILENAME written before the log was segmented
+// to segment 1, as long as no segments exist yet.
+func migrateLegacyFile(dir string, segmentIDs []int) ([]int, error) {
+	legacyPath := filepath.Join(dir, PRIMARY_FILENAME)
+	if _, err := os.Stat(legacyPath); os.IsNotExist(err) || len(segmentIDs) > 0 {
+		return segmentIDs, nil
+	}
+	if err := os.Rename(legacyPath, filepath.Join(dir, segmentFileName(1, SEGMENT_EXT))); err != nil {
+		return nil, err
+	}
+	return []int{1}, nil
+}
+
+// openSegments opens every segment in dir in increasing ID order. If there are none,
+// an empty segment 1 is created so there is always an active segment to write to.
+func openSegments(dir string) ([]*DataFile, error) {
+	ids, err := listSegmentIDs(dir, SEGMENT_EXT)
+	if err != nil {
+		return nil, err
+	}
+	ids, err = migrateLegacyFile(dir, ids)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		ids = []int{1}
+	}
+
+	segments := make([]*DataFile, 0, len(ids))
+	for _, id := range ids {
+		segment, err := NewDataFile(dir, id)
+		if err != nil {
+			closeSegments(segments)
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+func closeSegments(segments []*DataFile) {
+	for _, segment := range segments {
+		segment.Close()
+	}
+}
+
+// sortedSegments returns the store's segments in increasing ID order.
+func (f *FileStore) sortedSegments() []*DataFile {
+	segments := make([]*DataFile, 0, len(f.segments))
+	for _, segment := range f.segments {
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].id < segments[j].id })
+	return segments
+}
+
+// loadIndex rebuilds the index from the given segments, in increasing ID order. A sealed
+// segment is loaded from its hint file if it has a valid one; otherwise it is replayed in
+// full and a hint file is written for it so the next startup is faster. A torn tail of the
+// active segment is truncated (see truncateTornTail). The entries of the active segment are
+// kept so its hint file can be written when it is sealed.
+func (f *FileStore) loadIndex(segments []*DataFile) error {
+	for i, segment := range segments {
+		sealed := i < len(segments)-1
+		if sealed {
+			entries, err := readHintFile(f.dir, segment.id, segment.Size())
+			if err == nil {
+				loadFromHints(f.index, segment.id, entries)
+				continue
+			}
+		}
+
+		entries, goodSize, err := loadFromFile(f.index, segment)
+		if err != nil && !sealed {
+			err = f.truncateTornTail(segment, goodSize, err)
+		}
+		if err != nil {
+			return fmt.Errorf("replaying segment %d: %w", segment.id, err)
+		}
+		if sealed {
+			writeHintFile(f.dir, segment.id, segment.Size(), entries) // Best effort; replayed again next time if it fails
+		} else {
+			f.activeHints = entries
+		}
+	}
+	return nil
+}
+
+// addActiveHint records the hint entry for a record just appended to the active segment.
+func (f *FileStore) addActiveHint(data record, offset int64) {
+	f.activeHints = append(f.activeHints, newHintEntry(data, offset, f.active.Size()-offset))
+}
+
+// rollover seals the active segment, writes its hint file, and starts writing to a new,
+// empty segment. Unless the sync mode is SYNC_NEVER the sealed segment is fsynced first.
+func (f *FileStore) rollover() error {
+	if f.opts.SyncMode != SYNC_NEVER {
+		if err := f.syncActive(); err != nil {
+			return err
+		}
+	}
+	next, err := NewDataFile(f.dir, f.active.id+1)
+	if err != nil {
+		return err
+	}
+	next.compression = f.opts.compression()
+	writeHintFile(f.dir, f.active.id, f.active.Size(), f.activeHints) // Best effort; the segment is replayed in full if it's missing
+	f.segments[next.id] = next
+	for t := range f.tailers {
+		t.segments[next.id] = next
+	}
+	f.active = next
+	f.activeHints = nil
+	f.dirty = false
+	f.wakeTailers() // Tailers at the end of the sealed segment move on to the new one
+	return nil
+}
+
+// maybeRollover rolls over to a new segment once the active one reaches MaxSegmentSize.
+func (f *FileStore) maybeRollover() error {
+	if f.active.Size() < f.opts.MaxSegmentSize {
+		return nil
+	}
+	return f.rollover()
+}
+
+// diskSize returns the combined size in bytes of all segments.
+func (f *FileStore) diskSize() int64 {
+	var size int64
+	for _, segment := range f.segments {
+		size += segment.Size()
+	}
+	return size
+}
@@ -0,0 +1,170 @@
+package kvstorefromscratchpart2
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func smallSegmentOptions() Options {
+	opts := DefaultOptions()
+	opts.MaxSegmentSize = 1024
+	return opts
+}
+
+func TestFileStore_RollsOverSegments(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	store, err := ConnectFileStoreWithOptions(tmpDir, smallSegmentOptions())
+	if err != nil {
+		t.Fatalf("ConnectFileStoreWithOptions failed: %v", err)
+	}
+	if err := addNItemsToKVStore(store, 500); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i += 3 {
+		if err := store.Del(fmt.Sprintf("key-%d", i)); err != nil {
+			t.Fatalf("Del failed: %v", err)
+		}
+	}
+	if len(store.segments) < 10 {
+		t.Errorf("store has %d segments, want at least 10", len(store.segments))
+	}
+	for _, segment := range store.segments {
+		if segment.id != store.active.id && segment.Size() > 1024+64 {
+			t.Errorf("sealed segment %d is %d bytes, want about MaxSegmentSize", segment.id, segment.Size())
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	store, err = ConnectFileStoreWithOptions(tmpDir, smallSegmentOptions())
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 500; i++ {
+		got, err := getNthItemFromKVStore(store, i)
+		if i%3 == 0 {
+			if err == nil {
+				t.Errorf("key-%d returned %q after Del, want an error", i, got)
+			}
+			continue
+		}
+		if want := fmt.Sprintf("value-%d", i); err != nil || got != want {
+			t.Errorf("key-%d returned (%q, %v), want %q", i, got, err, want)
+		}
+	}
+}
+
+func TestFileStore_CompactMergesSealedSegments(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	store, err := ConnectFileStoreWithOptions(tmpDir, smallSegmentOptions())
+	if err != nil {
+		t.Fatalf("ConnectFileStoreWithOptions failed: %v", err)
+	}
+	defer store.Close()
+	for round := 0; round < 5; round++ {
+		if err := addNItemsToKVStore(store, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Del("key-7"); err != nil {
+		t.Fatalf("Del failed: %v", err)
+	}
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if len(store.segments) != 2 {
+		t.Errorf("store has %d segments after Compact, want the merged one and the active one", len(store.segments))
+	}
+	ids, err := listSegmentIDs(tmpDir, SEGMENT_EXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 {
+		t.Errorf("directory has segments %v after Compact, want 2", ids)
+	}
+	if _, err := store.Get("key-7"); err != ErrKeyDoesntExist {
+		t.Errorf("Get of deleted key returned %v, want ErrKeyDoesntExist", err)
+	}
+	if got, err := store.Get("key-8"); err != nil || got != "value-8" {
+		t.Errorf("Get(key-8) returned (%q, %v), want value-8", got, err)
+	}
+}
+
+func TestConnectFileStore_MigratesLegacyFile(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	legacy := record{operation: OPERATION_PUT, data: KVPair{key: "foo", val: "bar"}}
+	encoded, err := legacy.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, PRIMARY_FILENAME), encoded, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+	if got, err := store.Get("foo"); err != nil || got != "bar" {
+		t.Errorf("Get(foo) returned (%q, %v), want bar", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, segmentFileName(1, SEGMENT_EXT))); err != nil {
+		t.Errorf("legacy file was not migrated to segment 1: %v", err)
+	}
+}
+
+func TestConnectFileStore_FinishesCommittedCompaction(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	put := func(id int, recs ...record) {
+		t.Helper()
+		var data []byte
+		for _, rec := range recs {
+			encoded, err := rec.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = append(data, encoded...)
+		}
+		if err := os.WriteFile(filepath.Join(tmpDir, segmentFileName(id, SEGMENT_EXT)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Segment 1 has a key that segment 2 deletes; the compacted output for 2 only keeps "b".
+	put(1, record{operation: OPERATION_PUT, data: KVPair{key: "a", val: "1"}})
+	put(2, record{operation: OPERATION_DEL, data: KVPair{key: "a"}}, record{operation: OPERATION_PUT, data: KVPair{key: "b", val: "2"}})
+	put(3, record{operation: OPERATION_PUT, data: KVPair{key: "c", val: "3"}})
+	compacted, err := (&record{operation: OPERATION_PUT, data: KVPair{key: "b", val: "2"}}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, segmentFileName(2, COMPACTED_EXT)), compacted, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+
+	if _, err := store.Get("a"); err != ErrKeyDoesntExist {
+		t.Errorf("Get(a) returned %v, want ErrKeyDoesntExist", err)
+	}
+	for key, want := range map[string]string{"b": "2", "c": "3"} {
+		if got, err := store.Get(key); err != nil || got != want {
+			t.Errorf("Get(%q) returned (%q, %v), want %q", key, got, err, want)
+		}
+	}
+	if ids, _ := listSegmentIDs(tmpDir, SEGMENT_EXT); len(ids) != 2 || ids[0] != 2 || ids[1] != 3 {
+		t.Errorf("segments after recovery are %v, want [2 3]", ids)
+	}
+}
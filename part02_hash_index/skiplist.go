@@ -0,0 +1,209 @@
+package kvstorefromscratchpart2
+
+import (
+	"math/rand/v2"
+	"sync"
+)
+
+const (
+	SKIPLIST_MAX_LEVEL = 32
+	SKIPLIST_P         = 0.25 // Probability that a node is promoted to the next level
+)
+
+// skipListIndex is an ordered alternative to hashIndex. Keys are kept sorted in a skip
+// list, so point lookups cost O(log n) instead of O(1), but range scans walk the keys in
+// order without sorting them first. It is safe for concurrent use.
+type skipListIndex struct {
+	mu    sync.RWMutex
+	head  *skipListNode // Sentinel; its entry is unused
+	level int           // Number of levels currently in use
+	count int
+}
+
+type skipListNode struct {
+	entry keyOffset
+	next  []*skipListNode // next[i] is the following node on level i
+}
+
+// NewSkipListIndex creates an empty skipListIndex.
+func NewSkipListIndex() *skipListIndex {
+	return &skipListIndex{
+		head:  &skipListNode{next: make([]*skipListNode, SKIPLIST_MAX_LEVEL)},
+		level: 1,
+	}
+}
+
+// findPredecessors fills update with the last node before key on every level and returns
+// the first node whose key is >= key, or nil.
+func (sl *skipListIndex) findPredecessors(key string, update *[SKIPLIST_MAX_LEVEL]*skipListNode) *skipListNode {
+	node := sl.head
+	for level := sl.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].entry.Key < key {
+			node = node.next[level]
+		}
+		if update != nil {
+			update[level] = node
+		}
+	}
+	return node.next[0]
+}
+
+// find returns the node holding key, or nil.
+func (sl *skipListIndex) find(key string) *skipListNode {
+	node := sl.findPredecessors(key, nil)
+	if node != nil && node.entry.Key == key {
+		return node
+	}
+	return nil
+}
+
+// Insert adds a key and the location of its latest record to the index.
+// If the key already exists, its location is updated.
+func (sl *skipListIndex) Insert(key string, segmentID int, offset int64) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	var update [SKIPLIST_MAX_LEVEL]*skipListNode
+	node := sl.findPredecessors(key, &update)
+	if node != nil && node.entry.Key == key {
+		node.entry.SegmentID = segmentID
+		node.entry.Offset = offset
+		return
+	}
+
+	level := randomLevel()
+	for ; sl.level < level; sl.level++ {
+		update[sl.level] = sl.head
+	}
+	node = &skipListNode{
+		entry: keyOffset{Key: key, SegmentID: segmentID, Offset: offset},
+		next:  make([]*skipListNode, level),
+	}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	sl.count++
+}
+
+// randomLevel picks the number of levels for a new node: 1, promoted to each further
+// level with probability SKIPLIST_P.
+func randomLevel() int {
+	level := 1
+	for level < SKIPLIST_MAX_LEVEL && rand.Float64() < SKIPLIST_P {
+		level++
+	}
+	return level
+}
+
+// GetOffset returns the segment ID and offset of the latest record of key,
+// or -1, -1 and ErrKeyDoesntExist if the key is not in the index.
+func (sl *skipListIndex) GetOffset(key string) (int, int64, error) {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+
+	node := sl.find(key)
+	if node == nil {
+		return -1, -1, ErrKeyDoesntExist
+	}
+	return node.entry.SegmentID, node.entry.Offset, nil
+}
+
+// Relocate moves key to a new location, but only if its latest record is still the one at
+// (fromSegmentID, fromOffset). It reports whether the key was moved.
+func (sl *skipListIndex) Relocate(key string, fromSegmentID int, fromOffset int64, toSegmentID int, toOffset int64) bool {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	node := sl.find(key)
+	if node == nil || node.entry.SegmentID != fromSegmentID || node.entry.Offset != fromOffset {
+		return false
+	}
+	node.entry.SegmentID = toSegmentID
+	node.entry.Offset = toOffset
+	return true
+}
+
+// Delete removes the key from the index. If the key does not exist, it's a no-op.
+func (sl *skipListIndex) Delete(key string) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	var update [SKIPLIST_MAX_LEVEL]*skipListNode
+	node := sl.findPredecessors(key, &update)
+	if node == nil || node.entry.Key != key {
+		return
+	}
+	sl.unlink(node, &update)
+}
+
+// DeleteIfAt removes key, but only if its latest record is still the one at
+// (segmentID, offset). It reports whether the key was removed.
+func (sl *skipListIndex) DeleteIfAt(key string, segmentID int, offset int64) bool {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	var update [SKIPLIST_MAX_LEVEL]*skipListNode
+	node := sl.findPredecessors(key, &update)
+	if node == nil || node.entry.Key != key || node.entry.SegmentID != segmentID || node.entry.Offset != offset {
+		return false
+	}
+	sl.unlink(node, &update)
+	return true
+}
+
+// unlink removes node, whose predecessors on every level are in update.
+// Callers hold the write lock.
+func (sl *skipListIndex) unlink(node *skipListNode, update *[SKIPLIST_MAX_LEVEL]*skipListNode) {
+	for i := range node.next {
+		update[i].next[i] = node.next[i]
+	}
+	for sl.level > 1 && sl.head.next[sl.level-1] == nil {
+		sl.level--
+	}
+	sl.count--
+}
+
+// Len returns the number of keys in the index.
+func (sl *skipListIndex) Len() int {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+	return sl.count
+}
+
+// ForEach calls fn for every key in the index, in increasing key order.
+// Iteration stops early if fn returns false. The index is read locked for the
+// whole iteration, so fn must be quick and must not modify the index.
+func (sl *skipListIndex) ForEach(fn func(ko keyOffset) bool) {
+	sl.Ascend("", "", fn)
+}
+
+// Ascend calls fn for every key in [start, end) in increasing key order; an empty end
+// means no upper bound. The index is read locked for the whole iteration, so fn must be
+// quick and must not modify the index.
+func (sl *skipListIndex) Ascend(start, end string, fn func(ko keyOffset) bool) {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+
+	for node := sl.findPredecessors(start, nil); node != nil; node = node.next[0] {
+		if end != "" && node.entry.Key >= end {
+			return
+		}
+		if !fn(node.entry) {
+			return
+		}
+	}
+}
+
+// snapshot copies the entries, in order, into a read-only sortedView. Nodes are updated in
+// place, so unlike the hashIndex the skip list can't share them with a snapshot.
+func (sl *skipListIndex) snapshot() indexView {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+
+	entries := make(sortedView, 0, sl.count)
+	for node := sl.head.next[0]; node != nil; node = node.next[0] {
+		entries = append(entries, node.entry)
+	}
+	return entries
+}
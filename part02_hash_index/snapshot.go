@@ -0,0 +1,204 @@
+package kvstorefromscratchpart2
+
+import (
+	"errors"
+	"sort"
+)
+
+var ErrSnapshotClosed = errors.New("snapshot is closed")
+
+// Snapshot is a read-only, point-in-time view of a FileStore. Its Gets and scans see the
+// store exactly as it was when the snapshot was taken, while writes to the store continue.
+// A WriteBatch is either entirely visible or not at all. Keys that had expired when the
+// snapshot was taken are not visible, and later expiries don't affect it.
+//
+// A snapshot pins the segments it reads from, so Compact doesn't reclaim them until the
+// snapshot is closed. Long-lived snapshots therefore hold on to disk space; close them
+// as soon as they are no longer needed. A Snapshot is safe for concurrent use.
+type Snapshot struct {
+	store    *FileStore
+	index    indexView         // The store's index at the time of the snapshot
+	segments map[int]*DataFile // The segments the index refers to
+	now      int64             // Time of the snapshot, for expiry checks (Unix nanoseconds)
+	closed   bool              // Guarded by store.mu
+
+	activeSegmentID int   // Segment that was being appended to
+	activeSize      int64 // Its size: the snapshot covers the log up to this offset
+
+	compacted   int // The store's compaction state, see COMPACTION_STATE_FILENAME
+	compactions int
+}
+
+// Snapshot returns a consistent, read-only view of the store as it is now. Taking a
+// snapshot doesn't copy any records. The hash index shares its buckets with the snapshot
+// and copies each one the first time it changes afterwards, while the ordered index is
+// copied as a whole. The snapshot must be released with Close.
+func (f *FileStore) Snapshot() (*Snapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, ErrStoreClosed
+	}
+
+	snap := &Snapshot{
+		store:           f,
+		index:           f.index.snapshot(),
+		segments:        make(map[int]*DataFile, len(f.segments)),
+		now:             timeNow().UnixNano(),
+		activeSegmentID: f.active.id,
+		activeSize:      f.active.Size(),
+		compacted:       f.compacted,
+		compactions:     f.compactions,
+	}
+	for id, segment := range f.segments {
+		snap.segments[id] = segment
+	}
+	f.snapshots[snap] = struct{}{}
+	return snap, nil
+}
+
+// Get returns the value the key had when the snapshot was taken, or ErrKeyDoesntExist.
+func (s *Snapshot) Get(K string) (string, error) {
+	s.store.mu.RLock()
+	defer s.store.mu.RUnlock()
+	if err := s.checkOpen(); err != nil {
+		return "", err
+	}
+
+	segmentID, offset, err := s.index.GetOffset(K)
+	if err != nil {
+		return "", err
+	}
+	recordRead, err := s.segments[segmentID].ReadRecordAt(offset)
+	if err != nil {
+		return "", err
+	}
+	if recordRead.isExpired(s.now) {
+		return "", ErrKeyDoesntExist
+	}
+	return recordRead.GetValue(), nil
+}
+
+// Scan returns an iterator over the keys in [start, end) as of the snapshot, in increasing
+// key order. An empty end means no upper bound.
+func (s *Snapshot) Scan(start, end string) (Iterator, error) {
+	s.store.mu.RLock()
+	defer s.store.mu.RUnlock()
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	s.index.Ascend(start, end, func(ko keyOffset) bool {
+		keys = append(keys, ko.Key)
+		return true
+	})
+	return &ScanIterator{get: s.Get, keys: keys}, nil
+}
+
+// ScanPrefix returns an iterator over the keys starting with prefix as of the snapshot,
+// in increasing key order.
+func (s *Snapshot) ScanPrefix(prefix string) (Iterator, error) {
+	return s.Scan(prefix, PrefixEnd(prefix))
+}
+
+// Close releases the snapshot. Segments that Compact replaced while the snapshot was open
+// are closed once no other snapshot needs them. Closing a snapshot twice is a no-op.
+func (s *Snapshot) Close() error {
+	f := s.store
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	delete(f.snapshots, s)
+	f.closeUnpinned()
+	return nil
+}
+
+// checkOpen returns an error if the snapshot or its store is closed. Callers hold store.mu.
+func (s *Snapshot) checkOpen() error {
+	if s.store.closed {
+		return ErrStoreClosed
+	}
+	if s.closed {
+		return ErrSnapshotClosed
+	}
+	return nil
+}
+
+// retireSegment closes a segment that is no longer part of the store, or if a snapshot or
+// log tailer still reads from it, defers that until they are closed. Callers hold the
+// write lock.
+func (f *FileStore) retireSegment(segment *DataFile) {
+	if f.isPinned(segment) {
+		f.retired = append(f.retired, segment)
+		return
+	}
+	segment.Close()
+}
+
+// closeUnpinned closes the retired segments that no snapshot or log tailer reads from
+// anymore. Callers hold the write lock.
+func (f *FileStore) closeUnpinned() {
+	var stillPinned []*DataFile
+	for _, segment := range f.retired {
+		if f.isPinned(segment) {
+			stillPinned = append(stillPinned, segment)
+		} else {
+			segment.Close()
+		}
+	}
+	f.retired = stillPinned
+}
+
+// isPinned reports whether an open snapshot or log tailer reads from segment. Callers
+// hold mu.
+func (f *FileStore) isPinned(segment *DataFile) bool {
+	for snap := range f.snapshots {
+		if snap.segments[segment.id] == segment {
+			return true
+		}
+	}
+	for t := range f.tailers {
+		if t.segments[segment.id] == segment {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedView is a read-only index over entries sorted by key, used to snapshot the
+// skipListIndex.
+type sortedView []keyOffset
+
+func (sv sortedView) search(key string) int {
+	return sort.Search(len(sv), func(i int) bool { return sv[i].Key >= key })
+}
+
+func (sv sortedView) GetOffset(key string) (int, int64, error) {
+	if i := sv.search(key); i < len(sv) && sv[i].Key == key {
+		return sv[i].SegmentID, sv[i].Offset, nil
+	}
+	return -1, -1, ErrKeyDoesntExist
+}
+
+func (sv sortedView) Len() int {
+	return len(sv)
+}
+
+func (sv sortedView) ForEach(fn func(ko keyOffset) bool) {
+	sv.Ascend("", "", fn)
+}
+
+func (sv sortedView) Ascend(start, end string, fn func(ko keyOffset) bool) {
+	for _, ko := range sv[sv.search(start):] {
+		if end != "" && ko.Key >= end {
+			return
+		}
+		if !fn(ko) {
+			return
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package kvstorefromscratchpart2
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSnapshot_IsolatedFromLaterWrites(t *testing.T) {
+	for _, indexType := range []IndexType{INDEX_HASH, INDEX_ORDERED} {
+		t.Run(fmt.Sprint(indexType), func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.IndexType = indexType
+			store, err := ConnectFileStoreWithOptions(t.TempDir(), opts)
+			if err != nil {
+				t.Fatalf("ConnectFileStore failed: %v", err)
+			}
+			defer store.Close()
+
+			store.Put("a", "1")
+			store.Put("b", "2")
+			snap, err := store.Snapshot()
+			if err != nil {
+				t.Fatalf("Snapshot failed: %v", err)
+			}
+			defer snap.Close()
+
+			store.Put("a", "changed")
+			store.Del("b")
+			store.Put("c", "3")
+			// Enough new keys to make the hash index grow
+			if err := addNItemsToKVStore(store, 2*INITIAL_INDEX_BUCKETS); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+
+			for key, want := range map[string]string{"a": "1", "b": "2"} {
+				if got, err := snap.Get(key); err != nil || got != want {
+					t.Errorf("snapshot Get(%q) returned (%q, %v), want %q", key, got, err, want)
+				}
+			}
+			if _, err := snap.Get("c"); err != ErrKeyDoesntExist {
+				t.Errorf("snapshot Get(c) returned %v, want ErrKeyDoesntExist", err)
+			}
+			if got, err := store.Get("a"); err != nil || got != "changed" {
+				t.Errorf("store Get(a) returned (%q, %v), want changed", got, err)
+			}
+
+			got := collectScan(t)(snap.Scan("", ""))
+			want := []string{"a=1", "b=2"}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("snapshot Scan returned %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSnapshot_SurvivesCompaction(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	store, err := ConnectFileStoreWithOptions(tmpDir, smallSegmentOptions())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 50; i++ {
+		store.Put("key-"+strconv.Itoa(i), "old-"+strconv.Itoa(i))
+	}
+	snap, err := store.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		store.Put("key-"+strconv.Itoa(i), "new-"+strconv.Itoa(i))
+	}
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	store.mu.RLock()
+	retired := len(store.retired)
+	store.mu.RUnlock()
+	if retired == 0 {
+		t.Fatalf("Compact closed segments that an open snapshot reads from")
+	}
+	for i := 0; i < 50; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if got, err := snap.Get(key); err != nil || got != "old-"+strconv.Itoa(i) {
+			t.Errorf("snapshot Get(%q) after Compact returned (%q, %v)", key, got, err)
+		}
+		if got, err := store.Get(key); err != nil || got != "new-"+strconv.Itoa(i) {
+			t.Errorf("store Get(%q) after Compact returned (%q, %v)", key, got, err)
+		}
+	}
+
+	if err := snap.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if len(store.retired) != 0 {
+		t.Errorf("%d retired segments still open after the snapshot was closed", len(store.retired))
+	}
+	if _, err := snap.Get("key-1"); err != ErrSnapshotClosed {
+		t.Errorf("Get on a closed snapshot returned %v, want ErrSnapshotClosed", err)
+	}
+	if err := snap.Close(); err != nil {
+		t.Errorf("second Close returned %v", err)
+	}
+}
+
+func TestSnapshot_ExpiryAsOfSnapshot(t *testing.T) {
+	advance := fakeClock(t)
+
+	store, err := ConnectFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+	store.PutWithTTL("session", "token", time.Minute)
+	snap, err := store.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	defer snap.Close()
+
+	advance(time.Hour)
+	if got, err := snap.Get("session"); err != nil || got != "token" {
+		t.Errorf("snapshot Get returned (%q, %v), want token", got, err)
+	}
+	if _, err := store.Get("session"); err != ErrKeyDoesntExist {
+		t.Errorf("store Get returned %v, want ErrKeyDoesntExist", err)
+	}
+}
+
+func TestSnapshot_SeesWholeBatches(t *testing.T) {
+	store, err := ConnectFileStoreWithOptions(t.TempDir(), smallSegmentOptions())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			batch := NewWriteBatch()
+			batch.Put("from", strconv.Itoa(-i))
+			batch.Put("to", strconv.Itoa(i))
+			if err := store.Write(batch); err != nil {
+				t.Errorf("Write failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		snap, err := store.Snapshot()
+		if err != nil {
+			t.Fatalf("Snapshot failed: %v", err)
+		}
+		from, errFrom := snap.Get("from")
+		to, errTo := snap.Get("to")
+		if errFrom == nil && errTo == nil && from != "-"+to && !(from == "0" && to == "0") {
+			t.Errorf("snapshot saw half a batch: from=%s to=%s", from, to)
+		}
+		snap.Close()
+		if i%50 == 0 {
+			if err := store.Compact(); err != nil {
+				t.Fatalf("Compact failed: %v", err)
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,29 @@
+package kvstorefromscratchpart2
+
+// Stats is a summary of the state of a store, as returned by FileStore.Stats.
+type Stats struct {
+	Keys            int       // Number of live keys in the index
+	Segments        int       // Number of segment files, including the active one
+	ActiveSegmentID int       // Segment that new records are appended to
+	ActiveSize      int64     // Size in bytes of the active segment
+	DiskSize        int64     // Combined size in bytes of all segments
+	IndexType       IndexType // Index selected when the store was opened
+}
+
+// Stats returns the current Stats of the store.
+func (f *FileStore) Stats() (Stats, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return Stats{}, ErrStoreClosed
+	}
+
+	return Stats{
+		Keys:            f.index.Len(),
+		Segments:        len(f.segments),
+		ActiveSegmentID: f.active.id,
+		ActiveSize:      f.active.Size(),
+		DiskSize:        f.diskSize(),
+		IndexType:       f.opts.IndexType,
+	}, nil
+}
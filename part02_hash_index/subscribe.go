@@ -0,0 +1,167 @@
+package kvstorefromscratchpart2
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrSubscriptionClosed = errors.New("subscription is closed")
+
+// ChangeEvent is a PUT or DEL that was committed to the log, as delivered by a
+// Subscription.
+type ChangeEvent struct {
+	Operation string // OPERATION_PUT or OPERATION_DEL
+	Key       string
+	Value     string    // Empty unless Operation is OPERATION_PUT
+	ExpiresAt time.Time // Zero unless the PUT was written with PutWithTTL
+	Position  LogPosition
+
+	// Resume is where to Subscribe from to continue after this event. For the events of
+	// a WriteBatch it is the start of the batch, except for the last one, so the batch is
+	// delivered again as a whole.
+	Resume LogPosition
+}
+
+// Subscription delivers the changes made to a store in log order, see Subscribe.
+type Subscription struct {
+	tailer *logTailer
+
+	mu         sync.Mutex // Held by Next
+	closed     bool
+	batch      []ChangeEvent // Events of the batch being read, nil outside of a batch
+	batchStart LogPosition
+	ready      []ChangeEvent // Events of a committed batch not delivered yet
+
+	done   context.Context // Done once the subscription is closed
+	cancel context.CancelFunc
+}
+
+// Subscribe returns a Subscription to every PUT and DEL in the log from the position from
+// onwards: first the history that is already in the log, then new writes as they are
+// appended. The zero LogPosition starts at the beginning of the log and LogEnd only
+// delivers new writes. The events of a WriteBatch are delivered once its commit marker
+// has been read, so a batch is never seen partially.
+//
+// Events are read from the log on demand, never buffered in memory beyond a single batch,
+// so a slow consumer only falls behind and doesn't hold up writers. While it is behind, it
+// pins the segments it hasn't read yet, so Compact can't reclaim their disk space.
+//
+// History that Compact has rewritten is gone: if from points into a compacted segment,
+// Subscribe returns an error wrapping ErrPositionLost. The subscription must be released
+// with Close.
+func (f *FileStore) Subscribe(from LogPosition) (*Subscription, error) {
+	t, err := f.newLogTailer(from)
+	if err != nil {
+		return nil, err
+	}
+	s := &Subscription{tailer: t}
+	s.done, s.cancel = context.WithCancel(context.Background())
+	return s, nil
+}
+
+// LogEnd returns the position right after the last record in the log.
+func (f *FileStore) LogEnd() (LogPosition, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return LogPosition{}, ErrStoreClosed
+	}
+	return LogPosition{SegmentID: f.active.id, Offset: f.active.Size(), Compactions: f.compactions}, nil
+}
+
+// Next returns the next change, waiting for one to be written if the subscription has
+// caught up with the log. It returns ctx's error if ctx is done first, and
+// ErrSubscriptionClosed once the subscription is closed.
+func (s *Subscription) Next(ctx context.Context) (ChangeEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if s.closed {
+			return ChangeEvent{}, ErrSubscriptionClosed
+		}
+		if len(s.ready) > 0 {
+			event := s.ready[0]
+			s.ready = s.ready[1:]
+			return event, nil
+		}
+
+		rec, pos, _, ok, err := s.tailer.next()
+		if err != nil {
+			return ChangeEvent{}, err
+		}
+		if !ok {
+			if err := s.wait(ctx); err != nil {
+				return ChangeEvent{}, err
+			}
+			continue
+		}
+		if s.batch != nil && pos.SegmentID != s.batchStart.SegmentID {
+			s.batch = nil // A batch never spans segments, so this one was never committed
+		}
+
+		switch rec.operation {
+		case OPERATION_BATCH_BEGIN:
+			s.batch, s.batchStart = []ChangeEvent{}, pos
+		case OPERATION_BATCH_COMMIT:
+			if s.batch == nil {
+				continue // Commit without a begin; replay skips it as well
+			}
+			if n := len(s.batch); n > 0 {
+				s.batch[n-1].Resume = s.tailer.pos
+			}
+			s.ready, s.batch = s.batch, nil
+		default:
+			event := newChangeEvent(rec, pos, s.tailer.pos)
+			if s.batch == nil {
+				return event, nil
+			}
+			event.Resume = s.batchStart
+			s.batch = append(s.batch, event)
+		}
+	}
+}
+
+// wait blocks until the log may have grown, ctx is done or the subscription is closed.
+func (s *Subscription) wait(ctx context.Context) error {
+	waitCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(s.done, cancel)
+	defer stop()
+
+	err := s.tailer.wait(waitCtx)
+	if err != nil && ctx.Err() == nil && s.done.Err() != nil {
+		return ErrSubscriptionClosed
+	}
+	return err
+}
+
+// Close releases the subscription and the segments it pinned. It may be called while
+// another goroutine waits in Next, which then returns ErrSubscriptionClosed. Closing a
+// subscription twice is a no-op.
+func (s *Subscription) Close() error {
+	s.cancel() // Wakes up Next so it releases mu
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.tailer.close()
+	}
+	return nil
+}
+
+func newChangeEvent(rec record, pos, resume LogPosition) ChangeEvent {
+	event := ChangeEvent{
+		Operation: rec.operation,
+		Key:       rec.data.key,
+		Value:     rec.data.val,
+		Position:  pos,
+		Resume:    resume,
+	}
+	if rec.expiresAt != 0 {
+		event.ExpiresAt = time.Unix(0, rec.expiresAt)
+	}
+	return event
+}
@@ -0,0 +1,153 @@
+package kvstorefromscratchpart2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// nextEvents reads n events from sub and formats them as "op key=value".
+func nextEvents(t *testing.T, sub *Subscription, n int) ([]string, []ChangeEvent) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var got []string
+	var events []ChangeEvent
+	for i := 0; i < n; i++ {
+		event, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatalf("Next failed after %v: %v", got, err)
+		}
+		got = append(got, fmt.Sprintf("%s %s=%s", event.Operation, event.Key, event.Value))
+		events = append(events, event)
+	}
+	return got, events
+}
+
+func TestSubscribe_ReplaysHistoryThenStreams(t *testing.T) {
+	store, err := ConnectFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+
+	store.Put("a", "1")
+	store.Del("a")
+	batch := NewWriteBatch()
+	batch.Put("b", "2")
+	batch.Put("c", "3")
+	if err := store.Write(batch); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	sub, err := store.Subscribe(LogPosition{})
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer sub.Close()
+	got, events := nextEvents(t, sub, 4)
+	want := []string{"PUT a=1", "DEL a=", "PUT b=2", "PUT c=3"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("history is %v, want %v", got, want)
+	}
+	if events[2].Resume != events[1].Resume || events[3].Resume == events[2].Resume {
+		t.Errorf("batch events resume at %v and %v, want the start of the batch and the end of it", events[2].Resume, events[3].Resume)
+	}
+
+	// Live writes, including one made while Next is waiting
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		store.PutWithTTL("d", "4", time.Hour)
+	}()
+	_, live := nextEvents(t, sub, 1)
+	if live[0].Key != "d" || live[0].ExpiresAt.IsZero() {
+		t.Errorf("live event is %+v, want d with an expiry", live[0])
+	}
+	end, err := store.LogEnd()
+	if err != nil {
+		t.Fatalf("LogEnd failed: %v", err)
+	}
+	if live[0].Resume != end {
+		t.Errorf("last event resumes at %v, want the end of the log %v", live[0].Resume, end)
+	}
+
+	// Resuming after the first event of the batch delivers the whole batch again
+	resumed, err := store.Subscribe(events[2].Resume)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer resumed.Close()
+	got, _ = nextEvents(t, resumed, 3)
+	want = []string{"PUT b=2", "PUT c=3", "PUT d=4"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("resumed subscription delivered %v, want %v", got, want)
+	}
+}
+
+func TestSubscribe_SlowConsumer(t *testing.T) {
+	store, err := ConnectFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+	store.opts.MaxSegmentSize = 1024
+
+	end, err := store.LogEnd()
+	if err != nil {
+		t.Fatalf("LogEnd failed: %v", err)
+	}
+	sub, err := store.Subscribe(end)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer sub.Close()
+
+	// Writers aren't held up by a subscriber that doesn't read, even across rollovers
+	// and a compaction of the segments it hasn't read yet
+	if err := addNItemsToKVStore(store, 200); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	got, _ := nextEvents(t, sub, 200)
+	if got[0] != "PUT key-0=value-0" || got[199] != "PUT key-199=value-199" {
+		t.Errorf("events run from %q to %q, want key-0 to key-199", got[0], got[199])
+	}
+}
+
+func TestSubscribe_NextStops(t *testing.T) {
+	store, err := ConnectFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+
+	sub, err := store.Subscribe(LogPosition{})
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := sub.Next(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Next returned %v, want context.DeadlineExceeded", err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		sub.Close()
+	}()
+	if _, err := sub.Next(context.Background()); err != ErrSubscriptionClosed {
+		t.Errorf("Next returned %v, want ErrSubscriptionClosed", err)
+	}
+
+	store.Put("a", "1")
+	store.Compact()
+	store.Put("b", "2")
+	store.Compact()
+	if _, err := store.Subscribe(LogPosition{SegmentID: 1, Offset: 1}); !errors.Is(err, ErrPositionLost) {
+		t.Errorf("Subscribe into a compacted segment returned %v, want ErrPositionLost", err)
+	}
+}
@@ -0,0 +1,76 @@
+package kvstorefromscratchpart2
+
+import (
+	"time"
+)
+
+// Sync fsyncs the active segment, making every write acknowledged so far durable.
+// Sealed segments are already synced when they are sealed.
+func (f *FileStore) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return ErrStoreClosed
+	}
+	return f.syncActive()
+}
+
+// syncActive fsyncs the active segment if it has unsynced writes. Callers hold f.mu.
+func (f *FileStore) syncActive() error {
+	if !f.dirty {
+		return nil
+	}
+	if err := f.active.Sync(); err != nil {
+		return err
+	}
+	f.dirty = false
+	return nil
+}
+
+// afterAppend applies the sync policy once a record has been appended. Callers hold f.mu.
+func (f *FileStore) afterAppend() error {
+	f.dirty = true
+	f.wakeTailers()
+	if f.opts.SyncMode == SYNC_ALWAYS {
+		return f.syncActive()
+	}
+	return nil
+}
+
+// startSyncLoop starts the background goroutine used by SYNC_INTERVAL mode.
+// It runs until stopSyncLoop is called.
+func (f *FileStore) startSyncLoop() {
+	if f.opts.SyncMode != SYNC_INTERVAL {
+		return
+	}
+	f.stopSync = make(chan struct{})
+	f.syncDone = make(chan struct{})
+	go func() {
+		defer close(f.syncDone)
+		ticker := time.NewTicker(f.opts.SyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				f.mu.Lock()
+				if !f.closed {
+					f.syncActive() // A failed sync leaves the segment dirty, so it's retried next tick
+				}
+				f.mu.Unlock()
+			case <-f.stopSync:
+				return
+			}
+		}
+	}()
+}
+
+// stopSyncLoop stops the background sync goroutine and waits for it to exit.
+// It must be called without holding f.mu.
+func (f *FileStore) stopSyncLoop() {
+	if f.stopSync == nil {
+		return
+	}
+	close(f.stopSync)
+	<-f.syncDone
+	f.stopSync = nil
+}
@@ -0,0 +1,30 @@
+package kvstorefromscratchpart2
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrInvalidTTL = errors.New("ttl must be positive")
+
+// timeNow is the clock used for expiry checks; tests replace it to move time forward.
+var timeNow = time.Now
+
+// PutWithTTL stores the key like Put, but the value stops being visible once ttl has
+// elapsed: Get then returns ErrKeyDoesntExist, a replay on open skips the record and
+// Compact drops it from disk.
+//
+// The expiry is stored in the record as an absolute timestamp, so it survives restarts
+// and is not extended by them.
+func (f *FileStore) PutWithTTL(K, V string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+
+	dataToAppend := record{
+		operation: OPERATION_PUT,
+		data:      KVPair{key: K, val: V},
+		expiresAt: timeNow().Add(ttl).UnixNano(),
+	}
+	return f.put(dataToAppend)
+}
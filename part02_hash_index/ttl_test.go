@@ -0,0 +1,146 @@
+package kvstorefromscratchpart2
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeClock replaces timeNow for the duration of the test and returns a function that
+// moves it forward.
+func fakeClock(t *testing.T) func(time.Duration) {
+	t.Helper()
+	now := time.Unix(1700000000, 0)
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = time.Now })
+	return func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestFileStore_PutWithTTL(t *testing.T) {
+	advance := fakeClock(t)
+	tmpDir := t.TempDir()
+
+	store, err := ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.PutWithTTL("session", "token", 0); err != ErrInvalidTTL {
+		t.Errorf("PutWithTTL with zero ttl returned %v, want ErrInvalidTTL", err)
+	}
+	if err := store.Put("session", "old"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.PutWithTTL("session", "token", time.Minute); err != nil {
+		t.Fatalf("PutWithTTL failed: %v", err)
+	}
+
+	if got, err := store.Get("session"); err != nil || got != "token" {
+		t.Errorf("Get before expiry returned (%q, %v), want token", got, err)
+	}
+	advance(time.Minute)
+	if _, err := store.Get("session"); err != ErrKeyDoesntExist {
+		t.Errorf("Get after expiry returned %v, want ErrKeyDoesntExist", err)
+	}
+
+	// A plain Put clears the expiry
+	if err := store.Put("session", "forever"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	advance(time.Hour)
+	if got, err := store.Get("session"); err != nil || got != "forever" {
+		t.Errorf("Get after overwrite returned (%q, %v), want forever", got, err)
+	}
+}
+
+func TestFileStore_TTLSurvivesReopen(t *testing.T) {
+	advance := fakeClock(t)
+	tmpDir := t.TempDir()
+
+	store, err := ConnectFileStoreWithOptions(tmpDir, smallSegmentOptions())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	if err := store.Put("short", "old"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.PutWithTTL("short", "v", time.Second); err != nil {
+		t.Fatalf("PutWithTTL failed: %v", err)
+	}
+	if err := store.PutWithTTL("long", "v", time.Hour); err != nil {
+		t.Fatalf("PutWithTTL failed: %v", err)
+	}
+	// Push the records into a sealed segment so the reopen goes through its hint file
+	for store.active.id == 1 {
+		if err := store.Put("filler", "value"); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	advance(time.Minute)
+	for _, name := range []string{"hint", "replay"} {
+		store, err := ConnectFileStoreWithOptions(tmpDir, smallSegmentOptions())
+		if err != nil {
+			t.Fatalf("ConnectFileStore (%s) failed: %v", name, err)
+		}
+		// The expired PUT must hide the older value instead of resurrecting it
+		if _, err := store.Get("short"); err != ErrKeyDoesntExist {
+			t.Errorf("Get(short) after %s returned %v, want ErrKeyDoesntExist", name, err)
+		}
+		if got, err := store.Get("long"); err != nil || got != "v" {
+			t.Errorf("Get(long) after %s returned (%q, %v), want v", name, got, err)
+		}
+		if store.index.Len() != 2 {
+			t.Errorf("index has %d keys after %s, want 2", store.index.Len(), name)
+		}
+		store.Close()
+
+		hints, _ := filepath.Glob(filepath.Join(tmpDir, "*"+HINT_EXT))
+		for _, hint := range hints {
+			os.Remove(hint)
+		}
+	}
+}
+
+func TestFileStore_CompactDropsExpiredRecords(t *testing.T) {
+	advance := fakeClock(t)
+	tmpDir := t.TempDir()
+
+	store, err := ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.PutWithTTL("cache", "value", time.Second); err != nil {
+		t.Fatalf("PutWithTTL failed: %v", err)
+	}
+	if err := store.Put("kept", "value"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	advance(time.Second)
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	if store.index.Len() != 1 {
+		t.Errorf("index has %d keys after Compact, want 1", store.index.Len())
+	}
+	var keys []string
+	iterator, err := store.segments[1].GetIterator(0)
+	if err != nil {
+		t.Fatalf("GetIterator failed: %v", err)
+	}
+	for iterator.HasNext() {
+		rec, _ := iterator.Get()
+		keys = append(keys, rec.GetKey())
+	}
+	if len(keys) != 1 || keys[0] != "kept" {
+		t.Errorf("compacted segment holds %v, want [kept]", keys)
+	}
+}
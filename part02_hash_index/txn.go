@@ -0,0 +1,196 @@
+package kvstorefromscratchpart2
+
+import "errors"
+
+var (
+	ErrConflict = errors.New("transaction conflicts with a concurrent write")
+	ErrTxnDone  = errors.New("transaction has already been committed or rolled back")
+)
+
+// Version identifies the record that holds the current value of a key: its location in
+// the log. Every Put or Del of the key appends a new record, so the version changes with
+// every write. Compact moves records to a new segment, which changes their version as
+// well even though the value stays the same.
+//
+// Like a LogPosition, a version carries the number of compactions the store had done
+// when it was handed out, since the merged segment takes over the ID of a segment it
+// replaces and a location in it may hold a different record than before.
+type Version struct {
+	SegmentID   int
+	Offset      int64
+	Compactions int
+}
+
+// versionAt returns the version of the record at the given location. The caller must
+// hold f.mu.
+func (f *FileStore) versionAt(segmentID int, offset int64) Version {
+	return Version{SegmentID: segmentID, Offset: offset, Compactions: f.compactions}
+}
+
+// isCurrent reports whether v is the version of the record at the given location, i.e.
+// the record hasn't been replaced since v was handed out. The caller must hold f.mu.
+func (f *FileStore) isCurrent(v Version, segmentID int, offset int64) bool {
+	if v.SegmentID != segmentID || v.Offset != offset {
+		return false
+	}
+	return segmentID != f.compacted || v.Compactions == f.compactions
+}
+
+// Txn is a multi-key transaction with optimistic concurrency control, see Begin.
+//
+// A Txn is not safe for concurrent use.
+type Txn struct {
+	store   *FileStore
+	reads   map[string]txnRead // Version of every key read from the store
+	writes  *WriteBatch
+	pending map[string]int // Position of the latest write of each key in writes
+	done    bool
+}
+
+// txnRead is what a Txn saw when it read a key from the store.
+type txnRead struct {
+	exists    bool    // Whether the index had a record of the key
+	version   Version // Location of that record
+	expiresAt int64   // Its expiry, 0 if it has none
+	expired   bool    // Whether it had expired when it was read
+}
+
+// Begin starts a transaction. Its Gets read the latest committed values, and its Puts
+// and Dels are buffered until Commit. Nothing is locked while the transaction runs: Commit
+// checks that none of the keys it read has been written since, and fails with ErrConflict
+// otherwise, in which case the caller can retry the whole transaction.
+//
+// A transaction must end with Commit or Rollback.
+func (f *FileStore) Begin() *Txn {
+	return &Txn{
+		store:   f,
+		reads:   make(map[string]txnRead),
+		writes:  NewWriteBatch(),
+		pending: make(map[string]int),
+	}
+}
+
+// Get returns the value of key K as seen by the transaction: its own buffered write if
+// it made one, otherwise the latest committed value, or ErrKeyDoesntExist. Reading a key
+// from the store adds it to the keys Commit validates, whether or not it exists.
+func (t *Txn) Get(K string) (string, error) {
+	if t.done {
+		return "", ErrTxnDone
+	}
+	if i, ok := t.pending[K]; ok {
+		rec := t.writes.records[i]
+		if rec.operation == OPERATION_DEL {
+			return "", ErrKeyDoesntExist
+		}
+		return rec.data.val, nil
+	}
+
+	f := t.store
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return "", ErrStoreClosed
+	}
+
+	rec, version, err := f.lookup(K)
+	if err == ErrKeyDoesntExist {
+		t.observe(K, txnRead{})
+		return "", err
+	}
+	if err != nil {
+		return "", err
+	}
+	read := txnRead{
+		exists:    true,
+		version:   version,
+		expiresAt: rec.expiresAt,
+		expired:   rec.isExpired(timeNow().UnixNano()),
+	}
+	t.observe(K, read)
+	if read.expired {
+		return "", ErrKeyDoesntExist
+	}
+	return rec.GetValue(), nil
+}
+
+// observe records the first read of key K. A later read that saw something else fails
+// validation anyway, since the first one no longer matches the store.
+func (t *Txn) observe(K string, read txnRead) {
+	if _, ok := t.reads[K]; !ok {
+		t.reads[K] = read
+	}
+}
+
+// Put buffers the insertion or update of key K until Commit.
+func (t *Txn) Put(K, V string) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.pending[K] = t.writes.Len()
+	t.writes.Put(K, V)
+	return nil
+}
+
+// Del buffers the deletion of key K until Commit.
+func (t *Txn) Del(K string) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.pending[K] = t.writes.Len()
+	t.writes.Del(K)
+	return nil
+}
+
+// Commit validates the transaction and writes its buffered operations atomically, as a
+// single WriteBatch frame. Validation and the write happen under the store's write lock,
+// so no other write can slip in between.
+//
+// It returns ErrConflict without writing anything if a key the transaction read has been
+// written or deleted since, or has expired since. Compact also counts as a write of the
+// keys it moves, so a transaction that overlaps a compaction may have to be retried even
+// though no value changed. A read-only transaction is validated the same way, so a nil
+// error means all of its reads were consistent with each other.
+//
+// The transaction ends with Commit, whether it succeeds or not.
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+
+	f := t.store
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return ErrStoreClosed
+	}
+
+	now := timeNow().UnixNano()
+	for key, read := range t.reads {
+		segmentID, offset, err := f.index.GetOffset(key)
+		exists := err == nil
+		if exists != read.exists {
+			return ErrConflict
+		}
+		if !exists {
+			continue
+		}
+		if !f.isCurrent(read.version, segmentID, offset) {
+			return ErrConflict
+		}
+		if !read.expired && read.expiresAt != 0 && now >= read.expiresAt {
+			return ErrConflict
+		}
+	}
+	if t.writes.Len() == 0 {
+		return nil
+	}
+	return f.writeBatch(t.writes)
+}
+
+// Rollback discards the buffered operations and ends the transaction. Rolling back a
+// transaction that has already ended is a no-op, so it can be deferred.
+func (t *Txn) Rollback() {
+	t.done = true
+	t.reads, t.writes, t.pending = nil, nil, nil
+}
@@ -0,0 +1,270 @@
+package kvstorefromscratchpart2
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTxn_CommitAndRollback(t *testing.T) {
+	tmpDir := t.TempDir()
+	store, err := ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	store.Put("account:1", "100")
+	store.Put("account:2", "100")
+	store.Put("stale", "old")
+
+	txn := store.Begin()
+	balance, err := txn.Get("account:1")
+	if err != nil || balance != "100" {
+		t.Fatalf("Txn.Get(account:1) returned (%q, %v), want 100", balance, err)
+	}
+	txn.Put("account:1", "90")
+	txn.Put("account:2", "110")
+	txn.Del("stale")
+
+	// The transaction sees its own writes, the store doesn't until Commit
+	if got, err := txn.Get("account:2"); err != nil || got != "110" {
+		t.Errorf("Txn.Get(account:2) returned (%q, %v), want its own write 110", got, err)
+	}
+	if _, err := txn.Get("stale"); err != ErrKeyDoesntExist {
+		t.Errorf("Txn.Get(stale) returned %v, want ErrKeyDoesntExist after its own Del", err)
+	}
+	if got, _ := store.Get("account:1"); got != "100" {
+		t.Errorf("Get(account:1) returned %q before Commit, want 100", got)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if err := txn.Commit(); err != ErrTxnDone {
+		t.Errorf("second Commit returned %v, want ErrTxnDone", err)
+	}
+
+	rolledBack := store.Begin()
+	rolledBack.Put("account:1", "0")
+	rolledBack.Rollback()
+	rolledBack.Rollback()
+	if err := rolledBack.Put("account:1", "0"); err != ErrTxnDone {
+		t.Errorf("Put after Rollback returned %v, want ErrTxnDone", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// The committed transaction was written as a batch and survives a restart
+	store, err = ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer store.Close()
+	for key, want := range map[string]string{"account:1": "90", "account:2": "110"} {
+		if got, err := store.Get(key); err != nil || got != want {
+			t.Errorf("Get(%q) returned (%q, %v), want %q", key, got, err, want)
+		}
+	}
+	if _, err := store.Get("stale"); err != ErrKeyDoesntExist {
+		t.Errorf("Get(stale) returned %v, want ErrKeyDoesntExist", err)
+	}
+	var markers int
+	store.WalkLog(func(e LogEntry) error {
+		if e.Operation == OPERATION_BATCH_BEGIN || e.Operation == OPERATION_BATCH_COMMIT {
+			markers++
+		}
+		return nil
+	})
+	if markers != 2 {
+		t.Errorf("log has %d batch markers, want a single frame", markers)
+	}
+}
+
+func TestTxn_Conflicts(t *testing.T) {
+	store, err := ConnectFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+	store.Put("x", "1")
+	store.Put("y", "1")
+
+	tests := []struct {
+		name     string
+		key      string
+		meddle   func()
+		conflict bool
+	}{
+		{"overwritten", "x", func() { store.Put("x", "2") }, true},
+		{"same value written again", "x", func() { store.Put("x", "2") }, true},
+		{"deleted", "x", func() { store.Del("x") }, true},
+		{"absent key created", "new", func() { store.Put("new", "1") }, true},
+		{"compacted", "y", func() { store.Compact() }, true},
+		{"other key written", "y", func() { store.Put("z", "1") }, false},
+		{"absent key written and deleted", "gone", func() { store.Put("gone", "1"); store.Del("gone") }, false},
+	}
+	for _, tt := range tests {
+		txn := store.Begin()
+		txn.Get(tt.key)
+		tt.meddle()
+		txn.Put("written-by-txn", tt.name)
+		err := txn.Commit()
+		if tt.conflict && err != ErrConflict {
+			t.Errorf("%s: Commit returned %v, want ErrConflict", tt.name, err)
+		}
+		if !tt.conflict && err != nil {
+			t.Errorf("%s: Commit returned %v, want nil", tt.name, err)
+		}
+		got, _ := store.Get("written-by-txn")
+		if written := got == tt.name; written == tt.conflict {
+			t.Errorf("%s: transaction's write visible is %v after Commit returned %v", tt.name, written, err)
+		}
+	}
+
+	// Blind writes aren't validated
+	txn := store.Begin()
+	txn.Put("x", "blind")
+	store.Put("x", "concurrent")
+	if err := txn.Commit(); err != nil {
+		t.Errorf("Commit of a blind write returned %v, want nil", err)
+	}
+}
+
+func TestTxn_ReadCompactedToSameLocation(t *testing.T) {
+	store, err := ConnectFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+	store.Put("x", "1")
+
+	// The merged segment takes over the ID of the newest segment it replaces, so the
+	// latest record of x lands at the location the transaction read the older one from
+	txn := store.Begin()
+	if got, err := txn.Get("x"); err != nil || got != "1" {
+		t.Fatalf("Txn.Get(x) returned (%q, %v), want 1", got, err)
+	}
+	read := txn.reads["x"].version
+	store.Put("x", "2")
+	store.Compact()
+	store.mu.RLock()
+	segmentID, offset, _ := store.index.GetOffset("x")
+	store.mu.RUnlock()
+	if segmentID != read.SegmentID || offset != read.Offset {
+		t.Fatalf("x was compacted to %d:%d, want it at %d:%d where it was read", segmentID, offset, read.SegmentID, read.Offset)
+	}
+	txn.Put("y", "from stale read")
+	if err := txn.Commit(); err != ErrConflict {
+		t.Errorf("Commit after x was overwritten and compacted back returned %v, want ErrConflict", err)
+	}
+}
+
+func TestTxn_ReadValueExpires(t *testing.T) {
+	advance := fakeClock(t)
+	store, err := ConnectFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	defer store.Close()
+	store.PutWithTTL("lease", "node-1", time.Minute)
+	store.PutWithTTL("expired", "node-1", time.Second)
+	advance(2 * time.Second)
+
+	txn := store.Begin()
+	if got, err := txn.Get("lease"); err != nil || got != "node-1" {
+		t.Fatalf("Txn.Get(lease) returned (%q, %v), want node-1", got, err)
+	}
+	if _, err := txn.Get("expired"); err != ErrKeyDoesntExist {
+		t.Fatalf("Txn.Get(expired) returned %v, want ErrKeyDoesntExist", err)
+	}
+	advance(time.Minute)
+	txn.Put("lease", "node-1")
+	if err := txn.Commit(); err != ErrConflict {
+		t.Errorf("Commit after the value read expired returned %v, want ErrConflict", err)
+	}
+}
+
+func TestTxn_ConcurrentIncrements(t *testing.T) {
+	store, err := ConnectFileStoreWithOptions(t.TempDir(), smallSegmentOptions())
+	if err != nil {
+		t.Fatalf("ConnectFileStoreWithOptions failed: %v", err)
+	}
+	defer store.Close()
+
+	// Each transaction moves one unit from a random account to the counter; without
+	// validation, increments would be lost and the total would drift
+	const workers, increments, accounts = 8, 50, 4
+	for i := 0; i < accounts; i++ {
+		store.Put(fmt.Sprintf("account:%d", i), "1000")
+	}
+	transfer := func(w, i int) error {
+		from := fmt.Sprintf("account:%d", (w+i)%accounts)
+		txn := store.Begin()
+		defer txn.Rollback()
+		counter, err := txn.Get("counter")
+		if err == ErrKeyDoesntExist {
+			counter, err = "0", nil
+		}
+		if err != nil {
+			return err
+		}
+		balance, err := txn.Get(from)
+		if err != nil {
+			return err
+		}
+		n, _ := strconv.Atoi(counter)
+		b, _ := strconv.Atoi(balance)
+		txn.Put("counter", strconv.Itoa(n+1))
+		txn.Put(from, strconv.Itoa(b-1))
+		return txn.Commit()
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				err := transfer(w, i)
+				for err == ErrConflict {
+					err = transfer(w, i)
+				}
+				if err != nil {
+					t.Errorf("transfer failed: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if got, _ := store.Get("counter"); got != strconv.Itoa(workers*increments) {
+		t.Errorf("counter is %s, want %d", got, workers*increments)
+	}
+	total := 0
+	for i := 0; i < accounts; i++ {
+		balance, _ := store.Get(fmt.Sprintf("account:%d", i))
+		b, _ := strconv.Atoi(balance)
+		total += b
+	}
+	if total != accounts*1000-workers*increments {
+		t.Errorf("accounts hold %d in total, want %d", total, accounts*1000-workers*increments)
+	}
+}
+
+func TestTxn_ClosedStore(t *testing.T) {
+	store, err := ConnectFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	txn := store.Begin()
+	txn.Put("k", "v")
+	store.Close()
+	if _, err := txn.Get("other"); err != ErrStoreClosed {
+		t.Errorf("Txn.Get on a closed store returned %v, want ErrStoreClosed", err)
+	}
+	if err := txn.Commit(); err != ErrStoreClosed {
+		t.Errorf("Commit on a closed store returned %v, want ErrStoreClosed", err)
+	}
+}
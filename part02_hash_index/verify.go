@@ -0,0 +1,314 @@
+package kvstorefromscratchpart2
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	QUARANTINE_EXT = ".quarantine"
+)
+
+// RepairMode selects what Repair does with the damaged regions Verify finds.
+type RepairMode int
+
+const (
+	// REPAIR_TRUNCATE cuts each damaged segment off at its first damaged region. Any
+	// intact records after that point are lost as well.
+	REPAIR_TRUNCATE RepairMode = iota
+	// REPAIR_QUARANTINE moves every damaged region out of its segment into a
+	// "<segment>.<offset>.quarantine" file and keeps the intact records around it.
+	REPAIR_QUARANTINE
+)
+
+// VerifyReport is the result of checking a data directory with Verify.
+type VerifyReport struct {
+	Segments []SegmentReport
+
+	// BadHints lists hint files that are corrupt or don't match their segment. They are
+	// harmless, since the segment is replayed instead and the hint rewritten on open.
+	BadHints []string
+
+	// OrphanedFiles lists files left behind by an interrupted write or compaction, such
+	// as TEMP_FILENAME or a hint file without a segment.
+	OrphanedFiles []string
+}
+
+// SegmentReport is the result of checking a single segment file.
+type SegmentReport struct {
+	ID       int
+	Path     string
+	Size     int64
+	Records  int // Intact PUT and DEL records, including those of committed batches
+	Problems []Problem
+}
+
+// Problem is a damaged region of a segment.
+type Problem struct {
+	Offset int64 // Start of the region
+	Length int64 // Length of the region; the next intact record starts right after it
+	Err    error // What is wrong with the first record of the region, e.g. ErrCorruptRecord
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%d bytes at offset %d: %v", p.Length, p.Offset, p.Err)
+}
+
+// OK reports whether every segment is intact. Bad hints and orphaned files don't count,
+// since opening the store cleans them up.
+func (r *VerifyReport) OK() bool {
+	for _, segment := range r.Segments {
+		if len(segment.Problems) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Verify checks every record of every segment in dir, without modifying anything. The
+// store must not be open while dir is checked.
+//
+// A record is damaged if it is truncated, fails its checksum, or has an unknown format
+// version or operation; a WriteBatch is damaged if its framing is inconsistent or it was
+// never committed. After a damaged record, Verify looks for the next offset where an intact
+// record starts and reports everything in between as a single Problem. A damaged batch is
+// reported as a whole, since replay applies all of it or nothing.
+func Verify(dir string) (*VerifyReport, error) {
+	report := &VerifyReport{}
+
+	ids, err := listSegmentIDs(dir, SEGMENT_EXT)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(ids)+1)
+	if _, err := os.Stat(filepath.Join(dir, PRIMARY_FILENAME)); err == nil && len(ids) == 0 {
+		// Single-file layout, segment 1 once the store is opened
+		ids = []int{1}
+		paths = append(paths, filepath.Join(dir, PRIMARY_FILENAME))
+	} else {
+		for _, id := range ids {
+			paths = append(paths, filepath.Join(dir, segmentFileName(id, SEGMENT_EXT)))
+		}
+	}
+
+	for i, id := range ids {
+		data, err := os.ReadFile(paths[i])
+		if err != nil {
+			return nil, err
+		}
+		segment := SegmentReport{ID: id, Path: paths[i], Size: int64(len(data))}
+		segment.Records, segment.Problems = verifySegment(data)
+		report.Segments = append(report.Segments, segment)
+
+		if _, err := os.Stat(filepath.Join(dir, segmentFileName(id, HINT_EXT))); err == nil {
+			if _, err := readHintFile(dir, id, segment.Size); err != nil {
+				report.BadHints = append(report.BadHints, filepath.Join(dir, segmentFileName(id, HINT_EXT)))
+			}
+		}
+	}
+
+	report.OrphanedFiles, err = findOrphanedFiles(dir, ids)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// verifySegment walks the encoded records in data and returns the number of intact PUT
+// and DEL records and the damaged regions, in increasing offset order.
+func verifySegment(data []byte) (int, []Problem) {
+	var problems []Problem
+	addProblem := func(start, end int64, err error) {
+		if n := len(problems); n > 0 && problems[n-1].Offset+problems[n-1].Length >= start {
+			last := &problems[n-1] // Adjacent to the previous region, extend it
+			last.Length = max(last.Length, end-last.Offset)
+			return
+		}
+		problems = append(problems, Problem{Offset: start, Length: end - start, Err: err})
+	}
+
+	records := 0
+	batchStart := int64(-1) // Offset of the open batch's BEGIN marker, -1 outside of a batch
+	var batchCount uint32
+	batchRecords := 0
+	size := int64(len(data))
+	for pos := int64(0); pos < size; {
+		rec, n, err := decodeRecord(data[pos:])
+		if err != nil {
+			start := pos
+			if batchStart >= 0 {
+				start, batchStart = batchStart, -1
+			}
+			next := resyncRecords(data, pos+1)
+			addProblem(start, next, err)
+			pos = next
+			continue
+		}
+
+		switch rec.operation {
+		case OPERATION_BATCH_BEGIN:
+			if batchStart >= 0 {
+				addProblem(batchStart, pos, ErrCorruptBatch) // BEGIN inside a batch
+			}
+			batchStart, batchRecords = pos, 0
+			if batchCount, err = decodeBatchCount(rec); err != nil {
+				addProblem(pos, pos+n, ErrCorruptBatch)
+				batchStart = -1
+			}
+		case OPERATION_BATCH_COMMIT:
+			count, err := decodeBatchCount(rec)
+			switch {
+			case batchStart < 0:
+				addProblem(pos, pos+n, ErrCorruptBatch) // COMMIT without BEGIN
+			case err != nil || count != batchCount || int(count) != batchRecords:
+				addProblem(batchStart, pos+n, ErrCorruptBatch)
+			default:
+				records += batchRecords
+			}
+			batchStart = -1
+		default:
+			if batchStart >= 0 {
+				batchRecords++
+			} else {
+				records++
+			}
+		}
+		pos += n
+	}
+	if batchStart >= 0 {
+		addProblem(batchStart, size, ErrUncommittedBatch)
+	}
+	return records, problems
+}
+
+// resyncRecords returns the first offset at or after from where an intact record starts,
+// or len(data) if there is none.
+func resyncRecords(data []byte, from int64) int64 {
+	for pos := from; pos+RECORD_HEADER_SIZE <= int64(len(data)); pos++ {
+		if data[pos+4] != RECORD_VERSION {
+			continue // Cheap check before decoding
+		}
+		if _, _, err := decodeRecord(data[pos:]); err == nil {
+			return pos
+		}
+	}
+	return int64(len(data))
+}
+
+// findOrphanedFiles returns the files in dir that a crash can leave behind: the temporary
+// files of compaction and hint writing, committed but unfinished compactions, and hint
+// files whose segment no longer exists.
+func findOrphanedFiles(dir string, segmentIDs []int) ([]string, error) {
+	var orphans []string
+	for _, name := range []string{TEMP_FILENAME, HINT_TEMP_FILENAME} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			orphans = append(orphans, filepath.Join(dir, name))
+		}
+	}
+
+	compacted, err := listSegmentIDs(dir, COMPACTED_EXT)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range compacted {
+		orphans = append(orphans, filepath.Join(dir, segmentFileName(id, COMPACTED_EXT)))
+	}
+
+	hints, err := listSegmentIDs(dir, HINT_EXT)
+	if err != nil {
+		return nil, err
+	}
+	segments := make(map[int]bool, len(segmentIDs))
+	for _, id := range segmentIDs {
+		segments[id] = true
+	}
+	for _, id := range hints {
+		if !segments[id] {
+			orphans = append(orphans, filepath.Join(dir, segmentFileName(id, HINT_EXT)))
+		}
+	}
+	return orphans, nil
+}
+
+// Repair verifies dir like Verify and then fixes what it found: damaged regions are
+// handled according to mode, the hint files of repaired segments and bad hints are
+// deleted, and orphaned temporary files are removed. An interrupted compaction is finished
+// first, as opening the store would. It returns the report describing the directory before
+// the repair. The store must not be open while dir is repaired.
+func Repair(dir string, mode RepairMode) (*VerifyReport, error) {
+	if err := finishInterruptedCompaction(dir); err != nil {
+		return nil, err
+	}
+	report, err := Verify(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, segment := range report.Segments {
+		if len(segment.Problems) == 0 {
+			continue
+		}
+		// Record offsets change, so the hint is stale from now on
+		os.Remove(filepath.Join(dir, segmentFileName(segment.ID, HINT_EXT)))
+		switch mode {
+		case REPAIR_TRUNCATE:
+			err = os.Truncate(segment.Path, segment.Problems[0].Offset)
+		case REPAIR_QUARANTINE:
+			err = quarantineProblems(dir, segment)
+		default:
+			err = fmt.Errorf("%w: unknown repair mode %d", ErrInvalidOptions, mode)
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+
+	for _, path := range append(report.BadHints, report.OrphanedFiles...) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// quarantineProblems copies each damaged region of the segment to its own quarantine file
+// and rewrites the segment without them. The segment is replaced atomically by renaming
+// TEMP_FILENAME over it.
+func quarantineProblems(dir string, segment SegmentReport) error {
+	data, err := os.ReadFile(segment.Path)
+	if err != nil {
+		return err
+	}
+
+	kept := make([]byte, 0, len(data))
+	pos := int64(0)
+	for _, problem := range segment.Problems {
+		end := problem.Offset + problem.Length
+		name := fmt.Sprintf("%s.%d%s", filepath.Base(segment.Path), problem.Offset, QUARANTINE_EXT)
+		if err := os.WriteFile(filepath.Join(dir, name), data[problem.Offset:end], 0644); err != nil {
+			return err
+		}
+		kept = append(kept, data[pos:problem.Offset]...)
+		pos = end
+	}
+	kept = append(kept, data[pos:]...)
+
+	tmpPath := filepath.Join(dir, TEMP_FILENAME)
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(kept)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, segment.Path)
+}
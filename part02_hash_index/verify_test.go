@@ -0,0 +1,184 @@
+package kvstorefromscratchpart2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func encodedSize(t *testing.T, rec record) int64 {
+	t.Helper()
+	encoded, err := rec.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(len(encoded))
+}
+
+func TestVerify_CleanStore(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	store, err := ConnectFileStoreWithOptions(tmpDir, smallSegmentOptions())
+	if err != nil {
+		t.Fatalf("ConnectFileStore failed: %v", err)
+	}
+	if err := addNItemsToKVStore(store, 100); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	batch := NewWriteBatch()
+	batch.Put("x", "1")
+	batch.Del("key-1")
+	if err := store.Write(batch); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	store.Close()
+
+	report, err := Verify(tmpDir)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if !report.OK() || len(report.BadHints) != 0 || len(report.OrphanedFiles) != 0 {
+		t.Fatalf("Verify reported problems in a clean store: %+v", report)
+	}
+	records := 0
+	for _, segment := range report.Segments {
+		records += segment.Records
+	}
+	if records != 102 {
+		t.Errorf("Verify counted %d records, want 102", records)
+	}
+}
+
+func TestVerify_ReportsDamage(t *testing.T) {
+	tmpDir := t.TempDir()
+	a, b, c := putRecord("a", "1"), putRecord("b", "2"), putRecord("c", "3")
+	data := writeSegment(t, tmpDir, 1, a, b, c)
+	offsetB := encodedSize(t, a)
+	data[offsetB+RECORD_HEADER_SIZE] ^= 0xFF // Flip a bit in b's key
+	os.WriteFile(filepath.Join(tmpDir, segmentFileName(1, SEGMENT_EXT)), data, 0644)
+
+	unknownOp := writeSegment(t, tmpDir, 2, a, b)
+	unknownOp[5] = 9 // Operation of a, with a valid checksum so only the op is wrong
+	binary.BigEndian.PutUint32(unknownOp[0:4], crc32.ChecksumIEEE(unknownOp[4:offsetB]))
+	os.WriteFile(filepath.Join(tmpDir, segmentFileName(2, SEGMENT_EXT)), unknownOp, 0644)
+
+	writeSegment(t, tmpDir, 3, a, batchMarker(OPERATION_BATCH_BEGIN, 2), b, c)
+	os.WriteFile(filepath.Join(tmpDir, TEMP_FILENAME), []byte("partial"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, segmentFileName(9, HINT_EXT)), nil, 0644)
+
+	report, err := Verify(tmpDir)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if report.OK() || len(report.Segments) != 3 {
+		t.Fatalf("Verify returned %+v, want 3 damaged segments", report)
+	}
+
+	tests := []struct {
+		records int
+		problem Problem
+	}{
+		{2, Problem{Offset: offsetB, Length: encodedSize(t, b), Err: ErrCorruptRecord}},
+		{1, Problem{Offset: 0, Length: encodedSize(t, a), Err: ErrUnknownOperation}},
+		{1, Problem{Offset: offsetB, Length: encodedSize(t, batchMarker(OPERATION_BATCH_BEGIN, 2)) + encodedSize(t, b) + encodedSize(t, c), Err: ErrUncommittedBatch}},
+	}
+	for i, tt := range tests {
+		segment := report.Segments[i]
+		if segment.Records != tt.records {
+			t.Errorf("segment %d has %d intact records, want %d", segment.ID, segment.Records, tt.records)
+		}
+		if len(segment.Problems) != 1 {
+			t.Errorf("segment %d has problems %v, want one", segment.ID, segment.Problems)
+			continue
+		}
+		got := segment.Problems[0]
+		if got.Offset != tt.problem.Offset || got.Length != tt.problem.Length || !errors.Is(got.Err, tt.problem.Err) {
+			t.Errorf("segment %d has problem %v, want %v", segment.ID, got, tt.problem)
+		}
+	}
+	if len(report.OrphanedFiles) != 2 {
+		t.Errorf("Verify found orphaned files %v, want tmp.db and the hint of segment 9", report.OrphanedFiles)
+	}
+}
+
+func TestRepair_Quarantine(t *testing.T) {
+	tmpDir := t.TempDir()
+	a, b, c := putRecord("a", "1"), putRecord("b", "2"), putRecord("c", "3")
+	data := writeSegment(t, tmpDir, 1, a, b, c)
+	offsetB := encodedSize(t, a)
+	data[offsetB+RECORD_HEADER_SIZE] ^= 0xFF
+	os.WriteFile(filepath.Join(tmpDir, segmentFileName(1, SEGMENT_EXT)), data, 0644)
+	writeSegment(t, tmpDir, 2, putRecord("d", "4"))
+
+	if _, err := ConnectFileStore(tmpDir); err == nil {
+		t.Fatalf("ConnectFileStore opened a store with a corrupt sealed segment")
+	}
+	if _, err := Repair(tmpDir, REPAIR_QUARANTINE); err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+
+	quarantined, err := os.ReadFile(filepath.Join(tmpDir, fmt.Sprintf("%s.%d%s", segmentFileName(1, SEGMENT_EXT), offsetB, QUARANTINE_EXT)))
+	if err != nil {
+		t.Fatalf("reading the quarantine file failed: %v", err)
+	}
+	if string(quarantined) != string(data[offsetB:offsetB+encodedSize(t, b)]) {
+		t.Errorf("quarantine file holds %q, want the damaged record", quarantined)
+	}
+
+	store, err := ConnectFileStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectFileStore after Repair failed: %v", err)
+	}
+	defer store.Close()
+	for key, want := range map[string]string{"a": "1", "c": "3", "d": "4"} {
+		if got, err := store.Get(key); err != nil || got != want {
+			t.Errorf("Get(%q) returned (%q, %v), want %q", key, got, err, want)
+		}
+	}
+	if _, err := store.Get("b"); err != ErrKeyDoesntExist {
+		t.Errorf("Get(b) returned %v, want ErrKeyDoesntExist", err)
+	}
+}
+
+func TestRepair_Truncate(t *testing.T) {
+	tmpDir := t.TempDir()
+	a, b := putRecord("a", "1"), putRecord("b", "2")
+	data := writeSegment(t, tmpDir, 1, a, b, putRecord("c", "3"))
+	data[encodedSize(t, a)] ^= 0xFF // Corrupt b's checksum
+	os.WriteFile(filepath.Join(tmpDir, segmentFileName(1, SEGMENT_EXT)), data, 0644)
+	writeSegment(t, tmpDir, 2, putRecord("d", "4"))
+	os.WriteFile(filepath.Join(tmpDir, segmentFileName(1, HINT_EXT)), []byte("stale"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, HINT_TEMP_FILENAME), nil, 0644)
+
+	report, err := Repair(tmpDir, REPAIR_TRUNCATE)
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if len(report.BadHints) != 1 || len(report.OrphanedFiles) != 1 {
+		t.Errorf("Repair reported bad hints %v and orphans %v, want one of each", report.BadHints, report.OrphanedFiles)
+	}
+
+	after, err := Verify(tmpDir)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if !after.OK() || len(after.BadHints) != 0 || len(after.OrphanedFiles) != 0 {
+		t.Errorf("Verify after Repair returned %+v", after)
+	}
+	if size := after.Segments[0].Size; size != encodedSize(t, a) {
+		t.Errorf("segment 1 is %d bytes after truncation, want %d", size, encodedSize(t, a))
+	}
+}
+
+func TestVerifySegment_TornTail(t *testing.T) {
+	encoded, _ := (&record{operation: OPERATION_PUT, data: KVPair{key: "k", val: "v"}}).MarshalBinary()
+	records, problems := verifySegment(append(encoded, encoded[:7]...))
+	if records != 1 || len(problems) != 1 || problems[0].Err != io.ErrUnexpectedEOF || problems[0].Length != 7 {
+		t.Errorf("verifySegment returned (%d, %v), want one record and a 7-byte torn tail", records, problems)
+	}
+}
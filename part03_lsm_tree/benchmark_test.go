@@ -0,0 +1,102 @@
+package kvstorefromscratchpart3
+
+import (
+	"fmt"
+	"testing"
+)
+
+func BenchmarkGet(b *testing.B) {
+
+	inputData := []struct {
+		input int
+	}{
+		{input: 10000},
+		{input: 100000},
+		{input: 1000000},
+	}
+	for _, data := range inputData {
+		b.Run(fmt.Sprintf("Get-%d", data.input), func(b *testing.B) {
+			opts := DefaultOptions()
+			opts.SyncMode = SYNC_NEVER // Keeps loading a million keys quick
+			store, err := ConnectLSMStoreWithOptions(b.TempDir(), opts)
+			if err != nil {
+				b.Fatalf("ConnectLSMStoreWithOptions failed: %v", err)
+			}
+			defer store.Close()
+
+			if err := addNItemsToKVStore(store, data.input); err != nil {
+				b.Fatalf("addNItemsToKVStore failed: %v", err)
+			}
+			if err := store.Flush(); err != nil {
+				b.Fatalf("Flush failed: %v", err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := getNthItemFromKVStore(store, i%data.input); err != nil {
+					b.Errorf("Get failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetMissing(b *testing.B) {
+	opts := DefaultOptions()
+	opts.SyncMode = SYNC_NEVER
+	store, err := ConnectLSMStoreWithOptions(b.TempDir(), opts)
+	if err != nil {
+		b.Fatalf("ConnectLSMStoreWithOptions failed: %v", err)
+	}
+	defer store.Close()
+	if err := addNItemsToKVStore(store, 1000000); err != nil {
+		b.Fatalf("addNItemsToKVStore failed: %v", err)
+	}
+	if err := store.Flush(); err != nil {
+		b.Fatalf("Flush failed: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.Get(fmt.Sprintf("missing-%d", i)); err != ErrKeyDoesntExist {
+			b.Errorf("Get returned %v, want ErrKeyDoesntExist", err)
+		}
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	opts := DefaultOptions()
+	opts.SyncMode = SYNC_NEVER
+	store, err := ConnectLSMStoreWithOptions(b.TempDir(), opts)
+	if err != nil {
+		b.Fatalf("ConnectLSMStoreWithOptions failed: %v", err)
+	}
+	defer store.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := store.Put(fmt.Sprintf("key-%d", i), "value"); err != nil {
+			b.Fatalf("Put failed: %v", err)
+		}
+	}
+}
+
+func addNItemsToKVStore(store Store, N int) error {
+	for i := 0; i < N; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		val := fmt.Sprintf("value-%d", i)
+		if err := store.Put(key, val); err != nil {
+			return fmt.Errorf("failed to put key %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func getNthItemFromKVStore(store Store, N int) (string, error) {
+	key := fmt.Sprintf("key-%d", N)
+	val, err := store.Get(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to get key %s: %w", key, err)
+	}
+	return val, nil
+}
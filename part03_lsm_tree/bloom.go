@@ -0,0 +1,173 @@
+package kvstorefromscratchpart3
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// A Bloom filter file sits next to its SSTable ("000001.bloom" for "000001.sst") and holds
+// a filter over every key in the table, tombstones included. A Get consults the filter
+// before reading a block: if it says the key is absent, the table is skipped without I/O.
+//
+// Layout (all integers are big-endian):
+//
+//	| magic 4B | tableEntries 8B | hashCount 4B | bitCount 8B | bits | crc32 4B |
+//
+// The checksum covers every byte before it. The recorded entry count guards against a
+// filter that was written for a different version of the table. A missing, corrupt or
+// stale filter is rebuilt from the table when it is opened.
+const (
+	BLOOM_EXT         = ".bloom"
+	BLOOM_TEMP_EXT    = ".bloom.tmp"
+	BLOOM_MAGIC       = "KVB\x01"
+	BLOOM_HEADER_SIZE = 24
+
+	MAX_BLOOM_HASHES = 30
+)
+
+var (
+	ErrCorruptBloomFilter = errors.New("bloom filter file is corrupt")
+	ErrStaleBloomFilter   = errors.New("bloom filter file does not match its sstable")
+)
+
+// bloomFilter is a set of keys that answers "definitely not present" or "maybe present".
+// It is only written while it is built, so it is safe for concurrent reads afterwards.
+type bloomFilter struct {
+	bits      []byte
+	bitCount  uint64
+	hashCount uint32
+}
+
+// newBloomFilter sizes a filter for n keys with the given false-positive rate, using the
+// optimal m = -n ln(p) / (ln 2)^2 bits and k = (m / n) ln 2 hash functions.
+func newBloomFilter(n int, falsePositiveRate float64) *bloomFilter {
+	n = max(n, 1)
+	bitCount := uint64(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	bitCount = max(bitCount, 64)
+	hashCount := uint32(math.Round(float64(bitCount) / float64(n) * math.Ln2))
+	hashCount = min(max(hashCount, 1), MAX_BLOOM_HASHES)
+	return &bloomFilter{
+		bits:      make([]byte, (bitCount+7)/8),
+		bitCount:  bitCount,
+		hashCount: hashCount,
+	}
+}
+
+// add inserts the key with the given hash, as returned by hash.
+func (b *bloomFilter) add(h uint64) {
+	h1, h2 := splitHash(h)
+	for i := uint64(0); i < uint64(b.hashCount); i++ {
+		bit := (h1 + i*h2) % b.bitCount
+		b.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// mayContain reports whether the key with the given hash may have been added. A false
+// answer is always right; a true one is wrong with about the configured probability.
+func (b *bloomFilter) mayContain(h uint64) bool {
+	h1, h2 := splitHash(h)
+	for i := uint64(0); i < uint64(b.hashCount); i++ {
+		bit := (h1 + i*h2) % b.bitCount
+		if b.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// splitHash derives the two hashes of double hashing (Kirsch and Mitzenmacher) from one:
+// the i-th hash function is h1 + i*h2. The second is scrambled with the finalizer of
+// MurmurHash3 so it doesn't share the low bits of the first, and made odd so it never
+// degenerates to a single bit.
+func splitHash(h uint64) (uint64, uint64) {
+	h2 := h
+	h2 ^= h2 >> 33
+	h2 *= 0xff51afd7ed558ccd
+	h2 ^= h2 >> 33
+	h2 *= 0xc4ceb9fe1a85ec53
+	h2 ^= h2 >> 33
+	return h, h2 | 1
+}
+
+const (
+	fnvOffsetBasis64 = 14695981039346656037
+	fnvPrime64       = 1099511628211
+)
+
+// hash computes the 64-bit FNV-1a hash of the key. It is computed inline to avoid the
+// allocation of hash/fnv's []byte interface.
+func hash(key string) uint64 {
+	var hash uint64 = fnvOffsetBasis64
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= fnvPrime64
+	}
+	return hash
+}
+
+// writeBloomFile atomically writes the filter for the SSTable with the given ID and
+// number of entries.
+func writeBloomFile(dir string, id int, tableEntries int64, b *bloomFilter) error {
+	data := make([]byte, 0, BLOOM_HEADER_SIZE+len(b.bits)+4)
+	data = append(data, BLOOM_MAGIC...)
+	data = binary.BigEndian.AppendUint64(data, uint64(tableEntries))
+	data = binary.BigEndian.AppendUint32(data, b.hashCount)
+	data = binary.BigEndian.AppendUint64(data, b.bitCount)
+	data = append(data, b.bits...)
+	data = binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+
+	tmpPath := filepath.Join(dir, fileName(id, BLOOM_TEMP_EXT))
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath) // No-op once renamed
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(dir, fileName(id, BLOOM_EXT)))
+}
+
+// readBloomFile reads the filter for the SSTable with the given ID. It returns
+// ErrCorruptBloomFilter if the checksum doesn't match, ErrStaleBloomFilter if the filter
+// was written for a table with a different number of entries, and an os.ErrNotExist error
+// if there is none.
+func readBloomFile(dir string, id int, tableEntries int64) (*bloomFilter, error) {
+	data, err := os.ReadFile(filepath.Join(dir, fileName(id, BLOOM_EXT)))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < BLOOM_HEADER_SIZE+4 || string(data[:len(BLOOM_MAGIC)]) != BLOOM_MAGIC {
+		return nil, ErrCorruptBloomFilter
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return nil, ErrCorruptBloomFilter
+	}
+	if int64(binary.BigEndian.Uint64(body[4:12])) != tableEntries {
+		return nil, ErrStaleBloomFilter
+	}
+
+	b := &bloomFilter{
+		hashCount: binary.BigEndian.Uint32(body[12:16]),
+		bitCount:  binary.BigEndian.Uint64(body[16:24]),
+		bits:      body[BLOOM_HEADER_SIZE:],
+	}
+	if b.hashCount == 0 || b.hashCount > MAX_BLOOM_HASHES || b.bitCount == 0 || uint64(len(b.bits)) != (b.bitCount+7)/8 {
+		return nil, ErrCorruptBloomFilter
+	}
+	return b, nil
+}
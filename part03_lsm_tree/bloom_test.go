@@ -0,0 +1,138 @@
+package kvstorefromscratchpart3
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBloomFilter_FalsePositiveRate(t *testing.T) {
+	for _, rate := range []float64{0.1, 0.01, 0.001} {
+		filter := newBloomFilter(10000, rate)
+		for i := 0; i < 10000; i++ {
+			filter.add(hash(fmt.Sprintf("key-%d", i)))
+		}
+		for i := 0; i < 10000; i++ {
+			if !filter.mayContain(hash(fmt.Sprintf("key-%d", i))) {
+				t.Fatalf("rate %v: filter doesn't contain key-%d", rate, i)
+			}
+		}
+		var falsePositives int
+		for i := 0; i < 100000; i++ {
+			if filter.mayContain(hash(fmt.Sprintf("missing-%d", i))) {
+				falsePositives++
+			}
+		}
+		if got := float64(falsePositives) / 100000; got > rate*1.5 {
+			t.Errorf("rate %v: %.4f of absent keys pass the filter", rate, got)
+		}
+	}
+}
+
+func TestBloomFile_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	filter := newBloomFilter(100, 0.01)
+	for i := 0; i < 100; i++ {
+		filter.add(hash(fmt.Sprintf("key-%d", i)))
+	}
+	if err := writeBloomFile(dir, 7, 100, filter); err != nil {
+		t.Fatalf("writeBloomFile failed: %v", err)
+	}
+	got, err := readBloomFile(dir, 7, 100)
+	if err != nil {
+		t.Fatalf("readBloomFile failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, filter) {
+		t.Errorf("readBloomFile returned a different filter")
+	}
+	if _, err := readBloomFile(dir, 7, 101); err != ErrStaleBloomFilter {
+		t.Errorf("readBloomFile for a different table returned %v, want ErrStaleBloomFilter", err)
+	}
+	if _, err := readBloomFile(dir, 8, 100); !os.IsNotExist(err) {
+		t.Errorf("readBloomFile of a missing file returned %v, want a not-exist error", err)
+	}
+
+	path := filepath.Join(dir, fileName(7, BLOOM_EXT))
+	data, _ := os.ReadFile(path)
+	data[BLOOM_HEADER_SIZE] ^= 0xFF
+	os.WriteFile(path, data, 0644)
+	if _, err := readBloomFile(dir, 7, 100); err != ErrCorruptBloomFilter {
+		t.Errorf("readBloomFile of a damaged file returned %v, want ErrCorruptBloomFilter", err)
+	}
+}
+
+func TestLSMStore_FilterSkipsMissingKeys(t *testing.T) {
+	tmpDir := t.TempDir()
+	store, err := ConnectLSMStoreWithOptions(tmpDir, smallMemtableOptions())
+	if err != nil {
+		t.Fatalf("ConnectLSMStoreWithOptions failed: %v", err)
+	}
+	if err := addNItemsToKVStore(store, 2000); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if _, err := store.Get(fmt.Sprintf("missing-%d", i)); err != ErrKeyDoesntExist {
+			t.Fatalf("Get(missing-%d) returned %v, want ErrKeyDoesntExist", i, err)
+		}
+	}
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	lookups := int64(1000 * stats.SSTables)
+	if stats.FilterHits+stats.FilterMisses != lookups {
+		t.Errorf("%d filter hits and %d misses, want %d lookups", stats.FilterHits, stats.FilterMisses, lookups)
+	}
+	if stats.FilterHits != stats.FilterFalsePositives || float64(stats.FilterHits) > 0.02*float64(lookups) {
+		t.Errorf("%d of %d lookups of absent keys passed the filter (%d false positives), want about 1%%", stats.FilterHits, lookups, stats.FilterFalsePositives)
+	}
+	if stats.FilterBytes == 0 {
+		t.Errorf("FilterBytes is 0")
+	}
+
+	// Present keys pass the filter of the table that has them
+	if got, err := store.Get("key-1234"); err != nil || got != "value-1234" {
+		t.Errorf("Get(key-1234) returned (%q, %v)", got, err)
+	}
+	after, _ := store.Stats()
+	if after.FilterHits-after.FilterFalsePositives != stats.FilterHits-stats.FilterFalsePositives+1 {
+		t.Errorf("Get of a present key didn't count as a true filter hit")
+	}
+	store.Close()
+
+	// Missing and damaged filters are rebuilt on open
+	filters, _ := filepath.Glob(filepath.Join(tmpDir, "*"+BLOOM_EXT))
+	if len(filters) != stats.SSTables {
+		t.Fatalf("%d filter files for %d SSTables", len(filters), stats.SSTables)
+	}
+	os.Remove(filters[0])
+	os.WriteFile(filters[1], []byte("garbage"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, fileName(999, BLOOM_EXT)), []byte("orphan"), 0644)
+
+	store, err = ConnectLSMStoreWithOptions(tmpDir, smallMemtableOptions())
+	if err != nil {
+		t.Fatalf("ConnectLSMStoreWithOptions failed: %v", err)
+	}
+	defer store.Close()
+	for i, path := range filters[:2] {
+		table := store.sstables[i] // Both are in ID order
+		if _, err := readBloomFile(tmpDir, table.id, table.count); err != nil {
+			t.Errorf("filter %s wasn't rebuilt: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, fileName(999, BLOOM_EXT))); !os.IsNotExist(err) {
+		t.Errorf("filter without an SSTable still exists after recovery (%v)", err)
+	}
+	for i := 0; i < 2000; i += 97 {
+		key, want := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)
+		if got, err := store.Get(key); err != nil || got != want {
+			t.Errorf("Get(%s) returned (%q, %v), want %q", key, got, err, want)
+		}
+	}
+}
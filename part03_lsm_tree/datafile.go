@@ -0,0 +1,126 @@
+package kvstorefromscratchpart3
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	WAL_EXT = ".wal"
+)
+
+// DataFile is an append-only file of records. The LSM store uses one as the write-ahead
+// log of each memtable, so a write is durable before it is only held in memory.
+type DataFile struct {
+	id                int // Same ID as the memtable it logs, and later its SSTable
+	dir               string
+	fullpath          string
+	file              *os.File
+	bytesWrittenSoFar int64 // Track the total bytes written so far
+}
+
+// NewDataFile opens or creates the write-ahead log with the given ID in the directory at
+// path. Offsets of new records continue after the existing ones.
+func NewDataFile(path string, id int) (*DataFile, error) {
+	fullPath := filepath.Join(path, fileName(id, WAL_EXT))
+
+	f, err := os.OpenFile(fullPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &DataFile{
+		id:                id,
+		dir:               path,
+		fullpath:          fullPath,
+		file:              f,
+		bytesWrittenSoFar: info.Size(),
+	}, nil
+}
+
+// fileName returns the name of the file with the given ID and extension, zero padded so
+// that a lexical directory listing is also in ID order.
+func fileName(id int, ext string) string {
+	return fmt.Sprintf("%06d%s", id, ext)
+}
+
+// ID returns the ID of the data file.
+func (df *DataFile) ID() int {
+	return df.id
+}
+
+// GetIterator returns a new FileIterator starting at the specified offset within the DataFile.
+func (df *DataFile) GetIterator(offset int64) (*FileIterator, error) {
+	return newFileIterator(df.file, offset)
+}
+
+// Size returns the number of bytes in the data file.
+func (df *DataFile) Size() int64 {
+	return df.bytesWrittenSoFar
+}
+
+// Append writes the record to the file, flushes, and returns the starting byte offset.
+func (df *DataFile) Append(data record) (int64, error) {
+	writer, err := df.Writer()
+	if err != nil {
+		return 0, err
+	}
+	bytesWritten, err := writer.Append(data)
+	if err != nil {
+		return 0, err
+	}
+	err = writer.Flush()
+	if err != nil {
+		return 0, err
+	}
+	startingOffset := df.bytesWrittenSoFar
+	df.bytesWrittenSoFar += bytesWritten
+	return startingOffset, nil
+}
+
+// Writer returns a new DatFileWriter appending to the end of the DataFile.
+func (df *DataFile) Writer() (*DatFileWriter, error) {
+	_, err := df.file.Seek(0, io.SeekEnd) // Ensure the file pointer is at the end of the file before writing new records
+	if err != nil {
+		return nil, err
+	}
+	return &DatFileWriter{
+		writer: bufio.NewWriter(df.file),
+	}, nil
+}
+
+// Remove closes the data file and deletes it from disk.
+func (df *DataFile) Remove() error {
+	if err := df.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(df.fullpath)
+}
+
+// Truncate cuts the data file down to size bytes and fsyncs it.
+func (df *DataFile) Truncate(size int64) error {
+	if err := df.file.Truncate(size); err != nil {
+		return err
+	}
+	df.bytesWrittenSoFar = size
+	return df.file.Sync()
+}
+
+// Sync commits the data file's contents to stable storage.
+func (df *DataFile) Sync() error {
+	return df.file.Sync()
+}
+
+// Close closes the underlying file. The DataFile should not be used after Close has
+// been called.
+func (df *DataFile) Close() error {
+	return df.file.Close()
+}
@@ -0,0 +1,27 @@
+package kvstorefromscratchpart3
+
+import (
+	"bufio"
+)
+
+type DatFileWriter struct {
+	writer *bufio.Writer
+}
+
+// Append encodes the record and writes it to the buffered writer.
+// Returns the number of bytes written.
+func (dfw *DatFileWriter) Append(data record) (int64, error) {
+	encoded, err := data.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	bytes, err := dfw.writer.Write(encoded)
+	if err != nil {
+		return int64(bytes), err
+	}
+	return int64(bytes), nil
+}
+
+func (dfw *DatFileWriter) Flush() error {
+	return dfw.writer.Flush()
+}
@@ -0,0 +1,64 @@
+package kvstorefromscratchpart3
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"os"
+)
+
+type FileIterator struct {
+	reader     *bufio.Reader
+	curOffset  int64
+	current    record
+	currentAt  int64
+	err        error
+	openedfile *os.File
+}
+
+func newFileIterator(openedfile *os.File, offset int64) (*FileIterator, error) {
+	// Positional reads through a SectionReader leave the shared file pointer untouched.
+	section := io.NewSectionReader(openedfile, offset, math.MaxInt64-offset)
+	fileIterator := &FileIterator{
+		reader:     bufio.NewReader(section),
+		curOffset:  offset,
+		openedfile: openedfile,
+	}
+	return fileIterator, nil
+}
+
+// HasNext decodes the next record and reports whether one was available.
+// It returns false at the end of the file or on the first malformed record;
+// use Err to tell the two apart.
+func (fi *FileIterator) HasNext() bool {
+	if fi.err != nil {
+		return false
+	}
+	rec, size, err := readRecord(fi.reader)
+	if err != nil {
+		if err != io.EOF {
+			fi.err = err
+		}
+		return false
+	}
+	fi.current = rec
+	fi.currentAt = fi.curOffset
+	fi.curOffset += size
+	return true
+}
+
+// Get returns the current record and its starting offset in the file.
+func (fi *FileIterator) Get() (record, int64) {
+	return fi.current, fi.currentAt
+}
+
+// Err returns the error that stopped the iteration, or nil if the iterator
+// reached a clean end of file. A truncated record yields io.ErrUnexpectedEOF.
+func (fi *FileIterator) Err() error {
+	return fi.err
+}
+
+// Offset returns the offset just past the last successfully decoded record.
+func (fi *FileIterator) Offset() int64 {
+	return fi.curOffset
+}
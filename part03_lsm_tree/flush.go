@@ -0,0 +1,130 @@
+package kvstorefromscratchpart3
+
+// maybeFreeze freezes the active memtable once it has reached MemtableSize and starts a new
+// one with its own write-ahead log. If MaxImmutableMemtables are already waiting to be
+// flushed, it waits for the flusher to catch up first, which holds up the writer that
+// filled the memtable and every writer behind it. Callers hold mu.
+func (s *LSMStore) maybeFreeze() error {
+	for s.mem.size >= s.opts.MemtableSize {
+		if s.closed || s.flushErr != nil {
+			return nil // The write is logged; the next one reports the problem
+		}
+		if len(s.immutables) < s.opts.MaxImmutableMemtables {
+			return s.freeze()
+		}
+		s.cond.Wait()
+	}
+	return nil
+}
+
+// freeze moves the active memtable to the flush queue and starts a new one, even if the
+// active one is empty. Callers hold mu.
+func (s *LSMStore) freeze() error {
+	// The frozen log must be durable on its own; later Syncs only cover the new one
+	if err := s.syncWAL(); err != nil {
+		return err
+	}
+	wal, err := NewDataFile(s.dir, s.nextID)
+	if err != nil {
+		return err
+	}
+	s.nextID++
+	s.immutables = append(s.immutables, frozen{mem: s.mem, wal: s.wal})
+	s.mem, s.wal = newMemtable(), wal
+	s.kickFlush()
+	return nil
+}
+
+// Flush freezes the active memtable, if it holds any writes, and waits until every frozen
+// memtable has been written to an SSTable and its write-ahead log deleted. It returns the
+// error of a failed background flush, if any.
+func (s *LSMStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	if s.mem.Len() > 0 && s.flushErr == nil {
+		for len(s.immutables) >= s.opts.MaxImmutableMemtables && !s.closed && s.flushErr == nil {
+			s.cond.Wait()
+		}
+		if s.closed {
+			return ErrStoreClosed
+		}
+		if s.flushErr == nil {
+			if err := s.freeze(); err != nil {
+				return err
+			}
+		}
+	}
+	for len(s.immutables) > 0 && !s.closed && s.flushErr == nil {
+		s.cond.Wait()
+	}
+	if s.flushErr != nil {
+		return s.flushErr
+	}
+	if s.closed {
+		return ErrStoreClosed
+	}
+	return nil
+}
+
+// kickFlush wakes up the flusher without blocking.
+func (s *LSMStore) kickFlush() {
+	select {
+	case s.flushKick <- struct{}{}:
+	default:
+	}
+}
+
+// flushLoop runs in the background, flushing frozen memtables oldest first until the store
+// is closed.
+func (s *LSMStore) flushLoop() {
+	defer close(s.flushDone)
+	for {
+		select {
+		case <-s.stopFlush:
+			return
+		case <-s.flushKick:
+		}
+		for s.flushOldest() {
+			select {
+			case <-s.stopFlush:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// flushOldest writes the oldest frozen memtable to an SSTable with the ID of its log, then
+// deletes the log. The SSTable is renamed into place before the log is deleted, so a crash
+// in between leaves both, and recovery deletes the log. It reports whether a memtable was
+// flushed, so the caller should try again.
+func (s *LSMStore) flushOldest() bool {
+	s.mu.RLock()
+	if len(s.immutables) == 0 || s.flushErr != nil {
+		s.mu.RUnlock()
+		return false
+	}
+	oldest := s.immutables[0]
+	s.mu.RUnlock()
+
+	// The memtable is frozen, so it is written out without holding mu
+	table, err := writeSSTable(s.dir, oldest.wal.ID(), s.opts.BlockSize, s.opts.BloomFalsePositiveRate, oldest.mem.iterator("", ""))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.cond.Broadcast()
+	if err != nil {
+		s.flushErr = err
+		return false
+	}
+	s.sstables = append(s.sstables, table)
+	s.immutables = s.immutables[1:]
+	if err := oldest.wal.Remove(); err != nil {
+		s.flushErr = err
+		return false
+	}
+	return true
+}
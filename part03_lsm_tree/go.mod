@@ -0,0 +1,3 @@
+module kvstorefromscratchpart3
+
+go 1.24.4
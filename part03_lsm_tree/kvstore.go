@@ -0,0 +1,93 @@
+package kvstorefromscratchpart3
+
+// Store defines the interface for a simple Key-Value storage engine. It is the same
+// interface part02's FileStore implements, so the engines are interchangeable.
+//
+// It provides basic functions to retrieve, insert and delete data by key.
+type Store interface {
+
+	// Get retrieves a value associated with the given key.
+	// If the key doesn't exists then ErrKeyDoesntExist is thrown.
+	Get(K string) (string, error)
+
+	// Put inserts or updates the value of the given key.
+	// Returns an error if operation fails.
+	Put(K, V string) error
+
+	// Del removes the given key and its associated value from the storage engine.
+	// Returns error if operation fails.
+	Del(K string) error
+
+	// Scan returns an iterator over the keys in [start, end) and their values, in
+	// increasing key order. An empty end means no upper bound.
+	Scan(start, end string) (Iterator, error)
+
+	// ScanPrefix returns an iterator over the keys starting with prefix and their
+	// values, in increasing key order.
+	ScanPrefix(prefix string) (Iterator, error)
+
+	// Sync flushes every acknowledged write to stable storage.
+	// Returns error if operation fails.
+	Sync() error
+
+	Close() error
+}
+
+// Iterator walks over key/value pairs in key order.
+//
+//	for it.HasNext() {
+//		key, val := it.Get()
+//	}
+//	if err := it.Err(); err != nil { ... }
+type Iterator interface {
+
+	// HasNext advances to the next pair and reports whether there is one.
+	HasNext() bool
+
+	// Get returns the current key and value.
+	Get() (string, string)
+
+	// Err returns the error that stopped the iteration, or nil at the end of the range.
+	Err() error
+
+	// Close releases the resources held by the iterator.
+	Close() error
+}
+
+type kvStore struct {
+	store Store
+}
+
+func New() (Store, error) {
+	store, err := ConnectLSMStore("./data/")
+	if err != nil {
+		return nil, err
+	}
+	return kvStore{
+		store: store,
+	}, nil
+
+}
+
+func (jdb kvStore) Put(K, V string) error {
+	return jdb.store.Put(K, V)
+}
+
+func (jdb kvStore) Del(K string) error {
+	return jdb.store.Del(K)
+}
+func (jdb kvStore) Get(K string) (string, error) {
+	return jdb.store.Get(K)
+}
+func (jdb kvStore) Scan(start, end string) (Iterator, error) {
+	return jdb.store.Scan(start, end)
+}
+func (jdb kvStore) ScanPrefix(prefix string) (Iterator, error) {
+	return jdb.store.ScanPrefix(prefix)
+}
+func (jdb kvStore) Sync() error {
+	return jdb.store.Sync()
+}
+func (jdb kvStore) Close() error {
+	return jdb.store.Close()
+}
@@ -0,0 +1,213 @@
+package kvstorefromscratchpart3
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	OPERATION_PUT = "PUT"
+	OPERATION_DEL = "DEL"
+)
+
+var (
+	ErrKeyDoesntExist = errors.New("given key doesn't exist")
+	ErrStoreClosed    = errors.New("store is closed")
+)
+
+// LSMStore is a log-structured merge tree. Writes are appended to a write-ahead log and
+// applied to an in-memory memtable; once the memtable is full it is frozen and written
+// out by a background goroutine as an immutable, sorted SSTable, after which its log is
+// deleted. Reads consult the memtables and then the SSTables, newest first.
+//
+// Unlike FileStore in part02, only the recent writes are held in memory, and keys are
+// kept sorted, so scans read them in order. LSMStore is safe for concurrent use: writes
+// are serialized through mu, while Gets and Scans share it.
+type LSMStore struct {
+	mu   sync.RWMutex // Guards the fields below; held exclusively by writers
+	cond *sync.Cond   // Signalled on mu when a flush finishes or the store is closed
+
+	dir        string
+	opts       Options
+	mem        *memtable  // The active memtable new writes go to
+	wal        *DataFile  // Write-ahead log of the active memtable
+	immutables []frozen   // Frozen memtables waiting to be flushed, oldest first
+	sstables   []*sstable // Flushed SSTables, oldest first
+	nextID     int        // ID of the next write-ahead log
+	closed     bool
+	dirty      bool  // The write-ahead log has writes that haven't been fsynced
+	flushErr   error // Set when a background flush fails; later writes return it
+
+	flushKick chan struct{} // Wakes up the flusher; buffered so kicks don't block
+	stopFlush chan struct{} // Closed to stop the flusher
+	flushDone chan struct{} // Closed once the flusher has exited
+}
+
+// frozen is a memtable that no longer takes writes, along with the write-ahead log that
+// holds its contents until they are flushed to an SSTable of the same ID.
+type frozen struct {
+	mem *memtable
+	wal *DataFile
+}
+
+// ConnectLSMStore opens the store in the directory at path using DefaultOptions.
+// See ConnectLSMStoreWithOptions.
+func ConnectLSMStore(path string) (*LSMStore, error) {
+	return ConnectLSMStoreWithOptions(path, DefaultOptions())
+}
+
+// ConnectLSMStoreWithOptions initializes and returns a new LSMStore in the specified
+// directory, creating it if necessary. It opens the SSTables in it and replays the
+// write-ahead logs that were not flushed yet into memtables; see recover for the details.
+// A background goroutine flushes full memtables to SSTables until Close is called.
+// If the options are invalid, the directory cannot be created or a file cannot be opened
+// or replayed, an error is returned.
+func ConnectLSMStoreWithOptions(path string, opts Options) (*LSMStore, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	store := &LSMStore{
+		dir:       path,
+		opts:      opts,
+		flushKick: make(chan struct{}, 1),
+		stopFlush: make(chan struct{}),
+		flushDone: make(chan struct{}),
+	}
+	store.cond = sync.NewCond(&store.mu)
+	if err := store.recover(); err != nil {
+		return nil, err
+	}
+	go store.flushLoop()
+	store.kickFlush()
+	return store, nil
+}
+
+// Put stores the given key-value pair.
+// It is appended to the write-ahead log and then applied to the active memtable.
+// Returns an error if the record can't be written, in SYNC_ALWAYS mode if it can't be
+// fsynced, or if a background flush has failed.
+func (s *LSMStore) Put(K, V string) error {
+	return s.write(entry{key: K, val: V})
+}
+
+// Del removes the given key. Since older tables may still hold the key, a tombstone is
+// written that hides them. Deleting a key that doesn't exist is not an error.
+func (s *LSMStore) Del(K string) error {
+	return s.write(entry{key: K, tombstone: true})
+}
+
+// write logs e, applies it to the active memtable and freezes the memtable if it is full.
+func (s *LSMStore) write(e entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	if s.flushErr != nil {
+		return s.flushErr
+	}
+
+	rec := record{operation: OPERATION_PUT, data: KVPair{key: e.key, val: e.val}}
+	if e.tombstone {
+		rec.operation = OPERATION_DEL
+	}
+	if _, err := s.wal.Append(rec); err != nil {
+		return err
+	}
+	if s.opts.SyncMode == SYNC_ALWAYS {
+		if err := s.wal.Sync(); err != nil {
+			return err
+		}
+	} else {
+		s.dirty = true
+	}
+	s.mem.put(e)
+
+	return s.maybeFreeze()
+}
+
+// Get retrieves the value of the given key. The active memtable is checked first, then the
+// frozen memtables and the SSTables from newest to oldest; the first entry found decides.
+// If the key doesn't exist or was deleted, ErrKeyDoesntExist is returned.
+func (s *LSMStore) Get(K string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return "", ErrStoreClosed
+	}
+
+	e, ok := s.mem.get(K)
+	for i := len(s.immutables) - 1; !ok && i >= 0; i-- {
+		e, ok = s.immutables[i].mem.get(K)
+	}
+	for i := len(s.sstables) - 1; !ok && i >= 0; i-- {
+		var err error
+		e, ok, err = s.sstables[i].get(K)
+		if err != nil {
+			return "", err
+		}
+	}
+	if !ok || e.tombstone {
+		return "", ErrKeyDoesntExist
+	}
+	return e.val, nil
+}
+
+// Sync fsyncs the active write-ahead log, making every acknowledged write durable. Frozen
+// memtables are covered by their own logs, which are fsynced when they are frozen.
+func (s *LSMStore) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	return s.syncWAL()
+}
+
+// syncWAL fsyncs the active write-ahead log if it has unsynced writes. Callers hold mu.
+func (s *LSMStore) syncWAL() error {
+	if !s.dirty {
+		return nil
+	}
+	if err := s.wal.Sync(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Close stops the background flusher, fsyncs the write-ahead log and closes every file.
+// Frozen memtables that weren't flushed yet are replayed from their logs on the next open.
+// Closing a closed store is a no-op.
+func (s *LSMStore) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.cond.Broadcast() // Wake writers waiting for a flush
+	s.mu.Unlock()
+
+	close(s.stopFlush)
+	<-s.flushDone
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.syncWAL()
+	if closeErr := s.wal.Close(); err == nil {
+		err = closeErr
+	}
+	for _, f := range s.immutables {
+		if closeErr := f.wal.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	for _, t := range s.sstables {
+		if closeErr := t.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
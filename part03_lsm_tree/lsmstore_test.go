@@ -0,0 +1,277 @@
+package kvstorefromscratchpart3
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// smallMemtableOptions returns options that freeze a memtable every few dozen writes.
+func smallMemtableOptions() Options {
+	opts := DefaultOptions()
+	opts.MemtableSize = 1024
+	opts.BlockSize = 128
+	return opts
+}
+
+func TestLSMStore_PutGetDel(t *testing.T) {
+	store, err := ConnectLSMStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectLSMStore failed: %v", err)
+	}
+	defer store.Close()
+	var _ Store = store
+
+	if err := store.Put("foo", "bar"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	got, err := store.Get("foo")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if got != "bar" {
+		t.Errorf("Get returned %q, want bar", got)
+	}
+	if err := store.Del("foo"); err != nil {
+		t.Fatalf("Del failed: %v", err)
+	}
+	if _, err := store.Get("foo"); err != ErrKeyDoesntExist {
+		t.Errorf("Get after Del returned %v, want ErrKeyDoesntExist", err)
+	}
+	if err := store.Del("never-written"); err != nil {
+		t.Errorf("Del of a missing key returned %v, want nil", err)
+	}
+}
+
+func TestLSMStore_FlushesToSSTables(t *testing.T) {
+	tmpDir := t.TempDir()
+	store, err := ConnectLSMStoreWithOptions(tmpDir, smallMemtableOptions())
+	if err != nil {
+		t.Fatalf("ConnectLSMStoreWithOptions failed: %v", err)
+	}
+
+	if err := addNItemsToKVStore(store, 500); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	// Overwrites and deletes of keys that are only in SSTables by now
+	store.Put("key-7", "changed")
+	store.Del("key-8")
+	if err := store.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	tables, _ := filepath.Glob(filepath.Join(tmpDir, "*"+SSTABLE_EXT))
+	wals, _ := filepath.Glob(filepath.Join(tmpDir, "*"+WAL_EXT))
+	if len(tables) < 10 || len(wals) != 1 {
+		t.Errorf("%d SSTables and %d write-ahead logs after Flush, want many SSTables and only the active log", len(tables), len(wals))
+	}
+	if store.mem.Len() != 0 || len(store.immutables) != 0 {
+		t.Errorf("%d keys in the memtable and %d frozen memtables after Flush, want none", store.mem.Len(), len(store.immutables))
+	}
+	checkItems := func(store *LSMStore) {
+		t.Helper()
+		for i := 0; i < 500; i++ {
+			key, want := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)
+			got, err := store.Get(key)
+			switch i {
+			case 7:
+				want = "changed"
+			case 8:
+				if err != ErrKeyDoesntExist {
+					t.Errorf("Get(key-8) returned %v, want ErrKeyDoesntExist", err)
+				}
+				continue
+			}
+			if err != nil || got != want {
+				t.Errorf("Get(%s) returned (%q, %v), want %q", key, got, err, want)
+			}
+		}
+	}
+	checkItems(store)
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	store, err = ConnectLSMStoreWithOptions(tmpDir, smallMemtableOptions())
+	if err != nil {
+		t.Fatalf("ConnectLSMStoreWithOptions failed: %v", err)
+	}
+	defer store.Close()
+	checkItems(store)
+}
+
+func TestLSMStore_RecoversUnflushedWrites(t *testing.T) {
+	tmpDir := t.TempDir()
+	opts := smallMemtableOptions()
+	store, err := ConnectLSMStoreWithOptions(tmpDir, opts)
+	if err != nil {
+		t.Fatalf("ConnectLSMStoreWithOptions failed: %v", err)
+	}
+	if err := addNItemsToKVStore(store, 100); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	store.Del("key-99")
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// A crash after an SSTable was renamed into place but before its log was deleted
+	// leaves both; the log must not be replayed on top of newer writes
+	tables, _ := filepath.Glob(filepath.Join(tmpDir, "*"+SSTABLE_EXT))
+	if len(tables) == 0 {
+		t.Fatalf("no SSTables were flushed")
+	}
+	stale, err := NewDataFile(tmpDir, 1)
+	if err != nil {
+		t.Fatalf("NewDataFile failed: %v", err)
+	}
+	stale.Append(record{operation: OPERATION_PUT, data: KVPair{key: "key-0", val: "stale"}})
+	stale.Close()
+
+	// A write torn in half by a crash at the end of the active log
+	wals, _ := filepath.Glob(filepath.Join(tmpDir, "*"+WAL_EXT))
+	active := wals[len(wals)-1]
+	torn, err := (&record{operation: OPERATION_PUT, data: KVPair{key: "torn", val: "write"}}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+	f, err := os.OpenFile(active, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	f.Write(torn[:len(torn)-3])
+	f.Close()
+
+	store, err = ConnectLSMStoreWithOptions(tmpDir, opts)
+	if err != nil {
+		t.Fatalf("ConnectLSMStoreWithOptions failed: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 99; i++ {
+		key, want := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)
+		if got, err := store.Get(key); err != nil || got != want {
+			t.Errorf("Get(%s) returned (%q, %v), want %q", key, got, err, want)
+		}
+	}
+	for _, key := range []string{"key-99", "torn"} {
+		if _, err := store.Get(key); err != ErrKeyDoesntExist {
+			t.Errorf("Get(%s) returned %v, want ErrKeyDoesntExist", key, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, fileName(1, WAL_EXT))); !os.IsNotExist(err) {
+		t.Errorf("log of a flushed memtable still exists after recovery (%v)", err)
+	}
+	// Writes continue in the recovered log
+	if err := store.Put("after", "recovery"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if got, err := store.Get("after"); err != nil || got != "recovery" {
+		t.Errorf("Get(after) returned (%q, %v), want recovery", got, err)
+	}
+}
+
+func TestLSMStore_RejectsCorruptLog(t *testing.T) {
+	tmpDir := t.TempDir()
+	store, err := ConnectLSMStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectLSMStore failed: %v", err)
+	}
+	addNItemsToKVStore(store, 10)
+	store.Close()
+
+	// Damage in the middle of the log is not a torn write, so it isn't silently cut off
+	path := filepath.Join(tmpDir, fileName(1, WAL_EXT))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	data[RECORD_HEADER_SIZE+2] ^= 0xFF
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if _, err := ConnectLSMStore(tmpDir); err != ErrCorruptRecord {
+		t.Errorf("ConnectLSMStore returned %v, want ErrCorruptRecord", err)
+	}
+}
+
+func TestLSMStore_ConcurrentWriters(t *testing.T) {
+	opts := smallMemtableOptions()
+	opts.SyncMode = SYNC_NEVER
+	opts.MaxImmutableMemtables = 1 // Writers regularly wait for the flusher
+	store, err := ConnectLSMStoreWithOptions(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("ConnectLSMStoreWithOptions failed: %v", err)
+	}
+	defer store.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("w%d-%d", w, i)
+				if err := store.Put(key, key); err != nil {
+					t.Errorf("Put failed: %v", err)
+					return
+				}
+				if got, err := store.Get(key); err != nil || got != key {
+					t.Errorf("Get(%s) returned (%q, %v)", key, got, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if err := store.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if len(store.sstables) == 0 {
+		t.Errorf("no SSTables after 1600 writes")
+	}
+	if got, err := store.Get("w3-150"); err != nil || got != "w3-150" {
+		t.Errorf("Get(w3-150) returned (%q, %v)", got, err)
+	}
+}
+
+func TestLSMStore_Closed(t *testing.T) {
+	store, err := ConnectLSMStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectLSMStore failed: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Errorf("second Close returned %v, want nil", err)
+	}
+	if err := store.Put("a", "1"); err != ErrStoreClosed {
+		t.Errorf("Put returned %v, want ErrStoreClosed", err)
+	}
+	if _, err := store.Get("a"); err != ErrStoreClosed {
+		t.Errorf("Get returned %v, want ErrStoreClosed", err)
+	}
+	if _, err := store.Scan("", ""); err != ErrStoreClosed {
+		t.Errorf("Scan returned %v, want ErrStoreClosed", err)
+	}
+}
+
+func TestOptions_RejectsInvalid(t *testing.T) {
+	for _, modify := range []func(*Options){
+		func(o *Options) { o.MemtableSize = 0 },
+		func(o *Options) { o.BlockSize = -1 },
+		func(o *Options) { o.MaxImmutableMemtables = 0 },
+		func(o *Options) { o.SyncMode = SyncMode(5) },
+	} {
+		opts := DefaultOptions()
+		modify(&opts)
+		if _, err := ConnectLSMStoreWithOptions(t.TempDir(), opts); err != ErrInvalidOptions {
+			t.Errorf("ConnectLSMStoreWithOptions returned %v, want ErrInvalidOptions", err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package kvstorefromscratchpart3
+
+import (
+	"math/rand/v2"
+)
+
+const (
+	SKIPLIST_MAX_LEVEL = 32
+	SKIPLIST_P         = 0.25 // Probability that a node is promoted to the next level
+
+	MEMTABLE_ENTRY_OVERHEAD = 32 // Rough per-entry cost of a node, counted towards MemtableSize
+)
+
+// entry is a key and its latest value, or a tombstone if the key was deleted. Tombstones
+// are kept in memtables and SSTables so a delete hides older values in older tables.
+type entry struct {
+	key       string
+	val       string
+	tombstone bool
+}
+
+// memtable holds the most recent writes in a skip list sorted by key. It is not safe for
+// concurrent use on its own: the active memtable is guarded by the store's mutex, and once
+// frozen a memtable is only ever read.
+type memtable struct {
+	head  *memtableNode // Sentinel; its entry is unused
+	level int           // Number of levels currently in use
+	count int
+	size  int64 // Approximate number of bytes held, see MEMTABLE_ENTRY_OVERHEAD
+}
+
+type memtableNode struct {
+	entry entry
+	next  []*memtableNode // next[i] is the following node on level i
+}
+
+// newMemtable creates an empty memtable.
+func newMemtable() *memtable {
+	return &memtable{
+		head:  &memtableNode{next: make([]*memtableNode, SKIPLIST_MAX_LEVEL)},
+		level: 1,
+	}
+}
+
+// findPredecessors fills update with the last node before key on every level and returns
+// the first node whose key is >= key, or nil.
+func (m *memtable) findPredecessors(key string, update *[SKIPLIST_MAX_LEVEL]*memtableNode) *memtableNode {
+	node := m.head
+	for level := m.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].entry.key < key {
+			node = node.next[level]
+		}
+		if update != nil {
+			update[level] = node
+		}
+	}
+	return node.next[0]
+}
+
+// put records the latest value of key. A tombstone records that key was deleted.
+func (m *memtable) put(e entry) {
+	var update [SKIPLIST_MAX_LEVEL]*memtableNode
+	node := m.findPredecessors(e.key, &update)
+	if node != nil && node.entry.key == e.key {
+		m.size += int64(len(e.val)) - int64(len(node.entry.val))
+		node.entry = e
+		return
+	}
+
+	level := randomLevel()
+	for ; m.level < level; m.level++ {
+		update[m.level] = m.head
+	}
+	node = &memtableNode{
+		entry: e,
+		next:  make([]*memtableNode, level),
+	}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	m.count++
+	m.size += int64(len(e.key)+len(e.val)) + MEMTABLE_ENTRY_OVERHEAD
+}
+
+// randomLevel picks the number of levels for a new node: 1, promoted to each further
+// level with probability SKIPLIST_P.
+func randomLevel() int {
+	level := 1
+	for level < SKIPLIST_MAX_LEVEL && rand.Float64() < SKIPLIST_P {
+		level++
+	}
+	return level
+}
+
+// get returns the latest entry of key and whether the memtable has one. The entry may be
+// a tombstone, in which case older tables must not be consulted.
+func (m *memtable) get(key string) (entry, bool) {
+	node := m.findPredecessors(key, nil)
+	if node != nil && node.entry.key == key {
+		return node.entry, true
+	}
+	return entry{}, false
+}
+
+// Len returns the number of keys in the memtable, tombstones included.
+func (m *memtable) Len() int {
+	return m.count
+}
+
+// iterator returns an entrySource over the entries in [start, end), tombstones included.
+// The memtable must not be modified while the iterator is in use.
+func (m *memtable) iterator(start, end string) entrySource {
+	return &memtableIterator{next: m.findPredecessors(start, nil), end: end}
+}
+
+// copyRange returns an entrySource over a copy of the entries in [start, end), for
+// iterating over the active memtable after the store's mutex is released.
+func (m *memtable) copyRange(start, end string) entrySource {
+	var entries []entry
+	for node := m.findPredecessors(start, nil); node != nil; node = node.next[0] {
+		if end != "" && node.entry.key >= end {
+			break
+		}
+		entries = append(entries, node.entry)
+	}
+	return &sliceIterator{entries: entries, pos: -1}
+}
+
+// memtableIterator walks the nodes of a frozen memtable in key order.
+type memtableIterator struct {
+	next    *memtableNode
+	end     string
+	current entry
+}
+
+func (it *memtableIterator) HasNext() bool {
+	if it.next == nil || (it.end != "" && it.next.entry.key >= it.end) {
+		return false
+	}
+	it.current = it.next.entry
+	it.next = it.next.next[0]
+	return true
+}
+
+func (it *memtableIterator) Entry() entry { return it.current }
+
+func (it *memtableIterator) Err() error { return nil }
+
+// sliceIterator walks a sorted slice of entries.
+type sliceIterator struct {
+	entries []entry
+	pos     int
+}
+
+func (it *sliceIterator) HasNext() bool {
+	if it.pos+1 >= len(it.entries) {
+		return false
+	}
+	it.pos++
+	return true
+}
+
+func (it *sliceIterator) Entry() entry { return it.entries[it.pos] }
+
+func (it *sliceIterator) Err() error { return nil }
@@ -0,0 +1,71 @@
+package kvstorefromscratchpart3
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// drainEntries formats the entries of src as "key=value", or "key" followed by " (deleted)"
+// for tombstones.
+func drainEntries(t *testing.T, src entrySource) []string {
+	t.Helper()
+	var got []string
+	for src.HasNext() {
+		e := src.Entry()
+		if e.tombstone {
+			got = append(got, e.key+" (deleted)")
+		} else {
+			got = append(got, e.key+"="+e.val)
+		}
+	}
+	if err := src.Err(); err != nil {
+		t.Fatalf("iteration failed: %v", err)
+	}
+	return got
+}
+
+func TestMemtable_PutGetOrder(t *testing.T) {
+	mem := newMemtable()
+	for i := 99; i >= 0; i-- {
+		mem.put(entry{key: fmt.Sprintf("key-%02d", i), val: "old"})
+	}
+	mem.put(entry{key: "key-10", val: "new"})
+	mem.put(entry{key: "key-11", tombstone: true})
+
+	if e, ok := mem.get("key-10"); !ok || e.val != "new" {
+		t.Errorf("get(key-10) returned (%+v, %v), want new", e, ok)
+	}
+	if e, ok := mem.get("key-11"); !ok || !e.tombstone {
+		t.Errorf("get(key-11) returned (%+v, %v), want a tombstone", e, ok)
+	}
+	if _, ok := mem.get("missing"); ok {
+		t.Errorf("get(missing) found an entry")
+	}
+	if mem.Len() != 100 {
+		t.Errorf("Len is %d, want 100", mem.Len())
+	}
+
+	got := drainEntries(t, mem.iterator("key-09", "key-13"))
+	want := []string{"key-09=old", "key-10=new", "key-11 (deleted)", "key-12=old"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("iterator returned %q, want %q", got, want)
+	}
+	if copied := drainEntries(t, mem.copyRange("key-09", "key-13")); !reflect.DeepEqual(copied, want) {
+		t.Errorf("copyRange returned %q, want %q", copied, want)
+	}
+}
+
+func TestMemtable_Size(t *testing.T) {
+	mem := newMemtable()
+	mem.put(entry{key: "k", val: "12345"})
+	want := int64(1+5) + MEMTABLE_ENTRY_OVERHEAD
+	if mem.size != want {
+		t.Errorf("size is %d, want %d", mem.size, want)
+	}
+	mem.put(entry{key: "k", val: "12"})
+	mem.put(entry{key: "k", tombstone: true})
+	if want := int64(1) + MEMTABLE_ENTRY_OVERHEAD; mem.size != want {
+		t.Errorf("size after overwrites is %d, want %d", mem.size, want)
+	}
+}
@@ -0,0 +1,80 @@
+package kvstorefromscratchpart3
+
+import (
+	"errors"
+)
+
+const (
+	DEFAULT_MEMTABLE_SIZE             = 4 * 1024 * 1024 // 4 MiB
+	DEFAULT_BLOCK_SIZE                = 4 * 1024        // 4 KiB
+	DEFAULT_MAX_IMMUTABLE_MEMTABLES   = 2
+	DEFAULT_BLOOM_FALSE_POSITIVE_RATE = 0.01
+)
+
+// SyncMode controls when write-ahead log records are fsynced to stable storage.
+type SyncMode int
+
+const (
+	// SYNC_ALWAYS fsyncs the write-ahead log after every Put and Del, before it returns.
+	SYNC_ALWAYS SyncMode = iota
+	// SYNC_NEVER leaves flushing to the operating system. Writes survive a crash of the
+	// process but not of the machine, unless Sync is called explicitly. SSTables are
+	// always fsynced when they are written.
+	SYNC_NEVER
+)
+
+var (
+	ErrInvalidOptions = errors.New("invalid store options")
+)
+
+// Options configures an LSMStore. Use DefaultOptions and override individual fields
+// rather than building the struct from scratch, so new fields get sensible defaults.
+type Options struct {
+	// MemtableSize is the approximate size in bytes of the keys and values a memtable
+	// holds before it is frozen and flushed to an SSTable in the background.
+	MemtableSize int64
+
+	// BlockSize is the size in bytes after which an SSTable data block is closed. The
+	// sparse index holds the first key of every block, so larger blocks mean a smaller
+	// index but more bytes read per Get.
+	BlockSize int
+
+	// MaxImmutableMemtables is the number of frozen memtables that may wait to be flushed.
+	// Once it is reached, writes block until the flush catches up.
+	MaxImmutableMemtables int
+
+	// SyncMode selects the durability/latency trade-off of writes.
+	SyncMode SyncMode
+
+	// BloomFalsePositiveRate is the fraction of lookups for absent keys that each SSTable's
+	// Bloom filter lets through to a block read. Lower rates cost more memory: about 9.6
+	// bits per key at 1%, and 4.8 more for every tenfold reduction. It applies to SSTables
+	// written from now on; existing filters keep the rate they were built with.
+	BloomFalsePositiveRate float64
+}
+
+// DefaultOptions returns the Options used by ConnectLSMStore.
+func DefaultOptions() Options {
+	return Options{
+		MemtableSize:          DEFAULT_MEMTABLE_SIZE,
+		BlockSize:             DEFAULT_BLOCK_SIZE,
+		MaxImmutableMemtables: DEFAULT_MAX_IMMUTABLE_MEMTABLES,
+		SyncMode:              SYNC_ALWAYS,
+
+		BloomFalsePositiveRate: DEFAULT_BLOOM_FALSE_POSITIVE_RATE,
+	}
+}
+
+// validate returns ErrInvalidOptions if the options can't be used to open a store.
+func (o Options) validate() error {
+	if o.MemtableSize <= 0 || o.BlockSize <= 0 || o.MaxImmutableMemtables <= 0 {
+		return ErrInvalidOptions
+	}
+	if o.SyncMode != SYNC_ALWAYS && o.SyncMode != SYNC_NEVER {
+		return ErrInvalidOptions
+	}
+	if !(o.BloomFalsePositiveRate > 0 && o.BloomFalsePositiveRate < 1) {
+		return ErrInvalidOptions
+	}
+	return nil
+}
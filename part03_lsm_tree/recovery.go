@@ -0,0 +1,197 @@
+package kvstorefromscratchpart3
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// recover loads the store's files from its directory:
+//
+//   - temporary files left behind by an interrupted flush are deleted, along with Bloom
+//     filters whose SSTable was never renamed into place;
+//   - every SSTable is opened and its index and Bloom filter loaded;
+//   - a write-ahead log whose SSTable exists was flushed already and is deleted;
+//   - every other log is replayed into a memtable, cutting off a record left half-written
+//     by a crash. The newest one becomes the active memtable and the others are queued to
+//     be flushed.
+func (s *LSMStore) recover() error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	for _, ext := range []string{SSTABLE_TEMP_EXT, BLOOM_TEMP_EXT} {
+		tempFiles, err := filepath.Glob(filepath.Join(s.dir, "*"+ext))
+		if err != nil {
+			return err
+		}
+		for _, tempFile := range tempFiles {
+			if err := os.Remove(tempFile); err != nil {
+				return err
+			}
+		}
+	}
+
+	tableIDs, err := listFileIDs(s.dir, SSTABLE_EXT)
+	if err != nil {
+		return err
+	}
+	filterIDs, err := listFileIDs(s.dir, BLOOM_EXT)
+	if err != nil {
+		return err
+	}
+	walIDs, err := listFileIDs(s.dir, WAL_EXT)
+	if err != nil {
+		return err
+	}
+
+	flushed := make(map[int]bool, len(tableIDs))
+	for _, id := range tableIDs {
+		flushed[id] = true
+	}
+	for _, id := range filterIDs {
+		if !flushed[id] {
+			if err := os.Remove(filepath.Join(s.dir, fileName(id, BLOOM_EXT))); err != nil {
+				return err
+			}
+		}
+	}
+	for _, id := range tableIDs {
+		table, err := openSSTable(s.dir, id, s.opts.BloomFalsePositiveRate)
+		if err != nil {
+			s.closeFiles()
+			return err
+		}
+		s.sstables = append(s.sstables, table)
+		s.nextID = max(s.nextID, id+1)
+	}
+
+	for _, id := range walIDs {
+		s.nextID = max(s.nextID, id+1)
+		wal, err := NewDataFile(s.dir, id)
+		if err != nil {
+			s.closeFiles()
+			return err
+		}
+		if flushed[id] {
+			if err := wal.Remove(); err != nil {
+				s.closeFiles()
+				return err
+			}
+			continue
+		}
+		mem, err := replayWAL(wal)
+		if err != nil {
+			wal.Close()
+			s.closeFiles()
+			return err
+		}
+		if mem.Len() == 0 && id != walIDs[len(walIDs)-1] {
+			if err := wal.Remove(); err != nil {
+				s.closeFiles()
+				return err
+			}
+			continue // Nothing to flush
+		}
+		s.immutables = append(s.immutables, frozen{mem: mem, wal: wal})
+	}
+
+	// The newest log keeps taking writes, unless there is none yet
+	if n := len(s.immutables); n > 0 {
+		s.mem, s.wal = s.immutables[n-1].mem, s.immutables[n-1].wal
+		s.immutables = s.immutables[:n-1]
+		return nil
+	}
+	s.nextID = max(s.nextID, 1)
+	wal, err := NewDataFile(s.dir, s.nextID)
+	if err != nil {
+		s.closeFiles()
+		return err
+	}
+	s.nextID++
+	s.mem, s.wal = newMemtable(), wal
+	return nil
+}
+
+// replayWAL applies every record of the write-ahead log to a new memtable. A record left
+// half-written at the end of the log by a crash is truncated away, see isTornTail; any
+// other damage is returned as an error rather than losing the records after it.
+func replayWAL(wal *DataFile) (*memtable, error) {
+	mem := newMemtable()
+	it, err := wal.GetIterator(0)
+	if err != nil {
+		return nil, err
+	}
+	for it.HasNext() {
+		rec, _ := it.Get()
+		mem.put(entry{key: rec.GetKey(), val: rec.GetValue(), tombstone: rec.operation == OPERATION_DEL})
+	}
+	if err := it.Err(); err != nil {
+		if !isTornTail(wal, it.Offset(), err) {
+			return nil, err
+		}
+		if err := wal.Truncate(it.Offset()); err != nil {
+			return nil, err
+		}
+	}
+	return mem, nil
+}
+
+// isTornTail reports whether the bytes of wal from offset on look like the remains of an
+// interrupted append: a truncated record, a run of zero bytes left by a file that was
+// extended but never written, or a single last record that fails its checksum.
+func isTornTail(wal *DataFile, offset int64, replayErr error) bool {
+	if errors.Is(replayErr, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	tail := make([]byte, wal.Size()-offset)
+	if _, err := wal.file.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return false
+	}
+	if len(bytes.Trim(tail, "\x00")) == 0 {
+		return true
+	}
+	if len(tail) < RECORD_HEADER_SIZE {
+		return false
+	}
+	header, err := decodeRecordHeader(tail[:RECORD_HEADER_SIZE])
+	return err == nil && RECORD_HEADER_SIZE+header.bodySize() == int64(len(tail))
+}
+
+// listFileIDs returns the IDs of the files in dir with the given extension, in increasing
+// order. Files whose name isn't a number are ignored.
+func listFileIDs(dir, ext string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ext)
+		if !ok || e.IsDir() {
+			continue
+		}
+		id, err := strconv.Atoi(name)
+		if err != nil || id <= 0 {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// closeFiles closes every file recover opened so far, after it failed.
+func (s *LSMStore) closeFiles() {
+	for _, f := range s.immutables {
+		f.wal.Close()
+	}
+	for _, t := range s.sstables {
+		t.Close()
+	}
+}
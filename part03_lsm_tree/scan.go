@@ -0,0 +1,163 @@
+package kvstorefromscratchpart3
+
+import (
+	"container/heap"
+)
+
+// entrySource walks the entries of a memtable or SSTable in increasing key order,
+// tombstones included.
+type entrySource interface {
+	HasNext() bool
+	Entry() entry
+	Err() error
+}
+
+// ScanIterator merges the memtables and SSTables of a store into a single stream of live
+// key/value pairs in increasing key order. Where several tables hold the same key, the
+// newest one wins, and keys whose newest entry is a tombstone are skipped.
+//
+// The tables are fixed when the scan starts and the active memtable is copied, so a scan
+// sees the store as it was at that moment; writes made during the scan are not visible.
+type ScanIterator struct {
+	sources mergeHeap
+	end     string
+	key     string
+	val     string
+	err     error
+}
+
+// Scan returns an iterator over the live keys in [start, end) in increasing key order.
+// An empty end means no upper bound, so Scan("", "") visits every key.
+func (s *LSMStore) Scan(start, end string) (Iterator, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+
+	// Newest first, so a lower priority means a newer table
+	sources := []entrySource{s.mem.copyRange(start, end)}
+	for i := len(s.immutables) - 1; i >= 0; i-- {
+		sources = append(sources, s.immutables[i].mem.iterator(start, end))
+	}
+	for i := len(s.sstables) - 1; i >= 0; i-- {
+		sources = append(sources, s.sstables[i].iterator(start, end))
+	}
+
+	it := &ScanIterator{end: end}
+	for priority, src := range sources {
+		if !it.push(&mergeSource{src: src, priority: priority}) {
+			return nil, it.err
+		}
+	}
+	return it, nil
+}
+
+// ScanPrefix returns an iterator over the live keys starting with prefix, in increasing
+// key order.
+func (s *LSMStore) ScanPrefix(prefix string) (Iterator, error) {
+	return s.Scan(prefix, prefixEnd(prefix))
+}
+
+// prefixEnd returns the smallest key greater than every key starting with prefix, or ""
+// (no upper bound) if there is none, i.e. the prefix is empty or all 0xFF bytes.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// push advances src to its next entry and adds it to the heap if it has one.
+// It reports false if src failed.
+func (it *ScanIterator) push(src *mergeSource) bool {
+	if src.src.HasNext() {
+		src.current = src.src.Entry()
+		heap.Push(&it.sources, src)
+		return true
+	}
+	if err := src.src.Err(); err != nil {
+		it.err = err
+		return false
+	}
+	return true
+}
+
+// HasNext advances to the next live key and reports whether there is one.
+// It returns false at the end of the range or on error; use Err to tell them apart.
+func (it *ScanIterator) HasNext() bool {
+	for it.err == nil && it.sources.Len() > 0 {
+		newest := heap.Pop(&it.sources).(*mergeSource)
+		e := newest.current
+		// Older entries of the same key are shadowed by the newest one
+		for it.sources.Len() > 0 && it.sources[0].current.key == e.key {
+			if !it.push(heap.Pop(&it.sources).(*mergeSource)) {
+				return false
+			}
+		}
+		if !it.push(newest) {
+			return false
+		}
+		if it.end != "" && e.key >= it.end {
+			return false
+		}
+		if e.tombstone {
+			continue
+		}
+		it.key, it.val = e.key, e.val
+		return true
+	}
+	return false
+}
+
+// Get returns the current key and value.
+func (it *ScanIterator) Get() (string, string) {
+	return it.key, it.val
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *ScanIterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator. It must not be used afterwards.
+func (it *ScanIterator) Close() error {
+	it.sources = nil
+	return nil
+}
+
+// mergeSource is an entrySource in the merge heap, positioned at its current entry.
+type mergeSource struct {
+	src      entrySource
+	priority int // Lower is newer
+	current  entry
+}
+
+// mergeHeap orders sources by their current key, and sources at the same key from newest
+// to oldest.
+type mergeHeap []*mergeSource
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].current.key != h[j].current.key {
+		return h[i].current.key < h[j].current.key
+	}
+	return h[i].priority < h[j].priority
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x any) { *h = append(*h, x.(*mergeSource)) }
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
@@ -0,0 +1,115 @@
+package kvstorefromscratchpart3
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// collectScan drains a scan into "key=value" strings. It takes the scan's return values
+// directly so calls read as collectScan(t)(store.Scan(...)).
+func collectScan(t *testing.T) func(it Iterator, err error) []string {
+	return func(it Iterator, err error) []string {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("scan failed: %v", err)
+		}
+		defer it.Close()
+		var pairs []string
+		for it.HasNext() {
+			key, val := it.Get()
+			pairs = append(pairs, key+"="+val)
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("iteration failed: %v", err)
+		}
+		return pairs
+	}
+}
+
+func TestLSMStore_ScanMergesTables(t *testing.T) {
+	store, err := ConnectLSMStoreWithOptions(t.TempDir(), smallMemtableOptions())
+	if err != nil {
+		t.Fatalf("ConnectLSMStoreWithOptions failed: %v", err)
+	}
+	defer store.Close()
+
+	// The oldest values end up in an SSTable, newer ones in a frozen memtable and the
+	// newest in the active memtable, each shadowing the ones before
+	for _, key := range []string{"user:42:name", "user:42:email", "user:421:name", "user:43:name", "account:1", "user:42:zip", "\xff\xff"} {
+		store.Put(key, "v1")
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	store.Put("user:42:email", "v2")
+	store.Del("user:42:zip")
+	store.Put("user:42:gone", "v2")
+	store.mu.Lock()
+	store.freeze()
+	store.mu.Unlock()
+	store.Put("user:42:age", "v3")
+	store.Put("user:42:email", "v3")
+	store.Del("user:42:gone")
+
+	got := collectScan(t)(store.ScanPrefix("user:42:"))
+	want := []string{"user:42:age=v3", "user:42:email=v3", "user:42:name=v1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ScanPrefix(user:42:) returned %q, want %q", got, want)
+	}
+	got = collectScan(t)(store.Scan("user:420", "user:42:f"))
+	want = []string{"user:421:name=v1", "user:42:age=v3", "user:42:email=v3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan(user:420, user:42:f) returned %q, want %q", got, want)
+	}
+	if got := collectScan(t)(store.ScanPrefix("\xff")); !reflect.DeepEqual(got, []string{"\xff\xff=v1"}) {
+		t.Errorf("ScanPrefix(0xFF) returned %q", got)
+	}
+	if got := collectScan(t)(store.Scan("", "")); len(got) != 7 {
+		t.Errorf("Scan of everything returned %d keys, want 7: %q", len(got), got)
+	}
+}
+
+func TestLSMStore_ScanIsPointInTime(t *testing.T) {
+	store, err := ConnectLSMStoreWithOptions(t.TempDir(), smallMemtableOptions())
+	if err != nil {
+		t.Fatalf("ConnectLSMStoreWithOptions failed: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 300; i++ {
+		store.Put(fmt.Sprintf("key-%03d", i), "before")
+	}
+
+	it, err := store.Scan("", "")
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	defer it.Close()
+	// Writes, deletes and flushes during the scan don't show up in it
+	for i := 0; i < 300; i += 2 {
+		store.Put(fmt.Sprintf("key-%03d", i), "after")
+		store.Del(fmt.Sprintf("key-%03d", i+1))
+	}
+	store.Put("key-999", "after")
+	if err := store.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	var n int
+	for it.HasNext() {
+		key, val := it.Get()
+		if want := fmt.Sprintf("key-%03d", n); key != want || val != "before" {
+			t.Fatalf("scan returned %s=%s, want %s=before", key, val, want)
+		}
+		n++
+	}
+	if err := it.Err(); err != nil || n != 300 {
+		t.Errorf("scan returned %d keys and %v, want 300", n, err)
+	}
+
+	got := collectScan(t)(store.Scan("key-010", "key-014"))
+	want := []string{"key-010=after", "key-012=after"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan after the writes returned %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,489 @@
+package kvstorefromscratchpart3
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+)
+
+// On-disk layout of an SSTable (all integers are big-endian):
+//
+//	+--------------+-----+--------------+-------+--------+
+//	| data block 1 | ... | data block n | index | footer |
+//	+--------------+-----+--------------+-------+--------+
+//
+// A data block holds entries sorted by key, followed by a crc32 of the entries:
+//
+//	+--------+--------+-------+-----+-------+
+//	| keyLen | valLen | flags | key | value |
+//	|   4B   |   4B   |  1B   |     |       |
+//	+--------+--------+-------+-----+-------+
+//
+// Blocks are closed once they reach BlockSize. The index is sparse: it holds the first
+// key, offset and size of every block, so it is small enough to keep in memory and a Get
+// reads a single block. The footer has a fixed size and sits at the end of the file:
+//
+//	+-------------+-----------+-------+----------+---------+-------+
+//	| indexOffset | indexSize | count | indexCRC | version | magic |
+//	|     8B      |    4B     |  8B   |    4B    |   4B    |  4B   |
+//	+-------------+-----------+-------+----------+---------+-------+
+//
+// SSTables are written once to a temporary file, fsynced and renamed into place, and are
+// never modified afterwards. Their Bloom filter is written to a file of its own before the
+// rename, see bloom.go.
+const (
+	SSTABLE_EXT         = ".sst"
+	SSTABLE_TEMP_EXT    = ".sst.tmp"
+	SSTABLE_VERSION     = 1
+	SSTABLE_MAGIC       = 0x4C534D54 // "LSMT"
+	SSTABLE_FOOTER_SIZE = 32
+
+	sstEntryHeaderSize = 9
+	sstFlagTombstone   = 0x01
+)
+
+var (
+	ErrCorruptSSTable = errors.New("sstable is corrupt")
+)
+
+// blockHandle is the sparse index entry of a data block.
+type blockHandle struct {
+	firstKey string
+	offset   int64
+	size     int64 // Size of the entries, without the trailing crc32
+}
+
+// sstWriter writes the entries of one SSTable, which must be added in increasing key order.
+type sstWriter struct {
+	file              *os.File
+	writer            *bufio.Writer
+	dir               string
+	id                int
+	tempPath          string
+	finalPath         string
+	blockSize         int
+	falsePositiveRate float64
+
+	block    []byte // Entries of the block being built
+	firstKey string // First key of the block being built
+	offset   int64  // Offset of the block being built
+	index    []blockHandle
+	count    int64
+	hashes   []uint64 // Hash of every key, for the Bloom filter
+}
+
+// newSSTWriter creates the temporary file of the SSTable with the given ID in dir.
+func newSSTWriter(dir string, id int, blockSize int, falsePositiveRate float64) (*sstWriter, error) {
+	tempPath := filepath.Join(dir, fileName(id, SSTABLE_TEMP_EXT))
+	f, err := os.OpenFile(tempPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &sstWriter{
+		file:              f,
+		writer:            bufio.NewWriter(f),
+		dir:               dir,
+		id:                id,
+		tempPath:          tempPath,
+		finalPath:         filepath.Join(dir, fileName(id, SSTABLE_EXT)),
+		blockSize:         blockSize,
+		falsePositiveRate: falsePositiveRate,
+	}, nil
+}
+
+// add appends an entry to the current block, writing the block out once it is full.
+func (w *sstWriter) add(e entry) error {
+	if len(w.block) == 0 {
+		w.firstKey = e.key
+	}
+	var header [sstEntryHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(e.key)))
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(e.val)))
+	if e.tombstone {
+		header[8] = sstFlagTombstone
+	}
+	w.block = append(w.block, header[:]...)
+	w.block = append(w.block, e.key...)
+	w.block = append(w.block, e.val...)
+	w.count++
+	w.hashes = append(w.hashes, hash(e.key))
+
+	if len(w.block) >= w.blockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// flushBlock writes the current block and its checksum and adds it to the index.
+func (w *sstWriter) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	if _, err := w.writer.Write(w.block); err != nil {
+		return err
+	}
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(w.block))
+	if _, err := w.writer.Write(crc[:]); err != nil {
+		return err
+	}
+	w.index = append(w.index, blockHandle{firstKey: w.firstKey, offset: w.offset, size: int64(len(w.block))})
+	w.offset += int64(len(w.block)) + 4
+	w.block = w.block[:0]
+	return nil
+}
+
+// finish writes the last block, the index and the footer, then fsyncs the file, writes
+// the Bloom filter and renames the table into place. The writer can't be used afterwards.
+func (w *sstWriter) finish() error {
+	if err := w.flushBlock(); err != nil {
+		w.abort()
+		return err
+	}
+
+	var index []byte
+	for _, handle := range w.index {
+		index = binary.BigEndian.AppendUint32(index, uint32(len(handle.firstKey)))
+		index = append(index, handle.firstKey...)
+		index = binary.BigEndian.AppendUint64(index, uint64(handle.offset))
+		index = binary.BigEndian.AppendUint32(index, uint32(handle.size))
+	}
+	footer := make([]byte, 0, SSTABLE_FOOTER_SIZE)
+	footer = binary.BigEndian.AppendUint64(footer, uint64(w.offset))
+	footer = binary.BigEndian.AppendUint32(footer, uint32(len(index)))
+	footer = binary.BigEndian.AppendUint64(footer, uint64(w.count))
+	footer = binary.BigEndian.AppendUint32(footer, crc32.ChecksumIEEE(index))
+	footer = binary.BigEndian.AppendUint32(footer, SSTABLE_VERSION)
+	footer = binary.BigEndian.AppendUint32(footer, SSTABLE_MAGIC)
+
+	for _, buf := range [][]byte{index, footer} {
+		if _, err := w.writer.Write(buf); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	if err := w.writer.Flush(); err != nil {
+		w.abort()
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		w.abort()
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.tempPath)
+		return err
+	}
+	filter := newBloomFilter(len(w.hashes), w.falsePositiveRate)
+	for _, h := range w.hashes {
+		filter.add(h)
+	}
+	if err := writeBloomFile(w.dir, w.id, w.count, filter); err != nil {
+		os.Remove(w.tempPath)
+		return err
+	}
+	if err := os.Rename(w.tempPath, w.finalPath); err != nil {
+		os.Remove(w.tempPath)
+		return err
+	}
+	return syncDir(filepath.Dir(w.finalPath))
+}
+
+// abort closes and removes the temporary file.
+func (w *sstWriter) abort() {
+	w.file.Close()
+	os.Remove(w.tempPath)
+}
+
+// syncDir fsyncs a directory so that a rename or removal in it is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// writeSSTable writes the entries of src, tombstones included, to the SSTable with the
+// given ID in dir, along with a Bloom filter with the given false-positive rate, and
+// opens it.
+func writeSSTable(dir string, id int, blockSize int, falsePositiveRate float64, src entrySource) (*sstable, error) {
+	w, err := newSSTWriter(dir, id, blockSize, falsePositiveRate)
+	if err != nil {
+		return nil, err
+	}
+	for src.HasNext() {
+		if err := w.add(src.Entry()); err != nil {
+			w.abort()
+			return nil, err
+		}
+	}
+	if err := src.Err(); err != nil {
+		w.abort()
+		return nil, err
+	}
+	if err := w.finish(); err != nil {
+		return nil, err
+	}
+	return openSSTable(dir, id, falsePositiveRate)
+}
+
+// sstable is an open, immutable SSTable file. Its sparse index and Bloom filter are held
+// in memory and blocks are read with positional reads, so it is safe for concurrent use.
+type sstable struct {
+	id     int
+	file   *os.File
+	index  []blockHandle
+	count  int64
+	filter *bloomFilter
+
+	filterHits           atomic.Int64 // Lookups the filter let through to a block read
+	filterMisses         atomic.Int64 // Lookups the filter answered without I/O
+	filterFalsePositives atomic.Int64 // Filter hits for keys that weren't in the table
+}
+
+// openSSTable opens the SSTable with the given ID in dir and loads its index and Bloom
+// filter. A missing, corrupt or stale filter is rebuilt with the given false-positive rate.
+// Returns ErrCorruptSSTable if the footer or the index don't check out.
+func openSSTable(dir string, id int, falsePositiveRate float64) (*sstable, error) {
+	f, err := os.Open(filepath.Join(dir, fileName(id, SSTABLE_EXT)))
+	if err != nil {
+		return nil, err
+	}
+	t := &sstable{id: id, file: f}
+	if err := t.loadIndex(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := t.loadFilter(dir, falsePositiveRate); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// loadFilter reads the Bloom filter file of the table, or rebuilds it from the keys in the
+// table and rewrites it if it is missing, corrupt or stale.
+func (t *sstable) loadFilter(dir string, falsePositiveRate float64) error {
+	filter, err := readBloomFile(dir, t.id, t.count)
+	if err == nil {
+		t.filter = filter
+		return nil
+	}
+	if !os.IsNotExist(err) && err != ErrCorruptBloomFilter && err != ErrStaleBloomFilter {
+		return err
+	}
+
+	filter = newBloomFilter(int(t.count), falsePositiveRate)
+	it := t.iterator("", "")
+	for it.HasNext() {
+		filter.add(hash(it.Entry().key))
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	if err := writeBloomFile(dir, t.id, t.count, filter); err != nil {
+		return err
+	}
+	t.filter = filter
+	return nil
+}
+
+// loadIndex reads the footer and the sparse index.
+func (t *sstable) loadIndex() error {
+	info, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < SSTABLE_FOOTER_SIZE {
+		return ErrCorruptSSTable
+	}
+	var footer [SSTABLE_FOOTER_SIZE]byte
+	if _, err := t.file.ReadAt(footer[:], info.Size()-SSTABLE_FOOTER_SIZE); err != nil {
+		return err
+	}
+	indexOffset := int64(binary.BigEndian.Uint64(footer[0:8]))
+	indexSize := int64(binary.BigEndian.Uint32(footer[8:12]))
+	t.count = int64(binary.BigEndian.Uint64(footer[12:20]))
+	indexCRC := binary.BigEndian.Uint32(footer[20:24])
+	if binary.BigEndian.Uint32(footer[24:28]) != SSTABLE_VERSION || binary.BigEndian.Uint32(footer[28:32]) != SSTABLE_MAGIC {
+		return ErrCorruptSSTable
+	}
+	if indexOffset < 0 || indexOffset+indexSize != info.Size()-SSTABLE_FOOTER_SIZE {
+		return ErrCorruptSSTable
+	}
+
+	index := make([]byte, indexSize)
+	if _, err := t.file.ReadAt(index, indexOffset); err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(index) != indexCRC {
+		return ErrCorruptSSTable
+	}
+	for len(index) > 0 {
+		if len(index) < 4 {
+			return ErrCorruptSSTable
+		}
+		keyLen := int(binary.BigEndian.Uint32(index[0:4]))
+		if len(index) < 4+keyLen+12 {
+			return ErrCorruptSSTable
+		}
+		handle := blockHandle{
+			firstKey: string(index[4 : 4+keyLen]),
+			offset:   int64(binary.BigEndian.Uint64(index[4+keyLen : 12+keyLen])),
+			size:     int64(binary.BigEndian.Uint32(index[12+keyLen : 16+keyLen])),
+		}
+		if handle.offset < 0 || handle.offset+handle.size+4 > indexOffset {
+			return ErrCorruptSSTable
+		}
+		t.index = append(t.index, handle)
+		index = index[16+keyLen:]
+	}
+	return nil
+}
+
+// findBlock returns the position in the index of the block that would hold key: the last
+// block whose first key is <= key, or 0 if key sorts before every block.
+func (t *sstable) findBlock(key string) int {
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].firstKey > key })
+	if i > 0 {
+		i--
+	}
+	return i
+}
+
+// readBlock reads the block at position i of the index and verifies its checksum.
+func (t *sstable) readBlock(i int) ([]byte, error) {
+	handle := t.index[i]
+	buf := make([]byte, handle.size+4)
+	if _, err := t.file.ReadAt(buf, handle.offset); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	block := buf[:handle.size]
+	if crc32.ChecksumIEEE(block) != binary.BigEndian.Uint32(buf[handle.size:]) {
+		return nil, ErrCorruptSSTable
+	}
+	return block, nil
+}
+
+// decodeEntry decodes the entry at the start of block and returns it along with the rest
+// of the block.
+func decodeEntry(block []byte) (entry, []byte, error) {
+	if len(block) < sstEntryHeaderSize {
+		return entry{}, nil, ErrCorruptSSTable
+	}
+	keyLen := int64(binary.BigEndian.Uint32(block[0:4]))
+	valLen := int64(binary.BigEndian.Uint32(block[4:8]))
+	end := sstEntryHeaderSize + keyLen + valLen
+	if int64(len(block)) < end {
+		return entry{}, nil, ErrCorruptSSTable
+	}
+	e := entry{
+		key:       string(block[sstEntryHeaderSize : sstEntryHeaderSize+keyLen]),
+		val:       string(block[sstEntryHeaderSize+keyLen : end]),
+		tombstone: block[8]&sstFlagTombstone != 0,
+	}
+	return e, block[end:], nil
+}
+
+// get returns the entry of key and whether the SSTable has one. It reads at most one block,
+// and none if the Bloom filter rules the key out.
+func (t *sstable) get(key string) (entry, bool, error) {
+	if !t.filter.mayContain(hash(key)) {
+		t.filterMisses.Add(1)
+		return entry{}, false, nil
+	}
+	t.filterHits.Add(1)
+	if len(t.index) == 0 || key < t.index[0].firstKey {
+		t.filterFalsePositives.Add(1)
+		return entry{}, false, nil
+	}
+	block, err := t.readBlock(t.findBlock(key))
+	if err != nil {
+		return entry{}, false, err
+	}
+	for len(block) > 0 {
+		var e entry
+		e, block, err = decodeEntry(block)
+		if err != nil {
+			return entry{}, false, err
+		}
+		if e.key == key {
+			return e, true, nil
+		}
+		if e.key > key {
+			break
+		}
+	}
+	t.filterFalsePositives.Add(1)
+	return entry{}, false, nil
+}
+
+// iterator returns an entrySource over the entries in [start, end), tombstones included.
+func (t *sstable) iterator(start, end string) entrySource {
+	return &sstIterator{table: t, start: start, end: end, next: t.findBlock(start)}
+}
+
+// Len returns the number of entries in the SSTable, tombstones included.
+func (t *sstable) Len() int64 {
+	return t.count
+}
+
+// Close closes the SSTable file.
+func (t *sstable) Close() error {
+	return t.file.Close()
+}
+
+// sstIterator walks the entries of an SSTable block by block.
+type sstIterator struct {
+	table      *sstable
+	start, end string
+	next       int    // Position in the index of the next block to read
+	block      []byte // Undecoded rest of the current block
+	current    entry
+	done       bool
+	err        error
+}
+
+func (it *sstIterator) HasNext() bool {
+	for !it.done && it.err == nil {
+		if len(it.block) == 0 {
+			if it.next >= len(it.table.index) {
+				it.done = true
+				return false
+			}
+			it.block, it.err = it.table.readBlock(it.next)
+			it.next++
+			continue
+		}
+		var e entry
+		e, it.block, it.err = decodeEntry(it.block)
+		if it.err != nil {
+			return false
+		}
+		if e.key < it.start {
+			continue
+		}
+		if it.end != "" && e.key >= it.end {
+			it.done = true
+			return false
+		}
+		it.current = e
+		return true
+	}
+	return false
+}
+
+func (it *sstIterator) Entry() entry { return it.current }
+
+func (it *sstIterator) Err() error { return it.err }
@@ -0,0 +1,116 @@
+package kvstorefromscratchpart3
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTestSSTable writes n keys "key-0000".. with every tenth one deleted, in blocks of
+// blockSize bytes.
+func writeTestSSTable(t *testing.T, dir string, n, blockSize int) *sstable {
+	t.Helper()
+	mem := newMemtable()
+	for i := 0; i < n; i++ {
+		e := entry{key: fmt.Sprintf("key-%04d", i), val: fmt.Sprintf("value-%d", i)}
+		if i%10 == 0 {
+			e = entry{key: e.key, tombstone: true}
+		}
+		mem.put(e)
+	}
+	table, err := writeSSTable(dir, 1, blockSize, DEFAULT_BLOOM_FALSE_POSITIVE_RATE, mem.iterator("", ""))
+	if err != nil {
+		t.Fatalf("writeSSTable failed: %v", err)
+	}
+	return table
+}
+
+func TestSSTable_GetAndIterate(t *testing.T) {
+	dir := t.TempDir()
+	table := writeTestSSTable(t, dir, 1000, 256)
+	defer table.Close()
+
+	if len(table.index) < 10 {
+		t.Errorf("index has %d blocks, want many small blocks", len(table.index))
+	}
+	if table.Len() != 1000 {
+		t.Errorf("Len is %d, want 1000", table.Len())
+	}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		e, ok, err := table.get(key)
+		if err != nil || !ok {
+			t.Fatalf("get(%s) returned (%v, %v)", key, ok, err)
+		}
+		if i%10 == 0 && !e.tombstone {
+			t.Errorf("get(%s) returned %+v, want a tombstone", key, e)
+		}
+		if i%10 != 0 && e.val != fmt.Sprintf("value-%d", i) {
+			t.Errorf("get(%s) returned %+v, want value-%d", key, e, i)
+		}
+	}
+	for _, key := range []string{"", "a", "key-0000a", "key-9999", "zzz"} {
+		if _, ok, err := table.get(key); ok || err != nil {
+			t.Errorf("get(%q) returned (%v, %v), want not found", key, ok, err)
+		}
+	}
+
+	got := drainEntries(t, table.iterator("key-0498", "key-0502"))
+	want := []string{"key-0498=value-498", "key-0499=value-499", "key-0500 (deleted)", "key-0501=value-501"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("iterator returned %q, want %q", got, want)
+	}
+	if all := drainEntries(t, table.iterator("", "")); len(all) != 1000 {
+		t.Errorf("full iteration returned %d entries, want 1000", len(all))
+	}
+
+	// Reopening loads the same index
+	reopened, err := openSSTable(dir, 1, DEFAULT_BLOOM_FALSE_POSITIVE_RATE)
+	if err != nil {
+		t.Fatalf("openSSTable failed: %v", err)
+	}
+	defer reopened.Close()
+	if !reflect.DeepEqual(reopened.index, table.index) || reopened.count != table.count {
+		t.Errorf("reopened SSTable has a different index")
+	}
+}
+
+func TestSSTable_DetectsCorruption(t *testing.T) {
+	dir := t.TempDir()
+	table := writeTestSSTable(t, dir, 100, 256)
+	table.Close()
+	path := filepath.Join(dir, fileName(1, SSTABLE_EXT))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	// A flipped byte in a data block fails that block's checksum
+	corrupt := append([]byte(nil), data...)
+	corrupt[20] ^= 0xFF
+	if err := os.WriteFile(path, corrupt, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	table, err = openSSTable(dir, 1, DEFAULT_BLOOM_FALSE_POSITIVE_RATE)
+	if err != nil {
+		t.Fatalf("openSSTable failed: %v", err)
+	}
+	if _, _, err := table.get("key-0001"); err != ErrCorruptSSTable {
+		t.Errorf("get from a corrupt block returned %v, want ErrCorruptSSTable", err)
+	}
+	table.Close()
+
+	// A damaged footer or index is caught when the table is opened
+	for _, at := range []int{len(data) - 1, len(data) - SSTABLE_FOOTER_SIZE - 2} {
+		corrupt := append([]byte(nil), data...)
+		corrupt[at] ^= 0xFF
+		if err := os.WriteFile(path, corrupt, 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		if _, err := openSSTable(dir, 1, DEFAULT_BLOOM_FALSE_POSITIVE_RATE); err != ErrCorruptSSTable {
+			t.Errorf("openSSTable with byte %d flipped returned %v, want ErrCorruptSSTable", at, err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package kvstorefromscratchpart3
+
+// Stats is a summary of the state of a store, as returned by LSMStore.Stats.
+type Stats struct {
+	MemtableKeys       int   // Keys in the active memtable, tombstones included
+	ImmutableMemtables int   // Frozen memtables waiting to be flushed
+	SSTables           int   // Number of SSTable files
+	SSTableEntries     int64 // Entries in all SSTables, tombstones and shadowed values included
+	FilterBytes        int64 // Memory held by the Bloom filters of all SSTables
+
+	// Bloom filter outcomes of Gets that reached an SSTable, since the store was opened.
+	// FilterMisses were answered without reading the table; FilterHits read a block, and
+	// FilterFalsePositives of them didn't find the key there.
+	FilterHits           int64
+	FilterMisses         int64
+	FilterFalsePositives int64
+}
+
+// Stats returns the current Stats of the store.
+func (s *LSMStore) Stats() (Stats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return Stats{}, ErrStoreClosed
+	}
+
+	stats := Stats{
+		MemtableKeys:       s.mem.Len(),
+		ImmutableMemtables: len(s.immutables),
+		SSTables:           len(s.sstables),
+	}
+	for _, t := range s.sstables {
+		stats.SSTableEntries += t.Len()
+		stats.FilterBytes += int64(len(t.filter.bits))
+		stats.FilterHits += t.filterHits.Load()
+		stats.FilterMisses += t.filterMisses.Load()
+		stats.FilterFalsePositives += t.filterFalsePositives.Load()
+	}
+	return stats, nil
+}
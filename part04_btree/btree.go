@@ -0,0 +1,354 @@
+package kvstorefromscratchpart4
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	DATA_FILENAME      = "btree.db"
+	DATA_TEMP_FILENAME = "btree.db.tmp"
+)
+
+var (
+	ErrKeyDoesntExist = errors.New("given key doesn't exist")
+	ErrStoreClosed    = errors.New("store is closed")
+	ErrCorruptStore   = errors.New("no valid meta page, store is corrupt")
+)
+
+// pageFile is the data file as seen by the store: page-sized positional reads and writes,
+// and fsync. It is an *os.File outside of tests.
+type pageFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Close() error
+}
+
+// BTreeStore is a B+tree stored in fixed-size pages of a single data file. Only the pages
+// in the buffer pool and the free list are held in memory, so its memory use doesn't grow
+// with the number of keys.
+//
+// Updates are copy-on-write: a Put or Del writes new copies of the pages on the path from
+// the leaf to the root into free pages, fsyncs them, and then commits by writing the new
+// root to the older of the two meta pages. A crash at any point leaves the previous meta
+// page and every page it references intact. Pages replaced by a commit are free for the
+// commits after it.
+//
+// BTreeStore is safe for concurrent use. Writes are serialized through mu, while Gets and
+// Scans share it.
+type BTreeStore struct {
+	mu sync.RWMutex // Guards the fields below; held exclusively by writers
+
+	file          pageFile
+	opts          Options
+	meta          meta   // The latest commit
+	free          []pgid // Pages not referenced by the latest commit, reusable by the next
+	freelistPages []pgid // Pages holding the free list of the latest commit
+	pool          *bufferPool
+	closed        bool
+	writeErr      error // Set when a commit fails after it started writing; later writes return it
+}
+
+// ConnectBTreeStore opens the store in the directory at path using DefaultOptions.
+// See ConnectBTreeStoreWithOptions.
+func ConnectBTreeStore(path string) (*BTreeStore, error) {
+	return ConnectBTreeStoreWithOptions(path, DefaultOptions())
+}
+
+// ConnectBTreeStoreWithOptions initializes and returns a new BTreeStore in the specified
+// directory, creating the directory and an empty data file if necessary. The latest commit
+// whose meta page is intact is loaded, so writes that were interrupted by a crash are
+// rolled back. If the options are invalid, the data file can't be created or opened, or
+// neither meta page is valid, an error is returned.
+func ConnectBTreeStoreWithOptions(path string, opts Options) (*BTreeStore, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(filepath.Join(path, DATA_TEMP_FILENAME)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	dataPath := filepath.Join(path, DATA_FILENAME)
+	if _, err := os.Stat(dataPath); os.IsNotExist(err) {
+		if err := createDataFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.OpenFile(dataPath, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	store, err := openBTreeStore(f, opts)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// createDataFile atomically creates an empty data file in dir: both meta pages pointing at
+// an empty root leaf.
+func createDataFile(dir string) error {
+	tmpPath := filepath.Join(dir, DATA_TEMP_FILENAME)
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath) // No-op once renamed
+
+	buf := make([]byte, 3*PAGE_SIZE)
+	for txid := uint64(0); txid < 2; txid++ {
+		meta{txid: txid, root: 2, pageCount: 3}.encode(buf[txid*PAGE_SIZE:])
+	}
+	(&node{leaf: true}).encode(buf[2*PAGE_SIZE:])
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(dir, DATA_FILENAME)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir fsyncs a directory so that a rename in it is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// openBTreeStore loads the latest valid commit of the data file f and its free list.
+func openBTreeStore(f pageFile, opts Options) (*BTreeStore, error) {
+	var latest meta
+	var found bool
+	buf := make([]byte, PAGE_SIZE)
+	for id := pgid(0); id < 2; id++ {
+		if err := readPage(f, id, buf); err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		m, err := decodeMeta(buf)
+		if err != nil {
+			continue // Torn by a crash while it was written; the other one is intact
+		}
+		if !found || m.txid > latest.txid {
+			latest, found = m, true
+		}
+	}
+	if !found {
+		return nil, ErrCorruptStore
+	}
+
+	store := &BTreeStore{
+		file: f,
+		opts: opts,
+		meta: latest,
+		pool: newBufferPool(opts.CacheSize),
+	}
+	if err := store.loadFreelist(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// loadFreelist reads the free list of the latest commit.
+func (s *BTreeStore) loadFreelist() error {
+	buf := make([]byte, PAGE_SIZE)
+	for id := s.meta.freelist; id != 0; {
+		if id < 2 || id >= s.meta.pageCount || len(s.freelistPages) > int(s.meta.pageCount) {
+			return ErrCorruptPage
+		}
+		if err := readPage(s.file, id, buf); err != nil {
+			return err
+		}
+		count, next, payload, err := decodeLinkedPage(buf, pageTypeFreelist)
+		if err != nil {
+			return err
+		}
+		if count > FREELIST_CAPACITY {
+			return ErrCorruptPage
+		}
+		for i := 0; i < count; i++ {
+			free := pgid(binary.BigEndian.Uint64(payload[i*8:]))
+			if free < 2 || free >= s.meta.pageCount {
+				return ErrCorruptPage
+			}
+			s.free = append(s.free, free)
+		}
+		s.freelistPages = append(s.freelistPages, id)
+		id = next
+	}
+	return nil
+}
+
+// readPage reads page id of f into buf. A page past the end of the file yields
+// io.ErrUnexpectedEOF.
+func readPage(f io.ReaderAt, id pgid, buf []byte) error {
+	n, err := f.ReadAt(buf[:PAGE_SIZE], int64(id)*PAGE_SIZE)
+	if n == PAGE_SIZE {
+		return nil
+	}
+	if err == io.EOF || err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readNode returns the decoded leaf or branch page id, from the buffer pool if possible.
+func (s *BTreeStore) readNode(id pgid) (*node, error) {
+	if n, ok := s.pool.get(id); ok {
+		return n, nil
+	}
+	if id < 2 || id >= s.meta.pageCount {
+		return nil, ErrCorruptPage
+	}
+	buf := make([]byte, PAGE_SIZE)
+	if err := readPage(s.file, id, buf); err != nil {
+		return nil, err
+	}
+	n, err := decodeNode(buf)
+	if err != nil {
+		return nil, err
+	}
+	s.pool.put(id, n)
+	return n, nil
+}
+
+// readValue returns the value of a leaf entry, reading its overflow pages if it has any.
+func (s *BTreeStore) readValue(v leafValue) (string, error) {
+	if v.overflow == 0 {
+		return v.inline, nil
+	}
+	value := make([]byte, 0, v.size)
+	buf := make([]byte, PAGE_SIZE)
+	for id := v.overflow; len(value) < int(v.size); {
+		if id < 2 || id >= s.meta.pageCount {
+			return "", ErrCorruptPage
+		}
+		if err := readPage(s.file, id, buf); err != nil {
+			return "", err
+		}
+		_, next, payload, err := decodeLinkedPage(buf, pageTypeOverflow)
+		if err != nil {
+			return "", err
+		}
+		value = append(value, payload[:min(len(payload), int(v.size)-len(value))]...)
+		id = next
+	}
+	return string(value), nil
+}
+
+// childIndex returns the child of a branch whose subtree holds key.
+func (n *node) childIndex(key string) int {
+	return sort.Search(len(n.keys), func(i int) bool { return n.keys[i] > key })
+}
+
+// search returns the position of key in a leaf, or where it would be inserted, and
+// whether it is there.
+func (n *node) search(key string) (int, bool) {
+	i := sort.SearchStrings(n.keys, key)
+	return i, i < len(n.keys) && n.keys[i] == key
+}
+
+// Get retrieves the value of the given key by walking from the root to its leaf.
+// If the key doesn't exist, ErrKeyDoesntExist is returned.
+func (s *BTreeStore) Get(K string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return "", ErrStoreClosed
+	}
+
+	n, err := s.readNode(s.meta.root)
+	for err == nil && !n.leaf {
+		n, err = s.readNode(n.children[n.childIndex(K)])
+	}
+	if err != nil {
+		return "", err
+	}
+	i, ok := n.search(K)
+	if !ok {
+		return "", ErrKeyDoesntExist
+	}
+	return s.readValue(n.values[i])
+}
+
+// Put stores the given key-value pair and commits it to disk before returning.
+// Returns an error if the key or value is too large, or if the commit fails.
+func (s *BTreeStore) Put(K, V string) error {
+	if len(K) > MAX_KEY_SIZE {
+		return ErrKeyTooLarge
+	}
+	if len(V) > MAX_VALUE_SIZE {
+		return ErrValueTooLarge
+	}
+	return s.update(K, &V)
+}
+
+// Del removes the given key and commits the removal to disk before returning. Deleting a
+// key that doesn't exist is a no-op.
+func (s *BTreeStore) Del(K string) error {
+	return s.update(K, nil)
+}
+
+// update puts value under key, or deletes key if value is nil, in a single commit.
+func (s *BTreeStore) update(key string, value *string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	if s.writeErr != nil {
+		return s.writeErr
+	}
+
+	t := s.begin()
+	changed, err := t.apply(key, value)
+	if err != nil || !changed {
+		t.rollback()
+		return err
+	}
+	return t.commit()
+}
+
+// Sync is a no-op apart from the closed check: every Put and Del is fsynced when it
+// commits.
+func (s *BTreeStore) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	return nil
+}
+
+// Close closes the data file. Every write was committed when it returned, so there is
+// nothing to flush. Closing a closed store is a no-op.
+func (s *BTreeStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.file.Close()
+}
@@ -0,0 +1,324 @@
+package kvstorefromscratchpart4
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// checkTree verifies the invariants of the latest commit: keys are sorted and lie between
+// the separators above them, the key count is right, and every page below pageCount is
+// used exactly once, by the tree, an overflow chain, the free list or a meta page.
+func checkTree(t *testing.T, s *BTreeStore) {
+	t.Helper()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	owner := make(map[pgid]string)
+	claim := func(id pgid, what string) {
+		if prev, ok := owner[id]; ok {
+			t.Fatalf("page %d is used by %s and %s", id, prev, what)
+		}
+		if id >= s.meta.pageCount {
+			t.Fatalf("%s uses page %d past pageCount %d", what, id, s.meta.pageCount)
+		}
+		owner[id] = what
+	}
+	claim(0, "meta")
+	claim(1, "meta")
+	for _, id := range s.free {
+		claim(id, "free list")
+	}
+	for _, id := range s.freelistPages {
+		claim(id, "free list page")
+	}
+
+	var keys int64
+	var walk func(id pgid, lo, hi string, depth int) int
+	walk = func(id pgid, lo, hi string, depth int) int {
+		n, err := s.readNode(id)
+		if err != nil {
+			t.Fatalf("readNode(%d) failed: %v", id, err)
+		}
+		claim(id, fmt.Sprintf("node at depth %d", depth))
+		for i, key := range n.keys {
+			if i > 0 && n.keys[i-1] >= key || key < lo || hi != "" && key >= hi {
+				t.Fatalf("page %d has key %q out of order or outside [%q, %q)", id, key, lo, hi)
+			}
+		}
+		if n.leaf {
+			keys += int64(len(n.keys))
+			buf := make([]byte, PAGE_SIZE)
+			for i, v := range n.values {
+				for page := v.overflow; page != 0; {
+					claim(page, "overflow of "+n.keys[i])
+					readPage(s.file, page, buf)
+					_, next, _, err := decodeLinkedPage(buf, pageTypeOverflow)
+					if err != nil {
+						t.Fatalf("overflow page %d: %v", page, err)
+					}
+					page = next
+				}
+			}
+			return depth
+		}
+		leafDepth := -1
+		for i, child := range n.children {
+			childLo, childHi := lo, hi
+			if i > 0 {
+				childLo = n.keys[i-1]
+			}
+			if i < len(n.keys) {
+				childHi = n.keys[i]
+			}
+			d := walk(child, childLo, childHi, depth+1)
+			if leafDepth != -1 && d != leafDepth {
+				t.Fatalf("leaves at depths %d and %d", leafDepth, d)
+			}
+			leafDepth = d
+		}
+		return leafDepth
+	}
+	walk(s.meta.root, "", "", 1)
+
+	if keys != s.meta.keyCount {
+		t.Errorf("tree holds %d keys, meta says %d", keys, s.meta.keyCount)
+	}
+	if len(owner) != int(s.meta.pageCount) {
+		t.Errorf("%d of %d pages are accounted for", len(owner), s.meta.pageCount)
+	}
+}
+
+func TestBTreeStore_PutGetDel(t *testing.T) {
+	store, err := ConnectBTreeStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectBTreeStore failed: %v", err)
+	}
+	defer store.Close()
+	var _ Store = store
+
+	if err := store.Put("foo", "bar"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if got, err := store.Get("foo"); err != nil || got != "bar" {
+		t.Errorf("Get returned (%q, %v), want bar", got, err)
+	}
+	if err := store.Put("foo", "baz"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if got, err := store.Get("foo"); err != nil || got != "baz" {
+		t.Errorf("Get after overwrite returned (%q, %v), want baz", got, err)
+	}
+	if err := store.Del("foo"); err != nil {
+		t.Fatalf("Del failed: %v", err)
+	}
+	if _, err := store.Get("foo"); err != ErrKeyDoesntExist {
+		t.Errorf("Get after Del returned %v, want ErrKeyDoesntExist", err)
+	}
+	if err := store.Del("never-written"); err != nil {
+		t.Errorf("Del of a missing key returned %v, want nil", err)
+	}
+	if err := store.Put(strings.Repeat("k", MAX_KEY_SIZE+1), "v"); err != ErrKeyTooLarge {
+		t.Errorf("Put of a large key returned %v, want ErrKeyTooLarge", err)
+	}
+	checkTree(t, store)
+}
+
+func TestBTreeStore_RandomOperations(t *testing.T) {
+	tmpDir := t.TempDir()
+	store, err := ConnectBTreeStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectBTreeStore failed: %v", err)
+	}
+
+	// A mix of inline and overflow values, so splits, merges and overflow chains all happen
+	rng := rand.New(rand.NewPCG(1, 2))
+	model := make(map[string]string)
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key-%04d", rng.IntN(1500))
+		if rng.IntN(3) == 0 {
+			if err := store.Del(key); err != nil {
+				t.Fatalf("Del failed: %v", err)
+			}
+			delete(model, key)
+			continue
+		}
+		val := strings.Repeat(fmt.Sprint(i), 1+rng.IntN(40))
+		if rng.IntN(20) == 0 {
+			val = strings.Repeat(val, 1+rng.IntN(2000))
+		}
+		if err := store.Put(key, val); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		model[key] = val
+	}
+	checkTree(t, store)
+
+	checkModel := func(store *BTreeStore) {
+		t.Helper()
+		for i := 0; i < 1500; i++ {
+			key := fmt.Sprintf("key-%04d", i)
+			got, err := store.Get(key)
+			want, ok := model[key]
+			if !ok && err != ErrKeyDoesntExist || ok && (err != nil || got != want) {
+				t.Fatalf("Get(%s) returned (%d bytes, %v), want %d bytes (present: %v)", key, len(got), err, len(want), ok)
+			}
+		}
+	}
+	checkModel(store)
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if stats.Keys != int64(len(model)) || stats.Depth < 2 {
+		t.Errorf("Stats reports %d keys at depth %d, want %d keys in a multi-level tree", stats.Keys, stats.Depth, len(model))
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	store, err = ConnectBTreeStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectBTreeStore failed: %v", err)
+	}
+	defer store.Close()
+	checkTree(t, store)
+	checkModel(store)
+
+	// Deleting everything shrinks the tree back to a single leaf and frees its pages
+	keys := make([]string, 0, len(model))
+	for key := range model {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := store.Del(key); err != nil {
+			t.Fatalf("Del failed: %v", err)
+		}
+	}
+	checkTree(t, store)
+	stats, _ = store.Stats()
+	if stats.Keys != 0 || stats.Depth != 1 || int64(stats.FreePages) < stats.Pages-8 {
+		t.Errorf("after deleting every key: %+v", stats)
+	}
+}
+
+func TestBTreeStore_ReusesFreePages(t *testing.T) {
+	store, err := ConnectBTreeStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectBTreeStore failed: %v", err)
+	}
+	defer store.Close()
+
+	for i := 0; i < 1000; i++ {
+		store.Put(fmt.Sprintf("key-%d", i), strings.Repeat("v", 100))
+	}
+	before, _ := store.Stats()
+	// Overwriting keeps copying pages on write, but into the pages freed by earlier commits
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 1000; i++ {
+			store.Put(fmt.Sprintf("key-%d", i), strings.Repeat("w", 100))
+		}
+	}
+	after, _ := store.Stats()
+	if after.Pages > before.Pages+16 {
+		t.Errorf("file grew from %d to %d pages while overwriting the same keys", before.Pages, after.Pages)
+	}
+	checkTree(t, store)
+}
+
+func TestBTreeStore_MemoryIsBoundedByCache(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CacheSize = 16
+	store, err := ConnectBTreeStoreWithOptions(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("ConnectBTreeStoreWithOptions failed: %v", err)
+	}
+	defer store.Close()
+
+	if err := addNItemsToKVStore(store, 5000); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	for i := 0; i < 5000; i += 7 {
+		if _, err := getNthItemFromKVStore(store, i); err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+	}
+	stats, _ := store.Stats()
+	if stats.CachedPages > 16 || stats.CacheEvictions == 0 || stats.CacheMisses == 0 {
+		t.Errorf("buffer pool holds %d pages after %d evictions and %d misses, want at most 16", stats.CachedPages, stats.CacheEvictions, stats.CacheMisses)
+	}
+	if stats.Pages < 50 {
+		t.Errorf("5000 keys take %d pages, want many more than the cache holds", stats.Pages)
+	}
+}
+
+func TestBTreeStore_Closed(t *testing.T) {
+	store, err := ConnectBTreeStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectBTreeStore failed: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Errorf("second Close returned %v, want nil", err)
+	}
+	if err := store.Put("a", "1"); err != ErrStoreClosed {
+		t.Errorf("Put returned %v, want ErrStoreClosed", err)
+	}
+	if _, err := store.Get("a"); err != ErrStoreClosed {
+		t.Errorf("Get returned %v, want ErrStoreClosed", err)
+	}
+	if _, err := store.Scan("", ""); err != ErrStoreClosed {
+		t.Errorf("Scan returned %v, want ErrStoreClosed", err)
+	}
+	if _, err := ConnectBTreeStoreWithOptions(t.TempDir(), Options{}); err != ErrInvalidOptions {
+		t.Errorf("ConnectBTreeStoreWithOptions with a zero CacheSize returned %v, want ErrInvalidOptions", err)
+	}
+}
+
+func TestBTreeStore_ConcurrentReadersAndWriter(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CacheSize = 8 // Readers keep evicting each other's pages
+	store, err := ConnectBTreeStoreWithOptions(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("ConnectBTreeStoreWithOptions failed: %v", err)
+	}
+	defer store.Close()
+	if err := addNItemsToKVStore(store, 500); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		go func() {
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					errs <- nil
+					return
+				default:
+				}
+				if _, err := getNthItemFromKVStore(store, i%500); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	for i := 500; i < 1000; i++ {
+		store.Put(fmt.Sprintf("key-%d", i), "new")
+		store.Del(fmt.Sprintf("extra-%d", i))
+	}
+	close(done)
+	for r := 0; r < 4; r++ {
+		if err := <-errs; err != nil {
+			t.Errorf("reader failed: %v", err)
+		}
+	}
+	checkTree(t, store)
+}
@@ -0,0 +1,95 @@
+package kvstorefromscratchpart4
+
+import (
+	"container/list"
+	"sync"
+)
+
+// bufferPool caches decoded leaf and branch pages, evicting the least recently used one
+// once it holds capacity pages. Since committed pages are never modified, cached nodes
+// never need to be written back; a page that is reused for new contents is simply
+// replaced. It is safe for concurrent use.
+type bufferPool struct {
+	mu       sync.Mutex
+	capacity int
+	pages    map[pgid]*list.Element
+	lru      *list.List // Front is the most recently used; values are *cachedPage
+
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+type cachedPage struct {
+	id   pgid
+	node *node
+}
+
+// newBufferPool creates an empty bufferPool holding up to capacity pages.
+func newBufferPool(capacity int) *bufferPool {
+	return &bufferPool{
+		capacity: capacity,
+		pages:    make(map[pgid]*list.Element, capacity),
+		lru:      list.New(),
+	}
+}
+
+// get returns the cached node of page id, if any, and marks it as recently used.
+func (bp *bufferPool) get(id pgid) (*node, bool) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	elem, ok := bp.pages[id]
+	if !ok {
+		bp.misses++
+		return nil, false
+	}
+	bp.hits++
+	bp.lru.MoveToFront(elem)
+	return elem.Value.(*cachedPage).node, true
+}
+
+// put caches the node of page id, replacing what was cached for it before, and evicts the
+// least recently used page if the pool is full.
+func (bp *bufferPool) put(id pgid, n *node) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if elem, ok := bp.pages[id]; ok {
+		elem.Value.(*cachedPage).node = n
+		bp.lru.MoveToFront(elem)
+		return
+	}
+	bp.pages[id] = bp.lru.PushFront(&cachedPage{id: id, node: n})
+	for bp.lru.Len() > bp.capacity {
+		oldest := bp.lru.Back()
+		bp.lru.Remove(oldest)
+		delete(bp.pages, oldest.Value.(*cachedPage).id)
+		bp.evictions++
+	}
+}
+
+// remove drops page id from the pool, if it is cached.
+func (bp *bufferPool) remove(id pgid) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+
+	if elem, ok := bp.pages[id]; ok {
+		bp.lru.Remove(elem)
+		delete(bp.pages, id)
+	}
+}
+
+// Len returns the number of cached pages.
+func (bp *bufferPool) Len() int {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	return bp.lru.Len()
+}
+
+// stats returns the number of cached pages and the hit, miss and eviction counts so far.
+func (bp *bufferPool) stats() (pages int, hits, misses, evictions int64) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	return bp.lru.Len(), bp.hits, bp.misses, bp.evictions
+}
@@ -0,0 +1,3 @@
+module kvstorefromscratchpart4
+
+go 1.24.4
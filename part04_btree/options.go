@@ -0,0 +1,36 @@
+package kvstorefromscratchpart4
+
+import (
+	"errors"
+)
+
+const (
+	DEFAULT_CACHE_SIZE = 1024 // Pages, i.e. 4 MiB
+)
+
+var (
+	ErrInvalidOptions = errors.New("invalid store options")
+)
+
+// Options configures a BTreeStore. Use DefaultOptions and override individual fields
+// rather than building the struct from scratch, so new fields get sensible defaults.
+type Options struct {
+	// CacheSize is the number of decoded pages the buffer pool keeps in memory. Together
+	// with the free list it bounds the memory the store uses, whatever the number of keys.
+	CacheSize int
+}
+
+// DefaultOptions returns the Options used by ConnectBTreeStore.
+func DefaultOptions() Options {
+	return Options{
+		CacheSize: DEFAULT_CACHE_SIZE,
+	}
+}
+
+// validate returns ErrInvalidOptions if the options can't be used to open a store.
+func (o Options) validate() error {
+	if o.CacheSize <= 0 {
+		return ErrInvalidOptions
+	}
+	return nil
+}
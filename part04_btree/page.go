@@ -0,0 +1,312 @@
+package kvstorefromscratchpart4
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// The data file is an array of PAGE_SIZE pages, addressed by their index. Every page
+// starts with the same header (all integers are big-endian):
+//
+//	+----------+------+-------+-------+
+//	| crc32 4B | type | flags | count |
+//	|          |  1B  |  1B   |  2B   |
+//	+----------+------+-------+-------+
+//
+// The checksum covers the rest of the page, so a page that was torn by a crash in the
+// middle of a write is detected. What follows the header depends on the type:
+//
+//	meta:     | magic 4B | version 4B | pageSize 4B | txid 8B | root 8B | pageCount 8B | freelist 8B | keyCount 8B |
+//	leaf:     | keyLen 2B | flags 1B | valLen 4B | key | value or overflow pgid 8B |  (count times)
+//	branch:   | child 8B | keyLen 2B | key | child 8B | ...                          (count keys)
+//	freelist: | next 8B | pgid 8B | ...                                              (count pgids)
+//	overflow: | next 8B | data ...                                                   (up to OVERFLOW_DATA_SIZE)
+//
+// Pages 0 and 1 are the two meta pages. A branch with count keys has count+1 children;
+// the subtree of child i holds the keys k with key[i-1] <= k < key[i].
+const (
+	PAGE_SIZE        = 4096
+	PAGE_HEADER_SIZE = 8
+
+	MAX_KEY_SIZE          = 512
+	MAX_INLINE_VALUE_SIZE = 512              // Larger values are stored in a chain of overflow pages
+	MAX_VALUE_SIZE        = 64 * 1024 * 1024 // 64 MiB
+
+	META_MAGIC   = 0x4B564254 // "KVBT"
+	META_VERSION = 1
+
+	LEAF_ENTRY_HEADER_SIZE = 7
+	OVERFLOW_DATA_SIZE     = PAGE_SIZE - PAGE_HEADER_SIZE - 8
+	FREELIST_CAPACITY      = (PAGE_SIZE - PAGE_HEADER_SIZE - 8) / 8
+
+	// MIN_FILL_SIZE is the encoded size below which a node is merged with a sibling after
+	// a delete, if the two fit in one page.
+	MIN_FILL_SIZE = PAGE_SIZE / 4
+)
+
+const (
+	pageTypeMeta     byte = 1
+	pageTypeLeaf     byte = 2
+	pageTypeBranch   byte = 3
+	pageTypeFreelist byte = 4
+	pageTypeOverflow byte = 5
+
+	leafFlagOverflow byte = 0x01
+)
+
+var (
+	ErrCorruptPage   = errors.New("page is corrupt")
+	ErrKeyTooLarge   = errors.New("key exceeds MAX_KEY_SIZE")
+	ErrValueTooLarge = errors.New("value exceeds MAX_VALUE_SIZE")
+)
+
+// pgid is the index of a page in the data file.
+type pgid uint64
+
+// leafValue is the value of a leaf entry: either stored inline, or in a chain of overflow
+// pages starting at overflow.
+type leafValue struct {
+	inline   string
+	overflow pgid
+	size     uint32 // Length of the value in bytes
+}
+
+// node is a decoded leaf or branch page. Nodes are copied on write: once a node is
+// committed it is never modified, so it can be shared by the buffer pool and readers.
+type node struct {
+	leaf     bool
+	keys     []string
+	values   []leafValue // Leaf only, one per key
+	children []pgid      // Branch only, one more than keys
+}
+
+// size returns the number of bytes the node takes when encoded.
+func (n *node) size() int {
+	size := PAGE_HEADER_SIZE
+	if n.leaf {
+		for i, key := range n.keys {
+			size += LEAF_ENTRY_HEADER_SIZE + len(key) + n.values[i].encodedSize()
+		}
+		return size
+	}
+	size += 8
+	for _, key := range n.keys {
+		size += 2 + len(key) + 8
+	}
+	return size
+}
+
+// encodedSize returns the number of bytes the value takes in a leaf page.
+func (v leafValue) encodedSize() int {
+	if v.overflow != 0 {
+		return 8
+	}
+	return len(v.inline)
+}
+
+// clone returns a copy of the node that can be modified without affecting n.
+func (n *node) clone() *node {
+	return &node{
+		leaf:     n.leaf,
+		keys:     append([]string(nil), n.keys...),
+		values:   append([]leafValue(nil), n.values...),
+		children: append([]pgid(nil), n.children...),
+	}
+}
+
+// encode writes the node into a page-sized buffer. The node must fit in a page.
+func (n *node) encode(buf []byte) {
+	clear(buf)
+	binary.BigEndian.PutUint16(buf[6:8], uint16(len(n.keys)))
+	p := PAGE_HEADER_SIZE
+	if n.leaf {
+		buf[4] = pageTypeLeaf
+		for i, key := range n.keys {
+			v := n.values[i]
+			binary.BigEndian.PutUint16(buf[p:], uint16(len(key)))
+			if v.overflow != 0 {
+				buf[p+2] = leafFlagOverflow
+			}
+			binary.BigEndian.PutUint32(buf[p+3:], v.size)
+			p += LEAF_ENTRY_HEADER_SIZE
+			p += copy(buf[p:], key)
+			if v.overflow != 0 {
+				binary.BigEndian.PutUint64(buf[p:], uint64(v.overflow))
+				p += 8
+			} else {
+				p += copy(buf[p:], v.inline)
+			}
+		}
+	} else {
+		buf[4] = pageTypeBranch
+		binary.BigEndian.PutUint64(buf[p:], uint64(n.children[0]))
+		p += 8
+		for i, key := range n.keys {
+			binary.BigEndian.PutUint16(buf[p:], uint16(len(key)))
+			p += 2
+			p += copy(buf[p:], key)
+			binary.BigEndian.PutUint64(buf[p:], uint64(n.children[i+1]))
+			p += 8
+		}
+	}
+	sealPage(buf)
+}
+
+// decodeNode decodes a leaf or branch page. Returns ErrCorruptPage if the checksum doesn't
+// match or the page is of another type.
+func decodeNode(buf []byte) (*node, error) {
+	if err := checkPage(buf); err != nil {
+		return nil, err
+	}
+	count := int(binary.BigEndian.Uint16(buf[6:8]))
+	n := &node{leaf: buf[4] == pageTypeLeaf, keys: make([]string, 0, count)}
+	p := PAGE_HEADER_SIZE
+	// need reports whether size more bytes are left in the page
+	need := func(size int) bool { return p+size <= PAGE_SIZE }
+
+	switch buf[4] {
+	case pageTypeLeaf:
+		n.values = make([]leafValue, 0, count)
+		for i := 0; i < count; i++ {
+			if !need(LEAF_ENTRY_HEADER_SIZE) {
+				return nil, ErrCorruptPage
+			}
+			keyLen := int(binary.BigEndian.Uint16(buf[p:]))
+			flags := buf[p+2]
+			v := leafValue{size: binary.BigEndian.Uint32(buf[p+3:])}
+			p += LEAF_ENTRY_HEADER_SIZE
+			if !need(keyLen) {
+				return nil, ErrCorruptPage
+			}
+			key := string(buf[p : p+keyLen])
+			p += keyLen
+			if flags&leafFlagOverflow != 0 {
+				if !need(8) {
+					return nil, ErrCorruptPage
+				}
+				v.overflow = pgid(binary.BigEndian.Uint64(buf[p:]))
+				p += 8
+			} else {
+				if !need(int(v.size)) {
+					return nil, ErrCorruptPage
+				}
+				v.inline = string(buf[p : p+int(v.size)])
+				p += int(v.size)
+			}
+			n.keys = append(n.keys, key)
+			n.values = append(n.values, v)
+		}
+	case pageTypeBranch:
+		n.children = make([]pgid, 0, count+1)
+		if !need(8) {
+			return nil, ErrCorruptPage
+		}
+		n.children = append(n.children, pgid(binary.BigEndian.Uint64(buf[p:])))
+		p += 8
+		for i := 0; i < count; i++ {
+			if !need(2) {
+				return nil, ErrCorruptPage
+			}
+			keyLen := int(binary.BigEndian.Uint16(buf[p:]))
+			p += 2
+			if !need(keyLen + 8) {
+				return nil, ErrCorruptPage
+			}
+			n.keys = append(n.keys, string(buf[p:p+keyLen]))
+			p += keyLen
+			n.children = append(n.children, pgid(binary.BigEndian.Uint64(buf[p:])))
+			p += 8
+		}
+	default:
+		return nil, ErrCorruptPage
+	}
+	return n, nil
+}
+
+// meta is the root of a committed version of the tree. The two meta pages alternate, so
+// the previous version stays intact while the next one is written.
+type meta struct {
+	txid      uint64 // Incremented by every commit; the valid meta with the highest wins
+	root      pgid
+	pageCount pgid // Pages in use; the file may be longer after an interrupted commit
+	freelist  pgid // First page of the free list, 0 if there are no free pages
+	keyCount  int64
+}
+
+// encode writes the meta into a page-sized buffer.
+func (m meta) encode(buf []byte) {
+	clear(buf)
+	buf[4] = pageTypeMeta
+	p := buf[PAGE_HEADER_SIZE:]
+	binary.BigEndian.PutUint32(p[0:4], META_MAGIC)
+	binary.BigEndian.PutUint32(p[4:8], META_VERSION)
+	binary.BigEndian.PutUint32(p[8:12], PAGE_SIZE)
+	binary.BigEndian.PutUint64(p[12:20], m.txid)
+	binary.BigEndian.PutUint64(p[20:28], uint64(m.root))
+	binary.BigEndian.PutUint64(p[28:36], uint64(m.pageCount))
+	binary.BigEndian.PutUint64(p[36:44], uint64(m.freelist))
+	binary.BigEndian.PutUint64(p[44:52], uint64(m.keyCount))
+	sealPage(buf)
+}
+
+// decodeMeta decodes a meta page. Returns ErrCorruptPage if it is torn or isn't one.
+func decodeMeta(buf []byte) (meta, error) {
+	if err := checkPage(buf); err != nil {
+		return meta{}, err
+	}
+	p := buf[PAGE_HEADER_SIZE:]
+	if buf[4] != pageTypeMeta || binary.BigEndian.Uint32(p[0:4]) != META_MAGIC ||
+		binary.BigEndian.Uint32(p[4:8]) != META_VERSION || binary.BigEndian.Uint32(p[8:12]) != PAGE_SIZE {
+		return meta{}, ErrCorruptPage
+	}
+	m := meta{
+		txid:      binary.BigEndian.Uint64(p[12:20]),
+		root:      pgid(binary.BigEndian.Uint64(p[20:28])),
+		pageCount: pgid(binary.BigEndian.Uint64(p[28:36])),
+		freelist:  pgid(binary.BigEndian.Uint64(p[36:44])),
+		keyCount:  int64(binary.BigEndian.Uint64(p[44:52])),
+	}
+	if m.root < 2 || m.root >= m.pageCount || m.freelist == 1 || m.freelist >= m.pageCount {
+		return meta{}, ErrCorruptPage
+	}
+	return m, nil
+}
+
+// sealPage sets the checksum of a page whose contents are complete.
+func sealPage(buf []byte) {
+	binary.BigEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:PAGE_SIZE]))
+}
+
+// checkPage verifies the checksum of a page.
+func checkPage(buf []byte) error {
+	if binary.BigEndian.Uint32(buf[0:4]) != crc32.ChecksumIEEE(buf[4:PAGE_SIZE]) {
+		return ErrCorruptPage
+	}
+	return nil
+}
+
+// encodeLinkedPage encodes a freelist or overflow page: a pointer to the next page of the
+// chain, or 0, followed by payload.
+func encodeLinkedPage(buf []byte, pageType byte, count int, next pgid, payload []byte) {
+	clear(buf)
+	buf[4] = pageType
+	binary.BigEndian.PutUint16(buf[6:8], uint16(count))
+	binary.BigEndian.PutUint64(buf[PAGE_HEADER_SIZE:], uint64(next))
+	copy(buf[PAGE_HEADER_SIZE+8:], payload)
+	sealPage(buf)
+}
+
+// decodeLinkedPage decodes a freelist or overflow page of the given type and returns its
+// count, the next page of the chain and the payload.
+func decodeLinkedPage(buf []byte, pageType byte) (int, pgid, []byte, error) {
+	if err := checkPage(buf); err != nil {
+		return 0, 0, nil, err
+	}
+	if buf[4] != pageType {
+		return 0, 0, nil, ErrCorruptPage
+	}
+	count := int(binary.BigEndian.Uint16(buf[6:8]))
+	next := pgid(binary.BigEndian.Uint64(buf[PAGE_HEADER_SIZE:]))
+	return count, next, buf[PAGE_HEADER_SIZE+8:], nil
+}
@@ -0,0 +1,95 @@
+package kvstorefromscratchpart4
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNode_EncodeDecode(t *testing.T) {
+	nodes := []*node{
+		{leaf: true, keys: []string{}, values: []leafValue{}},
+		{
+			leaf:   true,
+			keys:   []string{"", "a", strings.Repeat("k", MAX_KEY_SIZE)},
+			values: []leafValue{{inline: "x", size: 1}, {overflow: 42, size: 100000}, {inline: strings.Repeat("v", MAX_INLINE_VALUE_SIZE), size: MAX_INLINE_VALUE_SIZE}},
+		},
+		{keys: []string{"m", "t"}, children: []pgid{3, 4, 5}},
+	}
+	for _, n := range nodes {
+		buf := make([]byte, PAGE_SIZE)
+		n.encode(buf)
+		got, err := decodeNode(buf)
+		if err != nil {
+			t.Fatalf("decodeNode failed: %v", err)
+		}
+		if !reflect.DeepEqual(got, n) {
+			t.Errorf("decodeNode returned %+v, want %+v", got, n)
+		}
+		buf[PAGE_SIZE-1] ^= 0xFF
+		if _, err := decodeNode(buf); err != ErrCorruptPage {
+			t.Errorf("decodeNode of a damaged page returned %v, want ErrCorruptPage", err)
+		}
+	}
+}
+
+func TestNode_Split(t *testing.T) {
+	n := &node{leaf: true}
+	for i := 0; n.size() <= PAGE_SIZE; i++ {
+		n.keys = append(n.keys, strings.Repeat(string(rune('a'+i%26)), 300)+string(rune('a'+i/26)))
+		n.values = append(n.values, leafValue{inline: strings.Repeat("v", 500), size: 500})
+	}
+	left, right, sep := n.split()
+	if left.size() > PAGE_SIZE || right.size() > PAGE_SIZE || sep != right.keys[0] {
+		t.Errorf("split into %d and %d bytes at %q", left.size(), right.size(), sep)
+	}
+	if len(left.keys)+len(right.keys) != len(n.keys) {
+		t.Errorf("split lost keys")
+	}
+}
+
+func TestMeta_EncodeDecode(t *testing.T) {
+	m := meta{txid: 7, root: 5, pageCount: 10, freelist: 9, keyCount: 3}
+	buf := make([]byte, PAGE_SIZE)
+	m.encode(buf)
+	got, err := decodeMeta(buf)
+	if err != nil || got != m {
+		t.Errorf("decodeMeta returned (%+v, %v), want %+v", got, err, m)
+	}
+	buf[20] ^= 0xFF
+	if _, err := decodeMeta(buf); err != ErrCorruptPage {
+		t.Errorf("decodeMeta of a torn page returned %v, want ErrCorruptPage", err)
+	}
+	(&node{leaf: true}).encode(buf)
+	if _, err := decodeMeta(buf); err != ErrCorruptPage {
+		t.Errorf("decodeMeta of a leaf returned %v, want ErrCorruptPage", err)
+	}
+}
+
+func TestBufferPool_EvictsLeastRecentlyUsed(t *testing.T) {
+	pool := newBufferPool(2)
+	a, b, c := &node{leaf: true}, &node{leaf: true}, &node{leaf: true}
+	pool.put(2, a)
+	pool.put(3, b)
+	pool.get(2) // 3 is now the least recently used
+	pool.put(4, c)
+	if _, ok := pool.get(3); ok {
+		t.Errorf("page 3 is still cached, want it evicted")
+	}
+	if got, ok := pool.get(2); !ok || got != a {
+		t.Errorf("page 2 was evicted")
+	}
+	if pages, hits, misses, evictions := pool.stats(); pages != 2 || evictions != 1 || hits != 2 || misses != 1 {
+		t.Errorf("pool has %d pages, %d evictions, %d hits and %d misses", pages, evictions, hits, misses)
+	}
+
+	// A reused page replaces what was cached for it
+	pool.put(2, b)
+	if got, _ := pool.get(2); got != b {
+		t.Errorf("page 2 wasn't replaced")
+	}
+	pool.remove(2)
+	if _, ok := pool.get(2); ok {
+		t.Errorf("page 2 is still cached after remove")
+	}
+}
@@ -0,0 +1,211 @@
+package kvstorefromscratchpart4
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var errCrash = errors.New("simulated crash")
+
+// crashFile is a data file that loses power after a budget of page writes: the write that
+// exceeds it is torn in half, and every write and fsync after it fails.
+type crashFile struct {
+	*os.File
+	writesLeft int
+	crashed    bool
+}
+
+func (f *crashFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.crashed {
+		return 0, errCrash
+	}
+	if f.writesLeft == 0 {
+		f.crashed = true
+		n, _ := f.File.WriteAt(p[:len(p)/2], off)
+		return n, errCrash
+	}
+	f.writesLeft--
+	return f.File.WriteAt(p, off)
+}
+
+func (f *crashFile) Sync() error {
+	if f.crashed {
+		return errCrash
+	}
+	return f.File.Sync()
+}
+
+// crashOp is one step of the workload run against a crashing store.
+type crashOp struct {
+	key string
+	val *string // nil deletes the key
+}
+
+func (op crashOp) apply(store Store, model map[string]string) error {
+	if op.val == nil {
+		delete(model, op.key)
+		return store.Del(op.key)
+	}
+	model[op.key] = *op.val
+	return store.Put(op.key, *op.val)
+}
+
+func TestBTreeStore_RecoversFromCrashAtEveryWrite(t *testing.T) {
+	baseDir := t.TempDir()
+	store, err := ConnectBTreeStore(baseDir)
+	if err != nil {
+		t.Fatalf("ConnectBTreeStore failed: %v", err)
+	}
+	base := make(map[string]string)
+	for i := 0; i < 300; i++ {
+		key, val := fmt.Sprintf("key-%03d", i), strings.Repeat("v", 50)
+		store.Put(key, val)
+		base[key] = val
+	}
+	store.Close()
+	baseFile, err := os.ReadFile(filepath.Join(baseDir, DATA_FILENAME))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	// Splits, merges, overflow chains and free list changes, each a single commit
+	var ops []crashOp
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("key-%03d", (i*37)%300)
+		switch i % 4 {
+		case 0:
+			ops = append(ops, crashOp{key: key})
+		case 1:
+			val := strings.Repeat(fmt.Sprint(i), 3*PAGE_SIZE)
+			ops = append(ops, crashOp{key: key, val: &val})
+		default:
+			val := fmt.Sprintf("new-%d-%s", i, strings.Repeat("x", 300))
+			ops = append(ops, crashOp{key: key + "-new", val: &val})
+		}
+	}
+	states := []map[string]string{maps.Clone(base)}
+	for _, op := range ops {
+		next := maps.Clone(states[len(states)-1])
+		op.apply(nullStore{}, next)
+		states = append(states, next)
+	}
+
+	for budget := 0; ; budget++ {
+		dir := t.TempDir()
+		path := filepath.Join(dir, DATA_FILENAME)
+		if err := os.WriteFile(path, baseFile, 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		f, err := os.OpenFile(path, os.O_RDWR, 0644)
+		if err != nil {
+			t.Fatalf("OpenFile failed: %v", err)
+		}
+		file := &crashFile{File: f, writesLeft: budget}
+		store, err := openBTreeStore(file, DefaultOptions())
+		if err != nil {
+			t.Fatalf("openBTreeStore failed: %v", err)
+		}
+		applied := 0
+		for _, op := range ops {
+			if err := op.apply(store, map[string]string{}); err != nil {
+				break
+			}
+			applied++
+		}
+		if file.crashed {
+			if err := store.Put("after", "crash"); err == nil {
+				t.Fatalf("budget %d: Put after a failed commit succeeded", budget)
+			}
+		}
+		store.Close()
+
+		// The crashed commit is either entirely there or entirely gone
+		store, err = ConnectBTreeStore(dir)
+		if err != nil {
+			t.Fatalf("budget %d: ConnectBTreeStore after a crash in op %d failed: %v", budget, applied, err)
+		}
+		checkTree(t, store)
+		got := make(map[string]string)
+		it, _ := store.Scan("", "")
+		for it.HasNext() {
+			key, val := it.Get()
+			got[key] = val
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("budget %d: Scan failed: %v", budget, err)
+		}
+		if !maps.Equal(got, states[applied]) && (applied == len(ops) || !maps.Equal(got, states[applied+1])) {
+			t.Fatalf("budget %d: after a crash in op %d the store holds neither the state before nor after it", budget, applied)
+		}
+
+		// And the recovered store keeps working
+		for i := 0; i < 20; i++ {
+			if err := store.Put(fmt.Sprintf("later-%d", i), strings.Repeat("l", 200*i)); err != nil {
+				t.Fatalf("budget %d: Put after recovery failed: %v", budget, err)
+			}
+		}
+		checkTree(t, store)
+		store.Close()
+
+		if !file.crashed {
+			if budget < len(ops) {
+				t.Errorf("the workload finished within %d writes, want at least one per op", budget)
+			}
+			break
+		}
+	}
+}
+
+// nullStore discards writes; it lets crashOp.apply update a model without a store.
+type nullStore struct{ Store }
+
+func (nullStore) Put(K, V string) error { return nil }
+func (nullStore) Del(K string) error    { return nil }
+
+func TestBTreeStore_FallsBackToPreviousMeta(t *testing.T) {
+	tmpDir := t.TempDir()
+	store, err := ConnectBTreeStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectBTreeStore failed: %v", err)
+	}
+	store.Put("a", "1")
+	store.Put("b", "2")
+	latest := store.meta.txid
+	store.Close()
+
+	// A meta page torn by a crash is ignored, rolling back the commit it belonged to
+	path := filepath.Join(tmpDir, DATA_FILENAME)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	torn := append([]byte(nil), data...)
+	torn[int(latest%2)*PAGE_SIZE+PAGE_HEADER_SIZE+14] ^= 0xFF
+	os.WriteFile(path, torn, 0644)
+	store, err = ConnectBTreeStore(tmpDir)
+	if err != nil {
+		t.Fatalf("ConnectBTreeStore failed: %v", err)
+	}
+	if got, err := store.Get("a"); err != nil || got != "1" {
+		t.Errorf("Get(a) returned (%q, %v), want 1", got, err)
+	}
+	if _, err := store.Get("b"); err != ErrKeyDoesntExist {
+		t.Errorf("Get(b) of the rolled back commit returned %v, want ErrKeyDoesntExist", err)
+	}
+	checkTree(t, store)
+	store.Close()
+
+	// With both meta pages damaged there is nothing to recover
+	for id := 0; id < 2; id++ {
+		data[id*PAGE_SIZE+PAGE_HEADER_SIZE] ^= 0xFF
+	}
+	os.WriteFile(path, data, 0644)
+	if _, err := ConnectBTreeStore(tmpDir); err != ErrCorruptStore {
+		t.Errorf("ConnectBTreeStore with both meta pages damaged returned %v, want ErrCorruptStore", err)
+	}
+}
@@ -0,0 +1,159 @@
+package kvstorefromscratchpart4
+
+const (
+	SCAN_BATCH_SIZE = 256 // Pairs read per visit to the tree
+)
+
+// ScanIterator walks over the keys in a range and their values, in increasing key order.
+//
+// It reads SCAN_BATCH_SIZE pairs at a time, each batch by descending the tree again from
+// the root to the first key after the previous batch, so no lock is held between batches
+// and a long scan doesn't block writers. Each batch is consistent on its own, but writes
+// made during the scan may show up in later batches.
+type ScanIterator struct {
+	store *BTreeStore
+	next  string // Smallest key the next batch may return
+	end   string
+	batch []scanPair
+	pos   int
+	done  bool // The last batch has been read
+	key   string
+	val   string
+	err   error
+}
+
+type scanPair struct {
+	key, val string
+}
+
+// Scan returns an iterator over the keys in [start, end) in increasing key order.
+// An empty end means no upper bound, so Scan("", "") visits every key.
+func (s *BTreeStore) Scan(start, end string) (Iterator, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	return &ScanIterator{store: s, next: start, end: end}, nil
+}
+
+// ScanPrefix returns an iterator over the keys starting with prefix, in increasing key
+// order.
+func (s *BTreeStore) ScanPrefix(prefix string) (Iterator, error) {
+	return s.Scan(prefix, prefixEnd(prefix))
+}
+
+// prefixEnd returns the smallest key greater than every key starting with prefix, or ""
+// (no upper bound) if there is none, i.e. the prefix is empty or all 0xFF bytes.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// HasNext advances to the next pair and reports whether there is one.
+// It returns false at the end of the range or on error; use Err to tell them apart.
+func (it *ScanIterator) HasNext() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.pos >= len(it.batch) {
+		if it.done {
+			return false
+		}
+		if it.err = it.readBatch(); it.err != nil || len(it.batch) == 0 {
+			return false
+		}
+	}
+	it.key, it.val = it.batch[it.pos].key, it.batch[it.pos].val
+	it.pos++
+	return true
+}
+
+// readBatch reads the next batch of pairs from the tree.
+func (it *ScanIterator) readBatch() error {
+	s := it.store
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	it.batch, it.pos = it.batch[:0], 0
+	var full bool
+	var readErr error
+	_, err := s.ascend(s.meta.root, it.next, func(key string, v leafValue) bool {
+		if it.end != "" && key >= it.end {
+			return false
+		}
+		if len(it.batch) == SCAN_BATCH_SIZE {
+			full = true
+			return false
+		}
+		val, err := s.readValue(v)
+		if err != nil {
+			readErr = err
+			return false
+		}
+		it.batch = append(it.batch, scanPair{key: key, val: val})
+		return true
+	})
+	if err == nil {
+		err = readErr
+	}
+	if err != nil {
+		return err
+	}
+	it.done = !full // Otherwise the range or the tree ran out
+	if n := len(it.batch); n > 0 {
+		it.next = it.batch[n-1].key + "\x00" // The smallest key after the last one read
+	}
+	return nil
+}
+
+// ascend calls fn for every key >= start in the subtree at id, in increasing key order,
+// until fn returns false. It reports whether fn asked for more.
+func (s *BTreeStore) ascend(id pgid, start string, fn func(key string, v leafValue) bool) (bool, error) {
+	n, err := s.readNode(id)
+	if err != nil {
+		return false, err
+	}
+	if n.leaf {
+		i, _ := n.search(start)
+		for ; i < len(n.keys); i++ {
+			if !fn(n.keys[i], n.values[i]) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+	for i := n.childIndex(start); i < len(n.children); i++ {
+		more, err := s.ascend(n.children[i], start, fn)
+		if err != nil || !more {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Get returns the current key and value.
+func (it *ScanIterator) Get() (string, string) {
+	return it.key, it.val
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *ScanIterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator. It must not be used afterwards.
+func (it *ScanIterator) Close() error {
+	it.batch = nil
+	it.done = true
+	return nil
+}
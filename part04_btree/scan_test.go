@@ -0,0 +1,108 @@
+package kvstorefromscratchpart4
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// collectScan drains a scan into "key=value" strings. It takes the scan's return values
+// directly so calls read as collectScan(t)(store.Scan(...)).
+func collectScan(t *testing.T) func(it Iterator, err error) []string {
+	return func(it Iterator, err error) []string {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("scan failed: %v", err)
+		}
+		defer it.Close()
+		var pairs []string
+		for it.HasNext() {
+			key, val := it.Get()
+			pairs = append(pairs, key+"="+val)
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("iteration failed: %v", err)
+		}
+		return pairs
+	}
+}
+
+func TestBTreeStore_Scan(t *testing.T) {
+	store, err := ConnectBTreeStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectBTreeStore failed: %v", err)
+	}
+	defer store.Close()
+
+	for _, key := range []string{"user:42:name", "user:42:email", "user:421:name", "user:43:name", "account:1", "user:42:zip", "\xff\xff"} {
+		if err := store.Put(key, "v-"+key); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	store.Del("user:42:zip")
+
+	got := collectScan(t)(store.ScanPrefix("user:42:"))
+	want := []string{"user:42:email=v-user:42:email", "user:42:name=v-user:42:name"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ScanPrefix(user:42:) returned %q, want %q", got, want)
+	}
+	got = collectScan(t)(store.Scan("user:420", "user:42:f"))
+	want = []string{"user:421:name=v-user:421:name", "user:42:email=v-user:42:email"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan(user:420, user:42:f) returned %q, want %q", got, want)
+	}
+	if got := collectScan(t)(store.ScanPrefix("\xff")); !reflect.DeepEqual(got, []string{"\xff\xff=v-\xff\xff"}) {
+		t.Errorf("ScanPrefix(0xFF) returned %q", got)
+	}
+	if got := collectScan(t)(store.Scan("", "")); len(got) != 6 {
+		t.Errorf("Scan of everything returned %d keys, want 6: %q", len(got), got)
+	}
+}
+
+func TestBTreeStore_ScanAcrossBatches(t *testing.T) {
+	store, err := ConnectBTreeStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("ConnectBTreeStore failed: %v", err)
+	}
+	defer store.Close()
+	n := 3*SCAN_BATCH_SIZE + 17
+	for i := 0; i < n; i++ {
+		store.Put(fmt.Sprintf("key-%04d", i), fmt.Sprint(i))
+	}
+	// A large value in the middle is read from its overflow pages
+	big := fmt.Sprintf("%0*d", 3*PAGE_SIZE, 7)
+	store.Put("key-0300", big)
+
+	it, err := store.Scan("", "")
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	defer it.Close()
+	var i int
+	for it.HasNext() {
+		key, val := it.Get()
+		want := fmt.Sprint(i)
+		if i == 300 {
+			want = big
+		}
+		if key != fmt.Sprintf("key-%04d", i) || val != want {
+			t.Fatalf("pair %d is %s with %d bytes, want key-%04d with %d bytes", i, key, len(val), i, len(want))
+		}
+		// Keys written behind the scan aren't visited, keys ahead of it are
+		if i == SCAN_BATCH_SIZE+1 {
+			store.Put("key-0000a", "behind")
+			store.Put(fmt.Sprintf("key-%04d", n), fmt.Sprint(n))
+			n++
+		}
+		i++
+	}
+	if err := it.Err(); err != nil || i != n {
+		t.Errorf("scan returned %d pairs and %v, want %d", i, err, n)
+	}
+
+	// A batch that ends exactly at the end of the range
+	got := collectScan(t)(store.Scan("key-0000", fmt.Sprintf("key-%04d", SCAN_BATCH_SIZE)))
+	if len(got) != SCAN_BATCH_SIZE+1 { // key-0000a included
+		t.Errorf("Scan of one batch returned %d pairs, want %d", len(got), SCAN_BATCH_SIZE+1)
+	}
+}
@@ -0,0 +1,45 @@
+package kvstorefromscratchpart4
+
+// Stats is a summary of the state of a store, as returned by BTreeStore.Stats.
+type Stats struct {
+	Keys      int64  // Number of keys in the tree
+	Depth     int    // Levels from the root to the leaves, 1 for a lone root leaf
+	Pages     int64  // Pages in use by the data file, including free ones
+	FreePages int    // Pages the next commit may reuse
+	TxID      uint64 // Number of the latest commit
+
+	CachedPages    int   // Pages currently held by the buffer pool
+	CacheHits      int64 // Page reads served by the buffer pool
+	CacheMisses    int64 // Page reads that went to disk
+	CacheEvictions int64 // Pages dropped to make room for others
+}
+
+// Stats returns the current Stats of the store.
+func (s *BTreeStore) Stats() (Stats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return Stats{}, ErrStoreClosed
+	}
+
+	stats := Stats{
+		Keys:      s.meta.keyCount,
+		Pages:     int64(s.meta.pageCount),
+		FreePages: len(s.free),
+		TxID:      s.meta.txid,
+	}
+	for id := s.meta.root; ; stats.Depth++ {
+		n, err := s.readNode(id)
+		if err != nil {
+			return Stats{}, err
+		}
+		if n.leaf {
+			stats.Depth++
+			break
+		}
+		id = n.children[0]
+	}
+
+	stats.CachedPages, stats.CacheHits, stats.CacheMisses, stats.CacheEvictions = s.pool.stats()
+	return stats, nil
+}
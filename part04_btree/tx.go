@@ -0,0 +1,414 @@
+package kvstorefromscratchpart4
+
+import (
+	"encoding/binary"
+	"slices"
+)
+
+// tx is a single copy-on-write update of the tree. Pages are allocated from the free list
+// of the latest commit, or appended to the file, so nothing the latest commit references is
+// overwritten until the meta page of the next one is durable.
+type tx struct {
+	s         *BTreeStore
+	meta      meta
+	allocated []pgid          // Pages taken from s.free, given back on rollback
+	reusable  []pgid          // Pages allocated by this tx and released again, never committed
+	freed     []pgid          // Pages of the latest commit replaced by this tx
+	dirty     map[pgid]*node  // Leaf and branch pages written by this tx
+	overflow  map[pgid][]byte // Encoded overflow pages written by this tx
+}
+
+// ref points at a node written by the tx. key separates it from the node before it; it is
+// unused for the first node of a list.
+type ref struct {
+	key string
+	id  pgid
+}
+
+// begin starts a tx on top of the latest commit. Callers hold mu exclusively.
+func (s *BTreeStore) begin() *tx {
+	return &tx{
+		s:        s,
+		meta:     s.meta,
+		dirty:    make(map[pgid]*node),
+		overflow: make(map[pgid][]byte),
+	}
+}
+
+// allocate returns a page that the latest commit doesn't reference.
+func (t *tx) allocate() pgid {
+	if n := len(t.reusable); n > 0 {
+		id := t.reusable[n-1]
+		t.reusable = t.reusable[:n-1]
+		return id
+	}
+	if n := len(t.s.free); n > 0 {
+		id := t.s.free[n-1]
+		t.s.free = t.s.free[:n-1]
+		t.allocated = append(t.allocated, id)
+		return id
+	}
+	id := t.meta.pageCount
+	t.meta.pageCount++
+	return id
+}
+
+// release gives up page id: a page written by this tx can be reused right away, while a
+// page of the latest commit only becomes free once this tx has committed.
+func (t *tx) release(id pgid) {
+	if _, ok := t.dirty[id]; ok {
+		delete(t.dirty, id)
+		t.reusable = append(t.reusable, id)
+		return
+	}
+	if _, ok := t.overflow[id]; ok {
+		delete(t.overflow, id)
+		t.reusable = append(t.reusable, id)
+		return
+	}
+	t.freed = append(t.freed, id)
+}
+
+// node returns node id, whether it was written by this tx or is committed.
+func (t *tx) node(id pgid) (*node, error) {
+	if n, ok := t.dirty[id]; ok {
+		return n, nil
+	}
+	return t.s.readNode(id)
+}
+
+// write allocates a page for n.
+func (t *tx) write(n *node) pgid {
+	id := t.allocate()
+	t.dirty[id] = n
+	return id
+}
+
+// writeNodes writes n, splitting it into as many nodes as it takes to fit each in a page.
+func (t *tx) writeNodes(n *node) []ref {
+	if n.size() <= PAGE_SIZE {
+		return []ref{{id: t.write(n)}}
+	}
+	left, right, sep := n.split()
+	refs := t.writeNodes(left)
+	rightRefs := t.writeNodes(right)
+	rightRefs[0].key = sep
+	return append(refs, rightRefs...)
+}
+
+// split divides a node that doesn't fit in a page into two halves of about the same size.
+// For a leaf, sep is the first key of the right half; for a branch, it is the key between
+// the halves, which moves up to the parent.
+func (n *node) split() (*node, *node, string) {
+	half := (n.size() - PAGE_HEADER_SIZE) / 2
+	if n.leaf {
+		i, size := 0, 0
+		for ; i < len(n.keys)-1 && size < half; i++ {
+			size += LEAF_ENTRY_HEADER_SIZE + len(n.keys[i]) + n.values[i].encodedSize()
+		}
+		i = max(i, 1)
+		left := &node{leaf: true, keys: n.keys[:i:i], values: n.values[:i:i]}
+		right := &node{leaf: true, keys: n.keys[i:], values: n.values[i:]}
+		return left, right, right.keys[0]
+	}
+	j, size := 0, 8
+	for ; j < len(n.keys)-1 && size < half; j++ {
+		size += 2 + len(n.keys[j]) + 8
+	}
+	left := &node{keys: n.keys[:j:j], children: n.children[: j+1 : j+1]}
+	right := &node{keys: n.keys[j+1:], children: n.children[j+1:]}
+	return left, right, n.keys[j]
+}
+
+// apply puts value under key, or deletes key if value is nil, and points the tx at the new
+// root. It reports whether anything changed.
+func (t *tx) apply(key string, value *string) (bool, error) {
+	refs, changed, err := t.applyAt(t.meta.root, key, value)
+	if err != nil || !changed {
+		return false, err
+	}
+
+	// Grow the tree by a level for every split that reached the root
+	for len(refs) > 1 {
+		root := &node{}
+		for i, r := range refs {
+			if i > 0 {
+				root.keys = append(root.keys, r.key)
+			}
+			root.children = append(root.children, r.id)
+		}
+		refs = t.writeNodes(root)
+	}
+	if len(refs) == 0 {
+		refs = []ref{{id: t.write(&node{leaf: true})}}
+	}
+	t.meta.root = refs[0].id
+
+	// Shrink it while the root is a branch with a single child
+	for {
+		root, err := t.node(t.meta.root)
+		if err != nil {
+			return false, err
+		}
+		if root.leaf || len(root.children) > 1 {
+			return true, nil
+		}
+		t.release(t.meta.root)
+		t.meta.root = root.children[0]
+	}
+}
+
+// applyAt applies the update to the subtree at id and returns the nodes that replace it:
+// none if it became empty, one, or several if it had to be split.
+func (t *tx) applyAt(id pgid, key string, value *string) ([]ref, bool, error) {
+	n, err := t.s.readNode(id)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if n.leaf {
+		i, found := n.search(key)
+		if value == nil && !found {
+			return nil, false, nil
+		}
+		n = n.clone()
+		if found {
+			if err := t.releaseValue(n.values[i]); err != nil {
+				return nil, false, err
+			}
+		}
+		switch {
+		case value == nil:
+			n.keys = slices.Delete(n.keys, i, i+1)
+			n.values = slices.Delete(n.values, i, i+1)
+			t.meta.keyCount--
+		case found:
+			n.values[i] = t.writeValue(*value)
+		default:
+			n.keys = slices.Insert(n.keys, i, key)
+			n.values = slices.Insert(n.values, i, t.writeValue(*value))
+			t.meta.keyCount++
+		}
+		t.release(id)
+		if len(n.keys) == 0 {
+			return nil, true, nil
+		}
+		return t.writeNodes(n), true, nil
+	}
+
+	i := n.childIndex(key)
+	refs, changed, err := t.applyAt(n.children[i], key, value)
+	if err != nil || !changed {
+		return nil, false, err
+	}
+	n = n.clone()
+	n.replaceChild(i, refs)
+	if value == nil && len(refs) == 1 {
+		if err := t.mergeUnderfull(n, i); err != nil {
+			return nil, false, err
+		}
+	}
+	t.release(id)
+	if len(n.children) == 0 {
+		return nil, true, nil
+	}
+	return t.writeNodes(n), true, nil
+}
+
+// replaceChild replaces child i of a branch with the nodes in refs.
+func (n *node) replaceChild(i int, refs []ref) {
+	if len(refs) == 0 {
+		n.children = slices.Delete(n.children, i, i+1)
+		if len(n.keys) > 0 {
+			k := max(i-1, 0) // The separator on the left of child i, or on its right for the first
+			n.keys = slices.Delete(n.keys, k, k+1)
+		}
+		return
+	}
+	n.children[i] = refs[0].id
+	for j, r := range refs[1:] {
+		n.children = slices.Insert(n.children, i+1+j, r.id)
+		n.keys = slices.Insert(n.keys, i+j, r.key)
+	}
+}
+
+// mergeUnderfull merges child i of branch n with a sibling if the child has shrunk below
+// MIN_FILL_SIZE and the two fit in one page.
+func (t *tx) mergeUnderfull(n *node, i int) error {
+	if len(n.children) < 2 {
+		return nil
+	}
+	child, err := t.node(n.children[i])
+	if err != nil || child.size() >= MIN_FILL_SIZE {
+		return err
+	}
+	left := i
+	if left == len(n.children)-1 {
+		left--
+	}
+	l, err := t.node(n.children[left])
+	if err != nil {
+		return err
+	}
+	r, err := t.node(n.children[left+1])
+	if err != nil {
+		return err
+	}
+
+	merged := &node{leaf: l.leaf}
+	merged.keys = append(append(merged.keys, l.keys...), r.keys...)
+	if l.leaf {
+		merged.values = append(append(merged.values, l.values...), r.values...)
+	} else {
+		merged.keys = slices.Insert(merged.keys, len(l.keys), n.keys[left])
+		merged.children = append(append(merged.children, l.children...), r.children...)
+	}
+	if merged.size() > PAGE_SIZE {
+		return nil
+	}
+	t.release(n.children[left])
+	t.release(n.children[left+1])
+	n.children[left] = t.write(merged)
+	n.children = slices.Delete(n.children, left+1, left+2)
+	n.keys = slices.Delete(n.keys, left, left+1)
+	return nil
+}
+
+// writeValue stores value inline, or in a chain of overflow pages if it is too large to.
+func (t *tx) writeValue(value string) leafValue {
+	v := leafValue{size: uint32(len(value))}
+	if len(value) <= MAX_INLINE_VALUE_SIZE {
+		v.inline = value
+		return v
+	}
+	ids := make([]pgid, (len(value)+OVERFLOW_DATA_SIZE-1)/OVERFLOW_DATA_SIZE)
+	for i := range ids {
+		ids[i] = t.allocate()
+	}
+	for i, id := range ids {
+		var next pgid
+		if i+1 < len(ids) {
+			next = ids[i+1]
+		}
+		chunk := value[i*OVERFLOW_DATA_SIZE : min(len(value), (i+1)*OVERFLOW_DATA_SIZE)]
+		buf := make([]byte, PAGE_SIZE)
+		encodeLinkedPage(buf, pageTypeOverflow, 0, next, []byte(chunk))
+		t.overflow[id] = buf
+	}
+	v.overflow = ids[0]
+	return v
+}
+
+// releaseValue releases the overflow pages of a value that is overwritten or deleted.
+func (t *tx) releaseValue(v leafValue) error {
+	buf := make([]byte, PAGE_SIZE)
+	pages := (int(v.size) + OVERFLOW_DATA_SIZE - 1) / OVERFLOW_DATA_SIZE
+	for id, i := v.overflow, 0; id != 0 && i < pages; i++ {
+		if id < 2 || id >= t.s.meta.pageCount {
+			return ErrCorruptPage
+		}
+		if err := readPage(t.s.file, id, buf); err != nil {
+			return err
+		}
+		_, next, _, err := decodeLinkedPage(buf, pageTypeOverflow)
+		if err != nil {
+			return err
+		}
+		t.release(id)
+		id = next
+	}
+	return nil
+}
+
+// rollback gives the pages the tx took from the free list back. Callers hold mu.
+func (t *tx) rollback() {
+	t.s.free = append(t.s.free, t.allocated...)
+}
+
+// commit writes the pages of the tx and the new free list, fsyncs them, and then writes
+// and fsyncs the meta page that makes them the latest commit. It goes to the slot of the
+// commit before the latest, so the latest stays intact until the new one is durable.
+// If writing fails, the store refuses further writes; reopening it recovers the latest
+// durable commit.
+func (t *tx) commit() error {
+	// The new free list holds every page the new commit won't reference: what is still
+	// free, and what the tx and the old free list release. Its own pages are allocated
+	// first, which shrinks it, so keep allocating until it fits.
+	var listPages []pgid
+	for {
+		count := len(t.s.free) + len(t.reusable) + len(t.freed) + len(t.s.freelistPages)
+		if len(listPages)*FREELIST_CAPACITY >= count {
+			break
+		}
+		listPages = append(listPages, t.allocate())
+	}
+	free := slices.Concat(t.s.free, t.reusable, t.freed, t.s.freelistPages)
+
+	err := t.writePages(listPages, free)
+	if err == nil {
+		err = t.s.file.Sync()
+	}
+	newMeta := t.meta
+	newMeta.txid++
+	newMeta.freelist = 0
+	if len(listPages) > 0 {
+		newMeta.freelist = listPages[0]
+	}
+	if err == nil {
+		buf := make([]byte, PAGE_SIZE)
+		newMeta.encode(buf)
+		_, err = t.s.file.WriteAt(buf, int64(newMeta.txid%2)*PAGE_SIZE)
+	}
+	if err == nil {
+		err = t.s.file.Sync()
+	}
+	if err != nil {
+		t.rollback()
+		t.s.writeErr = err
+		return err
+	}
+
+	t.s.meta = newMeta
+	t.s.free = free
+	t.s.freelistPages = listPages
+	for _, id := range t.freed {
+		t.s.pool.remove(id)
+	}
+	for id, n := range t.dirty {
+		t.s.pool.put(id, n)
+	}
+	return nil
+}
+
+// writePages writes the nodes and overflow pages of the tx, and the free list into
+// listPages.
+func (t *tx) writePages(listPages []pgid, free []pgid) error {
+	buf := make([]byte, PAGE_SIZE)
+	for id, n := range t.dirty {
+		n.encode(buf)
+		if _, err := t.s.file.WriteAt(buf, int64(id)*PAGE_SIZE); err != nil {
+			return err
+		}
+	}
+	for id, page := range t.overflow {
+		if _, err := t.s.file.WriteAt(page, int64(id)*PAGE_SIZE); err != nil {
+			return err
+		}
+	}
+	for i, id := range listPages {
+		var next pgid
+		if i+1 < len(listPages) {
+			next = listPages[i+1]
+		}
+		chunk := free[min(len(free), i*FREELIST_CAPACITY):min(len(free), (i+1)*FREELIST_CAPACITY)]
+		payload := make([]byte, 8*len(chunk))
+		for j, free := range chunk {
+			binary.BigEndian.PutUint64(payload[j*8:], uint64(free))
+		}
+		encodeLinkedPage(buf, pageTypeFreelist, len(chunk), next, payload)
+		if _, err := t.s.file.WriteAt(buf, int64(id)*PAGE_SIZE); err != nil {
+			return err
+		}
+	}
+	return nil
+}